@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/fabiolb/fabio/cert"
+)
+
+// CertsHandler lists the certificates of the TLS listeners.
+type CertsHandler struct{}
+
+func (h *CertsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	certs := cert.LoadedCertificates()
+	if certs == nil {
+		certs = []cert.CertInfo{}
+	}
+	writeJSON(w, r, certs)
+}
@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/fabiolb/fabio/registry"
+)
+
+// RegistryHandler lists the status of the sources of the registry
+// backend. It is empty unless the backend reports the status of its
+// sources separately.
+type RegistryHandler struct{}
+
+func (h *RegistryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := []registry.SourceStatus{}
+	if sr, ok := registry.Default.(registry.StatusReporter); ok {
+		status = sr.Status()
+	}
+	writeJSON(w, r, status)
+}
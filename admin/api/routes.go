@@ -21,6 +21,9 @@ type apiRoute struct {
 	Weight  float64  `json:"weight"`
 	Tags    []string `json:"tags,omitempty"`
 	Cmd     string   `json:"cmd"`
+	Health  string   `json:"health,omitempty"`
+	Ejected bool     `json:"ejected,omitempty"`
+	Circuit string   `json:"circuit,omitempty"`
 	Rate1   float64  `json:"rate1"`
 	Pct99   float64  `json:"pct99"`
 }
@@ -59,6 +62,9 @@ func (h *RoutesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					Weight:  tg.Weight,
 					Tags:    tg.Tags,
 					Cmd:     "route add",
+					Health:  tg.HealthStatus(),
+					Ejected: tg.Ejected(),
+					Circuit: tg.CircuitState(),
 					// Rate1:   tg.Timer.Rate1(),
 					// Pct99:   tg.Timer.Percentile(0.99),
 				}
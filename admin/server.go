@@ -60,7 +60,9 @@ func (s *Server) handler() http.Handler {
 		})
 	}
 
+	mux.Handle("/api/certs", &api.CertsHandler{})
 	mux.Handle("/api/config", &api.ConfigHandler{Config: s.Cfg})
+	mux.Handle("/api/registry", &api.RegistryHandler{})
 	mux.Handle("/api/routes", &api.RoutesHandler{})
 	mux.Handle("/api/version", &api.VersionHandler{Version: s.Version})
 	mux.Handle("/routes", &ui.RoutesHandler{Color: s.Color, Title: s.Title, Version: s.Version, RoutingTable: s.Cfg.UI.RoutingTable})
@@ -49,7 +49,9 @@ func TestAdminServerAccess(t *testing.T) {
 	roTests := []test{
 		{"/api/manual", 403},
 		{"/api/paths", 403},
+		{"/api/certs", 200},
 		{"/api/config", 200},
+		{"/api/registry", 200},
 		{"/api/routes", 200},
 		{"/api/version", 200},
 		{"/manual", 403},
@@ -63,7 +65,9 @@ func TestAdminServerAccess(t *testing.T) {
 	rwTests := []test{
 		{"/api/manual", 200},
 		{"/api/paths", 200},
+		{"/api/certs", 200},
 		{"/api/config", 200},
+		{"/api/registry", 200},
 		{"/api/routes", 200},
 		{"/api/version", 200},
 		{"/manual", 200},
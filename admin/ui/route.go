@@ -104,6 +104,7 @@ $(function(){
 		thead += '<th>Dest</th>';
 		thead += '<th>Options</th>';
 		thead += '<th>Weight</th>';
+		thead += '<th>Status</th>';
 		thead += '</tr></thead>';
 
 		let $tbody = $('<tbody />');
@@ -136,6 +137,7 @@ $(function(){
 				$tr.append($('<td />').append($('<a />').attr('href', r.dst).text(r.dst)));
 				$tr.append($('<td />').text(r.opts));
 				$tr.append($('<td />').text((r.weight * 100).toFixed(2) + '%'));
+				$tr.append($('<td />').text([r.health, r.ejected ? 'ejected' : '', r.circuit && r.circuit != 'closed' ? 'circuit ' + r.circuit : ''].filter(Boolean).join(', ')));
 
 				$tr.appendTo($tbody);
 			}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -21,6 +22,30 @@ func LoadAuthSchemes(cfg map[string]config.AuthScheme) (map[string]AuthScheme, e
 				return nil, err
 			}
 			auths[a.Name] = b
+		case "jwt":
+			j, err := newJWTAuth(a.Name, a.JWT)
+			if err != nil {
+				return nil, err
+			}
+			auths[a.Name] = j
+		case "oidc":
+			o, err := newOIDCAuth(a.Name, a.OIDC)
+			if err != nil {
+				return nil, err
+			}
+			auths[a.Name] = o
+		case "forward":
+			f, err := newForwardAuth(a.Forward)
+			if err != nil {
+				return nil, err
+			}
+			auths[a.Name] = f
+		case "cert":
+			c, err := newCertAuth(a.Cert)
+			if err != nil {
+				return nil, err
+			}
+			auths[a.Name] = c
 		default:
 			return nil, fmt.Errorf("unknown auth type '%s'", a.Type)
 		}
@@ -28,3 +53,33 @@ func LoadAuthSchemes(cfg map[string]config.AuthScheme) (map[string]AuthScheme, e
 
 	return auths, nil
 }
+
+type principalKey struct{}
+
+// WithPrincipal returns a shallow copy of r whose context records the
+// name of the client which the auth scheme of the route authenticates.
+func WithPrincipal(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, new(string)))
+}
+
+// SetPrincipal records the name of the client which an auth scheme has
+// authenticated. It does nothing if r was not created by WithPrincipal.
+func SetPrincipal(r *http.Request, name string) {
+	if p, ok := r.Context().Value(principalKey{}).(*string); ok {
+		*p = name
+	}
+}
+
+// Principal returns the name of the client which the auth scheme of the
+// route has authenticated or an empty string if the request was not
+// authenticated. The name is the basic auth user, the 'sub' claim of
+// the JWT or the OpenID Connect session, the first response header of
+// the forward auth service or the first URI SAN or the common name of
+// the client certificate.
+func Principal(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey{}).(*string)
+	if p == nil {
+		return ""
+	}
+	return *p
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/fabiolb/fabio/config"
@@ -74,3 +76,38 @@ func TestLoadAuthSchemes(t *testing.T) {
 		}
 	})
 }
+
+func TestPrincipal(t *testing.T) {
+	a, err := newCertAuth(config.CertAuth{CommonNames: []string{"billing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal := func(r *http.Request) string {
+		r = WithPrincipal(r)
+		a.Authorized(r, httptest.NewRecorder())
+		return Principal(r)
+	}
+
+	// the basic auth user is not authenticated by the cert scheme
+	r := certRequest("billing", "Acme", true)
+	r.SetBasicAuth("alice", "secret")
+	if got, want := principal(r), "billing"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := principal(certRequest("billing", "Acme", true, "spiffe://mesh.example.com/billing")), "spiffe://mesh.example.com/billing"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := principal(certRequest("billing", "Acme", false)), ""; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := principal(certRequest("payments", "Acme", true)), ""; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	// requests without a principal context have no principal
+	r = certRequest("billing", "Acme", true)
+	SetPrincipal(r, "billing")
+	if got, want := Principal(r), ""; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
@@ -82,5 +82,9 @@ func (b *basic) Authorized(request *http.Request, response http.ResponseWriter)
 		return false
 	}
 
-	return b.secrets.Match(user, password)
+	if !b.secrets.Match(user, password) {
+		return false
+	}
+	SetPrincipal(request, user)
+	return true
 }
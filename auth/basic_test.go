@@ -158,9 +158,13 @@ func TestBasic_Authorised(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got, want := basicAuth.Authorized(tt.req, tt.res), tt.out; !reflect.DeepEqual(got, want) {
+			req := WithPrincipal(tt.req)
+			if got, want := basicAuth.Authorized(req, tt.res), tt.out; !reflect.DeepEqual(got, want) {
 				t.Errorf("got %v want %v", got, want)
 			}
+			if got, want := Principal(req) != "", tt.out; got != want {
+				t.Errorf("got principal %q", Principal(req))
+			}
 		})
 	}
 }
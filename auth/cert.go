@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/gobwas/glob"
+)
+
+// cert is an implementation of AuthScheme which authorizes requests by
+// the verified client certificate.
+type cert struct {
+	cns     []glob.Glob
+	uris    []glob.Glob
+	subject glob.Glob
+}
+
+func newCertAuth(cfg config.CertAuth) (AuthScheme, error) {
+	c := &cert{}
+	for _, p := range cfg.CommonNames {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		c.cns = append(c.cns, g)
+	}
+	for _, p := range cfg.URIs {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		c.uris = append(c.uris, g)
+	}
+	if cfg.Subject != "" {
+		g, err := glob.Compile(cfg.Subject)
+		if err != nil {
+			return nil, err
+		}
+		c.subject = g
+	}
+	return c, nil
+}
+
+// Authorized returns true if the request has a verified client
+// certificate whose common name, one of its URI SANs (e.g. a SPIFFE ID)
+// or its subject matches one of the patterns.
+func (c *cert) Authorized(request *http.Request, response http.ResponseWriter) bool {
+	x := ClientCertificate(request)
+	if x == nil || !c.match(x) {
+		return false
+	}
+	if len(x.URIs) > 0 {
+		SetPrincipal(request, x.URIs[0].String())
+	} else {
+		SetPrincipal(request, x.Subject.CommonName)
+	}
+	return true
+}
+
+func (c *cert) match(x *x509.Certificate) bool {
+	for _, g := range c.cns {
+		if g.Match(x.Subject.CommonName) {
+			return true
+		}
+	}
+	for _, g := range c.uris {
+		for _, u := range x.URIs {
+			if g.Match(u.String()) {
+				return true
+			}
+		}
+	}
+	return c.subject != nil && c.subject.Match(x.Subject.String())
+}
+
+// ClientCertificate returns the client certificate of the request if it
+// has been verified by the listener. Otherwise, it returns nil.
+func ClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
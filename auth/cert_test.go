@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// certRequest returns a request with a client certificate for the common
+// name, organization and URI SANs.
+func certRequest(cn, org string, verified bool, uris ...string) *http.Request {
+	x := &x509.Certificate{Subject: pkix.Name{CommonName: cn, Organization: []string{org}}}
+	for _, u := range uris {
+		uri, _ := url.Parse(u)
+		x.URIs = append(x.URIs, uri)
+	}
+	r, _ := http.NewRequest("GET", "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{x}}
+	if verified {
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{x}}
+	}
+	return r
+}
+
+func TestCertAuth(t *testing.T) {
+	a, err := newCertAuth(config.CertAuth{
+		CommonNames: []string{"billing", "payments-*"},
+		URIs:        []string{"spiffe://mesh.example.com/ns/prod/*"},
+		Subject:     "CN=*,O=Partner",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noTLS, _ := http.NewRequest("GET", "http://example.com/", nil)
+
+	tests := []struct {
+		desc string
+		r    *http.Request
+		want bool
+	}{
+		{"no tls", noTLS, false},
+		{"not verified", certRequest("billing", "Acme", false), false},
+		{"common name", certRequest("billing", "Acme", true), true},
+		{"common name glob", certRequest("payments-eu", "Acme", true), true},
+		{"unknown common name", certRequest("shipping", "Acme", true), false},
+		{"spiffe id", certRequest("shipping", "Acme", true, "spiffe://mesh.example.com/ns/prod/sa/shipping"), true},
+		{"unknown spiffe id", certRequest("shipping", "Acme", true, "spiffe://mesh.example.com/ns/dev/sa/shipping"), false},
+		{"subject", certRequest("shipping", "Partner", true), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got, want := a.Authorized(tt.r, &responseWriter{}), tt.want; got != want {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCertAuthInvalidPattern(t *testing.T) {
+	if _, err := newCertAuth(config.CertAuth{CommonNames: []string{"[a"}}); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
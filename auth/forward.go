@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// forwardMaxBody is the maximum size of the auth service response body
+// which is returned to the client.
+const forwardMaxBody = 64 * 1024
+
+// forwardCacheSize is the maximum number of cached decisions.
+const forwardCacheSize = 10000
+
+// hopHeaders are the headers of the auth service response which are not
+// returned to the client.
+var hopHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardAuth is an implementation of AuthScheme which asks an external
+// auth service whether the request is allowed.
+type forwardAuth struct {
+	cfg    config.ForwardAuth
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*decision
+}
+
+// decision is the response of the auth service. For allowed requests
+// header contains the headers for the upstream request. For denied
+// requests status, header and body are returned to the client.
+type decision struct {
+	allow   bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newForwardAuth(cfg config.ForwardAuth) (AuthScheme, error) {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, fmt.Errorf("invalid auth service url %q", cfg.URL)
+	}
+	return &forwardAuth{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		cache: map[string]*decision{},
+	}, nil
+}
+
+func (f *forwardAuth) Authorized(request *http.Request, response http.ResponseWriter) bool {
+	for _, h := range f.cfg.ResponseHeaders {
+		request.Header.Del(h)
+	}
+
+	key := f.cacheKey(request)
+	d := f.cached(key)
+	if d == nil {
+		var err error
+		d, err = f.ask(request)
+		if err != nil {
+			log.Printf("[WARN] auth: Auth service %s failed: %s", f.cfg.URL, err)
+			if f.cfg.FailOpen {
+				return true
+			}
+			http.Error(response, "authorization service unavailable", http.StatusServiceUnavailable)
+			return false
+		}
+		f.store(key, d)
+	}
+
+	if !d.allow {
+		for k, v := range d.header {
+			response.Header()[k] = append([]string(nil), v...)
+		}
+		response.WriteHeader(d.status)
+		response.Write(d.body)
+		return false
+	}
+	for k, v := range d.header {
+		request.Header[k] = append([]string(nil), v...)
+	}
+	if len(f.cfg.ResponseHeaders) > 0 {
+		SetPrincipal(request, d.header.Get(f.cfg.ResponseHeaders[0]))
+	}
+	return true
+}
+
+// ask sends the method, URI and the configured headers of the request to
+// the auth service and returns its decision.
+func (f *forwardAuth) ask(r *http.Request) (*decision, error) {
+	req, err := http.NewRequestWithContext(r.Context(), "GET", f.cfg.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range f.cfg.RequestHeaders {
+		for _, v := range r.Header.Values(h) {
+			req.Header.Add(h, v)
+		}
+	}
+	for _, h := range forwardedHeaders(r) {
+		if h[1] != "" {
+			req.Header.Set(h[0], h[1])
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		h := http.Header{}
+		for _, name := range f.cfg.ResponseHeaders {
+			if v := resp.Header.Values(name); len(v) > 0 {
+				h[http.CanonicalHeaderKey(name)] = v
+			}
+		}
+		return &decision{allow: true, header: h}, nil
+
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, forwardMaxBody))
+		if err != nil {
+			return nil, err
+		}
+		h := resp.Header.Clone()
+		for _, name := range hopHeaders {
+			h.Del(name)
+		}
+		return &decision{status: resp.StatusCode, header: h, body: body}, nil
+
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// forwardedHeaders returns the headers which describe the original
+// request to the auth service.
+func forwardedHeaders(r *http.Request) [][2]string {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return [][2]string{
+		{"X-Forwarded-Method", r.Method},
+		{"X-Forwarded-Proto", proto},
+		{"X-Forwarded-Host", r.Host},
+		{"X-Forwarded-Uri", r.URL.RequestURI()},
+		{"X-Forwarded-For", ip},
+	}
+}
+
+// cacheKey returns the key of the decision for the request or an empty
+// string if decisions are not cached. The key contains the original
+// request which is sent to the auth service and the values of the
+// cachekey headers so that a decision for one request is never used for
+// a request with a different method, host or URI.
+func (f *forwardAuth) cacheKey(r *http.Request) string {
+	if f.cfg.CacheTTL <= 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, h := range forwardedHeaders(r) {
+		b.WriteString(h[1])
+		b.WriteByte(0)
+	}
+	for _, h := range f.cfg.CacheKey {
+		b.WriteString(strings.Join(r.Header.Values(h), "\n"))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+func (f *forwardAuth) cached(key string) *decision {
+	if key == "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.cache[key]
+	if d == nil || time.Now().After(d.expires) {
+		return nil
+	}
+	return d
+}
+
+func (f *forwardAuth) store(key string, d *decision) {
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	d.expires = now.Add(f.cfg.CacheTTL)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= forwardCacheSize {
+		for k, v := range f.cache {
+			if now.After(v.expires) {
+				delete(f.cache, k)
+			}
+		}
+		if len(f.cache) >= forwardCacheSize {
+			f.cache = map[string]*decision{}
+		}
+	}
+	f.cache[key] = d
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// authServer is an auth service which allows requests with the token
+// "secret" and returns the headers of the last request.
+type authServer struct {
+	*httptest.Server
+	requests int32
+	header   atomic.Value
+}
+
+func newAuthServer(t *testing.T) *authServer {
+	s := &authServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		s.header.Store(r.Header.Clone())
+		switch r.Header.Get("Authorization") {
+		case "secret":
+			w.Header().Set("X-User", "alice")
+			w.Header().Set("X-Internal", "yes")
+		case "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sso"`)
+			http.Error(w, "login required", http.StatusUnauthorized)
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func authRequest(token string) *http.Request {
+	r, _ := http.NewRequest("POST", "http://example.com/orders?id=1", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+	r.Header.Set("X-User", "mallory")
+	return r
+}
+
+func TestForwardAuth(t *testing.T) {
+	srv := newAuthServer(t)
+	a, err := newForwardAuth(config.ForwardAuth{
+		URL:             srv.URL,
+		Timeout:         time.Second,
+		RequestHeaders:  []string{"Authorization"},
+		ResponseHeaders: []string{"X-User"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		r := WithPrincipal(authRequest("secret"))
+		if !a.Authorized(r, &responseWriter{}) {
+			t.Fatal("request not authorized")
+		}
+		if got, want := r.Header.Get("X-User"), "alice"; got != want {
+			t.Fatalf("got X-User %q want %q", got, want)
+		}
+		if got, want := Principal(r), "alice"; got != want {
+			t.Fatalf("got principal %q want %q", got, want)
+		}
+		if got := r.Header.Get("X-Internal"); got != "" {
+			t.Fatalf("got X-Internal %q want none", got)
+		}
+
+		h := srv.header.Load().(http.Header)
+		want := map[string]string{
+			"Authorization":      "secret",
+			"X-Forwarded-Method": "POST",
+			"X-Forwarded-Proto":  "http",
+			"X-Forwarded-Host":   "example.com",
+			"X-Forwarded-Uri":    "/orders?id=1",
+			"X-Forwarded-For":    "1.2.3.4",
+			"X-User":             "",
+		}
+		for k, v := range want {
+			if got := h.Get(k); got != v {
+				t.Errorf("got %s %q want %q", k, got, v)
+			}
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		r := authRequest("")
+		rw := &responseWriter{}
+		if a.Authorized(r, rw) {
+			t.Fatal("request authorized")
+		}
+		if got, want := rw.code, http.StatusUnauthorized; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+		if got, want := rw.Header().Get("WWW-Authenticate"), `Bearer realm="sso"`; got != want {
+			t.Fatalf("got WWW-Authenticate %q want %q", got, want)
+		}
+		if got, want := string(rw.written), "login required\n"; got != want {
+			t.Fatalf("got body %q want %q", got, want)
+		}
+		if got := r.Header.Get("X-User"); got != "" {
+			t.Fatalf("got X-User %q want none", got)
+		}
+	})
+}
+
+func TestForwardAuthFailure(t *testing.T) {
+	srv := newAuthServer(t)
+
+	tests := []struct {
+		desc     string
+		token    string
+		failOpen bool
+		want     bool
+	}{
+		{"error fail closed", "other", false, false},
+		{"error fail open", "other", true, true},
+		{"timeout fail closed", "slow", false, false},
+		{"timeout fail open", "slow", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			a, err := newForwardAuth(config.ForwardAuth{
+				URL:            srv.URL,
+				Timeout:        50 * time.Millisecond,
+				RequestHeaders: []string{"Authorization"},
+				FailOpen:       tt.failOpen,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rw := &responseWriter{}
+			if got, want := a.Authorized(authRequest(tt.token), rw), tt.want; got != want {
+				t.Fatalf("got %v want %v", got, want)
+			}
+			if !tt.want && rw.code != http.StatusServiceUnavailable {
+				t.Fatalf("got status %d want %d", rw.code, http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+func TestForwardAuthCache(t *testing.T) {
+	srv := newAuthServer(t)
+	a, err := newForwardAuth(config.ForwardAuth{
+		URL:             srv.URL,
+		Timeout:         time.Second,
+		RequestHeaders:  []string{"Authorization"},
+		ResponseHeaders: []string{"X-User"},
+		CacheKey:        []string{"Authorization"},
+		CacheTTL:        time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r := authRequest("secret")
+		if !a.Authorized(r, &responseWriter{}) {
+			t.Fatal("request not authorized")
+		}
+		if got, want := r.Header.Get("X-User"), "alice"; got != want {
+			t.Fatalf("got X-User %q want %q", got, want)
+		}
+		rw := &responseWriter{}
+		if a.Authorized(authRequest(""), rw) {
+			t.Fatal("request authorized")
+		}
+		if got, want := rw.code, http.StatusUnauthorized; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&srv.requests), int32(2); got != want {
+		t.Fatalf("got %d auth requests want %d", got, want)
+	}
+
+	// errors are not cached
+	for i := 0; i < 2; i++ {
+		a.Authorized(authRequest("other"), &responseWriter{})
+	}
+	if got, want := atomic.LoadInt32(&srv.requests), int32(4); got != want {
+		t.Fatalf("got %d auth requests want %d", got, want)
+	}
+
+	// decisions are not shared between requests for different
+	// methods, hosts or URIs
+	requests := []func(r *http.Request){
+		func(r *http.Request) { r.Method = "DELETE" },
+		func(r *http.Request) { r.Host = "admin.example.com" },
+		func(r *http.Request) { r.URL.Path = "/admin" },
+	}
+	for i, fn := range requests {
+		r := authRequest("secret")
+		fn(r)
+		a.Authorized(r, &responseWriter{})
+		if got, want := atomic.LoadInt32(&srv.requests), int32(5+i); got != want {
+			t.Fatalf("%d: got %d auth requests want %d", i, got, want)
+		}
+	}
+}
+
+func TestForwardAuthInvalidURL(t *testing.T) {
+	if _, err := newForwardAuth(config.ForwardAuth{URL: "auth.local:9000"}); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
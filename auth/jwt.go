@@ -0,0 +1,371 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// jwtAlgorithms are the supported signature algorithms of the tokens.
+var jwtAlgorithms = []jose.SignatureAlgorithm{jose.RS256, jose.ES256, jose.HS256}
+
+// jwksClient is the HTTP client for fetching the JWKS.
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// jwksMinRefetch is the minimum time between two requests for the JWKS
+// when a token is signed with an unknown key.
+var jwksMinRefetch = 10 * time.Second
+
+// jwtAuth is an implementation of AuthScheme which authorizes requests
+// with a bearer token.
+type jwtAuth struct {
+	realm    string
+	verifier *tokenVerifier
+	claims   map[string]string
+	headers  map[string]string
+}
+
+func newJWTAuth(name string, cfg config.JWTAuth) (AuthScheme, error) {
+	v, err := newTokenVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &jwtAuth{
+		realm:    name,
+		verifier: v,
+		claims:   cfg.Claims,
+		headers:  cfg.Headers,
+	}, nil
+}
+
+func (j *jwtAuth) Authorized(request *http.Request, response http.ResponseWriter) bool {
+	for _, h := range j.headers {
+		request.Header.Del(h)
+	}
+
+	token, ok := bearerToken(request)
+	if !ok {
+		response.Header().Set("WWW-Authenticate", `Bearer realm="`+j.realm+`"`)
+		return false
+	}
+
+	claims, err := j.verifier.verify(token)
+	if err == nil {
+		err = requireClaims(claims, j.claims)
+	}
+	if err != nil {
+		log.Printf("[DEBUG] auth: Invalid token for %s: %s", j.realm, err)
+		response.Header().Set("WWW-Authenticate", `Bearer realm="`+j.realm+`", error="invalid_token"`)
+		return false
+	}
+
+	for claim, h := range j.headers {
+		if v, ok := claims[claim]; ok {
+			request.Header.Set(h, claimString(v))
+		}
+	}
+	if v, ok := claims["sub"]; ok {
+		SetPrincipal(request, claimString(v))
+	}
+	return true
+}
+
+// bearerToken returns the bearer token from the Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(h[7:])
+	return token, token != ""
+}
+
+// tokenVerifier verifies the signature and the standard claims of JSON
+// web tokens.
+type tokenVerifier struct {
+	issuer   string
+	audience []string
+
+	// keys are the static public keys and shared secrets.
+	keys []interface{}
+
+	// jwks is nil if no JWKS URL is configured.
+	jwks *jwks
+}
+
+func newTokenVerifier(cfg config.JWTAuth) (*tokenVerifier, error) {
+	v := &tokenVerifier{issuer: cfg.Issuer, audience: cfg.Audience}
+	if cfg.KeyFile != "" {
+		keys, err := loadPublicKeys(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+	if cfg.Secret != "" {
+		v.keys = append(v.keys, []byte(cfg.Secret))
+	}
+	if cfg.JWKSURL != "" {
+		v.jwks = &jwks{url: cfg.JWKSURL, done: make(chan struct{})}
+		if err := v.jwks.fetch(); err != nil {
+			// the JWKS is fetched again when the first token arrives
+			log.Printf("[WARN] auth: Failed to fetch JWKS from %s: %s", cfg.JWKSURL, err)
+		}
+		go v.jwks.refresh(cfg.Refresh)
+	}
+	return v, nil
+}
+
+// verify returns the claims of the token if it is signed by one of the
+// keys and the issuer, audience and validity period are valid. Tokens
+// must have an expiry time.
+func (v *tokenVerifier) verify(token string) (map[string]interface{}, error) {
+	tok, err := jwt.ParseSigned(token, jwtAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+
+	var kid string
+	if len(tok.Headers) > 0 {
+		kid = tok.Headers[0].KeyID
+	}
+
+	var std jwt.Claims
+	var claims map[string]interface{}
+	err = errors.New("no matching key")
+	for _, key := range v.keysFor(kid) {
+		if err = tok.Claims(key, &std, &claims); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if std.Expiry == nil {
+		return nil, errors.New("missing exp claim")
+	}
+	expected := jwt.Expected{Issuer: v.issuer, AnyAudience: v.audience, Time: time.Now()}
+	if err := std.Validate(expected); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// keysFor returns the keys which can verify a token signed with the key
+// id. If the JWKS has no key with the id it is fetched again so that
+// rotated keys are picked up.
+func (v *tokenVerifier) keysFor(kid string) []interface{} {
+	keys := append([]interface{}(nil), v.keys...)
+	if v.jwks == nil {
+		return keys
+	}
+	jwk := v.jwks.keysFor(kid)
+	if len(jwk) == 0 && v.jwks.refetch() {
+		jwk = v.jwks.keysFor(kid)
+	}
+	for _, k := range jwk {
+		keys = append(keys, k.Key)
+	}
+	return keys
+}
+
+// stop stops refreshing the JWKS.
+func (v *tokenVerifier) stop() {
+	if v.jwks != nil {
+		v.jwks.stop()
+	}
+}
+
+// jwks is a JSON web key set which is loaded from a URL.
+type jwks struct {
+	url string
+
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu        sync.Mutex
+	keys      jose.JSONWebKeySet
+	lastFetch time.Time
+}
+
+func (s *jwks) fetch() error {
+	s.mu.Lock()
+	s.lastFetch = time.Now()
+	s.mu.Unlock()
+
+	resp, err := jwksClient.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", s.url, resp.Status)
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	return nil
+}
+
+// refresh fetches the JWKS in the given interval until stop is called.
+func (s *jwks) refresh(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.fetch(); err != nil {
+				log.Printf("[WARN] auth: Failed to refresh JWKS from %s: %s", s.url, err)
+			}
+		}
+	}
+}
+
+// stop stops the refresh.
+func (s *jwks) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// refetch fetches the JWKS unless it has been fetched recently and
+// returns true if it was fetched successfully.
+func (s *jwks) refetch() bool {
+	s.mu.Lock()
+	recent := time.Since(s.lastFetch) < jwksMinRefetch
+	s.mu.Unlock()
+	if recent {
+		return false
+	}
+	if err := s.fetch(); err != nil {
+		log.Printf("[WARN] auth: Failed to fetch JWKS from %s: %s", s.url, err)
+		return false
+	}
+	return true
+}
+
+// keysFor returns the keys with the key id or all keys if the key id is
+// empty.
+func (s *jwks) keysFor(kid string) []jose.JSONWebKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kid == "" {
+		return s.keys.Keys
+	}
+	return s.keys.Key(kid)
+}
+
+// loadPublicKeys loads the PEM encoded public keys and certificates from
+// the file.
+func loadPublicKeys(filename string) ([]interface{}, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []interface{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no public keys found", filename)
+	}
+	return keys, nil
+}
+
+// requireClaims returns an error if one of the claims does not have the
+// required value. A claim matches if it is equal to the value or if it
+// is a list which contains the value. The OAuth2 'scope' and 'scp'
+// claims can also be space separated lists.
+func requireClaims(claims map[string]interface{}, required map[string]string) error {
+	for name, want := range required {
+		if !claimHasValue(claims[name], want, name == "scope" || name == "scp") {
+			return fmt.Errorf("claim %s does not have the value %q", name, want)
+		}
+	}
+	return nil
+}
+
+func claimHasValue(v interface{}, want string, spaceSeparated bool) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case string:
+		if spaceSeparated {
+			for _, s := range strings.Fields(x) {
+				if s == want {
+					return true
+				}
+			}
+		}
+		return x == want
+	case []interface{}:
+		for _, e := range x {
+			if claimString(e) == want {
+				return true
+			}
+		}
+		return false
+	default:
+		return claimString(x) == want
+	}
+}
+
+// claimString returns the claim value as string. Lists are joined with
+// commas.
+func claimString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []interface{}:
+		s := make([]string, len(x))
+		for i, e := range x {
+			s[i] = claimString(e)
+		}
+		return strings.Join(s, ",")
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	default:
+		b, _ := json.Marshal(x)
+		return string(b)
+	}
+}
@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// signToken returns a token with the claims which is signed with the key.
+func signToken(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string, claims map[string]interface{}) string {
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(sig).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// jwksServer serves the public keys as JWKS. The keys can be replaced
+// while the server is running.
+type jwksServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     jose.JSONWebKeySet
+	requests int32
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.requests, 1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(s.keys)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) setKeys(keys ...jose.JSONWebKey) {
+	s.mu.Lock()
+	s.keys = jose.JSONWebKeySet{Keys: keys}
+	s.mu.Unlock()
+}
+
+func bearerRequest(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "https://example.com/", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newJWKSServer(t)
+	srv.setKeys(jose.JSONWebKey{Key: rsaKey.Public(), KeyID: "rsa1", Algorithm: "RS256", Use: "sig"})
+
+	der, err := x509.MarshalPKIXPublicKey(ecKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newJWTAuth("api", config.JWTAuth{
+		JWKSURL:  srv.URL,
+		KeyFile:  keyFile,
+		Secret:   "s3cr3t-s3cr3t-s3cr3t-s3cr3t-s3cr3t",
+		Issuer:   "https://idp.example.com",
+		Audience: []string{"api"},
+		Claims:   map[string]string{"scope": "read"},
+		Headers:  map[string]string{"sub": "X-User", "groups": "X-Groups"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://idp.example.com",
+			"aud":    "api",
+			"sub":    "alice",
+			"exp":    now + 60,
+			"scope":  "read write",
+			"groups": []string{"dev", "ops"},
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		desc  string
+		token string
+		want  bool
+	}{
+		{"no token", "", false},
+		{"garbage", "abc", false},
+		{"RS256 from jwks", signToken(t, jose.RS256, rsaKey, "rsa1", claims(nil)), true},
+		{"ES256 from key file", signToken(t, jose.ES256, ecKey, "", claims(nil)), true},
+		{"HS256 with secret", signToken(t, jose.HS256, []byte("s3cr3t-s3cr3t-s3cr3t-s3cr3t-s3cr3t"), "", claims(nil)), true},
+		{"unknown key", signToken(t, jose.ES256, otherKey, "", claims(nil)), false},
+		{"wrong issuer", signToken(t, jose.RS256, rsaKey, "rsa1", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.com" })), false},
+		{"wrong audience", signToken(t, jose.RS256, rsaKey, "rsa1", claims(func(c map[string]interface{}) { c["aud"] = "web" })), false},
+		{"expired", signToken(t, jose.RS256, rsaKey, "rsa1", claims(func(c map[string]interface{}) { c["exp"] = now - 3600 })), false},
+		{"no expiry", signToken(t, jose.RS256, rsaKey, "rsa1", claims(func(c map[string]interface{}) { delete(c, "exp") })), false},
+		{"missing scope", signToken(t, jose.RS256, rsaKey, "rsa1", claims(func(c map[string]interface{}) { c["scope"] = "write" })), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := WithPrincipal(bearerRequest(tt.token))
+			r.Header.Set("X-User", "mallory")
+			rw := &responseWriter{}
+			if got, want := a.Authorized(r, rw), tt.want; got != want {
+				t.Fatalf("got %v want %v", got, want)
+			}
+			if !tt.want {
+				if rw.Header().Get("WWW-Authenticate") == "" {
+					t.Fatal("got no WWW-Authenticate header")
+				}
+				if got := r.Header.Get("X-User"); got != "" {
+					t.Fatalf("got X-User %q want none", got)
+				}
+				return
+			}
+			if got, want := r.Header.Get("X-User"), "alice"; got != want {
+				t.Fatalf("got X-User %q want %q", got, want)
+			}
+			if got, want := r.Header.Get("X-Groups"), "dev,ops"; got != want {
+				t.Fatalf("got X-Groups %q want %q", got, want)
+			}
+			if got, want := Principal(r), "alice"; got != want {
+				t.Fatalf("got principal %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestJWTAuthKeyRotation(t *testing.T) {
+	key1, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	srv := newJWKSServer(t)
+	srv.setKeys(jose.JSONWebKey{Key: key1.Public(), KeyID: "k1", Algorithm: "ES256"})
+
+	defer func(d time.Duration) { jwksMinRefetch = d }(jwksMinRefetch)
+	jwksMinRefetch = 0
+
+	a, err := newJWTAuth("api", config.JWTAuth{JWKSURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+
+	r := bearerRequest(signToken(t, jose.ES256, key1, "k1", map[string]interface{}{"exp": exp}))
+	if !a.Authorized(r, &responseWriter{}) {
+		t.Fatal("token with k1 not authorized")
+	}
+
+	// a token with an unknown key id fetches the JWKS again
+	srv.setKeys(jose.JSONWebKey{Key: key2.Public(), KeyID: "k2", Algorithm: "ES256"})
+	r = bearerRequest(signToken(t, jose.ES256, key2, "k2", map[string]interface{}{"exp": exp}))
+	if !a.Authorized(r, &responseWriter{}) {
+		t.Fatal("token with k2 not authorized")
+	}
+	if got, want := atomic.LoadInt32(&srv.requests), int32(2); got != want {
+		t.Fatalf("got %d JWKS requests want %d", got, want)
+	}
+}
+
+func TestJWTAuthRefresh(t *testing.T) {
+	srv := newJWKSServer(t)
+	a, err := newJWTAuth("api", config.JWTAuth{JWKSURL: srv.URL, Refresh: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&srv.requests) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d JWKS requests want at least 3", atomic.LoadInt32(&srv.requests))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// no more requests after stop
+	a.(*jwtAuth).verifier.stop()
+	time.Sleep(60 * time.Millisecond)
+	n := atomic.LoadInt32(&srv.requests)
+	time.Sleep(150 * time.Millisecond)
+	if got := atomic.LoadInt32(&srv.requests); got != n {
+		t.Fatalf("got %d JWKS requests after stop want %d", got, n)
+	}
+}
+
+func TestRequireClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"scope":  "read write",
+		"scp":    []interface{}{"read", "write"},
+		"name":   "Alice Smith",
+		"groups": []interface{}{"dev", "ops"},
+		"admin":  true,
+	}
+
+	tests := []struct {
+		required map[string]string
+		ok       bool
+	}{
+		{map[string]string{"scope": "write"}, true},
+		{map[string]string{"scp": "write"}, true},
+		{map[string]string{"scope": "admin"}, false},
+		{map[string]string{"name": "Alice Smith"}, true},
+		{map[string]string{"name": "Alice"}, false},
+		{map[string]string{"groups": "ops"}, true},
+		{map[string]string{"admin": "true"}, true},
+		{map[string]string{"missing": "x"}, false},
+	}
+
+	for _, tt := range tests {
+		if got, want := requireClaims(claims, tt.required) == nil, tt.ok; got != want {
+			t.Errorf("%v: got %v want %v", tt.required, got, want)
+		}
+	}
+}
+
+func TestJWTAuthInvalidKeyFile(t *testing.T) {
+	if _, err := newJWTAuth("api", config.JWTAuth{KeyFile: "/some/non/existent/file"}); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
@@ -0,0 +1,458 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// oidcClient is the HTTP client for the requests to the provider.
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcLoginTimeout is the time in which the login must be completed.
+var oidcLoginTimeout = 10 * time.Minute
+
+// oidcAuth is an implementation of AuthScheme which authorizes browser
+// requests with an encrypted session cookie. Browsers without a valid
+// session are redirected to the OpenID Connect provider and the session
+// is created when the provider redirects them to the callback path.
+type oidcAuth struct {
+	name string
+	cfg  config.OIDCAuth
+	aead cipher.AEAD
+
+	mu       sync.Mutex
+	provider *oidcProvider
+
+	// lastErr is the error of the last discovery which is returned
+	// until jwksMinRefetch has passed.
+	lastErr     error
+	lastAttempt time.Time
+}
+
+// oidcProvider contains the endpoints of the provider from the discovery
+// document.
+type oidcProvider struct {
+	authURL  string
+	tokenURL string
+	verifier *tokenVerifier
+}
+
+// oidcSession is stored in the session cookie. Claims contains only the
+// claims which are forwarded to the upstream.
+type oidcSession struct {
+	Claims  map[string]interface{} `json:"c,omitempty"`
+	Refresh string                 `json:"r,omitempty"`
+	Expiry  int64                  `json:"e"`
+}
+
+// oidcState is stored in the state cookie during the login.
+type oidcState struct {
+	State  string `json:"s"`
+	Nonce  string `json:"n"`
+	URL    string `json:"u"`
+	Expiry int64  `json:"e"`
+}
+
+// oidcTokens is the response of the token endpoint.
+type oidcTokens struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+func newOIDCAuth(name string, cfg config.OIDCAuth) (AuthScheme, error) {
+	key := sha256.Sum256([]byte(cfg.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	o := &oidcAuth{name: name, cfg: cfg, aead: aead}
+	if _, err := o.discover(); err != nil {
+		// the provider is discovered again with the first request
+		log.Printf("[WARN] auth: Failed to discover OpenID provider %s: %s", cfg.Issuer, err)
+	}
+	return o, nil
+}
+
+func (o *oidcAuth) Authorized(request *http.Request, response http.ResponseWriter) bool {
+	for _, h := range o.cfg.Headers {
+		request.Header.Del(h)
+	}
+
+	p, err := o.discover()
+	if err != nil {
+		log.Printf("[WARN] auth: Failed to discover OpenID provider %s: %s", o.cfg.Issuer, err)
+		return false
+	}
+
+	if request.URL.Path == o.cfg.CallbackPath {
+		o.callback(p, request, response)
+		return false
+	}
+
+	s, ok := o.session(p, request, response)
+	if !ok {
+		if request.Method != "GET" && request.Method != "HEAD" {
+			return false
+		}
+		o.login(p, request, response)
+		return false
+	}
+
+	for claim, h := range o.cfg.Headers {
+		if v, ok := s.Claims[claim]; ok {
+			request.Header.Set(h, claimString(v))
+		}
+	}
+	if v, ok := s.Claims["sub"]; ok {
+		SetPrincipal(request, claimString(v))
+	}
+	return true
+}
+
+// session returns the session from the cookie. Expired sessions are
+// refreshed with the refresh token and the cookie is updated.
+func (o *oidcAuth) session(p *oidcProvider, r *http.Request, w http.ResponseWriter) (*oidcSession, bool) {
+	c, err := r.Cookie(o.cfg.CookieName)
+	if err != nil {
+		return nil, false
+	}
+	var s oidcSession
+	if err := o.decrypt(c.Value, &s); err != nil {
+		log.Printf("[DEBUG] auth: Invalid session cookie for %s: %s", o.name, err)
+		return nil, false
+	}
+	if time.Now().Unix() < s.Expiry {
+		return &s, true
+	}
+	if s.Refresh == "" {
+		return nil, false
+	}
+
+	tokens, err := o.token(p, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {s.Refresh}})
+	if err != nil {
+		log.Printf("[DEBUG] auth: Failed to refresh session for %s: %s", o.name, err)
+		return nil, false
+	}
+	ns, err := o.newSession(p, tokens, "", &s)
+	if err != nil {
+		log.Printf("[DEBUG] auth: Failed to refresh session for %s: %s", o.name, err)
+		return nil, false
+	}
+	if err := o.setCookie(w, r, o.cfg.CookieName, "/", ns, 0); err != nil {
+		log.Printf("[ERROR] auth: Failed to store session for %s: %s", o.name, err)
+		return nil, false
+	}
+	return ns, true
+}
+
+// login redirects the browser to the authorization endpoint of the
+// provider.
+func (o *oidcAuth) login(p *oidcProvider, r *http.Request, w http.ResponseWriter) {
+	st := oidcState{
+		State:  randomString(),
+		Nonce:  randomString(),
+		URL:    r.URL.RequestURI(),
+		Expiry: time.Now().Add(oidcLoginTimeout).Unix(),
+	}
+	if err := o.setCookie(w, r, o.cfg.CookieName+"_state", o.cfg.CallbackPath, st, oidcLoginTimeout); err != nil {
+		log.Printf("[ERROR] auth: Failed to store login state for %s: %s", o.name, err)
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.cfg.ClientID},
+		"redirect_uri":  {o.redirectURL(r)},
+		"scope":         {strings.Join(o.cfg.Scopes, " ")},
+		"state":         {st.State},
+		"nonce":         {st.Nonce},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// callback exchanges the authorization code for the tokens, creates the
+// session and redirects the browser to the page which started the login.
+func (o *oidcAuth) callback(p *oidcProvider, r *http.Request, w http.ResponseWriter) {
+	fail := func(format string, args ...interface{}) {
+		log.Printf("[DEBUG] auth: Login for %s failed: "+format, append([]interface{}{o.name}, args...)...)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+	}
+
+	c, err := r.Cookie(o.cfg.CookieName + "_state")
+	if err != nil {
+		fail("no login state")
+		return
+	}
+	var st oidcState
+	if err := o.decrypt(c.Value, &st); err != nil {
+		fail("%s", err)
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case time.Now().Unix() > st.Expiry:
+		fail("login expired")
+		return
+	case q.Get("state") != st.State:
+		fail("state mismatch")
+		return
+	case q.Get("error") != "":
+		fail("%s", q.Get("error"))
+		return
+	case q.Get("code") == "":
+		fail("no authorization code")
+		return
+	}
+
+	tokens, err := o.token(p, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {q.Get("code")},
+		"redirect_uri": {o.redirectURL(r)},
+	})
+	if err != nil {
+		fail("%s", err)
+		return
+	}
+	s, err := o.newSession(p, tokens, st.Nonce, nil)
+	if err != nil {
+		fail("%s", err)
+		return
+	}
+	if err := o.setCookie(w, r, o.cfg.CookieName, "/", s, 0); err != nil {
+		fail("%s", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: o.cfg.CookieName + "_state", Path: o.cfg.CallbackPath, MaxAge: -1})
+	http.Redirect(w, r, localURL(st.URL), http.StatusFound)
+}
+
+// newSession verifies the ID token and creates a session from it. The
+// nonce is checked if it is not empty. If the token response of a
+// refresh has no ID token the claims of the previous session are kept.
+func (o *oidcAuth) newSession(p *oidcProvider, tokens *oidcTokens, nonce string, prev *oidcSession) (*oidcSession, error) {
+	s := &oidcSession{Refresh: tokens.RefreshToken}
+	if s.Refresh == "" && prev != nil {
+		s.Refresh = prev.Refresh
+	}
+
+	if tokens.IDToken == "" {
+		if prev == nil {
+			return nil, errors.New("no id_token")
+		}
+		if tokens.ExpiresIn <= 0 {
+			return nil, errors.New("no id_token and expires_in")
+		}
+		s.Claims = prev.Claims
+		s.Expiry = time.Now().Unix() + tokens.ExpiresIn
+		return s, nil
+	}
+
+	claims, err := p.verifier.verify(tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce != "" && claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if err := requireClaims(claims, o.cfg.Claims); err != nil {
+		return nil, err
+	}
+	exp, _ := claims["exp"].(float64)
+	s.Expiry = int64(exp)
+	s.Claims = map[string]interface{}{}
+	for claim := range o.cfg.Headers {
+		if v, ok := claims[claim]; ok {
+			s.Claims[claim] = v
+		}
+	}
+	return s, nil
+}
+
+// token sends a request to the token endpoint of the provider.
+func (o *oidcAuth) token(p *oidcProvider, form url.Values) (*oidcTokens, error) {
+	req, err := http.NewRequest("POST", p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", p.tokenURL, resp.Status)
+	}
+	var tokens oidcTokens
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	return &tokens, nil
+}
+
+// discover returns the provider endpoints and loads them from the
+// discovery document of the issuer if they are not known yet.
+func (o *oidcAuth) discover() (*oidcProvider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	if o.lastErr != nil && time.Since(o.lastAttempt) < jwksMinRefetch {
+		return nil, o.lastErr
+	}
+	o.lastAttempt = time.Now()
+	o.provider, o.lastErr = o.fetchProvider()
+	return o.provider, o.lastErr
+}
+
+// fetchProvider loads the discovery document of the issuer.
+func (o *oidcAuth) fetchProvider() (*oidcProvider, error) {
+	u := strings.TrimSuffix(o.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	var doc struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != o.cfg.Issuer {
+		return nil, fmt.Errorf("%s: issuer %q does not match", u, doc.Issuer)
+	}
+	if doc.AuthURL == "" || doc.TokenURL == "" || doc.JWKSURL == "" {
+		return nil, fmt.Errorf("%s: missing endpoints", u)
+	}
+
+	v, err := newTokenVerifier(config.JWTAuth{
+		JWKSURL:  doc.JWKSURL,
+		Issuer:   o.cfg.Issuer,
+		Audience: []string{o.cfg.ClientID},
+		Refresh:  time.Hour,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &oidcProvider{authURL: doc.AuthURL, tokenURL: doc.TokenURL, verifier: v}, nil
+}
+
+// redirectURL returns the URL of the callback path for the host of the
+// request.
+func (o *oidcAuth) redirectURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host + o.cfg.CallbackPath
+}
+
+// setCookie stores the encrypted value in a cookie. A zero maxAge
+// creates a session cookie.
+func (o *oidcAuth) setCookie(w http.ResponseWriter, r *http.Request, name, path string, v interface{}, maxAge time.Duration) error {
+	value, err := o.encrypt(v)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   requestScheme(r) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// encrypt returns the JSON encoding of v encrypted with AES-GCM. The
+// name of the auth scheme is authenticated so that cookies cannot be
+// used for other schemes with the same secret.
+func (o *oidcAuth) encrypt(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, o.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	b := o.aead.Seal(nonce, nonce, data, []byte(o.name))
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (o *oidcAuth) decrypt(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	n := o.aead.NonceSize()
+	if len(b) < n {
+		return errors.New("cookie too short")
+	}
+	data, err := o.aead.Open(nil, b[:n], b[n:], []byte(o.name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// requestScheme returns the scheme of the request which is https if
+// fabio terminated TLS or the X-Forwarded-Proto header says so.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// localURL returns u if it is a path on the same host and "/" otherwise
+// so that the redirect after the login cannot point to another site.
+// Browsers treat "//host/path" and "/\host/path" as URLs of another host.
+func localURL(u string) string {
+	if !strings.HasPrefix(u, "/") || strings.HasPrefix(u, "//") || strings.HasPrefix(u, "/\\") {
+		return "/"
+	}
+	return u
+}
+
+// randomString returns a random URL safe string with 128 bits.
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
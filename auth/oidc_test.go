@@ -0,0 +1,356 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/go-jose/go-jose/v4"
+)
+
+// mockIdP is an OpenID Connect provider which issues ID tokens for the
+// authorization codes and refresh tokens it knows.
+type mockIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *ecdsa.PrivateKey
+
+	// lifetime is the lifetime of the ID tokens.
+	lifetime time.Duration
+
+	mu     sync.Mutex
+	codes  map[string]string // code -> nonce
+	tokens int32
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, lifetime: time.Hour, codes: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "k1", Algorithm: "ES256"}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "fabio" || secret != "s3cr3t" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		claims := map[string]interface{}{"email": "alice@example.com", "groups": []string{"admin"}}
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			idp.mu.Lock()
+			nonce, ok := idp.codes[r.FormValue("code")]
+			delete(idp.codes, r.FormValue("code"))
+			idp.mu.Unlock()
+			if !ok {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			claims["nonce"] = nonce
+		case "refresh_token":
+			if r.FormValue("refresh_token") != "refresh" {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		}
+		atomic.AddInt32(&idp.tokens, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id_token":      idp.idToken(claims),
+			"refresh_token": "refresh",
+			"expires_in":    3600,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) idToken(claims map[string]interface{}) string {
+	claims["iss"] = idp.URL
+	claims["aud"] = "fabio"
+	claims["sub"] = "alice"
+	claims["exp"] = time.Now().Add(idp.lifetime).Unix()
+	return signToken(idp.t, jose.ES256, idp.key, "k1", claims)
+}
+
+func (idp *mockIdP) newAuth(t *testing.T) AuthScheme {
+	a, err := newOIDCAuth("dash", config.OIDCAuth{
+		Issuer:       idp.URL,
+		ClientID:     "fabio",
+		ClientSecret: "s3cr3t",
+		Scopes:       []string{"openid", "email"},
+		CallbackPath: "/oauth2/callback",
+		CookieName:   "fabio_dash",
+		CookieSecret: "0123456789abcdef",
+		Claims:       map[string]string{"groups": "admin"},
+		Headers:      map[string]string{"email": "X-Email"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func browserRequest(method, u string, cookies ...*http.Cookie) *http.Request {
+	r, _ := http.NewRequest(method, u, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func responseCookie(rw *responseWriter, name string) *http.Cookie {
+	for _, c := range (&http.Response{Header: rw.Header()}).Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// oidcLogin runs the login flow for the URL and returns the session
+// cookie.
+func oidcLogin(t *testing.T, a AuthScheme, idp *mockIdP, u string) *http.Cookie {
+	t.Helper()
+
+	rw := &responseWriter{}
+	if a.Authorized(browserRequest("GET", u), rw) {
+		t.Fatal("request without session authorized")
+	}
+	if got, want := rw.code, http.StatusFound; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	loc, err := url.Parse(rw.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loc.Scheme+"://"+loc.Host+loc.Path, idp.URL+"/authorize"; got != want {
+		t.Fatalf("got redirect to %q want %q", got, want)
+	}
+	q := loc.Query()
+	if got, want := q.Get("redirect_uri"), "http://app.example.com/oauth2/callback"; got != want {
+		t.Fatalf("got redirect_uri %q want %q", got, want)
+	}
+	if got, want := q.Get("scope"), "openid email"; got != want {
+		t.Fatalf("got scope %q want %q", got, want)
+	}
+	state := responseCookie(rw, "fabio_dash_state")
+	if state == nil {
+		t.Fatal("got no state cookie")
+	}
+
+	// the provider redirects the browser to the callback
+	idp.mu.Lock()
+	idp.codes["code"] = q.Get("nonce")
+	idp.mu.Unlock()
+	rw = &responseWriter{}
+	cb := "http://app.example.com/oauth2/callback?code=code&state=" + url.QueryEscape(q.Get("state"))
+	if a.Authorized(browserRequest("GET", cb, state), rw) {
+		t.Fatal("callback authorized")
+	}
+	if got, want := rw.code, http.StatusFound; got != want {
+		t.Fatalf("got status %d want %d: %s", got, want, rw.written)
+	}
+	if got, want := rw.Header().Get("Location"), strings.TrimPrefix(u, "http://app.example.com"); got != want {
+		t.Fatalf("got redirect to %q want %q", got, want)
+	}
+	session := responseCookie(rw, "fabio_dash")
+	if session == nil {
+		t.Fatal("got no session cookie")
+	}
+	if !session.HttpOnly {
+		t.Fatal("session cookie is not http only")
+	}
+	return session
+}
+
+func TestOIDCAuth(t *testing.T) {
+	idp := newMockIdP(t)
+	a := idp.newAuth(t)
+	session := oidcLogin(t, a, idp, "http://app.example.com/dashboard?tab=1")
+
+	t.Run("session", func(t *testing.T) {
+		r := browserRequest("GET", "http://app.example.com/dashboard", session)
+		r.Header.Set("X-Email", "mallory@example.com")
+		if !a.Authorized(r, &responseWriter{}) {
+			t.Fatal("request with session not authorized")
+		}
+		if got, want := r.Header.Get("X-Email"), "alice@example.com"; got != want {
+			t.Fatalf("got X-Email %q want %q", got, want)
+		}
+	})
+
+	t.Run("tampered session", func(t *testing.T) {
+		c := *session
+		b := []byte(c.Value)
+		if b[20] == 'A' {
+			b[20] = 'B'
+		} else {
+			b[20] = 'A'
+		}
+		c.Value = string(b)
+		rw := &responseWriter{}
+		if a.Authorized(browserRequest("GET", "http://app.example.com/", &c), rw) {
+			t.Fatal("request with tampered session authorized")
+		}
+		if got, want := rw.code, http.StatusFound; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+	})
+
+	t.Run("no redirect for POST", func(t *testing.T) {
+		rw := &responseWriter{}
+		if a.Authorized(browserRequest("POST", "http://app.example.com/api"), rw) {
+			t.Fatal("request without session authorized")
+		}
+		if rw.code != 0 {
+			t.Fatalf("got status %d want none", rw.code)
+		}
+	})
+
+	t.Run("invalid state", func(t *testing.T) {
+		rw := &responseWriter{}
+		if a.Authorized(browserRequest("GET", "http://app.example.com/oauth2/callback?code=code&state=abc"), rw) {
+			t.Fatal("callback authorized")
+		}
+		if got, want := rw.code, http.StatusUnauthorized; got != want {
+			t.Fatalf("got status %d want %d", got, want)
+		}
+	})
+}
+
+func TestOIDCAuthRefresh(t *testing.T) {
+	idp := newMockIdP(t)
+
+	// ID tokens which expired within the leeway of the verifier create
+	// sessions which have to be refreshed with the next request.
+	idp.lifetime = -30 * time.Second
+	a := idp.newAuth(t)
+	session := oidcLogin(t, a, idp, "http://app.example.com/")
+	idp.lifetime = time.Hour
+
+	r := browserRequest("GET", "http://app.example.com/", session)
+	rw := &responseWriter{}
+	if !a.Authorized(r, rw) {
+		t.Fatal("request with expired session not refreshed")
+	}
+	if got, want := atomic.LoadInt32(&idp.tokens), int32(2); got != want {
+		t.Fatalf("got %d token requests want %d", got, want)
+	}
+	if got, want := r.Header.Get("X-Email"), "alice@example.com"; got != want {
+		t.Fatalf("got X-Email %q want %q", got, want)
+	}
+	refreshed := responseCookie(rw, "fabio_dash")
+	if refreshed == nil {
+		t.Fatal("got no refreshed session cookie")
+	}
+
+	// the refreshed session is valid without another refresh
+	if !a.Authorized(browserRequest("GET", "http://app.example.com/", refreshed), &responseWriter{}) {
+		t.Fatal("request with refreshed session not authorized")
+	}
+	if got, want := atomic.LoadInt32(&idp.tokens), int32(2); got != want {
+		t.Fatalf("got %d token requests want %d", got, want)
+	}
+}
+
+func TestOIDCAuthRequiredClaims(t *testing.T) {
+	idp := newMockIdP(t)
+	a, err := newOIDCAuth("dash", config.OIDCAuth{
+		Issuer:       idp.URL,
+		ClientID:     "fabio",
+		ClientSecret: "s3cr3t",
+		CallbackPath: "/oauth2/callback",
+		CookieName:   "fabio_dash",
+		CookieSecret: "0123456789abcdef",
+		Claims:       map[string]string{"groups": "ops"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := &responseWriter{}
+	a.Authorized(browserRequest("GET", "http://app.example.com/"), rw)
+	loc, _ := url.Parse(rw.Header().Get("Location"))
+	idp.mu.Lock()
+	idp.codes["code"] = loc.Query().Get("nonce")
+	idp.mu.Unlock()
+
+	cb := "http://app.example.com/oauth2/callback?code=code&state=" + url.QueryEscape(loc.Query().Get("state"))
+	rw2 := &responseWriter{}
+	if a.Authorized(browserRequest("GET", cb, responseCookie(rw, "fabio_dash_state")), rw2) {
+		t.Fatal("callback authorized")
+	}
+	if got, want := rw2.code, http.StatusUnauthorized; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if responseCookie(rw2, "fabio_dash") != nil {
+		t.Fatal("got session cookie for token without required claims")
+	}
+}
+
+func TestOIDCAuthRedirectToOtherHost(t *testing.T) {
+	idp := newMockIdP(t)
+	a := idp.newAuth(t)
+
+	rw := &responseWriter{}
+	a.Authorized(browserRequest("GET", "http://app.example.com//evil.example/x"), rw)
+	loc, _ := url.Parse(rw.Header().Get("Location"))
+	idp.mu.Lock()
+	idp.codes["code"] = loc.Query().Get("nonce")
+	idp.mu.Unlock()
+
+	cb := "http://app.example.com/oauth2/callback?code=code&state=" + url.QueryEscape(loc.Query().Get("state"))
+	rw2 := &responseWriter{}
+	if a.Authorized(browserRequest("GET", cb, responseCookie(rw, "fabio_dash_state")), rw2) {
+		t.Fatal("callback authorized")
+	}
+	if got, want := rw2.code, http.StatusFound; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if got, want := rw2.Header().Get("Location"), "/"; got != want {
+		t.Fatalf("got redirect to %q want %q", got, want)
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	tests := []struct {
+		u, want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/foo?x=y", "/foo?x=y"},
+		{"/foo//bar", "/foo//bar"},
+		{"//evil.example/x", "/"},
+		{`/\evil.example/x`, "/"},
+		{"http://evil.example/x", "/"},
+		{"evil.example/x", "/"},
+	}
+	for _, tt := range tests {
+		if got := localURL(tt.u); got != tt.want {
+			t.Errorf("localURL(%q): got %q want %q", tt.u, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMESource implements a certificate source which obtains TLS
+// certificates on-demand from an ACME server like Let's Encrypt.
+// Client authorization certificates are loaded from a file.
+//
+// The HTTP-01 challenge is answered by the HTTP listeners of fabio which
+// are wrapped with HTTPChallengeHandler and the TLS-ALPN-01 challenge is
+// answered by the TLS listener with this source. Accounts and
+// certificates are stored in Storage which is either a directory or a
+// Consul KV URL. The certificates are renewed automatically before they
+// expire.
+type ACMESource struct {
+	// DirectoryURL is the URL of the ACME directory.
+	DirectoryURL string
+
+	// Email is the optional contact email of the account.
+	Email string
+
+	// Storage is the directory or the Consul KV URL for the account key
+	// and the certificates.
+	Storage string
+
+	// CAPath is an optional file with the CA certificates for the
+	// connection to the ACME server.
+	CAPath string
+
+	ClientCAPath string
+	CAUpgradeCN  string
+
+	// Renew certificates this long before they expire. The default is
+	// 30 days.
+	RenewBefore time.Duration
+
+	// Policy restricts the hosts for which certificates are issued.
+	Policy *IssuePolicy
+
+	// HostPolicy decides whether the ACME client can obtain a
+	// certificate for the host. The default is to use Policy.
+	HostPolicy autocert.HostPolicy
+
+	initOnce sync.Once
+	initErr  error
+	m        *autocert.Manager
+	certsCh  chan []tls.Certificate
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu       sync.Mutex
+	certs    map[string]tls.Certificate // issued certs
+	renewals map[string]*time.Timer
+}
+
+// acmePruneInterval is the interval in which the ACME sources check
+// whether their hosts are still allowed by the host policy.
+var acmePruneInterval = 10 * time.Minute
+
+// acmeSources contains the initialized ACME sources for answering the
+// HTTP-01 challenges.
+var acmeSources = struct {
+	sync.Mutex
+	s []*ACMESource
+}{}
+
+func NewACMESource() *ACMESource {
+	return &ACMESource{
+		certs:    make(map[string]tls.Certificate),
+		renewals: make(map[string]*time.Timer),
+		certsCh:  make(chan []tls.Certificate, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *ACMESource) init() error {
+	s.initOnce.Do(func() {
+		cache, err := newACMECache(s.Storage)
+		if err != nil {
+			s.initErr = fmt.Errorf("acme: %s", err)
+			return
+		}
+
+		client := &acme.Client{DirectoryURL: s.DirectoryURL}
+		if s.CAPath != "" {
+			pemBlock, err := os.ReadFile(s.CAPath)
+			if err != nil {
+				s.initErr = fmt.Errorf("acme: %s", err)
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pemBlock) {
+				s.initErr = fmt.Errorf("acme: no certificates in %s", s.CAPath)
+				return
+			}
+			tr := http.DefaultTransport.(*http.Transport).Clone()
+			tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+			client.HTTPClient = &http.Client{Transport: tr}
+		}
+
+		policy := s.HostPolicy
+		if policy == nil {
+			policy = func(_ context.Context, host string) error {
+				return s.Policy.Allowed(host)
+			}
+		}
+
+		s.m = &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       cache,
+			HostPolicy:  policy,
+			RenewBefore: s.RenewBefore,
+			Client:      client,
+			Email:       s.Email,
+		}
+
+		// enables the HTTP-01 challenge in addition to TLS-ALPN-01
+		s.m.HTTPHandler(nil)
+
+		go func() {
+			ticker := time.NewTicker(acmePruneInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.done:
+					return
+				case <-ticker.C:
+					s.prune()
+				}
+			}
+		}()
+
+		acmeSources.Lock()
+		acmeSources.s = append(acmeSources.s, s)
+		acmeSources.Unlock()
+	})
+	return s.initErr
+}
+
+// stop stops pruning the certificates and removes the source from the
+// sources which answer the HTTP-01 challenges.
+func (s *ACMESource) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+
+		acmeSources.Lock()
+		defer acmeSources.Unlock()
+		for i, src := range acmeSources.s {
+			if src == s {
+				acmeSources.s = append(acmeSources.s[:i:i], acmeSources.s[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+func (s *ACMESource) LoadClientCAs() (*x509.CertPool, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	return FileSource{ClientAuthFile: s.ClientCAPath, CAUpgradeCN: s.CAUpgradeCN}.LoadClientCAs()
+}
+
+func (s *ACMESource) Certificates() chan []tls.Certificate {
+	return s.certsCh
+}
+
+func (s *ACMESource) issuePolicy() *IssuePolicy {
+	return s.Policy
+}
+
+// Issue obtains a certificate for the host from the ACME server or from
+// the storage. The certificate is obtained again after the ACME client
+// has renewed it.
+func (s *ACMESource) Issue(commonName string) (*tls.Certificate, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+
+	// prefer ECDSA certificates
+	hello := &tls.ClientHelloInfo{
+		ServerName:       commonName,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+	cert, err := s.m.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("acme: %s", err)
+		}
+	}
+
+	// The ACME client renews the certificate before the renewal time
+	// with a jitter of up to one hour. Pick up the new certificate
+	// shortly after that and check again every hour if the renewal
+	// has not succeeded yet.
+	renewBefore := s.m.RenewBefore
+	if renewBefore <= time.Hour {
+		renewBefore = 30 * 24 * time.Hour
+	}
+	next := time.Until(cert.Leaf.NotAfter) - renewBefore + time.Minute
+	if next < time.Hour {
+		next = time.Hour
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.renewals[commonName]; t != nil {
+		t.Stop()
+	}
+	s.renewals[commonName] = time.AfterFunc(next, func() {
+		// hosts which are no longer allowed are not renewed
+		s.prune()
+		if !s.issued(commonName) {
+			return
+		}
+		if _, err := s.Issue(commonName); err != nil {
+			log.Printf("[ERROR] cert: acme: Failed to renew cert for %s: %s", commonName, err)
+		}
+	})
+
+	if prev, ok := s.certs[commonName]; ok && bytes.Equal(prev.Certificate[0], cert.Certificate[0]) {
+		return cert, nil
+	}
+	log.Printf("[INFO] cert: acme: Loaded cert for %s valid until %s", commonName, cert.Leaf.NotAfter.Format(time.RFC3339))
+	s.certs[commonName] = *cert
+	s.publish()
+	return cert, nil
+}
+
+// issued returns true if the source has a certificate for the host.
+func (s *ACMESource) issued(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.certs[host]
+	return ok
+}
+
+// prune drops the certificates and stops the renewals of hosts which
+// are no longer allowed by the host policy, e.g. because they have been
+// removed from the routing table. The certificates stay in the storage
+// and are loaded again if the host comes back.
+func (s *ACMESource) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned bool
+	for host := range s.certs {
+		err := s.m.HostPolicy(context.Background(), host)
+		if err == nil {
+			continue
+		}
+		log.Printf("[INFO] cert: acme: Dropping cert for %s: %s", host, err)
+		if t := s.renewals[host]; t != nil {
+			t.Stop()
+		}
+		delete(s.renewals, host)
+		delete(s.certs, host)
+		pruned = true
+	}
+	if pruned {
+		s.publish()
+	}
+}
+
+// publish replaces the pending certificates of the source with the
+// issued ones. s.mu must be held.
+func (s *ACMESource) publish() {
+	certs := make([]tls.Certificate, 0, len(s.certs))
+	for _, c := range s.certs {
+		certs = append(certs, c)
+	}
+	select {
+	case <-s.certsCh:
+	default:
+	}
+	s.certsCh <- certs
+}
+
+// ChallengeCertificate returns the certificate for a TLS-ALPN-01
+// challenge request.
+func (s *ACMESource) ChallengeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	return s.m.GetCertificate(hello)
+}
+
+// challengeResponder is implemented by sources which answer the
+// TLS-ALPN-01 challenge of the ACME protocol.
+type challengeResponder interface {
+	ChallengeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// isChallenge returns true if the client hello is a TLS-ALPN-01
+// challenge request.
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// HTTPChallengeHandler returns a handler which answers the HTTP-01
+// challenges of the ACME certificate sources and passes all other
+// requests to h.
+func HTTPChallengeHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		acmeSources.Lock()
+		srcs := acmeSources.s
+		acmeSources.Unlock()
+
+		// every source only knows its own tokens
+		for _, s := range srcs {
+			rec := &challengeRecorder{header: http.Header{}}
+			s.m.HTTPHandler(nil).ServeHTTP(rec, r)
+			if rec.code == http.StatusOK {
+				for k, v := range rec.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(rec.code)
+				w.Write(rec.body.Bytes())
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// challengeRecorder records the response of an HTTP-01 challenge handler.
+type challengeRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *challengeRecorder) Header() http.Header { return r.header }
+
+func (r *challengeRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *challengeRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+// newACMECache returns the storage for the ACME accounts and
+// certificates. Consul KV URLs are in the same format as for the consul
+// certificate source. All other values are directories.
+func newACMECache(storage string) (autocert.Cache, error) {
+	if storage == "" {
+		return nil, errors.New("missing storage")
+	}
+	if !strings.HasPrefix(storage, "http://") && !strings.HasPrefix(storage, "https://") {
+		return autocert.DirCache(storage), nil
+	}
+	config, key, err := parseConsulURL(storage)
+	if err != nil {
+		return nil, err
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return consulCache{client.KV(), strings.TrimSuffix(key, "/")}, nil
+}
+
+// consulCache stores the ACME accounts and certificates in the Consul
+// KV store below the prefix.
+type consulCache struct {
+	kv     *api.KV
+	prefix string
+}
+
+func (c consulCache) Get(ctx context.Context, name string) ([]byte, error) {
+	kvpair, _, err := c.kv.Get(c.prefix+"/"+name, (&api.QueryOptions{RequireConsistent: true}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("consul: get: %s", err)
+	}
+	if kvpair == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return kvpair.Value, nil
+}
+
+func (c consulCache) Put(ctx context.Context, name string, data []byte) error {
+	_, err := c.kv.Put(&api.KVPair{Key: c.prefix + "/" + name, Value: data}, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("consul: put: %s", err)
+	}
+	return nil
+}
+
+func (c consulCache) Delete(ctx context.Context, name string) error {
+	_, err := c.kv.Delete(c.prefix+"/"+name, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("consul: delete: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package cert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestNewSourceACME(t *testing.T) {
+	src, err := NewSource(config.CertSource{
+		Type:         "acme",
+		CertPath:     "https://acme.example.com/directory",
+		ClientCAPath: "clientca",
+		CAUpgradeCN:  "upgcn",
+		Refresh:      48 * time.Hour,
+		ACMEEmail:    "admin@example.com",
+		ACMEStorage:  "/var/lib/fabio/acme",
+		ACMECAPath:   "ca.pem",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := src.(*ACMESource)
+	if !ok {
+		t.Fatalf("got %T want *ACMESource", src)
+	}
+	got := []interface{}{s.DirectoryURL, s.Email, s.Storage, s.CAPath, s.ClientCAPath, s.CAUpgradeCN, s.RenewBefore}
+	want := []interface{}{"https://acme.example.com/directory", "admin@example.com", "/var/lib/fabio/acme", "ca.pem", "clientca", "upgcn", 48 * time.Hour}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestTLSConfigACME(t *testing.T) {
+	src := NewACMESource()
+	src.DirectoryURL = "https://acme.example.com/directory"
+	src.Storage = t.TempDir()
+
+	cfg, stop, err := TLSConfig("test", src, true, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cfg.NextProtos, []string{"h2", "http/1.1", acme.ALPNProto}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got next protos %v want %v", got, want)
+	}
+
+	// stop ends the pruning and the HTTP-01 challenges of the source
+	stop()
+	select {
+	case <-src.done:
+	default:
+		t.Fatal("source not stopped")
+	}
+	acmeSources.Lock()
+	defer acmeSources.Unlock()
+	for _, s := range acmeSources.s {
+		if s == src {
+			t.Fatal("stopped source still answers challenges")
+		}
+	}
+}
+
+func TestACMESourcePrune(t *testing.T) {
+	allowed := map[string]bool{"a.com": true, "b.com": true}
+	var mu sync.Mutex
+	src := NewACMESource()
+	src.DirectoryURL = "https://acme.example.com/directory"
+	src.Storage = t.TempDir()
+	src.HostPolicy = func(_ context.Context, host string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !allowed[host] {
+			return errors.New("not allowed")
+		}
+		return nil
+	}
+	if err := src.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	src.mu.Lock()
+	for host := range allowed {
+		src.certs[host] = makeCert(host, time.Hour)
+		src.renewals[host] = time.AfterFunc(time.Hour, func() {})
+	}
+	src.mu.Unlock()
+
+	// hosts which are still allowed are kept
+	src.prune()
+	if !src.issued("a.com") || !src.issued("b.com") {
+		t.Fatal("got dropped certs want all certs")
+	}
+
+	mu.Lock()
+	delete(allowed, "b.com")
+	mu.Unlock()
+	src.prune()
+	if !src.issued("a.com") || src.issued("b.com") {
+		t.Fatal("got cert for b.com want only a.com")
+	}
+	src.mu.Lock()
+	_, ok := src.renewals["b.com"]
+	src.mu.Unlock()
+	if ok {
+		t.Fatal("got renewal for b.com")
+	}
+	certs := <-src.Certificates()
+	if got, want := len(certs), 1; got != want {
+		t.Fatalf("got %d certs want %d", got, want)
+	}
+	if got, want := certs[0].Leaf.DNSNames, []string{"a.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestNewACMECache(t *testing.T) {
+	if _, err := newACMECache(""); err == nil {
+		t.Fatal("got nil want error for empty storage")
+	}
+	if _, err := newACMECache("http://localhost:8500/fabio/acme"); err == nil {
+		t.Fatal("got nil want error for invalid consul url")
+	}
+
+	dir := t.TempDir()
+	c, err := newACMECache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c, autocert.DirCache(dir); got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	c, err = newACMECache("http://localhost:8500/v1/kv/fabio/acme/?token=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, ok := c.(consulCache)
+	if !ok {
+		t.Fatalf("got %T want consulCache", c)
+	}
+	if got, want := cc.prefix, "fabio/acme"; got != want {
+		t.Fatalf("got prefix %q want %q", got, want)
+	}
+}
+
+func TestHTTPChallengeHandler(t *testing.T) {
+	src := NewACMESource()
+	src.DirectoryURL = "https://acme.example.com/directory"
+	src.Storage = t.TempDir()
+	if err := src.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := HTTPChallengeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		desc, path string
+	}{
+		{"other path", "/foo"},
+		{"unknown token", "/.well-known/acme-challenge/abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "http://www.example.com"+tt.path, nil))
+			if got, want := rec.Code, http.StatusTeapot; got != want {
+				t.Fatalf("got %d want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestACMESourcePebble issues a certificate from a Pebble ACME test
+// server. The test requires the PEBBLE_EXE, PEBBLE_CONFIG and PEBBLE_CA
+// environment variables which point to the pebble binary, its
+// configuration file and the CA certificate of its HTTPS listener.
+// Pebble is started with PEBBLE_VA_ALWAYS_VALID=1 so that the challenges
+// do not have to be answered.
+func TestACMESourcePebble(t *testing.T) {
+	pebble, pebbleConfig, pebbleCA := os.Getenv("PEBBLE_EXE"), os.Getenv("PEBBLE_CONFIG"), os.Getenv("PEBBLE_CA")
+	if pebble == "" || pebbleConfig == "" || pebbleCA == "" {
+		t.Skip("PEBBLE_EXE, PEBBLE_CONFIG or PEBBLE_CA not set")
+	}
+
+	cmd := exec.Command(pebble, "-config", pebbleConfig)
+	cmd.Env = append(os.Environ(), "PEBBLE_VA_ALWAYS_VALID=1", "PEBBLE_VA_NOSLEEP=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start pebble: %s", err)
+	}
+	defer cmd.Process.Kill()
+
+	pemBlock, err := os.ReadFile(pebbleCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pemBlock)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	const directoryURL = "https://localhost:14000/dir"
+	isUp := func() bool {
+		resp, err := client.Get(directoryURL)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == 200
+	}
+	if !waitFor(10*time.Second, isUp) {
+		t.Fatal("Timeout waiting for pebble")
+	}
+
+	src := NewACMESource()
+	src.DirectoryURL = directoryURL
+	src.CAPath = pebbleCA
+	src.Storage = t.TempDir()
+	src.HostPolicy = autocert.HostWhitelist("localhost")
+
+	cert, err := src.Issue("localhost")
+	if err != nil {
+		t.Fatalf("Issue: %s", err)
+	}
+	if got, want := cert.Leaf.DNSNames, []string{"localhost"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got DNS names %v want %v", got, want)
+	}
+	if got, want := len(<-src.Certificates()), 1; got != want {
+		t.Fatalf("got %d certs want %d", got, want)
+	}
+	if _, err := src.Issue("www.example.com"); err == nil {
+		t.Fatal("got nil want error for host outside of the host policy")
+	}
+}
@@ -0,0 +1,142 @@
+package cert
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+	"github.com/gobwas/glob"
+)
+
+// ErrIssueRateLimited is returned by IssuePolicy.Check when the issuance
+// rate limit has been reached.
+var ErrIssueRateLimited = errors.New("issuance rate limit reached")
+
+// globCache caches the compiled host patterns of the routing table for
+// the issuance policy.
+var globCache = route.NewGlobCache(1000)
+
+// IssuePolicy decides for which server names an Issuer can obtain
+// certificates on-demand. Certificates are only issued for hosts which
+// are in the routing table, either by name or by a glob pattern. If
+// allow patterns are configured the server name must also match one of
+// them and it must not match any of the deny patterns. The number of
+// issued certificates can be limited with a token bucket.
+//
+// A nil policy only requires the host to be in the routing table.
+type IssuePolicy struct {
+	allow []glob.Glob
+	deny  []glob.Glob
+	rate  float64
+	burst int
+
+	// hasHost returns true if the host is in the routing table. It can
+	// be overridden in tests.
+	hasHost func(host string) bool
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewIssuePolicy returns the issuance policy of the certificate source.
+func NewIssuePolicy(cfg config.CertSource) (*IssuePolicy, error) {
+	compile := func(patterns []string) ([]glob.Glob, error) {
+		var globs []glob.Glob
+		for _, p := range patterns {
+			g, err := glob.Compile(strings.ToLower(p))
+			if err != nil {
+				return nil, fmt.Errorf("invalid issue pattern %q: %s", p, err)
+			}
+			globs = append(globs, g)
+		}
+		return globs, nil
+	}
+
+	allow, err := compile(cfg.IssueAllow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := compile(cfg.IssueDeny)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuePolicy{
+		allow:  allow,
+		deny:   deny,
+		rate:   cfg.IssueRate,
+		burst:  cfg.IssueBurst,
+		tokens: float64(cfg.IssueBurst),
+	}, nil
+}
+
+// Allowed returns an error if no certificate can be issued for the
+// server name.
+func (p *IssuePolicy) Allowed(serverName string) error {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return errors.New("missing server name")
+	}
+
+	hasHost := func(host string) bool { return route.GetTable().HasHost(host, globCache) }
+	if p != nil && p.hasHost != nil {
+		hasHost = p.hasHost
+	}
+	if !hasHost(name) {
+		return fmt.Errorf("host %q not in routing table", name)
+	}
+	if p == nil {
+		return nil
+	}
+
+	for _, g := range p.deny {
+		if g.Match(name) {
+			return fmt.Errorf("host %q denied", name)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, g := range p.allow {
+		if g.Match(name) {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q not allowed", name)
+}
+
+// Check returns an error if no certificate can be issued for the server
+// name or if the issuance rate limit has been reached.
+func (p *IssuePolicy) Check(serverName string) error {
+	if err := p.Allowed(serverName); err != nil {
+		return err
+	}
+	if p == nil || p.rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.last.IsZero() {
+		p.tokens += now.Sub(p.last).Seconds() * p.rate
+		if p.tokens > float64(p.burst) {
+			p.tokens = float64(p.burst)
+		}
+	}
+	p.last = now
+	if p.tokens < 1 {
+		return ErrIssueRateLimited
+	}
+	p.tokens--
+	return nil
+}
+
+// policyIssuer is implemented by issuers which have an issuance policy.
+type policyIssuer interface {
+	issuePolicy() *IssuePolicy
+}
@@ -0,0 +1,226 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+)
+
+func TestIssuePolicyAllowed(t *testing.T) {
+	tbl, err := route.NewTable(bytes.NewBufferString(`
+		route add svc www.example.com/ http://1.2.3.4/
+		route add svc admin.example.com/ http://1.2.3.4/
+		route add svc *.foo.com/ http://1.2.3.4/
+		route add svc www.bar.com/ http://1.2.3.4/
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.SetTable(tbl)
+	defer route.SetTable(route.Table{})
+
+	policy, err := NewIssuePolicy(config.CertSource{
+		IssueAllow: []string{"*.example.com", "*.foo.com"},
+		IssueDeny:  []string{"admin.*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc   string
+		policy *IssuePolicy
+		name   string
+		err    string
+	}{
+		{"nil policy", nil, "www.example.com", ""},
+		{"nil policy with glob host", nil, "a.foo.com", ""},
+		{"nil policy with trailing dot", nil, "WWW.example.com.", ""},
+		{"nil policy not in table", nil, "www.baz.com", `host "www.baz.com" not in routing table`},
+		{"nil policy without server name", nil, "", "missing server name"},
+		{"allowed", policy, "www.example.com", ""},
+		{"allowed glob host", policy, "a.foo.com", ""},
+		{"denied", policy, "admin.example.com", `host "admin.example.com" denied`},
+		{"not allowed", policy, "www.bar.com", `host "www.bar.com" not allowed`},
+		{"not in table", policy, "x.example.com", `host "x.example.com" not in routing table`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var errmsg string
+			if err := tt.policy.Allowed(tt.name); err != nil {
+				errmsg = err.Error()
+			}
+			if got, want := errmsg, tt.err; got != want {
+				t.Fatalf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestNewIssuePolicyInvalidPattern(t *testing.T) {
+	if _, err := NewIssuePolicy(config.CertSource{IssueDeny: []string{"[a"}}); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
+
+func TestIssuePolicyRateLimit(t *testing.T) {
+	policy, err := NewIssuePolicy(config.CertSource{IssueRate: 1.0 / 3600, IssueBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.hasHost = func(string) bool { return true }
+
+	for i := 0; i < 2; i++ {
+		if err := policy.Check("www.example.com"); err != nil {
+			t.Fatalf("%d: got %v want nil", i, err)
+		}
+	}
+	if got, want := policy.Check("www.example.com"), ErrIssueRateLimited; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// refill the bucket
+	policy.mu.Lock()
+	policy.last = policy.last.Add(-time.Hour)
+	policy.mu.Unlock()
+	if err := policy.Check("www.example.com"); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+}
+
+// issuerSource is a certificate source which issues self-signed
+// certificates with an issuance policy.
+type issuerSource struct {
+	certsCh chan []tls.Certificate
+	policy  *IssuePolicy
+	delay   time.Duration
+	mu      sync.Mutex
+	issued  []string
+}
+
+func newIssuerSource(policy *IssuePolicy) *issuerSource {
+	return &issuerSource{certsCh: make(chan []tls.Certificate, 1), policy: policy}
+}
+
+func (s *issuerSource) Certificates() chan []tls.Certificate {
+	return s.certsCh
+}
+
+func (s *issuerSource) LoadClientCAs() (*x509.CertPool, error) {
+	return nil, nil
+}
+
+func (s *issuerSource) Issue(commonName string) (*tls.Certificate, error) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.issued = append(s.issued, commonName)
+	s.mu.Unlock()
+	cert := makeCert(commonName, time.Hour)
+	return &cert, nil
+}
+
+func (s *issuerSource) issuePolicy() *IssuePolicy {
+	return s.policy
+}
+
+func (s *issuerSource) issuedNames() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.issued, ",")
+}
+
+func TestTLSConfigIssuePolicy(t *testing.T) {
+	policy := &IssuePolicy{hasHost: func(host string) bool { return host == "www.example.com" }}
+
+	t.Run("strictmatch", func(t *testing.T) {
+		src := newIssuerSource(policy)
+		cfg, stop, err := TLSConfig("test", src, true, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+		if err != nil || cert == nil {
+			t.Fatalf("got %v, %v want cert", cert, err)
+		}
+		cert, err = cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.com"})
+		if err == nil || !strings.Contains(err.Error(), "not in routing table") {
+			t.Fatalf("got %v, %v want error", cert, err)
+		}
+		if got, want := src.issuedNames(), "www.example.com"; got != want {
+			t.Fatalf("got issued %q want %q", got, want)
+		}
+	})
+
+	t.Run("default cert", func(t *testing.T) {
+		src := newIssuerSource(policy)
+		cfg, stop, err := TLSConfig("test", src, false, 0, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+
+		// no default certificate yet
+		if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.com"}); err == nil {
+			t.Fatal("got nil want error")
+		}
+
+		def := makeCert("default.com", time.Hour)
+		src.certsCh <- []tls.Certificate{def}
+		hasDefault := func() bool {
+			cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.com"})
+			return err == nil && cert != nil && bytes.Equal(cert.Certificate[0], def.Certificate[0])
+		}
+		if !waitFor(time.Second, hasDefault) {
+			t.Fatal("got no default cert")
+		}
+		if got := src.issuedNames(); got != "" {
+			t.Fatalf("got issued %q want none", got)
+		}
+	})
+}
+
+func TestTLSConfigIssueRateConcurrent(t *testing.T) {
+	policy, err := NewIssuePolicy(config.CertSource{IssueRate: 1.0 / 3600, IssueBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.hasHost = func(string) bool { return true }
+	src := newIssuerSource(policy)
+	src.delay = 200 * time.Millisecond
+	cfg, stop, err := TLSConfig("test", src, true, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	// concurrent handshakes for the same name use up a single token
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("got %v want nil", err)
+		}
+	}
+	if got, want := src.issuedNames(), "www.example.com"; got != want {
+		t.Fatalf("got issued %q want %q", got, want)
+	}
+}
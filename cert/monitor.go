@@ -0,0 +1,225 @@
+package cert
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/metrics"
+	gkm "github.com/go-kit/kit/metrics"
+)
+
+// monitorInterval is the interval in which the OCSP responses are
+// refreshed and the certificate metrics are updated.
+var monitorInterval = time.Minute
+
+type metrix struct {
+	expiry     gkm.Gauge
+	ocspAge    gkm.Gauge
+	ocspExpiry gkm.Gauge
+}
+
+var counters = newMetrix(metrics.DiscardProvider{})
+
+func newMetrix(p metrics.Provider) metrix {
+	return metrix{
+		expiry:     p.NewGauge("cert.expiry", "source", "name"),
+		ocspAge:    p.NewGauge("cert.ocsp.age", "source", "name"),
+		ocspExpiry: p.NewGauge("cert.ocsp.expiry", "source", "name"),
+	}
+}
+
+// SetMetricsProvider sets the metrics provider for the certificate
+// expiry and OCSP staple metrics.
+func SetMetricsProvider(p metrics.Provider) {
+	counters = newMetrix(p)
+}
+
+// stores contains the monitored certificate stores by the name of
+// their certificate source.
+var stores = struct {
+	sync.Mutex
+	m map[*Store]string
+}{m: map[*Store]string{}}
+
+// monitor registers the store for the certificate listing and refreshes
+// the OCSP responses and metrics of its certificates in the background
+// until done is closed. Then the store is removed from the listing and
+// the metrics of its certificates are deleted.
+func monitor(name string, s *Store, done <-chan struct{}) {
+	stores.Lock()
+	stores.m[s] = name
+	stores.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(monitorInterval)
+		defer ticker.Stop()
+		var names map[string]bool
+		for {
+			select {
+			case <-done:
+				stores.Lock()
+				delete(stores.m, s)
+				stores.Unlock()
+				deleteMetrics(name, names, nil)
+				return
+			case <-s.changed:
+			case <-ticker.C:
+			}
+			s.refreshStaples()
+			cur := s.updateMetrics(name)
+			deleteMetrics(name, names, cur)
+			names = cur
+		}
+	}()
+}
+
+// updateMetrics updates the metrics of the certificates in the store
+// and returns their names.
+func (s *Store) updateMetrics(name string) map[string]bool {
+	now := time.Now()
+	names := map[string]bool{}
+	for _, cert := range s.certstore().Certificates {
+		x, err := leaf(&cert)
+		if err != nil {
+			continue
+		}
+		cn := certName(x)
+		names[cn] = true
+		counters.expiry.With("source", name, "name", cn).Set(x.NotAfter.Sub(now).Seconds())
+
+		s.mu.Lock()
+		st := s.staples[fingerprint(&cert)]
+		s.mu.Unlock()
+		if st == nil {
+			continue
+		}
+		var age, expiry float64
+		if st.valid(now) {
+			age = now.Sub(st.thisUpdate).Seconds()
+			if !st.nextUpdate.IsZero() {
+				expiry = st.nextUpdate.Sub(now).Seconds()
+			}
+		}
+		counters.ocspAge.With("source", name, "name", cn).Set(age)
+		counters.ocspExpiry.With("source", name, "name", cn).Set(expiry)
+	}
+	return names
+}
+
+// deleteMetrics deletes the metrics of the certificates in old which
+// are not in names. The metrics of certificates which another store of
+// the same source still has are kept.
+func deleteMetrics(source string, old, names map[string]bool) {
+	for cn := range old {
+		if names[cn] || loaded(source, cn) {
+			continue
+		}
+		for _, g := range []gkm.Gauge{counters.expiry, counters.ocspAge, counters.ocspExpiry} {
+			metrics.Delete(g, "source", source, "name", cn)
+		}
+	}
+}
+
+// loaded returns true if a monitored store of the source has a
+// certificate with the given name.
+func loaded(source, cn string) bool {
+	stores.Lock()
+	defer stores.Unlock()
+	for s, name := range stores.m {
+		if name != source {
+			continue
+		}
+		for _, cert := range s.certstore().Certificates {
+			if x, err := leaf(&cert); err == nil && certName(x) == cn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CertInfo describes a loaded certificate.
+type CertInfo struct {
+	Source         string     `json:"source"`
+	Subject        string     `json:"subject"`
+	SANs           []string   `json:"sans"`
+	Issuer         string     `json:"issuer"`
+	Serial         string     `json:"serial"`
+	NotBefore      time.Time  `json:"notBefore"`
+	NotAfter       time.Time  `json:"notAfter"`
+	OCSPStatus     string     `json:"ocspStatus,omitempty"`
+	OCSPStapled    bool       `json:"ocspStapled"`
+	OCSPNextUpdate *time.Time `json:"ocspNextUpdate,omitempty"`
+}
+
+// LoadedCertificates returns the certificates of all monitored stores
+// sorted by source and subject. Certificates which are loaded by more
+// than one listener are only listed once.
+func LoadedCertificates() []CertInfo {
+	stores.Lock()
+	m := make(map[*Store]string, len(stores.m))
+	for s, name := range stores.m {
+		m[s] = name
+	}
+	stores.Unlock()
+
+	seen := map[string]bool{}
+	var infos []CertInfo
+	for s, name := range m {
+		for _, cert := range s.certstore().Certificates {
+			infos = appendCertInfo(infos, seen, name, s, cert)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Source != infos[j].Source {
+			return infos[i].Source < infos[j].Source
+		}
+		if infos[i].Subject != infos[j].Subject {
+			return infos[i].Subject < infos[j].Subject
+		}
+		return infos[i].Serial < infos[j].Serial
+	})
+	return infos
+}
+
+func appendCertInfo(infos []CertInfo, seen map[string]bool, name string, s *Store, cert tls.Certificate) []CertInfo {
+	x, err := leaf(&cert)
+	if err != nil {
+		return infos
+	}
+	fp := fingerprint(&cert)
+	key := name + " " + hex.EncodeToString(fp[:])
+	if seen[key] {
+		return infos
+	}
+	seen[key] = true
+
+	info := CertInfo{
+		Source:      name,
+		Subject:     x.Subject.String(),
+		SANs:        append([]string(nil), x.DNSNames...),
+		Issuer:      x.Issuer.String(),
+		Serial:      x.SerialNumber.String(),
+		NotBefore:   x.NotBefore,
+		NotAfter:    x.NotAfter,
+		OCSPStapled: cert.OCSPStaple != nil,
+	}
+	for _, ip := range x.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+
+	s.mu.Lock()
+	st := s.staples[fp]
+	s.mu.Unlock()
+	if st != nil && st.raw != nil {
+		info.OCSPStatus = ocspStatus(st.status)
+		if !st.nextUpdate.IsZero() {
+			t := st.nextUpdate
+			info.OCSPNextUpdate = &t
+		}
+	}
+	return append(infos, info)
+}
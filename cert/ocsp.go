@@ -0,0 +1,215 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspClient is the HTTP client for fetching OCSP responses.
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// ocspRetry is the time after which a failed OCSP request is retried.
+const ocspRetry = 5 * time.Minute
+
+// staple is the cached OCSP response of a certificate.
+type staple struct {
+	// raw is the DER encoded OCSP response which is stapled to the
+	// certificate if its status is good and it has not expired.
+	raw        []byte
+	status     int
+	thisUpdate time.Time
+	nextUpdate time.Time
+
+	// refreshAt is the time when the response is fetched again.
+	refreshAt time.Time
+}
+
+// valid returns true if the response can be stapled to the certificate.
+func (s *staple) valid(now time.Time) bool {
+	return s != nil && s.raw != nil && s.status == ocsp.Good && (s.nextUpdate.IsZero() || now.Before(s.nextUpdate))
+}
+
+// fingerprint returns the SHA-256 hash of the leaf certificate.
+func fingerprint(cert *tls.Certificate) [32]byte {
+	return sha256.Sum256(cert.Certificate[0])
+}
+
+// leaf returns the parsed leaf certificate.
+func leaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("empty certificate")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// ocspIssuer returns the leaf certificate and its issuer if the
+// certificate supports OCSP stapling. The issuer must be the second
+// certificate of the chain.
+func ocspIssuer(cert *tls.Certificate) (leafCert, issuer *x509.Certificate, ok bool) {
+	if len(cert.Certificate) < 2 {
+		return nil, nil, false
+	}
+	leafCert, err := leaf(cert)
+	if err != nil || len(leafCert.OCSPServer) == 0 {
+		return nil, nil, false
+	}
+	issuer, err = x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, false
+	}
+	return leafCert, issuer, true
+}
+
+// fetchOCSP requests the OCSP response for the certificate from the
+// first OCSP server of the certificate.
+func fetchOCSP(leafCert, issuer *x509.Certificate) (*staple, error) {
+	req, err := ocsp.CreateRequest(leafCert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	url := leafCert.OCSPServer[0]
+	resp, err := ocspClient.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := ocsp.ParseResponseForCert(raw, leafCert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &staple{raw: raw, status: r.Status, thisUpdate: r.ThisUpdate, nextUpdate: r.NextUpdate}, nil
+}
+
+// refreshTime returns the time when the OCSP response should be fetched
+// again which is halfway through its validity period. Responses
+// without a next update time are fetched again after one hour.
+func (s *staple) refreshTime(now time.Time) time.Time {
+	if s.nextUpdate.IsZero() || !s.nextUpdate.After(s.thisUpdate) {
+		return now.Add(time.Hour)
+	}
+	t := s.thisUpdate.Add(s.nextUpdate.Sub(s.thisUpdate) / 2)
+	if t.Before(now.Add(time.Minute)) {
+		return now.Add(time.Minute)
+	}
+	return t
+}
+
+// refreshStaples fetches the OCSP responses for the certificates in the
+// store which need to be refreshed and staples them to the
+// certificates.
+func (s *Store) refreshStaples() {
+	now := time.Now()
+	certs := s.certstore().Certificates
+
+	seen := map[[32]byte]bool{}
+	for i := range certs {
+		cert := &certs[i]
+		leafCert, issuer, ok := ocspIssuer(cert)
+		if !ok {
+			continue
+		}
+		key := fingerprint(cert)
+		seen[key] = true
+
+		s.mu.Lock()
+		old := s.staples[key]
+		s.mu.Unlock()
+		if old != nil && now.Before(old.refreshAt) {
+			continue
+		}
+
+		st, err := fetchOCSP(leafCert, issuer)
+		if err != nil {
+			log.Printf("[WARN] cert: Failed to fetch OCSP response for %s: %s", certName(leafCert), err)
+			if old == nil {
+				old = &staple{}
+			}
+			// keep the old response until it expires
+			retry := *old
+			retry.refreshAt = now.Add(ocspRetry)
+			st = &retry
+		} else {
+			st.refreshAt = st.refreshTime(now)
+			if st.status != ocsp.Good {
+				log.Printf("[WARN] cert: OCSP status of %s is %s", certName(leafCert), ocspStatus(st.status))
+			}
+		}
+
+		s.mu.Lock()
+		s.staples[key] = st
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.staples {
+		if !seen[key] {
+			delete(s.staples, key)
+		}
+	}
+	// staple new responses and remove expired ones
+	if len(seen) > 0 {
+		s.setCertificates(s.certstore().Certificates)
+	}
+}
+
+// applyStaples returns a copy of the certificates with the valid OCSP
+// responses stapled to them. s.mu must be held.
+func (s *Store) applyStaples(certs []tls.Certificate) []tls.Certificate {
+	now := time.Now()
+	out := make([]tls.Certificate, len(certs))
+	for i, cert := range certs {
+		cert.OCSPStaple = nil
+		if len(cert.Certificate) > 0 {
+			if st := s.staples[fingerprint(&cert)]; st.valid(now) {
+				cert.OCSPStaple = st.raw
+			}
+		}
+		out[i] = cert
+	}
+	return out
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// certName returns the common name of the certificate or its first DNS
+// name.
+func certName(c *x509.Certificate) string {
+	if c.Subject.CommonName != "" {
+		return c.Subject.CommonName
+	}
+	if len(c.DNSNames) > 0 {
+		return c.DNSNames[0]
+	}
+	return c.SerialNumber.String()
+}
@@ -0,0 +1,299 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gkm "github.com/go-kit/kit/metrics"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder starts an OCSP responder for the CA which returns the
+// given status for all certificates.
+func ocspResponder(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, status int) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now.Add(-time.Hour),
+			NextUpdate:   now.Add(23 * time.Hour),
+			RevokedAt:    now.Add(-time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// makeCA creates a CA certificate and its key.
+func makeCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// makeLeaf creates a certificate for host which is signed by the CA
+// and has its OCSP server set to ocspURL if it is not empty.
+func makeLeaf(t *testing.T, host, ocspURL string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+	}
+	if ocspURL != "" {
+		tmpl.OCSPServer = []string{ocspURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.Raw}, PrivateKey: key}
+}
+
+func TestStoreOCSPStapling(t *testing.T) {
+	tests := []struct {
+		desc    string
+		status  int
+		stapled bool
+	}{
+		{"good", ocsp.Good, true},
+		{"revoked", ocsp.Revoked, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ca, caKey := makeCA(t)
+			srv, requests := ocspResponder(t, ca, caKey, tt.status)
+			cert := makeLeaf(t, "www.example.com", srv.URL, ca, caKey)
+
+			s := NewStore()
+			s.SetCertificates([]tls.Certificate{cert})
+			s.refreshStaples()
+
+			got, _ := getCertificate(s.certstore(), &tls.ClientHelloInfo{ServerName: "www.example.com"}, true)
+			if got == nil {
+				t.Fatal("no certificate")
+			}
+			if gotStapled := got.OCSPStaple != nil; gotStapled != tt.stapled {
+				t.Fatalf("got stapled %v want %v", gotStapled, tt.stapled)
+			}
+			if tt.stapled {
+				resp, err := ocsp.ParseResponse(got.OCSPStaple, ca)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Status != ocsp.Good {
+					t.Fatalf("got status %d want good", resp.Status)
+				}
+			}
+
+			// the response is cached until half of its validity period
+			s.refreshStaples()
+			if got, want := atomic.LoadInt32(requests), int32(1); got != want {
+				t.Fatalf("got %d OCSP requests want %d", got, want)
+			}
+
+			// the staple survives certificate updates
+			s.SetCertificates([]tls.Certificate{cert})
+			got, _ = getCertificate(s.certstore(), &tls.ClientHelloInfo{ServerName: "www.example.com"}, true)
+			if gotStapled := got.OCSPStaple != nil; gotStapled != tt.stapled {
+				t.Fatalf("after update got stapled %v want %v", gotStapled, tt.stapled)
+			}
+		})
+	}
+}
+
+func TestLoadedCertificates(t *testing.T) {
+	ca, caKey := makeCA(t)
+	srv, _ := ocspResponder(t, ca, caKey, ocsp.Good)
+	cert := makeLeaf(t, "www.example.com", srv.URL, ca, caKey)
+
+	// the same source on two listeners
+	s1, s2 := NewStore(), NewStore()
+	for _, s := range []*Store{s1, s2} {
+		s.SetCertificates([]tls.Certificate{cert})
+		s.refreshStaples()
+		stores.Lock()
+		stores.m[s] = "ocsp-test"
+		stores.Unlock()
+	}
+	defer func() {
+		stores.Lock()
+		delete(stores.m, s1)
+		delete(stores.m, s2)
+		stores.Unlock()
+	}()
+
+	var infos []CertInfo
+	for _, info := range LoadedCertificates() {
+		if info.Source == "ocsp-test" {
+			infos = append(infos, info)
+		}
+	}
+	if got, want := len(infos), 1; got != want {
+		t.Fatalf("got %d certs want %d", got, want)
+	}
+	info := infos[0]
+	if got, want := info.Subject, "CN=www.example.com"; got != want {
+		t.Fatalf("got subject %q want %q", got, want)
+	}
+	if got, want := info.Issuer, "CN=Test CA"; got != want {
+		t.Fatalf("got issuer %q want %q", got, want)
+	}
+	if got, want := info.SANs, []string{"www.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got SANs %v want %v", got, want)
+	}
+	if !info.OCSPStapled || info.OCSPStatus != "good" || info.OCSPNextUpdate == nil {
+		t.Fatalf("got OCSP stapled %v status %q next update %v", info.OCSPStapled, info.OCSPStatus, info.OCSPNextUpdate)
+	}
+}
+
+// testGauge records the values of a gauge by label values and supports
+// deleting them.
+type testGauge struct {
+	mu     *sync.Mutex
+	values map[string]float64
+	lvs    string
+}
+
+func newTestGauge() *testGauge {
+	return &testGauge{mu: &sync.Mutex{}, values: map[string]float64{}}
+}
+
+func (g *testGauge) With(labelValues ...string) gkm.Gauge {
+	return &testGauge{mu: g.mu, values: g.values, lvs: strings.Join(labelValues, ",")}
+}
+
+func (g *testGauge) Set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.lvs] = v
+}
+
+func (g *testGauge) Add(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.lvs] += v
+}
+
+func (g *testGauge) Delete(labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.values, strings.Join(labelValues, ","))
+}
+
+func (g *testGauge) keys() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var keys []string
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type chanSource chan []tls.Certificate
+
+func (s chanSource) Certificates() chan []tls.Certificate   { return s }
+func (s chanSource) LoadClientCAs() (*x509.CertPool, error) { return nil, nil }
+
+func TestWatchStoreStop(t *testing.T) {
+	defer func(m metrix) { counters = m }(counters)
+	expiry := newTestGauge()
+	counters = metrix{expiry: expiry, ocspAge: newTestGauge(), ocspExpiry: newTestGauge()}
+
+	ca, caKey := makeCA(t)
+	a := makeLeaf(t, "a.example.com", "", ca, caKey)
+	b := makeLeaf(t, "b.example.com", "", ca, caKey)
+
+	src := make(chanSource)
+	stop := watchStore("monitor-test", src, NewStore())
+	defer stop()
+
+	waitKeys := func(want ...string) {
+		t.Helper()
+		if !waitFor(2*time.Second, func() bool { return reflect.DeepEqual(expiry.keys(), want) }) {
+			t.Fatalf("got metrics for %v want %v", expiry.keys(), want)
+		}
+	}
+	loaded := func() int {
+		var n int
+		for _, info := range LoadedCertificates() {
+			if info.Source == "monitor-test" {
+				n++
+			}
+		}
+		return n
+	}
+
+	src <- []tls.Certificate{a, b}
+	waitKeys("source,monitor-test,name,a.example.com", "source,monitor-test,name,b.example.com")
+
+	// the metrics of removed certificates are deleted
+	src <- []tls.Certificate{a}
+	waitKeys("source,monitor-test,name,a.example.com")
+	if got, want := loaded(), 1; got != want {
+		t.Fatalf("got %d certs want %d", got, want)
+	}
+
+	// the store and its metrics are removed when it is stopped
+	stop()
+	waitKeys()
+	if got, want := loaded(), 0; got != want {
+		t.Fatalf("got %d certs want %d", got, want)
+	}
+}
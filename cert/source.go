@@ -4,8 +4,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"log"
+	"sync"
 
 	"github.com/fabiolb/fabio/config"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -72,8 +75,29 @@ func NewSource(cfg config.CertSource) (Source, error) {
 			Refresh:      cfg.Refresh,
 			Client:       NewVaultClient(cfg.VaultFetchToken),
 		}, nil
+	case "acme":
+		policy, err := NewIssuePolicy(cfg)
+		if err != nil {
+			return nil, err
+		}
+		src := NewACMESource()
+		src.Policy = policy
+		src.DirectoryURL = cfg.CertPath
+		src.Email = cfg.ACMEEmail
+		src.Storage = cfg.ACMEStorage
+		src.CAPath = cfg.ACMECAPath
+		src.ClientCAPath = cfg.ClientCAPath
+		src.CAUpgradeCN = cfg.CAUpgradeCN
+		src.RenewBefore = cfg.Refresh
+		return src, nil
+
 	case "vault-pki":
+		policy, err := NewIssuePolicy(cfg)
+		if err != nil {
+			return nil, err
+		}
 		src := NewVaultPKISource()
+		src.Policy = policy
 		src.CertPath = cfg.CertPath
 		src.ClientCAPath = cfg.ClientCAPath
 		src.CAUpgradeCN = cfg.CAUpgradeCN
@@ -92,10 +116,17 @@ func NewSource(cfg config.CertSource) (Source, error) {
 //
 // It also sets the ClientCAs field if src.LoadClientCAs returns a non-nil
 // value and sets ClientAuth to RequireAndVerifyClientCert.
-func TLSConfig(src Source, strictMatch bool, minVersion, maxVersion uint16, cipherSuites []uint16) (*tls.Config, error) {
+//
+// The TLS settings are replaced with the settings of the TLS policy for
+// the server name of the client if there is one.
+//
+// The certificates are stapled with OCSP responses and reported with the
+// name of the certificate source in the metrics and the admin API until
+// the returned stop function is called.
+func TLSConfig(name string, src Source, strictMatch bool, minVersion, maxVersion uint16, cipherSuites []uint16) (*tls.Config, func(), error) {
 	clientCAs, err := src.LoadClientCAs()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	sf := &singleflight.Group{}
@@ -106,6 +137,10 @@ func TLSConfig(src Source, strictMatch bool, minVersion, maxVersion uint16, ciph
 		CipherSuites: cipherSuites,
 		NextProtos:   []string{"h2", "http/1.1"},
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+			if cr, ok := src.(challengeResponder); ok && isChallenge(clientHello) {
+				return cr.ChallengeCertificate(clientHello)
+			}
+
 			cert, err = getCertificate(store.certstore(), clientHello, strictMatch)
 			if cert != nil {
 				return
@@ -124,8 +159,29 @@ func TLSConfig(src Source, strictMatch bool, minVersion, maxVersion uint16, ciph
 				return
 			}
 
+			var policy *IssuePolicy
+			if pi, ok := src.(policyIssuer); ok {
+				policy = pi.issuePolicy()
+			}
 			serverName := clientHello.ServerName
 			x, err, _ := sf.Do(serverName, func() (interface{}, error) {
+				// The certificate may have been issued since the
+				// lookup above. It must not count against the
+				// issuance rate again.
+				if cert, err := getCertificate(store.certstore(), clientHello, true); cert != nil && err == nil {
+					return cert, nil
+				}
+
+				// Only issue certificates for hosts which are permitted by
+				// the issuance policy. Otherwise, anybody could request
+				// certificates for arbitrary names. Without strictMatch the
+				// store has already returned the default certificate if
+				// there is one. Concurrent handshakes for the same name
+				// share the result of a single check.
+				if err := policy.Check(serverName); err != nil {
+					log.Printf("[DEBUG] cert: Not issuing cert for %q: %s", serverName, err)
+					return nil, err
+				}
 				return ca.Issue(serverName)
 			})
 			if err != nil {
@@ -136,16 +192,58 @@ func TLSConfig(src Source, strictMatch bool, minVersion, maxVersion uint16, ciph
 		},
 	}
 
+	if _, ok := src.(challengeResponder); ok {
+		x.NextProtos = append(x.NextProtos, acme.ALPNProto)
+	}
+
 	if clientCAs != nil {
 		x.ClientCAs = clientCAs
 		x.ClientAuth = tls.RequireAndVerifyClientCert
 	}
 
+	// select the TLS policy by the server name. ACME challenges are
+	// answered with the settings of the listener.
+	x.GetConfigForClient = func(clientHello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if _, ok := src.(challengeResponder); ok && isChallenge(clientHello) {
+			return nil, nil
+		}
+		p := policyFor(clientHello.ServerName)
+		if p == nil {
+			return nil, nil
+		}
+		return p.apply(x), nil
+	}
+
+	stop := watchStore(name, src, store)
+	if s, ok := src.(*ACMESource); ok {
+		stopWatch := stop
+		stop = func() {
+			stopWatch()
+			s.stop()
+		}
+	}
+	return x, stop, nil
+}
+
+// watchStore monitors the store and replaces its certificates when the
+// source changes until the returned stop function is called.
+func watchStore(name string, src Source, store *Store) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	monitor(name, store, done)
 	go func() {
-		for certs := range src.Certificates() {
-			store.SetCertificates(certs)
+		ch := src.Certificates()
+		for {
+			select {
+			case <-done:
+				return
+			case certs, ok := <-ch:
+				if !ok {
+					return
+				}
+				store.SetCertificates(certs)
+			}
 		}
 	}()
-
-	return x, nil
+	return func() { once.Do(func() { close(done) }) }
 }
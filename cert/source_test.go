@@ -25,6 +25,7 @@ import (
 	"golang.org/x/net/http2"
 
 	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
 	consulapi "github.com/hashicorp/consul/api"
 	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/pascaldekloe/goe/verify"
@@ -43,10 +44,11 @@ func TestTLSConfig(t *testing.T) {
 	tlsciphers := []uint16{0x1234, 0x5678}
 	nextprotos := []string{"h2", "http/1.1"}
 
-	cfg, err := TLSConfig(src, false, tlsmin, tlsmax, tlsciphers)
+	cfg, stop, err := TLSConfig("test", src, false, tlsmin, tlsmax, tlsciphers)
 	if err != nil {
 		t.Fatalf("got error %v want nil", err)
 	}
+	defer stop()
 	if got, want := cfg.MinVersion, tlsmin; got != want {
 		t.Fatalf("got tls min version %04x want %04x", got, want)
 	}
@@ -534,6 +536,14 @@ func TestVaultPKISource(t *testing.T) {
 		t.Fatalf("Write role failed: %s", err)
 	}
 
+	// certificates are only issued for hosts in the routing table
+	tbl, err := route.NewTable(bytes.NewBufferString("route add svc localhost/ http://127.0.0.1/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.SetTable(tbl)
+	defer route.SetTable(route.Table{})
+
 	for _, tt := range vaultTestCases {
 		tt := tt // capture loop var
 		t.Run(tt.desc, func(t *testing.T) {
@@ -561,10 +571,11 @@ func TestVaultPKISource(t *testing.T) {
 // server.
 func testSource(t *testing.T, source Source, rootCAs *x509.CertPool, sleep time.Duration) {
 	const NoStrictMatch = false
-	srvConfig, err := TLSConfig(source, NoStrictMatch, 0, 0, nil)
+	srvConfig, stop, err := TLSConfig("test", source, NoStrictMatch, 0, 0, nil)
 	if err != nil {
 		t.Fatalf("TLSConfig: got %q want nil", err)
 	}
+	defer stop()
 
 	// give the source some time to initialize if necessary
 	time.Sleep(sleep)
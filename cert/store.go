@@ -6,27 +6,46 @@ import (
 	"errors"
 	"log"
 	"strings"
+	"sync"
 	"sync/atomic"
 )
 
 // Store provides a dynamic certificate store which can be updated at
 // runtime and is safe for concurrent use.
+//
+// Valid OCSP responses are stapled to the certificates when the store
+// is monitored.
 type Store struct {
 	cs atomic.Value
+
+	// changed is notified when the certificates have been replaced.
+	changed chan struct{}
+
+	mu      sync.Mutex
+	staples map[[32]byte]*staple // OCSP responses by fingerprint
 }
 
 // NewStore creates an empty certificate store.
 func NewStore() *Store {
-	s := new(Store)
+	s := &Store{
+		changed: make(chan struct{}, 1),
+		staples: map[[32]byte]*staple{},
+	}
 	s.cs.Store(certstore{})
 	return s
 }
 
 // SetCertificates replaces the certificates of the store.
 func (s *Store) SetCertificates(certs []tls.Certificate) {
-	cs := certstore{Certificates: certs}
-	cs.BuildNameToCertificate()
-	s.cs.Store(cs)
+	s.mu.Lock()
+	cs := s.setCertificates(certs)
+	s.mu.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+
 	var names []string
 	for name := range cs.NameToCertificate {
 		names = append(names, name)
@@ -34,6 +53,15 @@ func (s *Store) SetCertificates(certs []tls.Certificate) {
 	log.Printf("[INFO] cert: Store has certificates for [%q]", strings.Join(names, ","))
 }
 
+// setCertificates staples the OCSP responses to the certificates and
+// stores them. s.mu must be held.
+func (s *Store) setCertificates(certs []tls.Certificate) certstore {
+	cs := certstore{Certificates: s.applyStaples(certs)}
+	cs.BuildNameToCertificate()
+	s.cs.Store(cs)
+	return cs
+}
+
 func (s *Store) certstore() certstore {
 	return s.cs.Load().(certstore)
 }
@@ -0,0 +1,136 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+	"golang.org/x/crypto/acme"
+)
+
+// tlsPolicy is a TLS policy with its loaded client CA certificates.
+type tlsPolicy struct {
+	config.TLSPolicy
+	clientCAs *x509.CertPool
+}
+
+// tlsPolicies contains the TLS policies of the listeners by name.
+var tlsPolicies = struct {
+	sync.RWMutex
+	m     map[string]*tlsPolicy
+	names []string
+}{m: map[string]*tlsPolicy{}}
+
+// SetTLSPolicies loads the client CA certificates of the TLS policies
+// and replaces the policies of all listeners.
+func SetTLSPolicies(policies map[string]config.TLSPolicy) error {
+	m := map[string]*tlsPolicy{}
+	var names []string
+	for name, cfg := range policies {
+		p := &tlsPolicy{TLSPolicy: cfg}
+		if cfg.ClientCA.Name != "" {
+			src, err := NewSource(cfg.ClientCA)
+			if err != nil {
+				return fmt.Errorf("TLS policy %s: %s", name, err)
+			}
+			if p.clientCAs, err = src.LoadClientCAs(); err != nil {
+				return fmt.Errorf("TLS policy %s: %s", name, err)
+			}
+			if p.clientCAs == nil {
+				return fmt.Errorf("TLS policy %s: certificate source %s has no client CA certificates", name, cfg.ClientCA.Name)
+			}
+		}
+		m[name] = p
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tlsPolicies.Lock()
+	tlsPolicies.m, tlsPolicies.names = m, names
+	tlsPolicies.Unlock()
+	route.SetTLSPolicyNames(names)
+	return nil
+}
+
+// policyFor returns the TLS policy for the server name or nil if there
+// is none. A policy which is selected by a route with the 'tlspolicy'
+// option takes precedence over the hosts of the policies. Policies for
+// the exact host take precedence over policies with a matching glob
+// pattern. Without TLS policies the routing table is not consulted.
+// The 'tlspolicy' option with an unknown policy is ignored when the
+// table is built. Should one slip through the hosts of the policies
+// are used instead of failing the handshake.
+func policyFor(serverName string) *tlsPolicy {
+	if serverName == "" {
+		return nil
+	}
+	serverName = strings.ToLower(serverName)
+
+	tlsPolicies.RLock()
+	defer tlsPolicies.RUnlock()
+
+	if len(tlsPolicies.m) == 0 {
+		return nil
+	}
+
+	if p := tlsPolicies.m[route.TLSPolicy(serverName, globCache)]; p != nil {
+		return p
+	}
+
+	for _, name := range tlsPolicies.names {
+		for _, h := range tlsPolicies.m[name].Hosts {
+			if h == serverName {
+				return tlsPolicies.m[name]
+			}
+		}
+	}
+	for _, name := range tlsPolicies.names {
+		for _, h := range tlsPolicies.m[name].Hosts {
+			if g, err := globCache.Get(h); err == nil && g.Match(serverName) {
+				return tlsPolicies.m[name]
+			}
+		}
+	}
+	return nil
+}
+
+// apply returns a copy of the listener configuration with the settings
+// of the policy.
+func (p *tlsPolicy) apply(base *tls.Config) *tls.Config {
+	x := base.Clone()
+	if p.TLSMinVersion != 0 {
+		x.MinVersion = p.TLSMinVersion
+	}
+	if p.TLSMaxVersion != 0 {
+		x.MaxVersion = p.TLSMaxVersion
+	}
+	if len(p.TLSCiphers) > 0 {
+		x.CipherSuites = p.TLSCiphers
+	}
+	if len(p.ALPN) > 0 {
+		protos := append([]string(nil), p.ALPN...)
+		for _, proto := range base.NextProtos {
+			if proto == acme.ALPNProto {
+				protos = append(protos, proto)
+			}
+		}
+		x.NextProtos = protos
+	}
+	switch p.ClientAuth {
+	case "none":
+		x.ClientAuth = tls.NoClientCert
+		x.ClientCAs = nil
+	case "request":
+		x.ClientAuth = tls.VerifyClientCertIfGiven
+		x.ClientCAs = p.clientCAs
+	case "require":
+		x.ClientAuth = tls.RequireAndVerifyClientCert
+		x.ClientCAs = p.clientCAs
+	}
+	return x
+}
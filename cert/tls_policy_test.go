@@ -0,0 +1,185 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+	"golang.org/x/crypto/acme"
+)
+
+func TestPolicyFor(t *testing.T) {
+	err := SetTLSPolicies(map[string]config.TLSPolicy{
+		"legacy":   {Name: "legacy", Hosts: []string{"*.partner.com", "old.example.com"}},
+		"strict":   {Name: "strict", Hosts: []string{"*.example.com"}},
+		"internal": {Name: "internal"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTLSPolicies(nil)
+
+	tbl, err := route.NewTable(bytes.NewBufferString(`
+		route add svc api.example.com/ http://127.0.0.1:5000/ opts "tlspolicy=internal"
+		route add svc *.internal.com/ http://127.0.0.1:5000/ opts "tlspolicy=internal"
+		route add svc bad.example.com/ http://127.0.0.1:5000/ opts "tlspolicy=foo"
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.SetTable(tbl)
+	defer route.SetTable(route.Table{})
+
+	tests := []struct {
+		serverName string
+		policy     string
+	}{
+		{"", ""},
+		{"unknown.com", ""},
+		{"www.partner.com", "legacy"},
+		{"old.example.com", "legacy"},
+		{"OLD.example.com", "legacy"},
+		{"www.example.com", "strict"},
+		{"api.example.com", "internal"},
+		{"db.internal.com", "internal"},
+		// unknown policies are ignored
+		{"bad.example.com", "strict"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			p := policyFor(tt.serverName)
+			var name string
+			if p != nil {
+				name = p.Name
+			}
+			if got, want := name, tt.policy; got != want {
+				t.Fatalf("got policy %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPolicyForWithoutPolicies(t *testing.T) {
+	if err := SetTLSPolicies(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// without policies the routes are not consulted
+	tbl, err := route.NewTable(bytes.NewBufferString(`route add svc a.com/ http://127.0.0.1:5000/ opts "tlspolicy=foo"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	route.SetTable(tbl)
+	defer route.SetTable(route.Table{})
+
+	if p := policyFor("a.com"); p != nil {
+		t.Fatalf("got %v want nil", p)
+	}
+}
+
+func TestTLSConfigPolicy(t *testing.T) {
+	ca, caKey := makeCA(t)
+	certFile, keyFile, caFile := writePEM(t, t.TempDir(), makeLeaf(t, "client", "", ca, caKey), ca)
+	err := SetTLSPolicies(map[string]config.TLSPolicy{
+		"legacy": {
+			Name:          "legacy",
+			Hosts:         []string{"legacy.example.com"},
+			TLSMinVersion: tls.VersionTLS10,
+			TLSCiphers:    []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+			ALPN:          []string{"http/1.1"},
+			ClientAuth:    "none",
+		},
+		"strict": {
+			Name:          "strict",
+			Hosts:         []string{"strict.example.com"},
+			TLSMinVersion: tls.VersionTLS13,
+			ClientAuth:    "require",
+			ClientCA:      config.CertSource{Name: "ca", Type: "file", CertPath: certFile, KeyPath: keyFile, ClientCAPath: caFile},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTLSPolicies(nil)
+
+	src := newIssuerSource(nil)
+	src.certsCh <- []tls.Certificate{makeCert("default.com", time.Hour)}
+	cfg, stop, err := TLSConfig("test", src, false, tls.VersionTLS12, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	t.Run("listener", func(t *testing.T) {
+		x, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+		if x != nil || err != nil {
+			t.Fatalf("got %v, %v want nil", x, err)
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		x, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "legacy.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []interface{}{x.MinVersion, x.CipherSuites, x.NextProtos, x.ClientAuth}
+		want := []interface{}{uint16(tls.VersionTLS10), []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}, []string{"http/1.1"}, tls.NoClientCert}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+		if x.GetCertificate == nil {
+			t.Fatal("got no GetCertificate")
+		}
+		// the listener configuration is not modified
+		if cfg.MinVersion != tls.VersionTLS12 || cfg.CipherSuites != nil {
+			t.Fatalf("listener config was modified: %x %v", cfg.MinVersion, cfg.CipherSuites)
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		x, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "strict.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := x.MinVersion, uint16(tls.VersionTLS13); got != want {
+			t.Fatalf("got min version %x want %x", got, want)
+		}
+		if got, want := x.ClientAuth, tls.RequireAndVerifyClientCert; got != want {
+			t.Fatalf("got client auth %v want %v", got, want)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		if x.ClientCAs == nil || !x.ClientCAs.Equal(pool) {
+			t.Fatal("got wrong client CAs")
+		}
+	})
+}
+
+func TestTLSPolicyApplyKeepsACMEProto(t *testing.T) {
+	p := &tlsPolicy{TLSPolicy: config.TLSPolicy{ALPN: []string{"h2"}}}
+	x := p.apply(&tls.Config{NextProtos: []string{"h2", "http/1.1", acme.ALPNProto}})
+	if got, want := x.NextProtos, []string{"h2", acme.ALPNProto}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestSetTLSPoliciesWithoutClientCAs(t *testing.T) {
+	ca, caKey := makeCA(t)
+	certFile, keyFile, _ := writePEM(t, t.TempDir(), makeLeaf(t, "client", "", ca, caKey), ca)
+	err := SetTLSPolicies(map[string]config.TLSPolicy{
+		"strict": {
+			Name:       "strict",
+			ClientAuth: "require",
+			ClientCA:   config.CertSource{Name: "ca", Type: "file", CertPath: certFile, KeyPath: keyFile},
+		},
+	})
+	if err == nil {
+		t.Fatal("got nil want error")
+	}
+}
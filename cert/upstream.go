@@ -0,0 +1,53 @@
+package cert
+
+import (
+	"crypto/tls"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// UpstreamTLSConfig creates a tls.Config for connections to upstream
+// targets from the upstream TLS profile. The certificates of the
+// certificate source are presented as client certificates and the CA
+// certificates from the 'clientca' option of the source are used to
+// verify the upstream servers. If the source has no CA certificates the
+// system roots are used.
+//
+// The client certificates are reloaded when the source changes and are
+// listed under the name of the certificate source in the admin API until
+// the returned stop function is called.
+func UpstreamTLSConfig(p config.UpstreamTLS) (*tls.Config, func(), error) {
+	src, err := NewSource(p.CertSource)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rootCAs, err := src.LoadClientCAs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store := NewStore()
+	x := &tls.Config{
+		RootCAs:    rootCAs,
+		ServerName: p.ServerName,
+		MinVersion: p.TLSMinVersion,
+		GetClientCertificate: func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCertificate(store.certstore().Certificates, cri), nil
+		},
+	}
+
+	return x, watchStore(p.CertSource.Name, src, store), nil
+}
+
+// clientCertificate returns the first certificate which is acceptable
+// for the server. If there is none an empty certificate is returned
+// which continues the handshake without a client certificate.
+func clientCertificate(certs []tls.Certificate, cri *tls.CertificateRequestInfo) *tls.Certificate {
+	for i := range certs {
+		if cri.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i]
+		}
+	}
+	return &tls.Certificate{}
+}
@@ -0,0 +1,110 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// writePEM writes the certificate, its key and the CA certificate as
+// PEM files to dir and returns their paths.
+func writePEM(t *testing.T, dir string, cert tls.Certificate, ca *x509.Certificate) (certFile, keyFile, caFile string) {
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, caFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: cert.Certificate[0]},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: der},
+		caFile:   {Type: "CERTIFICATE", Bytes: ca.Raw},
+	}
+	for name, b := range files {
+		if err := os.WriteFile(name, pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile, caFile
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	ca, caKey := makeCA(t)
+	serverCert := makeLeaf(t, "upstream.mesh", "", ca, caKey)
+	clientCert := makeLeaf(t, "fabio.mesh", "", ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	certFile, keyFile, caFile := writePEM(t, t.TempDir(), clientCert, ca)
+	tlscfg, stop, err := UpstreamTLSConfig(config.UpstreamTLS{
+		Name: "mesh",
+		CertSource: config.CertSource{
+			Name:         "meshcerts",
+			Type:         "file",
+			CertPath:     certFile,
+			KeyPath:      keyFile,
+			ClientCAPath: caFile,
+		},
+		ServerName:    "upstream.mesh",
+		TLSMinVersion: tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlscfg}}
+	var got string
+	ok := waitFor(2*time.Second, func() bool {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b := make([]byte, 64)
+		n, _ := resp.Body.Read(b)
+		got = string(b[:n])
+		return resp.StatusCode == 200
+	})
+	if !ok {
+		t.Fatal("Timeout waiting for upstream request with client certificate")
+	}
+	if want := "fabio.mesh"; got != want {
+		t.Fatalf("got client cert %q want %q", got, want)
+	}
+
+	// the upstream certificate is verified with the CA bundle of the
+	// source and the server name of the profile
+	x := tlscfg.Clone()
+	x.ServerName = "other.mesh"
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: x}}
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Fatal("got nil want error for server name mismatch")
+	}
+}
+
+func TestUpstreamTLSConfigInvalidSource(t *testing.T) {
+	_, _, err := UpstreamTLSConfig(config.UpstreamTLS{Name: "mesh", CertSource: config.CertSource{Name: "x", Type: "foo"}})
+	if err == nil {
+		t.Fatal("got nil want error")
+	}
+}
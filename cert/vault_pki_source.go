@@ -28,6 +28,9 @@ type VaultPKISource struct {
 	// one hour.
 	Refresh time.Duration
 
+	// Policy restricts the hosts for which certificates are issued.
+	Policy *IssuePolicy
+
 	certsCh chan []tls.Certificate
 
 	mu    sync.Mutex
@@ -53,6 +56,10 @@ func (s *VaultPKISource) Certificates() chan []tls.Certificate {
 	return s.certsCh
 }
 
+func (s *VaultPKISource) issuePolicy() *IssuePolicy {
+	return s.Policy
+}
+
 func (s *VaultPKISource) Issue(commonName string) (*tls.Certificate, error) {
 	c, err := s.Client.Get()
 	if err != nil {
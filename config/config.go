@@ -33,6 +33,25 @@ type CertSource struct {
 	Refresh         time.Duration
 	Header          http.Header
 	VaultFetchToken string
+
+	// ACMEEmail, ACMEStorage and ACMECAPath configure the acme
+	// certificate source. They are the contact email of the account,
+	// the directory or Consul KV URL where accounts and certificates
+	// are stored and a file with the CA certificates for connecting to
+	// the ACME server.
+	ACMEEmail   string
+	ACMEStorage string
+	ACMECAPath  string
+
+	// IssueAllow and IssueDeny are glob patterns for the server names
+	// for which certificates can be issued on-demand in addition to
+	// being in the routing table. IssueRate is the number of
+	// certificates per second which can be issued with bursts of up to
+	// IssueBurst. Zero means no limit.
+	IssueAllow []string
+	IssueDeny  []string
+	IssueRate  float64
+	IssueBurst int
 }
 
 type Listen struct {
@@ -91,10 +110,49 @@ type Proxy struct {
 	GZIPContentTypes      *regexp.Regexp
 	RequestID             string
 	STSHeader             STSHeader
+	ClientCertHeader      ClientCertHeader
 	AuthSchemes           map[string]AuthScheme
+	UpstreamTLS           map[string]UpstreamTLS
+	TLSPolicies           map[string]TLSPolicy
+	GeoIPDB               string
 	GRPCMaxRxMsgSize      int
 	GRPCMaxTxMsgSize      int
 	GRPCGShutdownTimeout  time.Duration
+	HealthCheck           HealthCheck
+	Outlier               Outlier
+	Retry                 Retry
+	Hash                  Hash
+}
+
+type HealthCheck struct {
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+type Outlier struct {
+	ConsecutiveFailures int
+	ErrorRate           float64
+	MinRequests         int
+	Window              time.Duration
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+	MaxEjectionPercent  int
+}
+
+type Retry struct {
+	Attempts      int
+	On            []string
+	Methods       []string
+	PerTryTimeout time.Duration
+	Budget        int
+	MaxBodySize   int64
+}
+
+type Hash struct {
+	Key    string
+	Sticky string
 }
 
 type STSHeader struct {
@@ -103,6 +161,17 @@ type STSHeader struct {
 	Preload    bool
 }
 
+// ClientCertHeader contains the names of the headers which forward the
+// verified client certificate to the upstream. Empty names disable the
+// header.
+type ClientCertHeader struct {
+	Cert        string
+	Chain       string
+	Subject     string
+	URI         string
+	Fingerprint string
+}
+
 type Runtime struct {
 	GOGC       int
 	GOMAXPROCS int
@@ -145,13 +214,18 @@ type Metrics struct {
 }
 
 type Registry struct {
-	Backend string
-	Static  Static
-	File    File
-	Consul  Consul
-	Custom  Custom
-	Timeout time.Duration
-	Retry   time.Duration
+	Backend    string
+	Static     Static
+	File       File
+	Consul     Consul
+	Custom     Custom
+	Kubernetes Kubernetes
+	Nomad      Nomad
+	Etcd       Etcd
+	DNS        DNS
+	Composite  Composite
+	Timeout    time.Duration
+	Retry      time.Duration
 }
 
 type Static struct {
@@ -199,6 +273,59 @@ type Custom struct {
 	Timeout            time.Duration
 }
 
+type Kubernetes struct {
+	Addr          string
+	TokenPath     string
+	CAPath        string
+	TLSSkipVerify bool
+	Namespace     string
+	Annotation    string
+	IngressClass  string
+	ConfigMap     string
+}
+
+type Nomad struct {
+	Addr            string
+	Token           string
+	Namespace       string
+	TagPrefix       string
+	VarPath         string
+	NoRouteHTMLPath string
+	PollInterval    time.Duration
+	TLS             ConsulTlS
+}
+
+type Etcd struct {
+	Endpoints       []string
+	Username        string
+	Password        string
+	ServicePath     string
+	KVPath          string
+	NoRouteHTMLPath string
+	TagPrefix       string
+	Register        bool
+	ServiceAddr     string
+	ServiceName     string
+	ServiceTags     []string
+	RegisterTTL     time.Duration
+	TLS             ConsulTlS
+}
+
+type DNS struct {
+	Records   []string
+	Resolver  string
+	TagPrefix string
+	MinTTL    time.Duration
+	Timeout   time.Duration
+}
+
+type Composite struct {
+	Backends     []string
+	Manual       string
+	Timeout      time.Duration
+	StaleTimeout map[string]time.Duration
+}
+
 type Tracing struct {
 	TracingEnabled bool
 	CollectorType  string
@@ -212,9 +339,121 @@ type Tracing struct {
 }
 
 type AuthScheme struct {
-	Name  string
-	Type  string
-	Basic BasicAuth
+	Name    string
+	Type    string
+	Basic   BasicAuth
+	Cert    CertAuth
+	JWT     JWTAuth
+	Forward ForwardAuth
+	OIDC    OIDCAuth
+}
+
+// UpstreamTLS is a named TLS profile for connections to upstream
+// targets. The client certificate and the CA bundle are loaded from the
+// certificate source.
+type UpstreamTLS struct {
+	Name          string
+	CertSource    CertSource
+	ServerName    string
+	TLSMinVersion uint16
+}
+
+// TLSPolicy is a named TLS policy for listeners which is selected by
+// the server name of the client. Hosts contains the host names and glob
+// patterns for which the policy is used. Routes can select a policy for
+// their host with the 'tlspolicy' option. Zero values keep the settings
+// of the listener.
+type TLSPolicy struct {
+	Name          string
+	Hosts         []string
+	TLSMinVersion uint16
+	TLSMaxVersion uint16
+	TLSCiphers    []uint16
+	ALPN          []string
+
+	// ClientAuth is one of "none", "request" or "require". The client
+	// certificates are verified with the CA certificates of ClientCA.
+	ClientAuth string
+	ClientCA   CertSource
+}
+
+// CertAuth authorizes requests with a verified client certificate whose
+// common name, URI SAN or subject matches one of the glob patterns.
+type CertAuth struct {
+	CommonNames []string
+	URIs        []string
+	Subject     string
+}
+
+// JWTAuth authorizes requests with a bearer token which is signed by one
+// of the keys from the JWKS URL, the public key file or the shared
+// secret.
+type JWTAuth struct {
+	JWKSURL  string
+	KeyFile  string
+	Secret   string
+	Issuer   string
+	Audience []string
+
+	// Claims contains the values of claims which the token must have.
+	Claims map[string]string
+
+	// Headers maps claims to the request headers which forward them to
+	// the upstream.
+	Headers map[string]string
+
+	// Refresh is the interval in which the JWKS is reloaded.
+	Refresh time.Duration
+}
+
+// ForwardAuth authorizes requests by asking an external auth service.
+// Requests are allowed if the auth service responds with a 2xx status.
+type ForwardAuth struct {
+	URL     string
+	Timeout time.Duration
+
+	// RequestHeaders are the headers of the request which are sent to
+	// the auth service.
+	RequestHeaders []string
+
+	// ResponseHeaders are the headers of the auth service response which
+	// are copied to the upstream request.
+	ResponseHeaders []string
+
+	// CacheKey contains the request headers whose values identify the
+	// cached decisions. Decisions are cached for CacheTTL which disables
+	// the cache if it is zero.
+	CacheKey []string
+	CacheTTL time.Duration
+
+	// FailOpen allows requests if the auth service cannot be reached or
+	// returns an unexpected status.
+	FailOpen bool
+}
+
+// OIDCAuth authorizes browser requests with a session cookie which is
+// created after a login with an OpenID Connect provider.
+type OIDCAuth struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	// CallbackPath is the path to which the provider redirects the
+	// browser after the login.
+	CallbackPath string
+
+	// CookieName is the name of the session cookie which is encrypted
+	// with a key derived from CookieSecret.
+	CookieName   string
+	CookieSecret string
+
+	// Claims contains the values of claims which the ID token must have.
+	Claims map[string]string
+
+	// Headers maps claims to the request headers which forward them to
+	// the upstream.
+	Headers map[string]string
 }
 
 type BasicAuth struct {
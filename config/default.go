@@ -10,6 +10,8 @@ var defaultValues = struct {
 	ListenerValue         string
 	CertSourcesValue      string
 	AuthSchemesValue      string
+	UpstreamTLSValue      string
+	TLSPoliciesValue      string
 	ReadTimeout           time.Duration
 	WriteTimeout          time.Duration
 	IdleTimeout           time.Duration
@@ -52,10 +54,37 @@ var defaultConfig = &Config{
 		GlobalFlushInterval:  0,
 		LocalIP:              LocalIPString(),
 		AuthSchemes:          map[string]AuthScheme{},
+		UpstreamTLS:          map[string]UpstreamTLS{},
+		TLSPolicies:          map[string]TLSPolicy{},
 		IdleConnTimeout:      15 * time.Second,
 		GRPCMaxRxMsgSize:     4 * 1024 * 1024, // 4M
 		GRPCMaxTxMsgSize:     4 * 1024 * 1024, // 4M
 		GRPCGShutdownTimeout: time.Second * 2,
+		HealthCheck: HealthCheck{
+			Interval:           10 * time.Second,
+			Timeout:            2 * time.Second,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 2,
+		},
+		Outlier: Outlier{
+			ConsecutiveFailures: 0,
+			ErrorRate:           0,
+			MinRequests:         20,
+			Window:              10 * time.Second,
+			BaseEjectionTime:    30 * time.Second,
+			MaxEjectionTime:     5 * time.Minute,
+			MaxEjectionPercent:  50,
+		},
+		Retry: Retry{
+			Attempts:    1,
+			On:          []string{"connect-failure"},
+			Methods:     []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE", "TRACE"},
+			Budget:      20,
+			MaxBodySize: 64 * 1024,
+		},
+		Hash: Hash{
+			Key: "ip",
+		},
 	},
 	Registry: Registry{
 		Backend: "consul",
@@ -88,6 +117,38 @@ var defaultConfig = &Config{
 			Path:               "",
 			QueryParams:        "",
 		},
+		Kubernetes: Kubernetes{
+			TokenPath:  "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			CAPath:     "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+			Annotation: "fabio.urlprefix",
+		},
+		Nomad: Nomad{
+			Addr:            "http://127.0.0.1:4646",
+			Namespace:       "default",
+			TagPrefix:       "urlprefix-",
+			VarPath:         "fabio/config",
+			NoRouteHTMLPath: "fabio/noroute",
+			PollInterval:    5 * time.Second,
+		},
+		Etcd: Etcd{
+			Endpoints:       []string{"localhost:2379"},
+			ServicePath:     "/fabio/services",
+			KVPath:          "/fabio/config",
+			NoRouteHTMLPath: "/fabio/noroute.html",
+			TagPrefix:       "urlprefix-",
+			Register:        true,
+			ServiceAddr:     ":9998",
+			ServiceName:     "fabio",
+			RegisterTTL:     15 * time.Second,
+		},
+		DNS: DNS{
+			TagPrefix: "urlprefix-",
+			MinTTL:    5 * time.Second,
+			Timeout:   5 * time.Second,
+		},
+		Composite: Composite{
+			Timeout: 10 * time.Second,
+		},
 		Timeout: 10 * time.Second,
 		Retry:   500 * time.Millisecond,
 	},
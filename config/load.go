@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"regexp"
 	"runtime"
@@ -127,6 +128,9 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	var uiListenerValue string
 	var certSourcesValue string
 	var authSchemesValue string
+	var upstreamTLSValue string
+	var tlsPoliciesValue string
+	var compositeStaleTimeoutValue string
 	var readTimeout, writeTimeout time.Duration
 	var gzipContentTypesValue string
 
@@ -149,6 +153,11 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	f.StringVar(&cfg.Proxy.ClientIPHeader, "proxy.header.clientip", defaultConfig.Proxy.ClientIPHeader, "header for the request ip")
 	f.StringVar(&cfg.Proxy.TLSHeader, "proxy.header.tls", defaultConfig.Proxy.TLSHeader, "header for TLS connections")
 	f.StringVar(&cfg.Proxy.TLSHeaderValue, "proxy.header.tls.value", defaultConfig.Proxy.TLSHeaderValue, "value for TLS connection header")
+	f.StringVar(&cfg.Proxy.ClientCertHeader.Cert, "proxy.header.clientcert", defaultConfig.Proxy.ClientCertHeader.Cert, "header for the client certificate")
+	f.StringVar(&cfg.Proxy.ClientCertHeader.Chain, "proxy.header.clientcert.chain", defaultConfig.Proxy.ClientCertHeader.Chain, "header for the client certificate chain")
+	f.StringVar(&cfg.Proxy.ClientCertHeader.Subject, "proxy.header.clientcert.subject", defaultConfig.Proxy.ClientCertHeader.Subject, "header for the client certificate subject")
+	f.StringVar(&cfg.Proxy.ClientCertHeader.URI, "proxy.header.clientcert.uri", defaultConfig.Proxy.ClientCertHeader.URI, "header for the client certificate URI SANs")
+	f.StringVar(&cfg.Proxy.ClientCertHeader.Fingerprint, "proxy.header.clientcert.fingerprint", defaultConfig.Proxy.ClientCertHeader.Fingerprint, "header for the client certificate fingerprint")
 	f.StringVar(&cfg.Proxy.RequestID, "proxy.header.requestid", defaultConfig.Proxy.RequestID, "header for reqest id")
 	f.IntVar(&cfg.Proxy.STSHeader.MaxAge, "proxy.header.sts.maxage", defaultConfig.Proxy.STSHeader.MaxAge, "enable and set the max-age value for HSTS")
 	f.BoolVar(&cfg.Proxy.STSHeader.Subdomains, "proxy.header.sts.subdomains", defaultConfig.Proxy.STSHeader.Subdomains, "direct HSTS to include subdomains")
@@ -156,6 +165,25 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	f.IntVar(&cfg.Proxy.GRPCMaxRxMsgSize, "proxy.grpcmaxrxmsgsize", defaultConfig.Proxy.GRPCMaxRxMsgSize, "max grpc receive message size (in bytes)")
 	f.IntVar(&cfg.Proxy.GRPCMaxTxMsgSize, "proxy.grpcmaxtxmsgsize", defaultConfig.Proxy.GRPCMaxTxMsgSize, "max grpc transmit message size (in bytes)")
 	f.DurationVar(&cfg.Proxy.GRPCGShutdownTimeout, "proxy.grpcshutdowntimeout", defaultConfig.Proxy.GRPCGShutdownTimeout, "amount of time to wait for graceful shutdown of grpc backend")
+	f.DurationVar(&cfg.Proxy.HealthCheck.Interval, "proxy.healthcheck.interval", defaultConfig.Proxy.HealthCheck.Interval, "default interval for active health checks")
+	f.DurationVar(&cfg.Proxy.HealthCheck.Timeout, "proxy.healthcheck.timeout", defaultConfig.Proxy.HealthCheck.Timeout, "default timeout for active health checks")
+	f.IntVar(&cfg.Proxy.HealthCheck.HealthyThreshold, "proxy.healthcheck.healthythreshold", defaultConfig.Proxy.HealthCheck.HealthyThreshold, "number of passed health checks before a target is healthy")
+	f.IntVar(&cfg.Proxy.HealthCheck.UnhealthyThreshold, "proxy.healthcheck.unhealthythreshold", defaultConfig.Proxy.HealthCheck.UnhealthyThreshold, "number of failed health checks before a target is unhealthy")
+	f.IntVar(&cfg.Proxy.Outlier.ConsecutiveFailures, "proxy.outlier.consecutivefailures", defaultConfig.Proxy.Outlier.ConsecutiveFailures, "number of consecutive failures before a target is ejected. 0 disables outlier detection")
+	f.Float64Var(&cfg.Proxy.Outlier.ErrorRate, "proxy.outlier.errorrate", defaultConfig.Proxy.Outlier.ErrorRate, "ratio of failed requests within proxy.outlier.window after which a target is ejected. 0 disables the error rate")
+	f.IntVar(&cfg.Proxy.Outlier.MinRequests, "proxy.outlier.minrequests", defaultConfig.Proxy.Outlier.MinRequests, "minimum number of requests within proxy.outlier.window before the error rate is evaluated")
+	f.DurationVar(&cfg.Proxy.Outlier.Window, "proxy.outlier.window", defaultConfig.Proxy.Outlier.Window, "duration over which the error rate is measured")
+	f.DurationVar(&cfg.Proxy.Outlier.BaseEjectionTime, "proxy.outlier.baseejectiontime", defaultConfig.Proxy.Outlier.BaseEjectionTime, "duration of the first ejection of a target")
+	f.DurationVar(&cfg.Proxy.Outlier.MaxEjectionTime, "proxy.outlier.maxejectiontime", defaultConfig.Proxy.Outlier.MaxEjectionTime, "maximum duration of an ejection")
+	f.IntVar(&cfg.Proxy.Outlier.MaxEjectionPercent, "proxy.outlier.maxejectionpercent", defaultConfig.Proxy.Outlier.MaxEjectionPercent, "maximum percentage of targets of a route which can be ejected")
+	f.IntVar(&cfg.Proxy.Retry.Attempts, "proxy.retry.attempts", defaultConfig.Proxy.Retry.Attempts, "maximum number of attempts for a request including the first one. 1 disables retries")
+	f.StringSliceVar(&cfg.Proxy.Retry.On, "proxy.retry.on", defaultConfig.Proxy.Retry.On, "comma separated list of conditions which trigger a retry: connect-failure, timeout, 5xx or a status code")
+	f.StringSliceVar(&cfg.Proxy.Retry.Methods, "proxy.retry.methods", defaultConfig.Proxy.Retry.Methods, "comma separated list of request methods which can be retried")
+	f.DurationVar(&cfg.Proxy.Retry.PerTryTimeout, "proxy.retry.pertrytimeout", defaultConfig.Proxy.Retry.PerTryTimeout, "timeout for receiving the response headers of a single attempt. 0 disables the timeout")
+	f.IntVar(&cfg.Proxy.Retry.Budget, "proxy.retry.budget", defaultConfig.Proxy.Retry.Budget, "maximum percentage of active requests which can be retries")
+	f.StringVar(&cfg.Proxy.Hash.Key, "proxy.hash.key", defaultConfig.Proxy.Hash.Key, "source of the key for the hash strategy: ip, header:<name>, cookie:<name> or query:<name>")
+	f.StringVar(&cfg.Proxy.Hash.Sticky, "proxy.hash.sticky", defaultConfig.Proxy.Hash.Sticky, "name of the affinity cookie for the hash strategy. Empty disables the cookie")
+	f.Int64Var(&cfg.Proxy.Retry.MaxBodySize, "proxy.retry.maxbodysize", defaultConfig.Proxy.Retry.MaxBodySize, "maximum size of a request body which is buffered for retries")
 	f.StringVar(&gzipContentTypesValue, "proxy.gzip.contenttype", defaultValues.GZIPContentTypesValue, "regexp of content types to compress")
 	f.StringVar(&listenerValue, "proxy.addr", defaultValues.ListenerValue, "listener config")
 	f.StringVar(&certSourcesValue, "proxy.cs", defaultValues.CertSourcesValue, "certificate sources")
@@ -164,6 +192,9 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	f.DurationVar(&cfg.Proxy.FlushInterval, "proxy.flushinterval", defaultConfig.Proxy.FlushInterval, "flush interval for streaming responses")
 	f.DurationVar(&cfg.Proxy.GlobalFlushInterval, "proxy.globalflushinterval", defaultConfig.Proxy.GlobalFlushInterval, "flush interval for non-streaming responses")
 	f.StringVar(&authSchemesValue, "proxy.auth", defaultValues.AuthSchemesValue, "auth schemes")
+	f.StringVar(&upstreamTLSValue, "proxy.upstream.tls", defaultValues.UpstreamTLSValue, "upstream TLS profiles")
+	f.StringVar(&tlsPoliciesValue, "proxy.tls.policy", defaultValues.TLSPoliciesValue, "TLS policies for listeners by server name")
+	f.StringVar(&cfg.Proxy.GeoIPDB, "proxy.geoip.db", defaultConfig.Proxy.GeoIPDB, "path to the MaxMind GeoIP2 country database for country access rules")
 	f.StringVar(&cfg.Log.AccessFormat, "log.access.format", defaultConfig.Log.AccessFormat, "access log format")
 	f.StringVar(&cfg.Log.AccessTarget, "log.access.target", defaultConfig.Log.AccessTarget, "access log target")
 	f.StringVar(&cfg.Log.RoutesFormat, "log.routes.format", defaultConfig.Log.RoutesFormat, "log format of routing table updates")
@@ -252,6 +283,52 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 	f.DurationVar(&cfg.Registry.Custom.PollInterval, "registry.custom.pollinterval", defaultConfig.Registry.Custom.PollInterval, "poll interval for API request to custom back end")
 	f.StringVar(&cfg.Registry.Custom.Path, "registry.custom.path", defaultConfig.Registry.Custom.Path, "custom back end path in the URL")
 	f.StringVar(&cfg.Registry.Custom.QueryParams, "registry.custom.queryparams", defaultConfig.Registry.Custom.QueryParams, "custom back end query parameters in the URL")
+	f.StringVar(&cfg.Registry.Kubernetes.Addr, "registry.kubernetes.addr", defaultConfig.Registry.Kubernetes.Addr, "URL of the kubernetes API server. Empty for the in-cluster config")
+	f.StringVar(&cfg.Registry.Kubernetes.TokenPath, "registry.kubernetes.tokenpath", defaultConfig.Registry.Kubernetes.TokenPath, "path to the service account token for the kubernetes API server")
+	f.StringVar(&cfg.Registry.Kubernetes.CAPath, "registry.kubernetes.capath", defaultConfig.Registry.Kubernetes.CAPath, "path to the CA certificate of the kubernetes API server")
+	f.BoolVar(&cfg.Registry.Kubernetes.TLSSkipVerify, "registry.kubernetes.tlsskipverify", defaultConfig.Registry.Kubernetes.TLSSkipVerify, "disable TLS verification of the kubernetes API server")
+	f.StringVar(&cfg.Registry.Kubernetes.Namespace, "registry.kubernetes.namespace", defaultConfig.Registry.Kubernetes.Namespace, "kubernetes namespace to watch. Empty for all namespaces")
+	f.StringVar(&cfg.Registry.Kubernetes.Annotation, "registry.kubernetes.annotation", defaultConfig.Registry.Kubernetes.Annotation, "kubernetes service annotation with the routes")
+	f.StringVar(&cfg.Registry.Kubernetes.IngressClass, "registry.kubernetes.ingressclass", defaultConfig.Registry.Kubernetes.IngressClass, "kubernetes ingress class handled by fabio. Empty disables ingress support")
+	f.StringVar(&cfg.Registry.Kubernetes.ConfigMap, "registry.kubernetes.configmap", defaultConfig.Registry.Kubernetes.ConfigMap, "kubernetes config map <namespace>/<name> for manual overrides")
+	f.StringVar(&cfg.Registry.Nomad.Addr, "registry.nomad.addr", defaultConfig.Registry.Nomad.Addr, "URL of the nomad agent")
+	f.StringVar(&cfg.Registry.Nomad.Token, "registry.nomad.token", defaultConfig.Registry.Nomad.Token, "ACL token for the nomad agent")
+	f.StringVar(&cfg.Registry.Nomad.Namespace, "registry.nomad.namespace", defaultConfig.Registry.Nomad.Namespace, "nomad namespace of the services. '*' for all namespaces")
+	f.StringVar(&cfg.Registry.Nomad.TagPrefix, "registry.nomad.tagprefix", defaultConfig.Registry.Nomad.TagPrefix, "prefix for nomad service tags")
+	f.StringVar(&cfg.Registry.Nomad.VarPath, "registry.nomad.varpath", defaultConfig.Registry.Nomad.VarPath, "nomad variable path for manual overrides")
+	f.StringVar(&cfg.Registry.Nomad.NoRouteHTMLPath, "registry.nomad.noroutehtmlpath", defaultConfig.Registry.Nomad.NoRouteHTMLPath, "nomad variable path for HTML returned when no route is found")
+	f.DurationVar(&cfg.Registry.Nomad.PollInterval, "registry.nomad.pollinterval", defaultConfig.Registry.Nomad.PollInterval, "poll interval for the health check status of nomad services")
+	f.StringVar(&cfg.Registry.Nomad.TLS.KeyFile, "registry.nomad.tls.keyfile", defaultConfig.Registry.Nomad.TLS.KeyFile, "path to nomad key file")
+	f.StringVar(&cfg.Registry.Nomad.TLS.CertFile, "registry.nomad.tls.certfile", defaultConfig.Registry.Nomad.TLS.CertFile, "path to nomad cert file")
+	f.StringVar(&cfg.Registry.Nomad.TLS.CAFile, "registry.nomad.tls.cafile", defaultConfig.Registry.Nomad.TLS.CAFile, "path to nomad CA file")
+	f.StringVar(&cfg.Registry.Nomad.TLS.CAPath, "registry.nomad.tls.capath", defaultConfig.Registry.Nomad.TLS.CAPath, "path to nomad CA directory")
+	f.BoolVar(&cfg.Registry.Nomad.TLS.InsecureSkipVerify, "registry.nomad.tls.insecureskipverify", defaultConfig.Registry.Nomad.TLS.InsecureSkipVerify, "disable TLS verification of the nomad agent")
+	f.StringSliceVar(&cfg.Registry.Etcd.Endpoints, "registry.etcd.endpoints", defaultConfig.Registry.Etcd.Endpoints, "comma separated list of etcd endpoints")
+	f.StringVar(&cfg.Registry.Etcd.Username, "registry.etcd.username", defaultConfig.Registry.Etcd.Username, "etcd username")
+	f.StringVar(&cfg.Registry.Etcd.Password, "registry.etcd.password", defaultConfig.Registry.Etcd.Password, "etcd password")
+	f.StringVar(&cfg.Registry.Etcd.ServicePath, "registry.etcd.servicepath", defaultConfig.Registry.Etcd.ServicePath, "etcd key prefix for service instances")
+	f.StringVar(&cfg.Registry.Etcd.KVPath, "registry.etcd.kvpath", defaultConfig.Registry.Etcd.KVPath, "etcd key prefix for manual overrides")
+	f.StringVar(&cfg.Registry.Etcd.NoRouteHTMLPath, "registry.etcd.noroutehtmlpath", defaultConfig.Registry.Etcd.NoRouteHTMLPath, "etcd key for HTML returned when no route is found")
+	f.StringVar(&cfg.Registry.Etcd.TagPrefix, "registry.etcd.tagprefix", defaultConfig.Registry.Etcd.TagPrefix, "prefix for etcd service tags")
+	f.BoolVar(&cfg.Registry.Etcd.Register, "registry.etcd.register.enabled", defaultConfig.Registry.Etcd.Register, "register fabio in etcd")
+	f.StringVar(&cfg.Registry.Etcd.ServiceAddr, "registry.etcd.register.addr", "<ui.addr>", "service registration address")
+	f.StringVar(&cfg.Registry.Etcd.ServiceName, "registry.etcd.register.name", defaultConfig.Registry.Etcd.ServiceName, "service registration name")
+	f.StringSliceVar(&cfg.Registry.Etcd.ServiceTags, "registry.etcd.register.tags", defaultConfig.Registry.Etcd.ServiceTags, "service registration tags")
+	f.DurationVar(&cfg.Registry.Etcd.RegisterTTL, "registry.etcd.register.ttl", defaultConfig.Registry.Etcd.RegisterTTL, "TTL of the lease for the service registration")
+	f.StringVar(&cfg.Registry.Etcd.TLS.KeyFile, "registry.etcd.tls.keyfile", defaultConfig.Registry.Etcd.TLS.KeyFile, "path to etcd key file")
+	f.StringVar(&cfg.Registry.Etcd.TLS.CertFile, "registry.etcd.tls.certfile", defaultConfig.Registry.Etcd.TLS.CertFile, "path to etcd cert file")
+	f.StringVar(&cfg.Registry.Etcd.TLS.CAFile, "registry.etcd.tls.cafile", defaultConfig.Registry.Etcd.TLS.CAFile, "path to etcd CA file")
+	f.StringVar(&cfg.Registry.Etcd.TLS.CAPath, "registry.etcd.tls.capath", defaultConfig.Registry.Etcd.TLS.CAPath, "path to etcd CA directory")
+	f.BoolVar(&cfg.Registry.Etcd.TLS.InsecureSkipVerify, "registry.etcd.tls.insecureskipverify", defaultConfig.Registry.Etcd.TLS.InsecureSkipVerify, "disable TLS verification of the etcd endpoints")
+	f.StringSliceVar(&cfg.Registry.DNS.Records, "registry.dns.records", defaultConfig.Registry.DNS.Records, "comma separated list of SRV records with optional urlprefix tag")
+	f.StringVar(&cfg.Registry.DNS.Resolver, "registry.dns.resolver", defaultConfig.Registry.DNS.Resolver, "address of the DNS server. Defaults to the first nameserver in /etc/resolv.conf")
+	f.StringVar(&cfg.Registry.DNS.TagPrefix, "registry.dns.tagprefix", defaultConfig.Registry.DNS.TagPrefix, "prefix for TXT records and tags which define routes")
+	f.DurationVar(&cfg.Registry.DNS.MinTTL, "registry.dns.minttl", defaultConfig.Registry.DNS.MinTTL, "minimum interval between lookups of a record")
+	f.DurationVar(&cfg.Registry.DNS.Timeout, "registry.dns.timeout", defaultConfig.Registry.DNS.Timeout, "timeout for DNS queries")
+	f.StringSliceVar(&cfg.Registry.Composite.Backends, "registry.composite.backends", defaultConfig.Registry.Composite.Backends, "comma separated list of backends of the composite backend. Later backends take precedence")
+	f.StringVar(&cfg.Registry.Composite.Manual, "registry.composite.manual", defaultConfig.Registry.Composite.Manual, "backend which stores the manual overrides. Defaults to the first backend")
+	f.DurationVar(&cfg.Registry.Composite.Timeout, "registry.composite.timeout", defaultConfig.Registry.Composite.Timeout, "how long to wait for the first routes of all backends")
+	f.StringVar(&compositeStaleTimeoutValue, "registry.composite.staletimeout", "", "comma separated list of backend=duration pairs after which a backend without new routes is unhealthy")
 
 	f.BoolVar(&cfg.BGP.BGPEnabled, "bgp.enabled", defaultConfig.BGP.BGPEnabled, "enabled bgp announcements")
 	f.UintVar(&cfg.BGP.Asn, "bgp.asn", defaultConfig.BGP.Asn, "our BGP asn")
@@ -296,6 +373,21 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 
 	cfg.Proxy.AuthSchemes = authSchemes
 
+	cfg.Proxy.UpstreamTLS, err = parseUpstreamTLSProfiles(upstreamTLSValue, certSources)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Proxy.TLSPolicies, err = parseTLSPolicies(tlsPoliciesValue, certSources)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Registry.Composite.StaleTimeout, err = parseDurationList(compositeStaleTimeoutValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry.composite.staletimeout: %s", err)
+	}
+
 	if uiListenerValue != "" {
 		kvs, err := parseKVSlice(uiListenerValue)
 		if err != nil {
@@ -331,6 +423,14 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 			return nil, fmt.Errorf("failed to consul service address: %s", err)
 		}
 	}
+	if !f.IsSet("registry.etcd.register.addr") {
+		cfg.Registry.Etcd.ServiceAddr = cfg.UI.Listen.Addr
+	}
+	if cfg.Registry.Etcd.ServiceAddr != "" {
+		if cfg.Registry.Etcd.ServiceAddr, err = gs.Parse(cfg.Registry.Etcd.ServiceAddr); err != nil {
+			return nil, fmt.Errorf("failed to parse etcd service address: %s", err)
+		}
+	}
 
 	cfg.Registry.Consul.CheckScheme = defaultConfig.Registry.Consul.CheckScheme
 	if cfg.UI.Listen.CertSource.Name != "" {
@@ -348,11 +448,72 @@ func load(cmdline, environ, envprefix []string, props *properties.Properties) (c
 		}
 	}
 
-	if cfg.Proxy.Strategy != "rr" && cfg.Proxy.Strategy != "rnd" {
+	if cfg.Proxy.Strategy != "rr" && cfg.Proxy.Strategy != "rnd" && cfg.Proxy.Strategy != "leastconn" && cfg.Proxy.Strategy != "ewma" && cfg.Proxy.Strategy != "hash" {
 		return nil, fmt.Errorf("invalid proxy.strategy: %s", cfg.Proxy.Strategy)
 	}
 
-	if cfg.Proxy.Matcher != "prefix" && cfg.Proxy.Matcher != "glob" && cfg.Proxy.Matcher != "iprefix" {
+	if !validHashKey(cfg.Proxy.Hash.Key) {
+		return nil, fmt.Errorf("invalid proxy.hash.key: %s", cfg.Proxy.Hash.Key)
+	}
+
+	if cfg.Proxy.Hash.Sticky != "" && cfg.Proxy.Strategy != "hash" {
+		return nil, fmt.Errorf("proxy.hash.sticky requires proxy.strategy=hash")
+	}
+
+	if cfg.Proxy.HealthCheck.Interval <= 0 {
+		return nil, fmt.Errorf("proxy.healthcheck.interval must be > 0")
+	}
+
+	if cfg.Proxy.HealthCheck.Timeout <= 0 {
+		return nil, fmt.Errorf("proxy.healthcheck.timeout must be > 0")
+	}
+
+	if cfg.Proxy.HealthCheck.HealthyThreshold < 1 || cfg.Proxy.HealthCheck.UnhealthyThreshold < 1 {
+		return nil, fmt.Errorf("proxy.healthcheck thresholds must be >= 1")
+	}
+
+	if cfg.Proxy.Outlier.ConsecutiveFailures < 0 {
+		return nil, fmt.Errorf("proxy.outlier.consecutivefailures must be >= 0")
+	}
+
+	if cfg.Proxy.Outlier.ErrorRate < 0 || cfg.Proxy.Outlier.ErrorRate > 1 {
+		return nil, fmt.Errorf("proxy.outlier.errorrate must be between 0 and 1")
+	}
+
+	if cfg.Proxy.Outlier.MinRequests < 1 {
+		return nil, fmt.Errorf("proxy.outlier.minrequests must be >= 1")
+	}
+
+	if cfg.Proxy.Outlier.Window <= 0 {
+		return nil, fmt.Errorf("proxy.outlier.window must be > 0")
+	}
+
+	if cfg.Proxy.Outlier.BaseEjectionTime <= 0 || cfg.Proxy.Outlier.MaxEjectionTime < cfg.Proxy.Outlier.BaseEjectionTime {
+		return nil, fmt.Errorf("proxy.outlier.maxejectiontime must be >= proxy.outlier.baseejectiontime > 0")
+	}
+
+	if cfg.Proxy.Outlier.MaxEjectionPercent < 0 || cfg.Proxy.Outlier.MaxEjectionPercent > 100 {
+		return nil, fmt.Errorf("proxy.outlier.maxejectionpercent must be between 0 and 100")
+	}
+
+	if cfg.Proxy.Retry.Attempts < 1 {
+		return nil, fmt.Errorf("proxy.retry.attempts must be >= 1")
+	}
+
+	for _, v := range cfg.Proxy.Retry.On {
+		if v == "connect-failure" || v == "timeout" || v == "5xx" {
+			continue
+		}
+		if code, err := strconv.Atoi(v); err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid proxy.retry.on: %s", v)
+		}
+	}
+
+	if cfg.Proxy.Retry.Budget < 0 || cfg.Proxy.Retry.Budget > 100 {
+		return nil, fmt.Errorf("proxy.retry.budget must be between 0 and 100")
+	}
+
+	if cfg.Proxy.Matcher != "prefix" && cfg.Proxy.Matcher != "glob" && cfg.Proxy.Matcher != "iprefix" && cfg.Proxy.Matcher != "regex" {
 		return nil, fmt.Errorf("invalid proxy.matcher: %s", cfg.Proxy.Matcher)
 	}
 
@@ -522,10 +683,10 @@ func parseListen(cfg map[string]string, cs map[string]CertSource, readTimeout, w
 	if csName == "" && l.Proto == "grpcs" {
 		return Listen{}, fmt.Errorf("proto 'grpcs' requires cert source")
 	}
-	if cs[csName].Type == "vault-pki" && !l.StrictMatch {
+	if t := cs[csName].Type; (t == "vault-pki" || t == "acme") && !l.StrictMatch {
 		// Without StrictMatch the first issued certificate is used for all
 		// subsequent requests, even if the common name doesn't match.
-		log.Printf("[INFO] vault-pki requires strictmatch; enabling strictmatch for listener %s", l.Addr)
+		log.Printf("[INFO] %s requires strictmatch; enabling strictmatch for listener %s", t, l.Addr)
 		l.StrictMatch = true
 	}
 	if l.ProxyProto && l.ProxyHeaderTimeout == 0 {
@@ -577,6 +738,76 @@ func parseUint16(s string) (uint16, error) {
 	return uint16(n), nil
 }
 
+// ParseRate parses a rate in the '<n>/<unit>' format where the unit is
+// either 's', 'm' or 'h' and returns the rate per second and the number
+// per unit as burst.
+func ParseRate(v string) (rate float64, burst int, err error) {
+	n, unit, ok := strings.Cut(v, "/")
+	count, err := strconv.ParseFloat(n, 64)
+	if !ok || err != nil || count <= 0 {
+		return 0, 0, fmt.Errorf("%q is not <n>/<unit>", v)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return 0, 0, fmt.Errorf("unit %q is not s, m or h", unit)
+	}
+	return count / per.Seconds(), int(math.Ceil(count)), nil
+}
+
+// parsePatterns returns the comma separated list of patterns.
+func parsePatterns(v string) []string {
+	var p []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			p = append(p, s)
+		}
+	}
+	return p
+}
+
+// parseKVList parses a comma separated list of key=value pairs.
+func parseKVList(v string) (map[string]string, error) {
+	var m map[string]string
+	for _, s := range parsePatterns(v) {
+		p := strings.SplitN(s, "=", 2)
+		if len(p) != 2 || strings.TrimSpace(p[0]) == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", s)
+		}
+		if m == nil {
+			m = map[string]string{}
+		}
+		m[strings.TrimSpace(p[0])] = strings.TrimSpace(p[1])
+	}
+	return m, nil
+}
+
+// parseDurationList parses a comma separated list of key=duration pairs.
+func parseDurationList(v string) (map[string]time.Duration, error) {
+	kv, err := parseKVList(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]time.Duration
+	for k, v := range kv {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			m = map[string]time.Duration{}
+		}
+		m[k] = d
+	}
+	return m, nil
+}
+
 func parseCertSources(cfgs string) (cs map[string]CertSource, err error) {
 	kvs, err := parseKVSlice(cfgs)
 	if err != nil {
@@ -622,6 +853,31 @@ func parseCertSource(cfg map[string]string) (c CertSource, err error) {
 			c.Refresh = d
 		case "vaultfetchtoken":
 			c.VaultFetchToken = v
+		case "email":
+			c.ACMEEmail = v
+		case "storage":
+			c.ACMEStorage = v
+		case "acmeca":
+			c.ACMECAPath = v
+		case "issue.allow":
+			c.IssueAllow = parsePatterns(v)
+		case "issue.deny":
+			c.IssueDeny = parsePatterns(v)
+		case "issue.ratelimit":
+			rate, burst, err := ParseRate(v)
+			if err != nil {
+				return CertSource{}, fmt.Errorf("invalid issue.ratelimit: %s", err)
+			}
+			c.IssueRate = rate
+			if c.IssueBurst == 0 {
+				c.IssueBurst = burst
+			}
+		case "issue.burst":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return CertSource{}, fmt.Errorf("invalid issue.burst %q", v)
+			}
+			c.IssueBurst = n
 		case "hdr":
 			p := strings.SplitN(v, ": ", 2)
 			if len(p) != 2 {
@@ -639,6 +895,9 @@ func parseCertSource(cfg map[string]string) (c CertSource, err error) {
 	if c.CertPath == "" {
 		return CertSource{}, fmt.Errorf("missing 'cert' in %s", cfg)
 	}
+	if c.IssueBurst > 0 && c.IssueRate == 0 {
+		return CertSource{}, fmt.Errorf("issue.burst requires issue.ratelimit in %s", cfg)
+	}
 	switch c.Type {
 	case "":
 		return CertSource{}, fmt.Errorf("missing 'type' in %s", cfg)
@@ -646,6 +905,14 @@ func parseCertSource(cfg map[string]string) (c CertSource, err error) {
 		c.Refresh = 0
 	case "path", "http", "vault", "vault-pki":
 		// no-op
+	case "acme":
+		// refresh is the renewal time before the expiry for acme
+		if cfg["refresh"] == "" {
+			c.Refresh = 0
+		}
+		if c.ACMEStorage == "" {
+			return CertSource{}, fmt.Errorf("missing 'storage' in %s", cfg)
+		}
 	default:
 		return CertSource{}, fmt.Errorf("unknown cert source type %s", c.Type)
 	}
@@ -715,6 +982,110 @@ func parseAuthScheme(cfg map[string]string) (a AuthScheme, err error) {
 			a.Basic.Refresh = d
 		}
 
+	case "jwt":
+		a.JWT = JWTAuth{
+			JWKSURL:  cfg["jwks"],
+			KeyFile:  cfg["key"],
+			Secret:   cfg["secret"],
+			Issuer:   cfg["issuer"],
+			Audience: parsePatterns(cfg["audience"]),
+			Refresh:  time.Hour,
+		}
+		if a.JWT.JWKSURL == "" && a.JWT.KeyFile == "" && a.JWT.Secret == "" {
+			return AuthScheme{}, fmt.Errorf("missing 'jwks', 'key' or 'secret' in auth '%s'", a.Name)
+		}
+		if a.JWT.Claims, err = parseKVList(cfg["claims"]); err != nil {
+			return AuthScheme{}, fmt.Errorf("invalid 'claims' in auth '%s': %s", a.Name, err)
+		}
+		if a.JWT.Headers, err = parseKVList(cfg["headers"]); err != nil {
+			return AuthScheme{}, fmt.Errorf("invalid 'headers' in auth '%s': %s", a.Name, err)
+		}
+		if cfg["refresh"] != "" {
+			d, err := time.ParseDuration(cfg["refresh"])
+			if err != nil {
+				return AuthScheme{}, err
+			}
+			if d < time.Second {
+				d = time.Second
+			}
+			a.JWT.Refresh = d
+		}
+
+	case "forward":
+		a.Forward = ForwardAuth{
+			URL:             cfg["url"],
+			Timeout:         5 * time.Second,
+			RequestHeaders:  []string{"Authorization", "Cookie"},
+			ResponseHeaders: parsePatterns(cfg["responseheaders"]),
+		}
+		if a.Forward.URL == "" {
+			return AuthScheme{}, fmt.Errorf("missing 'url' in auth '%s'", a.Name)
+		}
+		if cfg["requestheaders"] != "" {
+			a.Forward.RequestHeaders = parsePatterns(cfg["requestheaders"])
+		}
+		a.Forward.CacheKey = a.Forward.RequestHeaders
+		if cfg["cachekey"] != "" {
+			a.Forward.CacheKey = parsePatterns(cfg["cachekey"])
+		}
+		if cfg["timeout"] != "" {
+			if a.Forward.Timeout, err = time.ParseDuration(cfg["timeout"]); err != nil {
+				return AuthScheme{}, err
+			}
+		}
+		if cfg["cachettl"] != "" {
+			if a.Forward.CacheTTL, err = time.ParseDuration(cfg["cachettl"]); err != nil {
+				return AuthScheme{}, err
+			}
+		}
+		if cfg["failopen"] != "" {
+			if a.Forward.FailOpen, err = strconv.ParseBool(cfg["failopen"]); err != nil {
+				return AuthScheme{}, fmt.Errorf("invalid 'failopen' in auth '%s': %s", a.Name, err)
+			}
+		}
+
+	case "oidc":
+		a.OIDC = OIDCAuth{
+			Issuer:       cfg["issuer"],
+			ClientID:     cfg["clientid"],
+			ClientSecret: cfg["clientsecret"],
+			Scopes:       []string{"openid", "profile", "email"},
+			CallbackPath: "/oauth2/callback",
+			CookieName:   "fabio_" + a.Name,
+			CookieSecret: cfg["cookiesecret"],
+		}
+		if a.OIDC.Issuer == "" || a.OIDC.ClientID == "" {
+			return AuthScheme{}, fmt.Errorf("missing 'issuer' or 'clientid' in auth '%s'", a.Name)
+		}
+		if len(a.OIDC.CookieSecret) < 16 {
+			return AuthScheme{}, fmt.Errorf("'cookiesecret' in auth '%s' must have at least 16 characters", a.Name)
+		}
+		if cfg["scopes"] != "" {
+			a.OIDC.Scopes = parsePatterns(cfg["scopes"])
+		}
+		if cfg["callback"] != "" {
+			a.OIDC.CallbackPath = cfg["callback"]
+		}
+		if cfg["cookie"] != "" {
+			a.OIDC.CookieName = cfg["cookie"]
+		}
+		if a.OIDC.Claims, err = parseKVList(cfg["claims"]); err != nil {
+			return AuthScheme{}, fmt.Errorf("invalid 'claims' in auth '%s': %s", a.Name, err)
+		}
+		if a.OIDC.Headers, err = parseKVList(cfg["headers"]); err != nil {
+			return AuthScheme{}, fmt.Errorf("invalid 'headers' in auth '%s': %s", a.Name, err)
+		}
+
+	case "cert":
+		a.Cert = CertAuth{
+			CommonNames: parsePatterns(cfg["cn"]),
+			URIs:        parsePatterns(cfg["uri"]),
+			Subject:     cfg["subject"],
+		}
+		if len(a.Cert.CommonNames) == 0 && len(a.Cert.URIs) == 0 && a.Cert.Subject == "" {
+			return AuthScheme{}, fmt.Errorf("missing 'cn', 'uri' or 'subject' in auth '%s'", a.Name)
+		}
+
 	default:
 		return AuthScheme{}, fmt.Errorf("unknown auth type '%s'", a.Type)
 	}
@@ -722,6 +1093,125 @@ func parseAuthScheme(cfg map[string]string) (a AuthScheme, err error) {
 	return
 }
 
+func parseUpstreamTLSProfiles(cfgs string, cs map[string]CertSource) (p map[string]UpstreamTLS, err error) {
+	kvs, err := parseKVSlice(cfgs)
+	if err != nil {
+		return nil, err
+	}
+	p = map[string]UpstreamTLS{}
+	for _, cfg := range kvs {
+		u, err := parseUpstreamTLS(cfg, cs)
+		if err != nil {
+			return nil, err
+		}
+		p[u.Name] = u
+	}
+	return
+}
+
+func parseUpstreamTLS(cfg map[string]string, cs map[string]CertSource) (u UpstreamTLS, err error) {
+	for k, v := range cfg {
+		switch k {
+		case "name":
+			u.Name = v
+		case "cs":
+			c, ok := cs[v]
+			if !ok {
+				return UpstreamTLS{}, fmt.Errorf("unknown certificate source %q", v)
+			}
+			u.CertSource = c
+		case "servername":
+			u.ServerName = v
+		case "tlsmin":
+			n, err := parseTLSVersion(v)
+			if err != nil {
+				return UpstreamTLS{}, err
+			}
+			u.TLSMinVersion = n
+		default:
+			return UpstreamTLS{}, fmt.Errorf("unknown upstream TLS option %q", k)
+		}
+	}
+
+	if u.Name == "" {
+		return UpstreamTLS{}, errors.New("missing 'name' in upstream TLS profile")
+	}
+	if u.CertSource.Name == "" {
+		return UpstreamTLS{}, fmt.Errorf("missing 'cs' in upstream TLS profile '%s'", u.Name)
+	}
+	return u, nil
+}
+
+func parseTLSPolicies(cfgs string, cs map[string]CertSource) (p map[string]TLSPolicy, err error) {
+	kvs, err := parseKVSlice(cfgs)
+	if err != nil {
+		return nil, err
+	}
+	p = map[string]TLSPolicy{}
+	for _, cfg := range kvs {
+		tp, err := parseTLSPolicy(cfg, cs)
+		if err != nil {
+			return nil, err
+		}
+		p[tp.Name] = tp
+	}
+	return
+}
+
+func parseTLSPolicy(cfg map[string]string, cs map[string]CertSource) (p TLSPolicy, err error) {
+	for k, v := range cfg {
+		switch k {
+		case "name":
+			p.Name = v
+		case "hosts":
+			p.Hosts = parsePatterns(strings.ToLower(v))
+		case "tlsmin":
+			n, err := parseTLSVersion(v)
+			if err != nil {
+				return TLSPolicy{}, err
+			}
+			p.TLSMinVersion = n
+		case "tlsmax":
+			n, err := parseTLSVersion(v)
+			if err != nil {
+				return TLSPolicy{}, err
+			}
+			p.TLSMaxVersion = n
+		case "tlsciphers":
+			c, err := parseTLSCiphers(v)
+			if err != nil {
+				return TLSPolicy{}, err
+			}
+			p.TLSCiphers = c
+		case "alpn":
+			p.ALPN = parsePatterns(v)
+		case "clientauth":
+			switch v {
+			case "none", "request", "require":
+				p.ClientAuth = v
+			default:
+				return TLSPolicy{}, fmt.Errorf("invalid clientauth %q", v)
+			}
+		case "clientcs":
+			c, ok := cs[v]
+			if !ok {
+				return TLSPolicy{}, fmt.Errorf("unknown certificate source %q", v)
+			}
+			p.ClientCA = c
+		default:
+			return TLSPolicy{}, fmt.Errorf("unknown TLS policy option %q", k)
+		}
+	}
+
+	if p.Name == "" {
+		return TLSPolicy{}, errors.New("missing 'name' in TLS policy")
+	}
+	if (p.ClientAuth == "request" || p.ClientAuth == "require") && p.ClientCA.Name == "" {
+		return TLSPolicy{}, fmt.Errorf("missing 'clientcs' in TLS policy '%s'", p.Name)
+	}
+	return p, nil
+}
+
 func parseBGPPeers(cfgs string) ([]BGPPeer, error) {
 	kvs, err := parseKVSlice(cfgs)
 	if err != nil {
@@ -775,3 +1265,16 @@ func parseBGPPeer(cfg map[string]string) (BGPPeer, error) {
 	}
 	return peer, nil
 }
+
+// validHashKey returns true if key is a valid source for the key of
+// the hash strategy.
+func validHashKey(key string) bool {
+	if key == "ip" {
+		return true
+	}
+	src, name, ok := strings.Cut(key, ":")
+	if !ok || name == "" {
+		return false
+	}
+	return src == "header" || src == "cookie" || src == "query"
+}
@@ -220,6 +220,74 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			desc: "-proxy.addr with acme cert source",
+			args: []string{
+				"-proxy.addr", ":5555;cs=name",
+				"-proxy.cs", "cs=name;type=acme;cert=https://acme/dir;email=ops@example.com;storage=/var/lib/fabio/acme;acmeca=ca.pem",
+			},
+			cfg: func(cfg *Config) *Config {
+				cfg.Listen = []Listen{{Addr: ":5555", Proto: "https"}}
+				cfg.Listen[0].CertSource = CertSource{
+					Name:        "name",
+					Type:        "acme",
+					CertPath:    "https://acme/dir",
+					ACMEEmail:   "ops@example.com",
+					ACMEStorage: "/var/lib/fabio/acme",
+					ACMECAPath:  "ca.pem",
+				}
+				cfg.Listen[0].StrictMatch = true // implicit
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.addr with acme cert source and refresh",
+			args: []string{
+				"-proxy.addr", ":5555;cs=name",
+				"-proxy.cs", "cs=name;type=acme;cert=https://acme/dir;storage=/var/lib/fabio/acme;refresh=240h",
+			},
+			cfg: func(cfg *Config) *Config {
+				cfg.Listen = []Listen{{Addr: ":5555", Proto: "https"}}
+				cfg.Listen[0].CertSource = CertSource{Name: "name", Type: "acme", CertPath: "https://acme/dir", ACMEStorage: "/var/lib/fabio/acme", Refresh: 240 * time.Hour}
+				cfg.Listen[0].StrictMatch = true // implicit
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.addr with issuance policy",
+			args: []string{
+				"-proxy.addr", ":5555;cs=name",
+				"-proxy.cs", `cs=name;type=vault-pki;cert=pki/issue/value;issue.allow="*.example.com, example.com";issue.deny=admin.example.com;issue.ratelimit=10/m`,
+			},
+			cfg: func(cfg *Config) *Config {
+				cfg.Listen = []Listen{{Addr: ":5555", Proto: "https"}}
+				cfg.Listen[0].CertSource = CertSource{
+					Name:       "name",
+					Type:       "vault-pki",
+					CertPath:   "pki/issue/value",
+					Refresh:    3 * time.Second,
+					IssueAllow: []string{"*.example.com", "example.com"},
+					IssueDeny:  []string{"admin.example.com"},
+					IssueRate:  10.0 / 60,
+					IssueBurst: 10,
+				}
+				cfg.Listen[0].StrictMatch = true // implicit
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.addr with issuance rate limit and burst",
+			args: []string{
+				"-proxy.addr", ":5555;cs=name",
+				"-proxy.cs", "cs=name;type=vault-pki;cert=pki/issue/value;issue.ratelimit=2/s;issue.burst=5",
+			},
+			cfg: func(cfg *Config) *Config {
+				cfg.Listen = []Listen{{Addr: ":5555", Proto: "https"}}
+				cfg.Listen[0].CertSource = CertSource{Name: "name", Type: "vault-pki", CertPath: "pki/issue/value", Refresh: 3 * time.Second, IssueRate: 2, IssueBurst: 5}
+				cfg.Listen[0].StrictMatch = true // implicit
+				return cfg
+			},
+		},
 		{
 			desc: "-proxy.addr with cert source",
 			args: []string{"-proxy.addr", ":5555;cs=name;strictmatch=true", "-proxy.cs", "cs=name;type=path;cert=foo;clientca=bar;refresh=2s;hdr=a: b;caupgcn=furb"},
@@ -306,6 +374,176 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			desc: "-proxy.auth with type cert",
+			args: []string{"-proxy.auth", `name=mesh;type=cert;cn="billing,payments-*";uri=spiffe://mesh.example.com/*;subject="*,O=Acme"`},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.AuthSchemes = map[string]AuthScheme{
+					"mesh": {
+						Name: "mesh",
+						Type: "cert",
+						Cert: CertAuth{
+							CommonNames: []string{"billing", "payments-*"},
+							URIs:        []string{"spiffe://mesh.example.com/*"},
+							Subject:     "*,O=Acme",
+						},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.auth with type jwt",
+			args: []string{"-proxy.auth", `name=api;type=jwt;jwks=https://idp.example.com/jwks.json;issuer=https://idp.example.com;audience="api,web";claims="scope=read,tenant=acme";headers="sub=X-User,email=X-Email";refresh=10m`},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.AuthSchemes = map[string]AuthScheme{
+					"api": {
+						Name: "api",
+						Type: "jwt",
+						JWT: JWTAuth{
+							JWKSURL:  "https://idp.example.com/jwks.json",
+							Issuer:   "https://idp.example.com",
+							Audience: []string{"api", "web"},
+							Claims:   map[string]string{"scope": "read", "tenant": "acme"},
+							Headers:  map[string]string{"sub": "X-User", "email": "X-Email"},
+							Refresh:  10 * time.Minute,
+						},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.auth with type forward",
+			args: []string{"-proxy.auth", `name=sso;type=forward;url=http://auth.local:9000/check;timeout=1s;responseheaders="X-User,X-Groups";cachettl=30s;failopen=true`},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.AuthSchemes = map[string]AuthScheme{
+					"sso": {
+						Name: "sso",
+						Type: "forward",
+						Forward: ForwardAuth{
+							URL:             "http://auth.local:9000/check",
+							Timeout:         time.Second,
+							RequestHeaders:  []string{"Authorization", "Cookie"},
+							ResponseHeaders: []string{"X-User", "X-Groups"},
+							CacheKey:        []string{"Authorization", "Cookie"},
+							CacheTTL:        30 * time.Second,
+							FailOpen:        true,
+						},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.auth forward with request headers and cache key",
+			args: []string{"-proxy.auth", `name=sso;type=forward;url=http://auth.local:9000/check;requestheaders="Authorization,X-Api-Key";cachekey=X-Api-Key`},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.AuthSchemes = map[string]AuthScheme{
+					"sso": {
+						Name: "sso",
+						Type: "forward",
+						Forward: ForwardAuth{
+							URL:            "http://auth.local:9000/check",
+							Timeout:        5 * time.Second,
+							RequestHeaders: []string{"Authorization", "X-Api-Key"},
+							CacheKey:       []string{"X-Api-Key"},
+						},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.auth with type oidc",
+			args: []string{"-proxy.auth", `name=dash;type=oidc;issuer=https://idp.example.com;clientid=fabio;clientsecret=s3cr3t;scopes="openid,groups";callback=/_auth/callback;cookie=dash_session;cookiesecret=0123456789abcdef;claims="groups=admin";headers="email=X-Email"`},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.AuthSchemes = map[string]AuthScheme{
+					"dash": {
+						Name: "dash",
+						Type: "oidc",
+						OIDC: OIDCAuth{
+							Issuer:       "https://idp.example.com",
+							ClientID:     "fabio",
+							ClientSecret: "s3cr3t",
+							Scopes:       []string{"openid", "groups"},
+							CallbackPath: "/_auth/callback",
+							CookieName:   "dash_session",
+							CookieSecret: "0123456789abcdef",
+							Claims:       map[string]string{"groups": "admin"},
+							Headers:      map[string]string{"email": "X-Email"},
+						},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.auth oidc with defaults",
+			args: []string{"-proxy.auth", "name=dash;type=oidc;issuer=https://idp.example.com;clientid=fabio;cookiesecret=0123456789abcdef"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.AuthSchemes = map[string]AuthScheme{
+					"dash": {
+						Name: "dash",
+						Type: "oidc",
+						OIDC: OIDCAuth{
+							Issuer:       "https://idp.example.com",
+							ClientID:     "fabio",
+							Scopes:       []string{"openid", "profile", "email"},
+							CallbackPath: "/oauth2/callback",
+							CookieName:   "fabio_dash",
+							CookieSecret: "0123456789abcdef",
+						},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.upstream.tls",
+			args: []string{"-proxy.upstream.tls", "name=mesh;cs=meshcerts;servername=svc.mesh;tlsmin=tls12", "-proxy.cs", "cs=meshcerts;type=path;cert=foo;clientca=bar"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.UpstreamTLS = map[string]UpstreamTLS{
+					"mesh": {
+						Name: "mesh",
+						CertSource: CertSource{
+							Name:         "meshcerts",
+							Type:         "path",
+							CertPath:     "foo",
+							ClientCAPath: "bar",
+							Refresh:      3 * time.Second,
+						},
+						ServerName:    "svc.mesh",
+						TLSMinVersion: tls.VersionTLS12,
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			desc: "-proxy.tls.policy",
+			args: []string{"-proxy.tls.policy", `name=partners;hosts="Partner.example.com,*.partner.com";tlsmin=tls10;tlsmax=tls12;tlsciphers="0xc02f,0x9f";alpn="http/1.1";clientauth=require;clientcs=partnerca`, "-proxy.cs", "cs=partnerca;type=file;cert=foo;clientca=bar"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.TLSPolicies = map[string]TLSPolicy{
+					"partners": {
+						Name:          "partners",
+						Hosts:         []string{"partner.example.com", "*.partner.com"},
+						TLSMinVersion: tls.VersionTLS10,
+						TLSMaxVersion: tls.VersionTLS12,
+						TLSCiphers:    []uint16{0xc02f, 0x9f},
+						ALPN:          []string{"http/1.1"},
+						ClientAuth:    "require",
+						ClientCA: CertSource{
+							Name:         "partnerca",
+							Type:         "file",
+							CertPath:     "foo",
+							ClientCAPath: "bar",
+						},
+					},
+				}
+				return cfg
+			},
+		},
 		{
 			desc: "-proxy.auth with source basic and no realm specified",
 			args: []string{"-proxy.auth", "name=foo;type=basic;file=/some/file/on/disk"},
@@ -364,6 +602,29 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.strategy", "leastconn"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.Strategy = "leastconn"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.strategy", "ewma"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.Strategy = "ewma"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.strategy", "hash", "-proxy.hash.key", "header:X-User", "-proxy.hash.sticky", "fabio-affinity"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.Strategy = "hash"
+				cfg.Proxy.Hash.Key = "header:X-User"
+				cfg.Proxy.Hash.Sticky = "fabio-affinity"
+				return cfg
+			},
+		},
 		{
 			args: []string{"-proxy.matcher", "prefix"},
 			cfg: func(cfg *Config) *Config {
@@ -385,6 +646,13 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.matcher", "regex"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.Matcher = "regex"
+				return cfg
+			},
+		},
 		{
 			args: []string{"-proxy.noroutestatus", "555"},
 			cfg: func(cfg *Config) *Config {
@@ -392,6 +660,53 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.healthcheck.interval", "3s", "-proxy.healthcheck.timeout", "500ms"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.HealthCheck.Interval = 3 * time.Second
+				cfg.Proxy.HealthCheck.Timeout = 500 * time.Millisecond
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.healthcheck.healthythreshold", "2", "-proxy.healthcheck.unhealthythreshold", "5"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.HealthCheck.HealthyThreshold = 2
+				cfg.Proxy.HealthCheck.UnhealthyThreshold = 5
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.outlier.consecutivefailures", "3", "-proxy.outlier.errorrate", "0.5", "-proxy.outlier.minrequests", "10", "-proxy.outlier.window", "1m", "-proxy.outlier.baseejectiontime", "10s", "-proxy.outlier.maxejectiontime", "1m", "-proxy.outlier.maxejectionpercent", "25"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.Outlier.ConsecutiveFailures = 3
+				cfg.Proxy.Outlier.ErrorRate = 0.5
+				cfg.Proxy.Outlier.MinRequests = 10
+				cfg.Proxy.Outlier.Window = time.Minute
+				cfg.Proxy.Outlier.BaseEjectionTime = 10 * time.Second
+				cfg.Proxy.Outlier.MaxEjectionTime = time.Minute
+				cfg.Proxy.Outlier.MaxEjectionPercent = 25
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.retry.attempts", "3", "-proxy.retry.on", "connect-failure,timeout,5xx,429", "-proxy.retry.methods", "GET,POST"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.Retry.Attempts = 3
+				cfg.Proxy.Retry.On = []string{"connect-failure", "timeout", "5xx", "429"}
+				cfg.Proxy.Retry.Methods = []string{"GET", "POST"}
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.retry.pertrytimeout", "2s", "-proxy.retry.budget", "50", "-proxy.retry.maxbodysize", "1024"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.Retry.PerTryTimeout = 2 * time.Second
+				cfg.Proxy.Retry.Budget = 50
+				cfg.Proxy.Retry.MaxBodySize = 1024
+				return cfg
+			},
+		},
 		{
 			args: []string{"-proxy.shutdownwait", "5ms"},
 			cfg: func(cfg *Config) *Config {
@@ -476,6 +791,26 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-proxy.header.clientcert", "Client-Cert", "-proxy.header.clientcert.chain", "Client-Cert-Chain", "-proxy.header.clientcert.subject", "X-Client-Subject", "-proxy.header.clientcert.uri", "X-Client-URI", "-proxy.header.clientcert.fingerprint", "X-Client-Fingerprint"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.ClientCertHeader = ClientCertHeader{
+					Cert:        "Client-Cert",
+					Chain:       "Client-Cert-Chain",
+					Subject:     "X-Client-Subject",
+					URI:         "X-Client-URI",
+					Fingerprint: "X-Client-Fingerprint",
+				}
+				return cfg
+			},
+		},
+		{
+			args: []string{"-proxy.geoip.db", "/var/lib/GeoLite2-Country.mmdb"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Proxy.GeoIPDB = "/var/lib/GeoLite2-Country.mmdb"
+				return cfg
+			},
+		},
 		{
 			args: []string{"-proxy.header.requestid", "value"},
 			cfg: func(cfg *Config) *Config {
@@ -746,6 +1081,292 @@ func TestLoad(t *testing.T) {
 				return cfg
 			},
 		},
+		{
+			args: []string{"-registry.kubernetes.addr", "https://10.0.0.1:6443"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.Addr = "https://10.0.0.1:6443"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.kubernetes.tokenpath", "/etc/fabio/token"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.TokenPath = "/etc/fabio/token"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.kubernetes.capath", "/etc/fabio/ca.crt"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.CAPath = "/etc/fabio/ca.crt"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.kubernetes.tlsskipverify", "true"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.TLSSkipVerify = true
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.kubernetes.namespace", "web"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.Namespace = "web"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.kubernetes.annotation", "example.com/urlprefix"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.Annotation = "example.com/urlprefix"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.kubernetes.ingressclass", "fabio"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.IngressClass = "fabio"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.kubernetes.configmap", "fabio/routes"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Kubernetes.ConfigMap = "fabio/routes"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.addr", "https://nomad.service:4646"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.Addr = "https://nomad.service:4646"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.token", "abc"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.Token = "abc"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.namespace", "*"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.Namespace = "*"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.tagprefix", "p-"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.TagPrefix = "p-"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.varpath", "lb/routes"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.VarPath = "lb/routes"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.noroutehtmlpath", "lb/noroute"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.NoRouteHTMLPath = "lb/noroute"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.pollinterval", "10s"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.PollInterval = 10 * time.Second
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.tls.cafile", "/etc/nomad/ca.pem"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.TLS.CAFile = "/etc/nomad/ca.pem"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.nomad.tls.insecureskipverify", "true"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Nomad.TLS.InsecureSkipVerify = true
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.endpoints", "10.0.0.1:2379,10.0.0.2:2379"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.Endpoints = []string{"10.0.0.1:2379", "10.0.0.2:2379"}
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.username", "fabio"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.Username = "fabio"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.password", "secret"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.Password = "secret"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.servicepath", "/services"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.ServicePath = "/services"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.kvpath", "/fabio/routes"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.KVPath = "/fabio/routes"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.noroutehtmlpath", "/fabio/html"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.NoRouteHTMLPath = "/fabio/html"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.tagprefix", "p-"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.TagPrefix = "p-"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.register.enabled=false"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.Register = false
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.register.addr", "1.2.3.4:5555"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.ServiceAddr = "1.2.3.4:5555"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.register.name", "fab"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.ServiceName = "fab"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.register.tags", "a, b"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.ServiceTags = []string{"a", "b"}
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.register.ttl", "30s"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.RegisterTTL = 30 * time.Second
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.tls.cafile", "/etc/etcd/ca.pem"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.TLS.CAFile = "/etc/etcd/ca.pem"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.etcd.tls.insecureskipverify", "true"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Etcd.TLS.InsecureSkipVerify = true
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.dns.records", "_web._tcp.example.com urlprefix-/web strip=/web, _api._tcp.example.com"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.DNS.Records = []string{"_web._tcp.example.com urlprefix-/web strip=/web", "_api._tcp.example.com"}
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.dns.resolver", "10.0.0.53:53"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.DNS.Resolver = "10.0.0.53:53"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.dns.tagprefix", "p-"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.DNS.TagPrefix = "p-"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.dns.minttl", "30s"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.DNS.MinTTL = 30 * time.Second
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.dns.timeout", "2s"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.DNS.Timeout = 2 * time.Second
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.composite.backends", "consul, file"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Composite.Backends = []string{"consul", "file"}
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.composite.manual", "file"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Composite.Manual = "file"
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.composite.timeout", "30s"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Composite.Timeout = 30 * time.Second
+				return cfg
+			},
+		},
+		{
+			args: []string{"-registry.composite.staletimeout", "consul=15m, custom=1m"},
+			cfg: func(cfg *Config) *Config {
+				cfg.Registry.Composite.StaleTimeout = map[string]time.Duration{"consul": 15 * time.Minute, "custom": time.Minute}
+				return cfg
+			},
+		},
+		{
+			desc: "-registry.composite.staletimeout with invalid duration",
+			args: []string{"-registry.composite.staletimeout", "consul=soon"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`invalid registry.composite.staletimeout: time: invalid duration "soon"`),
+		},
 		{
 			args: []string{"-registry.consul.pollinterval", "5s"},
 			cfg: func(cfg *Config) *Config {
@@ -913,6 +1534,7 @@ func TestLoad(t *testing.T) {
 				cfg.UI.Listen.Addr = "1.2.3.4:5555"
 				cfg.UI.Listen.Proto = "http"
 				cfg.Registry.Consul.ServiceAddr = "1.2.3.4:5555"
+				cfg.Registry.Etcd.ServiceAddr = "1.2.3.4:5555"
 				return cfg
 			},
 		},
@@ -926,6 +1548,7 @@ func TestLoad(t *testing.T) {
 				cfg.UI.Listen.CertSource.CertPath = "value"
 				cfg.Registry.Consul.CheckScheme = "https"
 				cfg.Registry.Consul.ServiceAddr = ":9998"
+				cfg.Registry.Etcd.ServiceAddr = ":9998"
 				return cfg
 			},
 		},
@@ -1058,6 +1681,24 @@ func TestLoad(t *testing.T) {
 			cfg:  func(cfg *Config) *Config { return nil },
 			err:  errors.New("unknown certificate source \"foo\""),
 		},
+		{
+			desc: "-proxy.cs with acme cert source requires storage",
+			args: []string{"-proxy.cs", "cs=name;type=acme;cert=https://acme/dir"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'storage' in map[cert:https://acme/dir cs:name type:acme]"),
+		},
+		{
+			desc: "-proxy.cs with invalid issue.ratelimit",
+			args: []string{"-proxy.cs", "cs=name;type=vault-pki;cert=pki/issue/value;issue.ratelimit=10/d"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`invalid issue.ratelimit: unit "d" is not s, m or h`),
+		},
+		{
+			desc: "-proxy.cs with issue.burst requires issue.ratelimit",
+			args: []string{"-proxy.cs", "cs=name;type=vault-pki;cert=pki/issue/value;issue.burst=5"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("issue.burst requires issue.ratelimit in map[cert:pki/issue/value cs:name issue.burst:5 type:vault-pki]"),
+		},
 		{
 			desc: "-proxy.addr with unknown proto 'foo'",
 			args: []string{"-proxy.addr", ":5555;proto=foo"},
@@ -1100,6 +1741,84 @@ func TestLoad(t *testing.T) {
 			cfg:  func(cfg *Config) *Config { return nil },
 			err:  errors.New("proxy.noroutestatus must be between 100 and 999"),
 		},
+		{
+			desc: "-proxy.healthcheck.interval must be positive",
+			args: []string{"-proxy.healthcheck.interval", "0s"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.healthcheck.interval must be > 0"),
+		},
+		{
+			desc: "-proxy.healthcheck.timeout must be positive",
+			args: []string{"-proxy.healthcheck.timeout", "0s"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.healthcheck.timeout must be > 0"),
+		},
+		{
+			desc: "-proxy.healthcheck.unhealthythreshold too small",
+			args: []string{"-proxy.healthcheck.unhealthythreshold", "0"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.healthcheck thresholds must be >= 1"),
+		},
+		{
+			desc: "-proxy.outlier.errorrate too large",
+			args: []string{"-proxy.outlier.errorrate", "1.5"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.outlier.errorrate must be between 0 and 1"),
+		},
+		{
+			desc: "-proxy.outlier.minrequests too small",
+			args: []string{"-proxy.outlier.minrequests", "0"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.outlier.minrequests must be >= 1"),
+		},
+		{
+			desc: "-proxy.outlier.window too small",
+			args: []string{"-proxy.outlier.window", "0s"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.outlier.window must be > 0"),
+		},
+		{
+			desc: "-proxy.outlier.maxejectiontime smaller than base",
+			args: []string{"-proxy.outlier.baseejectiontime", "1m", "-proxy.outlier.maxejectiontime", "10s"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.outlier.maxejectiontime must be >= proxy.outlier.baseejectiontime > 0"),
+		},
+		{
+			desc: "-proxy.outlier.maxejectionpercent too large",
+			args: []string{"-proxy.outlier.maxejectionpercent", "101"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.outlier.maxejectionpercent must be between 0 and 100"),
+		},
+		{
+			desc: "-proxy.hash.key with invalid source",
+			args: []string{"-proxy.hash.key", "body:foo"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("invalid proxy.hash.key: body:foo"),
+		},
+		{
+			desc: "-proxy.hash.sticky without hash strategy",
+			args: []string{"-proxy.hash.sticky", "affinity"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.hash.sticky requires proxy.strategy=hash"),
+		},
+		{
+			desc: "-proxy.retry.attempts too small",
+			args: []string{"-proxy.retry.attempts", "0"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.retry.attempts must be >= 1"),
+		},
+		{
+			desc: "-proxy.retry.on with invalid condition",
+			args: []string{"-proxy.retry.on", "connect-failure,4xx"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("invalid proxy.retry.on: 4xx"),
+		},
+		{
+			desc: "-proxy.retry.budget too large",
+			args: []string{"-proxy.retry.budget", "101"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("proxy.retry.budget must be between 0 and 100"),
+		},
 		{
 			desc: "-proxy.auth with unknown auth type 'foo'",
 			args: []string{"-proxy.auth", "name=myauth;type=foo"},
@@ -1112,6 +1831,84 @@ func TestLoad(t *testing.T) {
 			cfg:  func(cfg *Config) *Config { return nil },
 			err:  errors.New("missing 'name' in auth"),
 		},
+		{
+			desc: "-proxy.auth jwt with missing keys",
+			args: []string{"-proxy.auth", "name=api;type=jwt;issuer=https://idp.example.com"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'jwks', 'key' or 'secret' in auth 'api'"),
+		},
+		{
+			desc: "-proxy.auth jwt with invalid claims",
+			args: []string{"-proxy.auth", "name=api;type=jwt;secret=abc;claims=scope"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`invalid 'claims' in auth 'api': "scope" is not a key=value pair`),
+		},
+		{
+			desc: "-proxy.auth forward with missing url",
+			args: []string{"-proxy.auth", "name=sso;type=forward"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'url' in auth 'sso'"),
+		},
+		{
+			desc: "-proxy.auth forward with invalid failopen",
+			args: []string{"-proxy.auth", "name=sso;type=forward;url=http://auth.local/;failopen=maybe"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`invalid 'failopen' in auth 'sso': strconv.ParseBool: parsing "maybe": invalid syntax`),
+		},
+		{
+			desc: "-proxy.auth oidc with missing client id",
+			args: []string{"-proxy.auth", "name=dash;type=oidc;issuer=https://idp.example.com;cookiesecret=0123456789abcdef"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'issuer' or 'clientid' in auth 'dash'"),
+		},
+		{
+			desc: "-proxy.auth oidc with short cookie secret",
+			args: []string{"-proxy.auth", "name=dash;type=oidc;issuer=https://idp.example.com;clientid=fabio;cookiesecret=abc"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("'cookiesecret' in auth 'dash' must have at least 16 characters"),
+		},
+		{
+			desc: "-proxy.auth cert with missing patterns",
+			args: []string{"-proxy.auth", "name=mesh;type=cert"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'cn', 'uri' or 'subject' in auth 'mesh'"),
+		},
+		{
+			desc: "-proxy.tls.policy with invalid clientauth",
+			args: []string{"-proxy.tls.policy", "name=strict;clientauth=always"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`invalid clientauth "always"`),
+		},
+		{
+			desc: "-proxy.tls.policy with missing clientcs",
+			args: []string{"-proxy.tls.policy", "name=strict;clientauth=require"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'clientcs' in TLS policy 'strict'"),
+		},
+		{
+			desc: "-proxy.tls.policy with missing name",
+			args: []string{"-proxy.tls.policy", "tlsmin=tls13"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'name' in TLS policy"),
+		},
+		{
+			desc: "-proxy.upstream.tls with unknown cert source",
+			args: []string{"-proxy.upstream.tls", "name=mesh;cs=foo"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New(`unknown certificate source "foo"`),
+		},
+		{
+			desc: "-proxy.upstream.tls with missing name",
+			args: []string{"-proxy.upstream.tls", "cs=foo", "-proxy.cs", "cs=foo;type=path;cert=foo"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'name' in upstream TLS profile"),
+		},
+		{
+			desc: "-proxy.upstream.tls with missing cert source",
+			args: []string{"-proxy.upstream.tls", "name=mesh;servername=svc.mesh"},
+			cfg:  func(cfg *Config) *Config { return nil },
+			err:  errors.New("missing 'cs' in upstream TLS profile 'mesh'"),
+		},
 		{
 			desc: "-proxy.auth basic with missing file",
 			args: []string{"-proxy.auth", "name=foo;type=basic;realm=realm"},
@@ -1205,3 +2002,36 @@ func TestLoad(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in    string
+		rate  float64
+		burst int
+		err   string
+	}{
+		{"100/s", 100, 100, ""},
+		{"60/m", 1, 60, ""},
+		{"1.5/h", 1.5 / 3600, 2, ""},
+		{"100", 0, 0, `"100" is not <n>/<unit>`},
+		{"x/s", 0, 0, `"x/s" is not <n>/<unit>`},
+		{"0/s", 0, 0, `"0/s" is not <n>/<unit>`},
+		{"10/d", 0, 0, `unit "d" is not s, m or h`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			rate, burst, err := ParseRate(tt.in)
+			var errstr string
+			if err != nil {
+				errstr = err.Error()
+			}
+			if got, want := errstr, tt.err; got != want {
+				t.Fatalf("got error %q want %q", got, want)
+			}
+			if rate != tt.rate || burst != tt.burst {
+				t.Fatalf("got %g, %d want %g, %d", rate, burst, tt.rate, tt.burst)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+// Package health implements active health checks for the targets in
+// the routing table.
+//
+// Targets are checked when their route has the 'healthcheck' option.
+// Targets which fail the configured number of consecutive checks are
+// marked unhealthy and no longer receive traffic until they pass the
+// check again. See route.HealthCheck for the supported check types.
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Checker runs the active health checks for the targets of the
+// current routing table.
+type Checker struct {
+	cfg config.HealthCheck
+
+	// table returns the routing table which is checked.
+	table func() route.Table
+
+	mu     sync.Mutex
+	probes map[string]*probe
+}
+
+// NewChecker creates a health checker which uses the given
+// configuration for checks which do not override the defaults.
+func NewChecker(cfg config.HealthCheck) *Checker {
+	return &Checker{
+		cfg:    cfg,
+		table:  route.GetTable,
+		probes: map[string]*probe{},
+	}
+}
+
+// Watch synchronizes the running health checks with the routing
+// table every refresh interval. It does not return.
+func (c *Checker) Watch(refresh time.Duration) {
+	for {
+		c.sync()
+		time.Sleep(refresh)
+	}
+}
+
+// sync starts checks for new targets in the routing table and stops
+// the checks for targets which are no longer in the table.
+func (c *Checker) sync() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	active := map[string]bool{}
+	for _, routes := range c.table() {
+		for _, r := range routes {
+			for _, t := range r.Targets {
+				key := t.HealthKey()
+				if key == "" {
+					continue
+				}
+				active[key] = true
+				if c.probes[key] != nil {
+					continue
+				}
+				p := c.newProbe(key, t)
+				c.probes[key] = p
+				log.Printf("[INFO] health: Starting %s check for %s every %s", p.typ, p.addr, p.interval)
+				go c.run(p)
+			}
+		}
+	}
+
+	for key, p := range c.probes {
+		if active[key] {
+			continue
+		}
+		log.Printf("[INFO] health: Stopping %s check for %s", p.typ, p.addr)
+		close(p.stop)
+		delete(c.probes, key)
+	}
+}
+
+// run executes the checks for a single probe until it is stopped.
+func (c *Checker) run(p *probe) {
+	defer p.close()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	healthy := true
+	var passed, failed int
+	var msg string
+	for {
+		err := p.check()
+		if err == nil {
+			passed, failed = passed+1, 0
+		} else {
+			passed, failed = 0, failed+1
+			log.Printf("[DEBUG] health: %s check for %s failed. %s", p.typ, p.addr, err)
+		}
+
+		switch {
+		case !healthy && passed >= c.cfg.HealthyThreshold:
+			healthy, msg = true, ""
+			log.Printf("[INFO] health: %s is healthy", p.addr)
+
+		case healthy && failed >= c.cfg.UnhealthyThreshold:
+			healthy, msg = false, err.Error()
+			log.Printf("[WARN] health: %s is unhealthy. %s", p.addr, err)
+		}
+
+		// The result is recorded after every check since the state
+		// is created again when the target is removed from the
+		// routing table and added back before the check is stopped.
+		route.SetHealth(p.key, healthy, msg)
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe checks a single upstream address.
+type probe struct {
+	key      string
+	typ      string
+	addr     string
+	interval time.Duration
+	check    func() error
+	close    func()
+	stop     chan struct{}
+}
+
+func (c *Checker) newProbe(key string, t *route.Target) *probe {
+	hc := t.HealthCheck
+	p := &probe{
+		key:      key,
+		typ:      hc.Type,
+		addr:     t.URL.Host,
+		interval: hc.Interval,
+		close:    func() {},
+		stop:     make(chan struct{}),
+	}
+	if p.interval <= 0 {
+		p.interval = c.cfg.Interval
+	}
+	timeout := hc.Timeout
+	if timeout <= 0 {
+		timeout = c.cfg.Timeout
+	}
+
+	switch hc.Type {
+	case "http":
+		p.check, p.close = httpCheck(t, timeout)
+	case "grpc":
+		p.check, p.close = grpcCheck(t, timeout)
+	default:
+		p.check = tcpCheck(t.URL.Host, timeout)
+	}
+	return p
+}
+
+// httpCheck returns a check which is successful if a GET request to
+// the health check path returns a 2xx or 3xx status code.
+func httpCheck(t *route.Target, timeout time.Duration) (check func() error, close func()) {
+	scheme := t.URL.Scheme
+	if scheme != "https" {
+		scheme = "http"
+	}
+	url := scheme + "://" + t.URL.Host + t.HealthCheck.Path
+
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: t.TLSSkipVerify},
+	}
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	check = func() error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		if t.Host != "" && t.Host != "dst" {
+			req.Host = t.Host
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 399 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}
+	return check, tr.CloseIdleConnections
+}
+
+// tcpCheck returns a check which is successful if a TCP connection
+// to addr can be established.
+func tcpCheck(addr string, timeout time.Duration) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+var errNotServing = errors.New("service is not serving")
+
+// grpcCheck returns a check which uses the gRPC health checking
+// protocol. The health check path is the name of the service.
+func grpcCheck(t *route.Target, timeout time.Duration) (check func() error, close func()) {
+	creds := insecure.NewCredentials()
+	if t.URL.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{
+			InsecureSkipVerify: t.TLSSkipVerify,
+			ServerName:         t.Opts["grpcservername"],
+		})
+	}
+
+	conn, err := grpc.NewClient(t.URL.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return func() error { return err }, func() {}
+	}
+	client := healthpb.NewHealthClient(conn)
+
+	check = func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: t.HealthCheck.Path})
+		if err != nil {
+			return err
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			return errNotServing
+		}
+		return nil
+	}
+	return check, func() { conn.Close() }
+}
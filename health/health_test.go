@@ -0,0 +1,105 @@
+package health
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+)
+
+func TestHTTPCheck(t *testing.T) {
+	var status int32 = 200
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	tg := &route.Target{URL: u, HealthCheck: &route.HealthCheck{Type: "http", Path: "/health"}}
+	check, closeFn := httpCheck(tg, time.Second)
+	defer closeFn()
+
+	if err := check(); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+	atomic.StoreInt32(&status, 301)
+	if err := check(); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+	atomic.StoreInt32(&status, 503)
+	if err := check(); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
+
+func TestTCPCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	check := tcpCheck(addr, time.Second)
+	if err := check(); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+	l.Close()
+	if err := check(); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
+
+func TestChecker(t *testing.T) {
+	var healthy int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(500)
+		}
+	}))
+	defer srv.Close()
+
+	tbl, err := route.NewTable(bytes.NewBufferString("route add svc / " + srv.URL + ` opts "healthcheck=/ healthcheck.interval=10ms"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := tbl[""][0].Targets[0]
+
+	c := NewChecker(config.HealthCheck{Interval: time.Second, Timeout: time.Second, HealthyThreshold: 1, UnhealthyThreshold: 2})
+	c.table = func() route.Table { return tbl }
+	c.sync()
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for tg.HealthStatus() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %q want %q", tg.HealthStatus(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor("healthy")
+	atomic.StoreInt32(&healthy, 0)
+	waitFor("unhealthy")
+	atomic.StoreInt32(&healthy, 1)
+	waitFor("healthy")
+
+	// removing the route stops the check
+	c.table = func() route.Table { return route.Table{} }
+	c.sync()
+	if got, want := len(c.probes), 0; got != want {
+		t.Fatalf("got %d probes want %d", got, want)
+	}
+}
@@ -12,6 +12,7 @@
 //	$request                 - request <method> <uri> <proto>
 //	$request_args            - request query parameters
 //	$request_host            - request host header (aka server name)
+//	$request_id              - request id (see proxy.header.requestid)
 //	$request_method          - request method
 //	$request_scheme          - request scheme
 //	$request_uri             - request URI
@@ -85,6 +86,18 @@ type Event struct {
 	// UpstreamURL is the URL which was sent to the upstream server.
 	// It should only be set for HTTP log events.
 	UpstreamURL *url.URL
+
+	// UpstreamRetries is the number of times the request was retried
+	// on a different upstream server.
+	UpstreamRetries int
+
+	// RequestID is the unique id of the request which is set in the
+	// header configured with proxy.header.requestid.
+	RequestID string
+
+	// DenyReason is the access rule which denied the request. It is
+	// empty if the request was not denied.
+	DenyReason string
 }
 
 // Logger logs an event.
@@ -109,6 +122,35 @@ func New(w io.Writer, format string) (Logger, error) {
 	return &logger{p: p, w: w}, nil
 }
 
+// Template expands the fields of the log format in a string, e.g. for
+// header values. Unlike the log output it has no trailing newline.
+type Template struct {
+	p pattern
+}
+
+// NewTemplate parses the format string into a template. Text without
+// fields is returned verbatim. If the format contains an unknown field
+// an error is returned.
+func NewTemplate(format string) (*Template, error) {
+	p, err := parse(format, fields)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{p: p}, nil
+}
+
+// Execute returns the expanded template for the event.
+func (t *Template) Execute(e *Event) string {
+	b := pool.Get().(*bytes.Buffer)
+	b.Reset()
+	for _, fn := range t.p {
+		fn(b, e)
+	}
+	s := b.String()
+	pool.Put(b)
+	return s
+}
+
 type noopLogger struct{}
 
 func (l *noopLogger) Log(*Event) {}
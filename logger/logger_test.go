@@ -83,12 +83,16 @@ func TestLog(t *testing.T) {
 		UpstreamAddr:    uurl.Host,
 		UpstreamService: "svc-a",
 		UpstreamURL:     uurl,
+		UpstreamRetries: 2,
+		RequestID:       "abc-123",
+		DenyReason:      "deny=ip:1.2.3.0/24",
 	}
 
 	tests := []struct {
 		format string
 		out    string
 	}{
+		{"$deny_reason", "deny=ip:1.2.3.0/24\n"},
 		{"$header.Referer", "http://foo.com/\n"},
 		{"$header.X-Forwarded-For", "3.3.3.3\n"},
 		{"$header.user-agent", "Mozilla Firefox\n"},
@@ -98,6 +102,7 @@ func TestLog(t *testing.T) {
 		{"$request", "GET /?q=x HTTP/1.1\n"},
 		{"$request_args", "q=x\n"},
 		{"$request_host", "foo.com\n"}, // TODO(fs): is this correct?
+		{"$request_id", "abc-123\n"},
 		{"$request_method", "GET\n"},
 		{"$request_proto", "HTTP/1.1\n"},
 		{"$request_scheme", "http\n"},
@@ -122,6 +127,7 @@ func TestLog(t *testing.T) {
 		{"$upstream_request_scheme", "http\n"},
 		{"$upstream_request_uri", "/foo?q=x\n"},
 		{"$upstream_request_url", "http://7.8.9.0:5678/foo?q=x\n"},
+		{"$upstream_retries", "2\n"},
 		{"$upstream_service", "svc-a\n"},
 	}
 
@@ -142,6 +148,41 @@ func TestLog(t *testing.T) {
 	}
 }
 
+func TestTemplate(t *testing.T) {
+	e := &Event{
+		Request:         &http.Request{RemoteAddr: "2.2.2.2:666", Header: http.Header{"X-User": {"joe"}}},
+		UpstreamService: "svc-a",
+		RequestID:       "abc-123",
+	}
+
+	tests := []struct {
+		format string
+		out    string
+		err    bool
+	}{
+		{"prod", "prod", false},
+		{"$remote_host", "2.2.2.2", false},
+		{"id=$request_id;svc=$upstream_service", "id=abc-123;svc=svc-a", false},
+		{"user:$header.X-User", "user:joe", false},
+		{"$unknown", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			tmpl, err := NewTemplate(tt.format)
+			if got, want := err != nil, tt.err; got != want {
+				t.Fatalf("got error %v want %v", err, want)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := tmpl.Execute(e), tt.out; got != want {
+				t.Errorf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
 func TestAtoi(t *testing.T) {
 	tests := []struct {
 		i   int64
@@ -83,6 +83,9 @@ var fields = map[string]field{
 		}
 		b.WriteString(e.Request.Host)
 	},
+	"$request_id": func(b *bytes.Buffer, e *Event) {
+		b.WriteString(e.RequestID)
+	},
 	"$request_method": func(b *bytes.Buffer, e *Event) {
 		if e.Request == nil {
 			return
@@ -259,6 +262,12 @@ var fields = map[string]field{
 	"$upstream_service": func(b *bytes.Buffer, e *Event) {
 		b.WriteString(e.UpstreamService)
 	},
+	"$upstream_retries": func(b *bytes.Buffer, e *Event) {
+		atoi(b, int64(e.UpstreamRetries), 0)
+	},
+	"$deny_reason": func(b *bytes.Buffer, e *Event) {
+		b.WriteString(e.DenyReason)
+	},
 }
 
 var shortMonthNames = []string{
@@ -26,15 +26,21 @@ import (
 	"github.com/fabiolb/fabio/cert"
 	"github.com/fabiolb/fabio/config"
 	"github.com/fabiolb/fabio/exit"
+	"github.com/fabiolb/fabio/health"
 	"github.com/fabiolb/fabio/logger"
 	"github.com/fabiolb/fabio/metrics"
 	"github.com/fabiolb/fabio/noroute"
 	"github.com/fabiolb/fabio/proxy"
 	"github.com/fabiolb/fabio/proxy/tcp"
 	"github.com/fabiolb/fabio/registry"
+	"github.com/fabiolb/fabio/registry/composite"
 	"github.com/fabiolb/fabio/registry/consul"
 	"github.com/fabiolb/fabio/registry/custom"
+	"github.com/fabiolb/fabio/registry/dns"
+	"github.com/fabiolb/fabio/registry/etcd"
 	"github.com/fabiolb/fabio/registry/file"
+	"github.com/fabiolb/fabio/registry/kubernetes"
+	"github.com/fabiolb/fabio/registry/nomad"
 	"github.com/fabiolb/fabio/registry/static"
 	"github.com/fabiolb/fabio/route"
 	"github.com/fabiolb/fabio/trace"
@@ -137,7 +143,15 @@ func main() {
 		exit.Fatal("[FATAL] ", err)
 	}
 	route.SetMetricsProvider(metrics)
+	cert.SetMetricsProvider(metrics)
+	route.SetOutlierConfig(cfg.Proxy.Outlier)
+	route.SetHashConfig(cfg.Proxy.Hash)
+	route.SetMatcher(cfg.Proxy.Matcher)
+	if err := route.SetGeoIPDatabase(cfg.Proxy.GeoIPDB); err != nil {
+		exit.Fatal("[FATAL] ", err)
+	}
 	initRuntime(cfg)
+	initTLS(cfg)
 	initBackend(cfg)
 
 	// init OpenTracing, if enabled
@@ -152,6 +166,9 @@ func main() {
 	log.Print("[INFO] Waiting for first routing table")
 	<-first
 
+	// start the active health checks for the targets
+	go health.NewChecker(cfg.Proxy.HealthCheck).Watch(time.Second)
+
 	// create proxies after metrics since they use the metrics registry.
 	startServers(cfg, metrics)
 
@@ -246,10 +263,10 @@ func newHTTPProxy(cfg *config.Config, statsHandler *proxy.HttpStatsHandler) *pro
 	}
 }
 
-func lookupHostFn(cfg *config.Config, notFound gkm.Counter) func(string) *route.Target {
+func lookupHostFn(cfg *config.Config, notFound gkm.Counter) func(string, string) *route.Target {
 	pick := route.Picker[cfg.Proxy.Strategy]
-	return func(host string) *route.Target {
-		t := route.GetTable().LookupHost(host, pick)
+	return func(host, remoteAddr string) *route.Target {
+		t := route.GetTable().LookupHostFrom(host, remoteAddr, pick)
 		if t == nil {
 			notFound.Add(1)
 			log.Print("[WARN] No route for ", host)
@@ -288,10 +305,11 @@ func makeTLSConfig(l config.Listen) (*tls.Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create cert source %s. %s", l.CertSource.Name, err)
 	}
-	tlscfg, err := cert.TLSConfig(src, l.StrictMatch, l.TLSMinVersion, l.TLSMaxVersion, l.TLSCiphers)
+	tlscfg, stop, err := cert.TLSConfig(l.CertSource.Name, src, l.StrictMatch, l.TLSMinVersion, l.TLSMaxVersion, l.TLSCiphers)
 	if err != nil {
 		return nil, fmt.Errorf("[FATAL] Failed to create TLS config for cert source %s. %s", l.CertSource.Name, err)
 	}
+	exit.Listen(func(os.Signal) { stop() })
 	return tlscfg, nil
 }
 
@@ -350,6 +368,7 @@ func startServers(cfg *config.Config, stats metrics.Provider) {
 			WSConn:          stats.NewGauge("ws.conn"),
 			StatusTimer:     stats.NewHistogram("http.status", "code"),
 			RedirectCounter: stats.NewCounter("http.redirect.count", "code"),
+			Retries:         stats.NewCounter("http.retries"),
 		}
 	}
 
@@ -388,7 +407,8 @@ func startServers(cfg *config.Config, stats metrics.Provider) {
 				h := newHTTPProxy(cfg, httpStatsHandler)
 				// reset the ws.conn gauge
 				h.Stats.WSConn.Set(0)
-				if err := proxy.ListenAndServeHTTP(l, h, tlscfg); err != nil {
+				// answer the HTTP-01 challenges of the acme cert sources
+				if err := proxy.ListenAndServeHTTP(l, cert.HTTPChallengeHandler(h), tlscfg); err != nil {
 					exit.Fatal("[FATAL] ", err)
 				}
 			}()
@@ -536,22 +556,28 @@ func initRuntime(cfg *config.Config) {
 	}
 }
 
+func initTLS(cfg *config.Config) {
+	if err := cert.SetTLSPolicies(cfg.Proxy.TLSPolicies); err != nil {
+		exit.Fatal("[FATAL] ", err)
+	}
+
+	profiles := map[string]*tls.Config{}
+	for name, p := range cfg.Proxy.UpstreamTLS {
+		tlscfg, stop, err := cert.UpstreamTLSConfig(p)
+		if err != nil {
+			exit.Fatalf("[FATAL] Failed to create upstream TLS profile %q: %s", name, err)
+		}
+		exit.Listen(func(os.Signal) { stop() })
+		profiles[name] = tlscfg
+	}
+	transport.SetTLSProfiles(profiles)
+}
+
 func initBackend(cfg *config.Config) {
 	var deadline = time.Now().Add(cfg.Registry.Timeout)
 	var err error
 	for {
-		switch cfg.Registry.Backend {
-		case "file":
-			registry.Default, err = file.NewBackend(&cfg.Registry.File)
-		case "static":
-			registry.Default, err = static.NewBackend(&cfg.Registry.Static)
-		case "consul":
-			registry.Default, err = consul.NewBackend(&cfg.Registry.Consul)
-		case "custom":
-			registry.Default, err = custom.NewBackend(&cfg.Registry.Custom)
-		default:
-			exit.Fatal("[FATAL] Unknown registry backend ", cfg.Registry.Backend)
-		}
+		registry.Default, err = newBackend(cfg, cfg.Registry.Backend, false)
 
 		if err == nil {
 			if err = registry.Default.Register(nil); err == nil {
@@ -571,6 +597,42 @@ func initBackend(cfg *config.Config) {
 	}
 }
 
+// newBackend creates the registry backend with the name. The backends
+// of the composite backend are created with composed set to true.
+func newBackend(cfg *config.Config, name string, composed bool) (registry.Backend, error) {
+	switch name {
+	case "file":
+		return file.NewBackend(&cfg.Registry.File)
+	case "static":
+		return static.NewBackend(&cfg.Registry.Static)
+	case "consul":
+		return consul.NewBackend(&cfg.Registry.Consul)
+	case "custom":
+		// the custom backend replaces the routing table unless its
+		// routes are merged with the routes of other backends
+		if composed {
+			return custom.NewRouteCmdBackend(&cfg.Registry.Custom)
+		}
+		return custom.NewBackend(&cfg.Registry.Custom)
+	case "kubernetes":
+		return kubernetes.NewBackend(&cfg.Registry.Kubernetes)
+	case "nomad":
+		return nomad.NewBackend(&cfg.Registry.Nomad)
+	case "etcd":
+		return etcd.NewBackend(&cfg.Registry.Etcd)
+	case "dns":
+		return dns.NewBackend(&cfg.Registry.DNS)
+	case "composite":
+		if !composed {
+			return composite.NewBackend(&cfg.Registry.Composite, func(name string) (registry.Backend, error) {
+				return newBackend(cfg, name, true)
+			})
+		}
+	}
+	exit.Fatal("[FATAL] Unknown registry backend ", name)
+	return nil, nil
+}
+
 func watchBackend(cfg *config.Config, p metrics.Provider, first chan bool) {
 	var (
 		nextTable   string
@@ -20,6 +20,24 @@ type Provider interface {
 	NewHistogram(name string, labels ...string) gkm.Histogram
 }
 
+// Deleter is implemented by gauges which can remove the value for a
+// set of label values, e.g. when the labelled object no longer exists.
+// Gauges of providers which do not keep the values just stop being
+// updated.
+type Deleter interface {
+	// Delete removes the value for the label values which are given
+	// as key/value pairs as for With.
+	Delete(labelValues ...string)
+}
+
+// Delete removes the value of the gauge for the label values if the
+// gauge supports it.
+func Delete(g gkm.Gauge, labelValues ...string) {
+	if d, ok := g.(Deleter); ok {
+		d.Delete(labelValues...)
+	}
+}
+
 func Initialize(cfg *config.Metrics) (Provider, error) {
 	var p []Provider
 	var prefix string
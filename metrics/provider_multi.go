@@ -83,6 +83,14 @@ func (m *MultiGauge) Add(val float64) {
 	}
 }
 
+// Delete removes the value for the label values from all gauges which
+// support it.
+func (m *MultiGauge) Delete(labelValues ...string) {
+	for _, v := range m.v {
+		Delete(v, labelValues...)
+	}
+}
+
 type MultiHistogram struct {
 	h []gkm.Histogram
 }
@@ -34,7 +34,9 @@ func (p *PromProvider) NewCounter(name string, labels ...string) gkm.Counter {
 func (p *PromProvider) NewGauge(name string, labels ...string) gkm.Gauge {
 	gopts := promclient.GaugeOpts(p.Opts)
 	gopts.Name = clean(name)
-	return prommetrics.NewGaugeFrom(gopts, labels)
+	gv := promclient.NewGaugeVec(gopts, labels)
+	promclient.MustRegister(gv)
+	return &promGauge{Gauge: prommetrics.NewGauge(gv), gv: gv}
 }
 
 func (p *PromProvider) NewHistogram(name string, labels ...string) gkm.Histogram {
@@ -48,3 +50,17 @@ func (p *PromProvider) NewHistogram(name string, labels ...string) gkm.Histogram
 	}
 	return prommetrics.NewHistogramFrom(hopts, labels)
 }
+
+// promGauge is a prometheus gauge whose values can be deleted.
+type promGauge struct {
+	*prommetrics.Gauge
+	gv *promclient.GaugeVec
+}
+
+func (g *promGauge) Delete(labelValues ...string) {
+	labels := promclient.Labels{}
+	for i := 0; i+1 < len(labelValues); i += 2 {
+		labels[labelValues[i]] = labelValues[i+1]
+	}
+	g.gv.Delete(labels)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	gkm "github.com/go-kit/kit/metrics"
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// promNames returns the values of the name label of the series of the
+// prometheus metric.
+func promNames(t *testing.T, metric string) []string {
+	t.Helper()
+	mfs, err := promclient.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, mf := range mfs {
+		if mf.GetName() != metric {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "name" {
+					names = append(names, l.GetValue())
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestPromGaugeDelete(t *testing.T) {
+	tests := []struct {
+		desc   string
+		metric string
+		gauge  gkm.Gauge
+	}{
+		{
+			desc:   "prometheus",
+			metric: "test_prom_cert_expiry",
+			gauge:  NewPromProvider("test", "prom", nil).NewGauge("cert.expiry", "source", "name"),
+		},
+		{
+			desc:   "multi",
+			metric: "test_multi_cert_expiry",
+			gauge:  NewMultiProvider([]Provider{NewPromProvider("test", "multi", nil), DiscardProvider{}}).NewGauge("cert.expiry", "source", "name"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tt.gauge.With("source", "cs", "name", "a").Set(1)
+			tt.gauge.With("source", "cs", "name", "b").Set(2)
+			Delete(tt.gauge, "source", "cs", "name", "a")
+			if got, want := promNames(t, tt.metric), []string{"b"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+}
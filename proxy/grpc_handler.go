@@ -8,11 +8,14 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/logger"
 	"github.com/fabiolb/fabio/route"
+	"github.com/fabiolb/fabio/transport"
 
 	gkm "github.com/go-kit/kit/metrics"
 	grpc_proxy "github.com/mwitkow/grpc-proxy/proxy"
@@ -22,6 +25,7 @@ import (
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
 )
@@ -108,6 +112,17 @@ func (g GrpcProxyInterceptor) Stream(srv interface{}, stream grpc.ServerStream,
 		return status.Error(codes.NotFound, "no route found")
 	}
 
+	if ctx, err = applyGRPCHeaders(ctx, stream, target, info.FullMethod); err != nil {
+		log.Println("[ERROR] grpc: error setting header metadata", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	done, err := target.Admit(ctx)
+	if err != nil {
+		log.Printf("[DEBUG] grpc: rejecting %s on %s. %s", info.FullMethod, target.URL, err)
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
 	ctx = context.WithValue(ctx, targetKey{}, target)
 
 	proxyStream := proxyStream{
@@ -118,6 +133,7 @@ func (g GrpcProxyInterceptor) Stream(srv interface{}, stream grpc.ServerStream,
 	start := time.Now()
 
 	err = handler(srv, proxyStream)
+	done(grpcFailed(err))
 
 	end := time.Now()
 	dur := end.Sub(start)
@@ -127,6 +143,76 @@ func (g GrpcProxyInterceptor) Stream(srv interface{}, stream grpc.ServerStream,
 	return err
 }
 
+// grpcFailed returns true if the error of a proxied call indicates a
+// failure of the upstream server for the circuit breaker.
+func grpcFailed(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// applyGRPCHeaders applies the header options of the target to the
+// incoming metadata which is forwarded to the upstream server and sets
+// the header metadata of the response. Since the response metadata of
+// the upstream server is merged later it can only be added to.
+func applyGRPCHeaders(ctx context.Context, stream grpc.ServerStream, t *route.Target, fullMethodName string) (context.Context, error) {
+	if t.RequestHeaders == nil && t.ResponseHeaders == nil {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	headers := http.Header{}
+	for k, v := range md {
+		for _, h := range v {
+			headers.Add(k, h)
+		}
+	}
+
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+	e := &logger.Event{
+		End: time.Now(),
+		Request: &http.Request{
+			Method:     "POST",
+			Proto:      "HTTP/2.0",
+			RemoteAddr: remoteAddr,
+			RequestURI: fullMethodName,
+			URL:        &url.URL{Path: fullMethodName},
+			Header:     headers,
+		},
+		Response:        &http.Response{},
+		UpstreamAddr:    t.URL.Host,
+		UpstreamService: t.Service,
+		UpstreamURL:     t.URL,
+	}
+
+	if t.RequestHeaders != nil {
+		t.RequestHeaders.Apply(headers, e)
+		ctx = metadata.NewIncomingContext(ctx, headerMetadata(headers))
+	}
+	if t.ResponseHeaders != nil {
+		resp := http.Header{}
+		t.ResponseHeaders.Apply(resp, e)
+		if err := stream.SetHeader(headerMetadata(resp)); err != nil {
+			return ctx, err
+		}
+	}
+	return ctx, nil
+}
+
+// headerMetadata converts HTTP headers to gRPC metadata with lower case keys.
+func headerMetadata(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range h {
+		md[strings.ToLower(k)] = v
+	}
+	return md
+}
+
 func (g GrpcProxyInterceptor) lookup(ctx context.Context, fullMethodName string) (*route.Target, error) {
 	pick := route.Picker[g.Config.Proxy.Strategy]
 	match := route.Matcher[g.Config.Proxy.Matcher]
@@ -264,7 +350,13 @@ func (p *grpcConnectionPool) newConnection(ctx context.Context, target *route.Ta
 		grpc.WithDefaultCallOptions(grpc.CallCustomCodec(grpc_proxy.Codec()), grpc.MaxCallRecvMsgSize(p.cfg.Proxy.GRPCMaxRxMsgSize)),
 	}
 
-	if target.URL.Scheme == "grpcs" && p.tlscfg != nil {
+	if name := target.Opts["tlsprofile"]; target.URL.Scheme == "grpcs" && name != "" {
+		tlscfg, err := transport.TLSProfile(name, target.Opts["grpcservername"], target.TLSSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlscfg)))
+	} else if target.URL.Scheme == "grpcs" && p.tlscfg != nil {
 		opts = append(opts, grpc.WithTransportCredentials(
 			credentials.NewTLS(&tls.Config{
 				ClientCAs:          p.tlscfg.ClientCAs,
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/fabiolb/fabio/route"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type headerStream struct {
+	grpc.ServerStream
+	header metadata.MD
+}
+
+func (s *headerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func TestApplyGRPCHeaders(t *testing.T) {
+	opts := `opts "proto=grpc reqhdr.set.X-Env=prod reqhdr.del=Authorization resphdr.set.X-Service=$upstream_service"`
+	tbl, err := route.NewTable(bytes.NewBufferString("route add svc /foo.Bar grpc://1.2.3.4:5678 " + opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := tbl[""][0].Targets[0]
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-env", "dev", "authorization", "secret", "x-user", "joe"))
+	stream := &headerStream{}
+	ctx, err = applyGRPCHeaders(ctx, stream, target, "/foo.Bar/Baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if got, want := md, metadata.Pairs("x-env", "prod", "x-user", "joe"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got request metadata %v want %v", got, want)
+	}
+	if got, want := stream.header, metadata.Pairs("x-service", "svc"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got response metadata %v want %v", got, want)
+	}
+}
+
+func TestGRPCFailed(t *testing.T) {
+	tests := []struct {
+		err    error
+		failed bool
+	}{
+		{nil, false},
+		{status.Error(codes.NotFound, "not found"), false},
+		{status.Error(codes.InvalidArgument, "invalid"), false},
+		{status.Error(codes.Unavailable, "unavailable"), true},
+		{status.Error(codes.DeadlineExceeded, "timeout"), true},
+		{status.Error(codes.Internal, "internal"), true},
+	}
+	for _, tt := range tests {
+		if got, want := grpcFailed(tt.err), tt.failed; got != want {
+			t.Errorf("%v: got %v want %v", tt.err, got, want)
+		}
+	}
+}
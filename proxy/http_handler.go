@@ -14,7 +14,7 @@ import (
 // StatusClientClosedRequest non-standard HTTP status code for client disconnection
 const StatusClientClosedRequest = 499
 
-func newHTTPProxy(target *url.URL, tr http.RoundTripper, flush time.Duration) http.Handler {
+func newHTTPProxy(target *url.URL, tr http.RoundTripper, flush time.Duration) *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{
 		// this is a simplified director function based on the
 		// httputil.NewSingleHostReverseProxy() which does not
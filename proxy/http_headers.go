@@ -1,12 +1,16 @@
 package proxy
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"net"
 	"net/http"
 	"strings"
 
+	"github.com/fabiolb/fabio/auth"
 	"github.com/fabiolb/fabio/config"
 )
 
@@ -33,6 +37,7 @@ func addResponseHeaders(w http.ResponseWriter, r *http.Request, cfg config.Proxy
 // * add X-Real-Ip, if not present
 // * ClientIPHeader != "": Set header with that name to <remote ip>
 // * TLS connection: Set header with name from `cfg.TLSHeader` to `cfg.TLSHeaderValue`
+// * verified client certificate: Set the headers from `cfg.ClientCertHeader`
 func addHeaders(r *http.Request, cfg config.Proxy, stripPath string) error {
 	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -131,9 +136,52 @@ func addHeaders(r *http.Request, cfg config.Proxy, stripPath string) error {
 		}
 	}
 
+	addClientCertHeaders(r, cfg.ClientCertHeader)
+
 	return nil
 }
 
+// addClientCertHeaders forwards the verified client certificate in the
+// configured headers. The certificate and the chain are encoded as
+// defined in RFC 9440. Headers sent by the client are always removed so
+// that they cannot be spoofed.
+func addClientCertHeaders(r *http.Request, cfg config.ClientCertHeader) {
+	for _, h := range []string{cfg.Cert, cfg.Chain, cfg.Subject, cfg.URI, cfg.Fingerprint} {
+		if h != "" {
+			r.Header.Del(h)
+		}
+	}
+
+	x := auth.ClientCertificate(r)
+	if x == nil {
+		return
+	}
+	if cfg.Cert != "" {
+		r.Header.Set(cfg.Cert, ":"+base64.StdEncoding.EncodeToString(x.Raw)+":")
+	}
+	if cfg.Chain != "" && len(r.TLS.PeerCertificates) > 1 {
+		var chain []string
+		for _, c := range r.TLS.PeerCertificates[1:] {
+			chain = append(chain, ":"+base64.StdEncoding.EncodeToString(c.Raw)+":")
+		}
+		r.Header.Set(cfg.Chain, strings.Join(chain, ", "))
+	}
+	if cfg.Subject != "" {
+		r.Header.Set(cfg.Subject, x.Subject.String())
+	}
+	if cfg.URI != "" && len(x.URIs) > 0 {
+		var uris []string
+		for _, u := range x.URIs {
+			uris = append(uris, u.String())
+		}
+		r.Header.Set(cfg.URI, strings.Join(uris, ","))
+	}
+	if cfg.Fingerprint != "" {
+		fp := sha256.Sum256(x.Raw)
+		r.Header.Set(cfg.Fingerprint, hex.EncodeToString(fp[:]))
+	}
+}
+
 var tlsver = map[uint16]string{
 	tls.VersionSSL30: "ssl30",
 	tls.VersionTLS10: "tls10",
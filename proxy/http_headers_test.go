@@ -2,9 +2,12 @@ package proxy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/fabiolb/fabio/config"
@@ -387,6 +390,60 @@ func TestAddHeaders(t *testing.T) {
 	}
 }
 
+func TestAddClientCertHeaders(t *testing.T) {
+	cfg := config.ClientCertHeader{
+		Cert:        "Client-Cert",
+		Chain:       "Client-Cert-Chain",
+		Subject:     "X-Client-Subject",
+		URI:         "X-Client-Uri",
+		Fingerprint: "X-Client-Fingerprint",
+	}
+	spiffe, _ := url.Parse("spiffe://mesh.example.com/billing")
+	leaf := &x509.Certificate{
+		Raw:     []byte("leaf"),
+		Subject: pkix.Name{CommonName: "billing", Organization: []string{"Acme"}},
+		URIs:    []*url.URL{spiffe},
+	}
+	ca := &x509.Certificate{Raw: []byte("ca")}
+	spoofed := http.Header{
+		"Client-Cert":      []string{":c3Bvb2Y=:"},
+		"X-Client-Subject": []string{"CN=admin"},
+	}
+
+	tests := []struct {
+		desc string
+		tls  *tls.ConnectionState
+		hdrs http.Header
+	}{
+		{"no tls", nil, http.Header{}},
+		{"not verified",
+			&tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}},
+			http.Header{},
+		},
+		{"verified",
+			&tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{leaf, ca},
+				VerifiedChains:   [][]*x509.Certificate{{leaf, ca}},
+			},
+			http.Header{
+				"Client-Cert":          []string{":bGVhZg==:"},
+				"Client-Cert-Chain":    []string{":Y2E=:"},
+				"X-Client-Subject":     []string{"CN=billing,O=Acme"},
+				"X-Client-Uri":         []string{"spiffe://mesh.example.com/billing"},
+				"X-Client-Fingerprint": []string{"9f91161f43433e49a6de6db680d79f60159f2e4ac9172621a12846428158440b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := &http.Request{Header: spoofed.Clone(), TLS: tt.tls}
+			addClientCertHeaders(r, cfg)
+			verify.Values(t, "", r.Header, tt.hdrs)
+		})
+	}
+}
+
 func TestAddResponseHeaders(t *testing.T) {
 	tests := []struct {
 		desc string
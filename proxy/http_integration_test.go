@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fabiolb/fabio/auth"
 	"github.com/fabiolb/fabio/config"
 	"github.com/fabiolb/fabio/logger"
 	"github.com/fabiolb/fabio/noroute"
@@ -154,6 +155,92 @@ func TestProxyChecksHeaderForAccessRules(t *testing.T) {
 	}
 }
 
+func TestProxyLogsAccessDenied(t *testing.T) {
+	var b bytes.Buffer
+	l, err := logger.New(&b, "$response_status $deny_reason")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Logger:    l,
+		Lookup: func(r *http.Request) *route.Target {
+			tgt := &route.Target{
+				URL:  mustParse("http://127.0.0.1:1/"),
+				Opts: map[string]string{"deny": "header:X-Debug"},
+			}
+			tgt.ProcessAccessRules()
+			return tgt
+		},
+	})
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Header.Set("X-Debug", "1")
+	resp, _ := mustDo(req)
+
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if got, want := b.String(), "403 deny=header:X-Debug\n"; got != want {
+		t.Fatalf("got log %q want %q", got, want)
+	}
+}
+
+// authFunc is an auth scheme for testing.
+type authFunc func(r *http.Request, w http.ResponseWriter) bool
+
+func (f authFunc) Authorized(r *http.Request, w http.ResponseWriter) bool {
+	return f(r, w)
+}
+
+func TestProxyAuthResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		AuthSchemes: map[string]auth.AuthScheme{
+			"deny": authFunc(func(r *http.Request, w http.ResponseWriter) bool {
+				return false
+			}),
+			"login": authFunc(func(r *http.Request, w http.ResponseWriter) bool {
+				w.Header().Set("Location", "https://login.example.com/")
+				http.Error(w, "please log in", http.StatusForbidden)
+				return false
+			}),
+		},
+		Lookup: func(r *http.Request) *route.Target {
+			return &route.Target{URL: mustParse(server.URL), AuthScheme: strings.TrimPrefix(r.URL.Path, "/")}
+		},
+	})
+	defer proxy.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/deny", http.StatusUnauthorized, "authorization failed\n"},
+		{"/login", http.StatusForbidden, "please log in\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, body := mustGet(proxy.URL + tt.path)
+			if got, want := resp.StatusCode, tt.status; got != want {
+				t.Fatalf("got status %d want %d", got, want)
+			}
+			if got, want := string(body), tt.body; got != want {
+				t.Fatalf("got body %q want %q", got, want)
+			}
+		})
+	}
+}
+
 func TestProxyNoRouteHTML(t *testing.T) {
 	want := "<html>503</html>"
 	noroute.SetHTML(want)
@@ -239,6 +326,217 @@ func TestProxyPrependsPath(t *testing.T) {
 	}
 }
 
+func TestProxyRewritesPath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer server.Close()
+
+	routes := "route add mock /users/([0-9]+)/orders " + server.URL + ` opts "rewrite=/orders/$1"` +
+		"\nroute add mock /api/(?P<version>v[0-9])/ " + server.URL + ` opts "rewrite=/${version}/api/ strip=/v2"`
+	tbl, _ := route.NewTable(bytes.NewBufferString(routes))
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["regex"], globCache, globEnabled)
+		},
+	})
+	defer proxy.Close()
+
+	tests := []struct {
+		path, want string
+	}{
+		{"/users/42/orders", "/orders/42"},
+		{"/users/42/orders/7", "/orders/42/7"},
+		{"/api/v1/items", "/v1/api/items"},
+		{"/api/v2/items", "/api/items"},
+	}
+	for _, tt := range tests {
+		resp, body := mustGet(proxy.URL + tt.path)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("%s: got status %d want %d", tt.path, got, want)
+		}
+		if got, want := string(body), tt.want; got != want {
+			t.Fatalf("%s: got path %q want %q", tt.path, got, want)
+		}
+	}
+}
+
+func TestProxyModifiesHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "mock")
+		w.Header().Set("Cache-Control", "public")
+		fmt.Fprintf(w, "%s|%s|%s|%s", r.Header.Get("X-Env"), r.Header.Get("X-Client"), r.Header.Get("X-Request"), r.Header.Get("Cookie"))
+	}))
+	defer server.Close()
+
+	opts := "reqhdr.set.X-Env=prod reqhdr.set.X-Client=$remote_host reqhdr.set.X-Request=$request_id reqhdr.del=Cookie " +
+		"resphdr.set.Cache-Control=no-store resphdr.set.X-Service=$upstream_service resphdr.del=Server"
+	tbl, _ := route.NewTable(bytes.NewBufferString("route add mock / " + server.URL + ` opts "` + opts + `"`))
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Config:    config.Proxy{RequestID: "X-Request-Id"},
+		Transport: http.DefaultTransport,
+		UUID:      func() string { return "abc-123" },
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"], globCache, globEnabled)
+		},
+	})
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("GET", proxy.URL, nil)
+	req.Header.Set("X-Env", "dev")
+	req.Header.Set("Cookie", "a=b")
+	resp, body := mustDo(req)
+
+	if got, want := string(body), "prod|127.0.0.1|abc-123|"; got != want {
+		t.Fatalf("got request headers %q want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Cache-Control"), "no-store"; got != want {
+		t.Fatalf("got Cache-Control %q want %q", got, want)
+	}
+	if got, want := resp.Header.Get("X-Service"), "mock"; got != want {
+		t.Fatalf("got X-Service %q want %q", got, want)
+	}
+	if got := resp.Header.Get("Server"); got != "" {
+		t.Fatalf("got Server %q want none", got)
+	}
+}
+
+func TestProxyEjectsFailingTarget(t *testing.T) {
+	route.SetOutlierConfig(config.Outlier{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     time.Minute,
+		MaxEjectionPercent:  50,
+	})
+	defer route.SetOutlierConfig(config.Outlier{})
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	tbl, _ := route.NewTable(bytes.NewBufferString("route add mock / " + good.URL + "\nroute add mock / " + bad.URL))
+	defer route.SetTable(route.Table{}) // drops the outlier state
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"], globCache, globEnabled)
+		},
+	})
+	defer proxy.Close()
+
+	// the bad target fails twice with round-robin and is then ejected
+	for i := 0; i < 4; i++ {
+		mustGet(proxy.URL)
+	}
+	for i := 0; i < 10; i++ {
+		resp, _ := mustGet(proxy.URL)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("%d: got status %d want %d", i, got, want)
+		}
+	}
+}
+
+func TestProxyStickyCookie(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a"))
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("b"))
+	}))
+	defer b.Close()
+
+	routes := "route add mock / " + a.URL + ` opts "sticky=lb"` + "\nroute add mock / " + b.URL + ` opts "sticky=lb"`
+	tbl, _ := route.NewTable(bytes.NewBufferString(routes))
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"], globCache, globEnabled)
+		},
+	})
+	defer proxy.Close()
+
+	resp, body := mustGet(proxy.URL)
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "lb" {
+		t.Fatalf("got cookies %v want affinity cookie 'lb'", cookies)
+	}
+
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.AddCookie(cookies[0])
+		resp, got := mustDo(req)
+		if string(got) != string(body) {
+			t.Fatalf("%d: got body %q want %q", i, got, body)
+		}
+		if len(resp.Cookies()) != 0 {
+			t.Fatalf("%d: got cookies %v want none", i, resp.Cookies())
+		}
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tbl, _ := route.NewTable(bytes.NewBufferString("route add mock /ratelimit " + server.URL + ` opts "ratelimit=1/m"`))
+	defer route.SetTable(route.Table{})
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"], globCache, globEnabled)
+		},
+	})
+	defer proxy.Close()
+
+	if resp, _ := mustGet(proxy.URL + "/ratelimit"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp, _ := mustGet(proxy.URL + "/ratelimit")
+	if got, want := resp.StatusCode, http.StatusTooManyRequests; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+	if got, want := resp.Header.Get("Retry-After"), "60"; got != want {
+		t.Fatalf("got Retry-After %q want %q", got, want)
+	}
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	tbl, _ := route.NewTable(bytes.NewBufferString("route add mock /breaker " + server.URL + ` opts "breaker.errorrate=1 breaker.minrequests=2"`))
+	defer route.SetTable(route.Table{})
+
+	proxy := httptest.NewServer(&HTTPProxy{
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"], globCache, globEnabled)
+		},
+	})
+	defer proxy.Close()
+
+	for i, want := range []int{500, 500, 503, 503} {
+		resp, _ := mustGet(proxy.URL + "/breaker")
+		if got := resp.StatusCode; got != want {
+			t.Fatalf("%d: got status %d want %d", i, got, want)
+		}
+	}
+}
+
 func TestProxyHost(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, r.Host)
@@ -462,6 +760,7 @@ func testProxyLogOutput(t *testing.T, bodySize int, cfg config.Proxy) {
 	upstreamHost, upstreamPort, _ := net.SplitHostPort(upstreamURL.Host)
 	remoteHost, remotePort, _ := net.SplitHostPort(remoteAddr)
 	want := []string{
+		"deny_reason:",
 		"header.X-Foo:bar",
 		"remote_addr:" + remoteAddr,
 		"remote_host:" + remoteHost,
@@ -469,6 +768,7 @@ func testProxyLogOutput(t *testing.T, bodySize int, cfg config.Proxy) {
 		"request:GET /foo?x=y HTTP/1.1",
 		"request_args:x=y",
 		"request_host:example.com",
+		"request_id:",
 		"request_method:GET",
 		"request_proto:HTTP/1.1",
 		"request_scheme:http",
@@ -493,6 +793,7 @@ func testProxyLogOutput(t *testing.T, bodySize int, cfg config.Proxy) {
 		"upstream_request_scheme:" + upstreamURL.Scheme,
 		"upstream_request_uri:/foo?x=y",
 		"upstream_request_url:" + upstreamURL.String() + "/foo?x=y",
+		"upstream_retries:0",
 		"upstream_service:svc-a",
 	}
 
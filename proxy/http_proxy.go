@@ -6,6 +6,7 @@ import (
 	"errors"
 	gkm "github.com/go-kit/kit/metrics"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
@@ -39,6 +40,10 @@ type HttpStatsHandler struct {
 
 	// RedirectCounter - counts redirects
 	RedirectCounter gkm.Counter
+
+	// Retries counts the requests which were retried on a different
+	// target.
+	Retries gkm.Counter
 }
 
 // HTTPProxy is a dynamic reverse proxy for HTTP and HTTPS protocols.
@@ -85,12 +90,14 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic("no lookup function")
 	}
 
+	var requestID string
 	if p.Config.RequestID != "" {
 		id := p.UUID
 		if id == nil {
 			id = uuid.NewUUID
 		}
-		r.Header.Set(p.Config.RequestID, id())
+		requestID = id()
+		r.Header.Set(p.Config.RequestID, requestID)
 	}
 
 	//Create Span
@@ -112,13 +119,29 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if t.AccessDeniedHTTP(r) {
+	if reason := t.AccessDeniedHTTP(r); reason != "" {
+		p.logDenied(r, requestID, t, reason)
 		http.Error(w, "access denied", http.StatusForbidden)
 		return
 	}
 
-	if !t.Authorized(r, w, p.AuthSchemes) {
-		http.Error(w, "authorization failed", http.StatusUnauthorized)
+	// the auth scheme records the authenticated client for the
+	// 'principal' key of the rate limit.
+	if t.AuthScheme != "" {
+		r = auth.WithPrincipal(r)
+	}
+	aw := &authResponseWriter{ResponseWriter: w}
+	if !t.Authorized(r, aw, p.AuthSchemes) {
+		// auth schemes like forward auth write their own response
+		if !aw.written {
+			http.Error(w, "authorization failed", http.StatusUnauthorized)
+		}
+		return
+	}
+
+	if limited, wait := t.RateLimitedHTTP(r); limited {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
 		return
 	}
 
@@ -139,45 +162,18 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// build the real target url that is passed to the proxy
-	targetURL := &url.URL{
-		Scheme: t.URL.Scheme,
-		Host:   t.URL.Host,
-		Path:   r.URL.Path,
-	}
-	if t.URL.RawQuery == "" || r.URL.RawQuery == "" {
-		targetURL.RawQuery = t.URL.RawQuery + r.URL.RawQuery
-	} else {
-		targetURL.RawQuery = t.URL.RawQuery + "&" + r.URL.RawQuery
-	}
+	setStickyCookie(w, r, t)
 
-	if t.Host == "dst" {
-		r.Host = targetURL.Host
-	} else if t.Host != "" {
-		r.Host = t.Host
-	}
-
-	// TODO(fs): The HasPrefix check seems redundant since the lookup function should
-	// TODO(fs): have found the target based on the prefix but there may be other
-	// TODO(fs): matchers which may have different rules. I'll keep this for
-	// TODO(fs): a defensive approach.
-	if t.StripPath != "" && strings.HasPrefix(r.URL.Path, t.StripPath) {
-		targetURL.Path = targetURL.Path[len(t.StripPath):]
-		// ensure absolute path after stripping to maintain compliance with
-		// section 5.3 of RFC7230 (https://tools.ietf.org/html/rfc7230#section-5.3)
-		if !strings.HasPrefix(targetURL.Path, "/") {
-			targetURL.Path = "/" + targetURL.Path
-		}
+	// a retry looks up the next target with the request as it was
+	// received since its host and headers are modified below.
+	var lookup *http.Request
+	if p.retryable(r) {
+		lookup = r.Clone(r.Context())
 	}
 
-	if t.PrependPath != "" {
-		targetURL.Path = t.PrependPath + targetURL.Path
-		// ensure absolute path after stripping to maintain compliance with
-		// section 5.3 of RFC7230 (https://tools.ietf.org/html/rfc7230#section-5.3)
-		if !strings.HasPrefix(targetURL.Path, "/") {
-			targetURL.Path = "/" + targetURL.Path
-		}
-	}
+	// build the real target url that is passed to the proxy
+	targetURL := upstreamURL(t, r)
+	setUpstreamHost(r, t, targetURL)
 
 	if err := addHeaders(r, p.Config, t.StripPath); err != nil {
 		http.Error(w, "cannot parse "+r.RemoteAddr, http.StatusInternalServerError)
@@ -192,15 +188,53 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//Add OpenTrace Headers to response
 	trace.InjectHeaders(span, r)
 
+	// the header options of the route are applied last so that
+	// they can override the headers set by fabio. A retry applies
+	// the header options of the next target to the same headers.
+	var header http.Header
+	if lookup != nil {
+		header = r.Header.Clone()
+	}
+	t.RequestHeaders.Apply(r.Header, headerEvent(r, requestURL, requestID, t, targetURL, 0))
+
+	// the response headers are modified for the target which sent the
+	// response since the request may be retried on a different target.
+	var retry *retryHandler
+	modifyHeader := func(code int, h http.Header) {
+		t, targetURL := t, targetURL
+		if retry != nil {
+			t, targetURL = retry.target, retry.url
+		}
+		t.ResponseHeaders.Apply(h, headerEvent(r, requestURL, requestID, t, targetURL, code))
+	}
+
+	// the concurrency limit and the circuit breaker of the target are
+	// checked last since the request may wait for a free slot.
+	done, err := t.Admit(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// the result is reported in a deferred call since the reverse proxy
+	// aborts the handler with a panic if the response cannot be copied.
+	var failed bool
+	defer func() {
+		if retry != nil {
+			done = retry.done
+		}
+		done(failed)
+	}()
+
 	upgrade, accept := r.Header.Get("Upgrade"), r.Header.Get("Accept")
 
-	tr := p.Transport
-	if t.Transport != nil {
-		tr = t.Transport
-	} else if t.TLSSkipVerify {
-		tr = p.InsecureTransport
+	var wsModifyHeader func(http.Header)
+	if t.ResponseHeaders != nil {
+		wsModifyHeader = func(h http.Header) { modifyHeader(http.StatusSwitchingProtocols, h) }
 	}
 
+	tr := p.transport(t)
+
 	var h http.Handler
 	switch {
 	case upgrade == "websocket" || upgrade == "Websocket":
@@ -208,9 +242,9 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if targetURL.Scheme == "https" || targetURL.Scheme == "wss" {
 			h = newWSHandler(targetURL.Host, func(network, address string) (net.Conn, error) {
 				return tls.Dial(network, address, tr.(*http.Transport).TLSClientConfig)
-			}, p.Stats.WSConn)
+			}, p.Stats.WSConn, wsModifyHeader)
 		} else {
-			h = newWSHandler(targetURL.Host, net.Dial, p.Stats.WSConn)
+			h = newWSHandler(targetURL.Host, net.Dial, p.Stats.WSConn, wsModifyHeader)
 		}
 
 	case accept == "text/event-stream":
@@ -219,7 +253,21 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h = newHTTPProxy(targetURL, tr, p.Config.FlushInterval)
 
 	default:
-		h = newHTTPProxy(targetURL, tr, p.Config.GlobalFlushInterval)
+		if retry = p.newRetryHandler(r, t, targetURL); retry != nil {
+			retry.done = done
+			retry.lookup, retry.header = lookup, header
+			retry.event = func(t *route.Target, targetURL *url.URL) *logger.Event {
+				return headerEvent(r, requestURL, requestID, t, targetURL, 0)
+			}
+			h = retry
+		} else {
+			h = newHTTPProxy(targetURL, tr, p.Config.GlobalFlushInterval)
+		}
+	}
+
+	// the retry handler tracks the active requests for every attempt
+	if retry == nil {
+		h = trackActive(t, h)
 	}
 
 	if p.Config.GZIPContentTypes != nil {
@@ -233,16 +281,35 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	start := timeNow()
 	rw := &responseWriter{w: w}
+	if t.ResponseHeaders != nil {
+		rw.modifyHeader = modifyHeader
+	}
 	h.ServeHTTP(rw, r)
 	end := timeNow()
 	dur := end.Sub(start)
 
+	// the request may have been retried on a different target
+	retries := 0
+	if retry != nil {
+		t, targetURL, retries = retry.target, retry.url, retry.retries
+	}
+
 	if p.Stats.Requests != nil {
 		p.Stats.Requests.Observe(dur.Seconds())
 	}
 	if t.Timer != nil {
 		t.Timer.Observe(dur.Seconds())
 	}
+
+	// connection errors are reported as 502 or 504 by the error handler
+	failed = rw.code >= 500
+	switch {
+	case rw.code >= 500:
+		t.ReportFailure()
+	case rw.code > 0:
+		t.ReportSuccess()
+	}
+
 	if rw.code <= 0 {
 		return
 	}
@@ -265,16 +332,179 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			UpstreamAddr:    targetURL.Host,
 			UpstreamService: t.Service,
 			UpstreamURL:     targetURL,
+			UpstreamRetries: retries,
+			RequestID:       requestID,
 		})
 	}
 }
 
+// logDenied writes the access log entry for a request which was denied
+// by the access rules of the target.
+func (p *HTTPProxy) logDenied(r *http.Request, requestID string, t *route.Target, reason string) {
+	if p.Logger == nil {
+		return
+	}
+	timeNow := p.Time
+	if timeNow == nil {
+		timeNow = time.Now
+	}
+	now := timeNow()
+	p.Logger.Log(&logger.Event{
+		Start:   now,
+		End:     now,
+		Request: r,
+		Response: &http.Response{
+			StatusCode: http.StatusForbidden,
+		},
+		RequestURL: &url.URL{
+			Scheme:   scheme(r),
+			Host:     r.Host,
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		},
+		UpstreamService: t.Service,
+		RequestID:       requestID,
+		DenyReason:      reason,
+	})
+}
+
+// headerEvent returns the event for expanding the values of the header
+// options of the target. code is the status code of the response or
+// zero for the request headers.
+func headerEvent(r *http.Request, requestURL *url.URL, requestID string, t *route.Target, targetURL *url.URL, code int) *logger.Event {
+	return &logger.Event{
+		End:             time.Now(),
+		Request:         r,
+		Response:        &http.Response{StatusCode: code},
+		RequestURL:      requestURL,
+		RequestID:       requestID,
+		UpstreamAddr:    targetURL.Host,
+		UpstreamService: t.Service,
+		UpstreamURL:     targetURL,
+	}
+}
+
+// trackActive returns a handler which counts the active requests of
+// the target for the leastconn and ewma pickers.
+func trackActive(t *route.Target, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Acquire()
+		defer t.Release()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// setStickyCookie sets the affinity cookie of the hash picker for the
+// target unless the client already sent it. A cookie for a previous
+// target of the same request is replaced.
+func setStickyCookie(w http.ResponseWriter, r *http.Request, t *route.Target) {
+	if t.StickyCookie == "" {
+		return
+	}
+	if c, err := r.Cookie(t.StickyCookie); err == nil && c.Value == t.StickyID {
+		return
+	}
+
+	prefix := t.StickyCookie + "="
+	var cookies []string
+	for _, v := range w.Header()["Set-Cookie"] {
+		if !strings.HasPrefix(v, prefix) {
+			cookies = append(cookies, v)
+		}
+	}
+	w.Header()["Set-Cookie"] = cookies
+	http.SetCookie(w, &http.Cookie{Name: t.StickyCookie, Value: t.StickyID, Path: "/", HttpOnly: true})
+}
+
+// transport returns the round tripper for the target.
+func (p *HTTPProxy) transport(t *route.Target) http.RoundTripper {
+	switch {
+	case t.Transport != nil:
+		return t.Transport
+	case t.TLSSkipVerify:
+		return p.InsecureTransport
+	default:
+		return p.Transport
+	}
+}
+
+// upstreamURL builds the URL of the upstream request for the target.
+func upstreamURL(t *route.Target, r *http.Request) *url.URL {
+	targetURL := &url.URL{
+		Scheme: t.URL.Scheme,
+		Host:   t.URL.Host,
+		Path:   r.URL.Path,
+	}
+	if t.URL.RawQuery == "" || r.URL.RawQuery == "" {
+		targetURL.RawQuery = t.URL.RawQuery + r.URL.RawQuery
+	} else {
+		targetURL.RawQuery = t.URL.RawQuery + "&" + r.URL.RawQuery
+	}
+
+	if t.RewritePath != "" {
+		targetURL.Path = t.Rewrite(targetURL.Path)
+		if !strings.HasPrefix(targetURL.Path, "/") {
+			targetURL.Path = "/" + targetURL.Path
+		}
+	}
+
+	// TODO(fs): The HasPrefix check seems redundant since the lookup function should
+	// TODO(fs): have found the target based on the prefix but there may be other
+	// TODO(fs): matchers which may have different rules. I'll keep this for
+	// TODO(fs): a defensive approach.
+	if t.StripPath != "" && strings.HasPrefix(targetURL.Path, t.StripPath) {
+		targetURL.Path = targetURL.Path[len(t.StripPath):]
+		// ensure absolute path after stripping to maintain compliance with
+		// section 5.3 of RFC7230 (https://tools.ietf.org/html/rfc7230#section-5.3)
+		if !strings.HasPrefix(targetURL.Path, "/") {
+			targetURL.Path = "/" + targetURL.Path
+		}
+	}
+
+	if t.PrependPath != "" {
+		targetURL.Path = t.PrependPath + targetURL.Path
+		// ensure absolute path after stripping to maintain compliance with
+		// section 5.3 of RFC7230 (https://tools.ietf.org/html/rfc7230#section-5.3)
+		if !strings.HasPrefix(targetURL.Path, "/") {
+			targetURL.Path = "/" + targetURL.Path
+		}
+	}
+	return targetURL
+}
+
+// setUpstreamHost sets the Host header of the upstream request
+// according to the 'host' option of the target.
+func setUpstreamHost(r *http.Request, t *route.Target, targetURL *url.URL) {
+	if t.Host == "dst" {
+		r.Host = targetURL.Host
+	} else if t.Host != "" {
+		r.Host = t.Host
+	}
+}
+
 func key(code int) string {
 	b := []byte("http.status.")
 	b = strconv.AppendInt(b, int64(code), 10)
 	return string(b)
 }
 
+// authResponseWriter records whether an auth scheme has written the
+// response for a denied request.
+type authResponseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *authResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *authResponseWriter) WriteHeader(statusCode int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
 // responseWriter wraps an http.ResponseWriter to capture the status code and
 // the size of the response. It also implements http.Hijacker to forward
 // hijacking the connection to the wrapped writer if supported.
@@ -282,6 +512,10 @@ type responseWriter struct {
 	w    http.ResponseWriter
 	code int
 	size int
+
+	// modifyHeader is called with the status code and the response
+	// headers before they are written.
+	modifyHeader func(code int, h http.Header)
 }
 
 func (rw *responseWriter) Header() http.Header {
@@ -289,16 +523,25 @@ func (rw *responseWriter) Header() http.Header {
 }
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.writeHeader(http.StatusOK)
 	n, err := rw.w.Write(b)
 	rw.size += n
 	return n, err
 }
 
 func (rw *responseWriter) WriteHeader(statusCode int) {
+	rw.writeHeader(statusCode)
 	rw.w.WriteHeader(statusCode)
 	rw.code = statusCode
 }
 
+func (rw *responseWriter) writeHeader(statusCode int) {
+	if rw.modifyHeader != nil {
+		rw.modifyHeader(statusCode, rw.w.Header())
+		rw.modifyHeader = nil
+	}
+}
+
 func (rw *responseWriter) Flush() {
 	if fl, ok := rw.w.(http.Flusher); ok {
 		fl.Flush()
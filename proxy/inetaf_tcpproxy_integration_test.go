@@ -55,7 +55,7 @@ route add tcproute example2.com/ tcp://%s opts "proto=tcp"`
 	}
 
 	tp := &tcp.SNIProxy{
-		Lookup: func(h string) *route.Target {
+		Lookup: func(h, _ string) *route.Target {
 			return table.LookupHost(h, route.Picker["rr"])
 		},
 	}
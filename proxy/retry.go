@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/logger"
+	"github.com/fabiolb/fabio/route"
+)
+
+// errRetryStatus is passed to the error handler when a response with a
+// retriable status code is discarded to retry the request.
+var errRetryStatus = errors.New("retriable status code")
+
+// perTryTimeoutError is reported when an attempt did not receive the
+// response headers within proxy.retry.pertrytimeout. It is a net.Error
+// so that the error handler responds with 504 Gateway Timeout.
+type perTryTimeoutError struct{}
+
+func (perTryTimeoutError) Error() string   { return "per-try timeout exceeded" }
+func (perTryTimeoutError) Timeout() bool   { return true }
+func (perTryTimeoutError) Temporary() bool { return true }
+
+// minRetries is the number of concurrent retries which are always
+// allowed independent of the retry budget.
+const minRetries = 3
+
+// retryBudget limits the number of concurrent retries to a percentage of
+// the concurrent requests which can be retried to prevent retry storms
+// when all upstream servers are overloaded.
+type retryBudget struct {
+	requests int64
+	retries  int64
+}
+
+var budget retryBudget
+
+// acquire reserves a retry and returns false if the budget is exhausted.
+func (b *retryBudget) acquire(percent int) bool {
+	retries := atomic.AddInt64(&b.retries, 1)
+	max := atomic.LoadInt64(&b.requests) * int64(percent) / 100
+	if retries > minRetries && retries > max {
+		atomic.AddInt64(&b.retries, -1)
+		return false
+	}
+	return true
+}
+
+func (b *retryBudget) release() {
+	atomic.AddInt64(&b.retries, -1)
+}
+
+// retryOn returns true if the retry conditions match the status code or
+// the error of an attempt. Only errors which occur before the request
+// was sent are retried as a connect failure.
+func retryOn(conditions []string, code int, err error) bool {
+	for _, c := range conditions {
+		switch {
+		case err != nil:
+			if c == "connect-failure" && isDialError(err) {
+				return true
+			}
+			if _, ok := err.(perTryTimeoutError); ok && c == "timeout" {
+				return true
+			}
+		case c == "5xx":
+			if code >= 500 && code <= 599 {
+				return true
+			}
+		case c == strconv.Itoa(code):
+			return true
+		}
+	}
+	return false
+}
+
+// isDialError returns true if the connection to the upstream could not
+// be established.
+func isDialError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// prefixedBody is a request body whose first bytes have already been read.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// newRetryHandler returns a handler which retries the request according
+// to the retry policy or nil if the request cannot be retried. Request
+// bodies are buffered up to proxy.retry.maxbodysize so that they can be
+// replayed. Requests with larger bodies are not retried.
+func (p *HTTPProxy) newRetryHandler(r *http.Request, t *route.Target, targetURL *url.URL) *retryHandler {
+	cfg := p.Config.Retry
+	if !p.retryable(r) {
+		return nil
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if r.ContentLength > cfg.MaxBodySize {
+			return nil
+		}
+		b, err := io.ReadAll(io.LimitReader(r.Body, cfg.MaxBodySize+1))
+		if err != nil || int64(len(b)) > cfg.MaxBodySize {
+			r.Body = prefixedBody{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+			return nil
+		}
+		body = b
+	}
+
+	return &retryHandler{
+		proxy:  p,
+		cfg:    cfg,
+		body:   body,
+		target: t,
+		url:    targetURL,
+	}
+}
+
+// retryable returns true if the request can be retried according to
+// the retry policy.
+func (p *HTTPProxy) retryable(r *http.Request) bool {
+	return p.Config.Retry.Attempts > 1 && contains(p.Config.Retry.Methods, r.Method)
+}
+
+// retryHandler proxies a request and retries it on a different target of
+// the route if an attempt fails.
+type retryHandler struct {
+	proxy *HTTPProxy
+	cfg   config.Retry
+	body  []byte
+
+	// lookup is the request as it was received which is used to look
+	// up the next target since the host and the headers of the upstream
+	// request depend on the target.
+	lookup *http.Request
+
+	// header contains the headers of the upstream request before the
+	// header options of the target are applied.
+	header http.Header
+
+	// event returns the event for the header options of a target.
+	event func(t *route.Target, targetURL *url.URL) *logger.Event
+
+	// target and url are the target and upstream URL of the last attempt.
+	target *route.Target
+	url    *url.URL
+
+	// done reports the result of the last attempt to the circuit
+	// breaker of the target.
+	done func(failed bool)
+
+	// retries is the number of retries.
+	retries int
+}
+
+func (h *retryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&budget.requests, 1)
+	defer atomic.AddInt64(&budget.requests, -1)
+
+	ctx := r.Context()
+	for attempt := 1; ; attempt++ {
+		next, done := h.attempt(ctx, w, r, attempt)
+		if next == nil {
+			return
+		}
+		h.target.ReportFailure()
+		h.done(true)
+		if h.proxy.Stats.Retries != nil {
+			h.proxy.Stats.Retries.Add(1)
+		}
+		log.Printf("[DEBUG] Retrying %s %s on %s after attempt %d on %s", r.Method, r.URL.Path, next.URL, attempt, h.target.URL)
+
+		ctx = route.ExcludeTarget(ctx, h.target)
+		h.target, h.url, h.done = next, upstreamURL(next, r), done
+		r.Host, r.Header = h.lookup.Host, h.header.Clone()
+		setUpstreamHost(r, next, h.url)
+		next.RequestHeaders.Apply(r.Header, h.event(next, h.url))
+		setStickyCookie(w, r, next)
+		h.retries++
+	}
+}
+
+// attempt proxies the request to the current target. It returns the target
+// for the next attempt and the function which reports its result if the
+// request should be retried or nil if the response was sent to the client.
+func (h *retryHandler) attempt(ctx context.Context, w http.ResponseWriter, r *http.Request, attempt int) (next *route.Target, done func(failed bool)) {
+	if attempt > 1 {
+		defer budget.release()
+	}
+	h.target.Acquire()
+	defer h.target.Release()
+
+	// retry looks up a different target and reserves a retry if the
+	// request can be retried.
+	retry := func(code int, err error) bool {
+		if attempt >= h.cfg.Attempts || ctx.Err() != nil || !retryOn(h.cfg.On, code, err) {
+			return false
+		}
+		excluded := route.ExcludeTarget(ctx, h.target)
+		t := h.proxy.Lookup(h.lookup.WithContext(excluded))
+		if t == nil || route.ExcludedTargets(excluded)[t.URL.String()] {
+			return false
+		}
+		if !budget.acquire(h.cfg.Budget) {
+			log.Printf("[DEBUG] Retry budget exhausted for %s %s", r.Method, r.URL.Path)
+			return false
+		}
+		d, admitErr := t.Admit(ctx)
+		if admitErr != nil {
+			budget.release()
+			log.Printf("[DEBUG] Cannot retry %s %s on %s. %s", r.Method, r.URL.Path, t.URL, admitErr)
+			return false
+		}
+		next, done = t, d
+		return true
+	}
+
+	actx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timedOut int32
+	var timer *time.Timer
+	if h.cfg.PerTryTimeout > 0 {
+		timer = time.AfterFunc(h.cfg.PerTryTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	rp := newHTTPProxy(h.url, h.proxy.transport(h.target), h.proxy.Config.GlobalFlushInterval)
+	rp.ModifyResponse = func(resp *http.Response) error {
+		if timer != nil {
+			timer.Stop()
+		}
+		if retry(resp.StatusCode, nil) {
+			return errRetryStatus
+		}
+		return nil
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if err == errRetryStatus {
+			return
+		}
+		if atomic.LoadInt32(&timedOut) == 1 {
+			err = perTryTimeoutError{}
+		}
+		if retry(0, err) {
+			log.Printf("[DEBUG] Attempt %d for %s %s on %s failed. %s", attempt, r.Method, r.URL.Path, h.target.URL, err)
+			return
+		}
+		httpProxyErrorHandler(w, r, err)
+	}
+
+	if h.body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(h.body))
+	}
+	rp.ServeHTTP(w, r.WithContext(actx))
+	return next, done
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
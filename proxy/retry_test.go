@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/route"
+)
+
+func TestRetryOn(t *testing.T) {
+	errConn := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	errRead := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		desc       string
+		conditions []string
+		code       int
+		err        error
+		want       bool
+	}{
+		{"connect-failure error", []string{"connect-failure"}, 0, errConn, true},
+		{"connect-failure status", []string{"connect-failure"}, 502, nil, false},
+		{"connect-failure after sending", []string{"connect-failure"}, 0, errRead, false},
+		{"connect-failure timeout", []string{"connect-failure"}, 0, perTryTimeoutError{}, false},
+		{"timeout", []string{"timeout"}, 0, perTryTimeoutError{}, true},
+		{"timeout error", []string{"timeout"}, 0, errConn, false},
+		{"5xx error", []string{"5xx"}, 0, errConn, false},
+		{"5xx 503", []string{"5xx"}, 503, nil, true},
+		{"5xx 404", []string{"5xx"}, 404, nil, false},
+		{"status code", []string{"connect-failure", "429"}, 429, nil, true},
+		{"other status code", []string{"429"}, 503, nil, false},
+		{"no conditions", nil, 503, errConn, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got, want := retryOn(tt.conditions, tt.code, tt.err), tt.want; got != want {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var b retryBudget
+	b.requests = 20
+
+	// the minimum number of retries is always allowed
+	for i := 0; i < minRetries; i++ {
+		if !b.acquire(0) {
+			t.Fatalf("%d: retry not allowed", i)
+		}
+	}
+	if b.acquire(0) {
+		t.Fatal("retry allowed with exhausted budget")
+	}
+	if !b.acquire(20) {
+		t.Fatal("retry not allowed within budget")
+	}
+	if b.acquire(20) {
+		t.Fatal("retry allowed with exhausted budget")
+	}
+	b.release()
+	if !b.acquire(20) {
+		t.Fatal("retry not allowed after release")
+	}
+}
+
+// closedAddr returns the URL of an address which refuses connections.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func newRetryProxy(t *testing.T, cfg config.Retry, routes string) *httptest.Server {
+	tbl, err := route.NewTable(bytes.NewBufferString(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(&HTTPProxy{
+		Config:    config.Proxy{Retry: cfg},
+		Transport: http.DefaultTransport,
+		Lookup: func(r *http.Request) *route.Target {
+			return tbl.Lookup(r, "", route.Picker["rr"], route.Matcher["prefix"], globCache, globEnabled)
+		},
+	})
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestProxyRetriesConnectFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	cfg := config.Retry{Attempts: 2, On: []string{"connect-failure"}, Methods: []string{"GET"}, Budget: 20}
+	proxy := newRetryProxy(t, cfg, "route add mock / "+closedAddr(t)+"\nroute add mock / "+server.URL)
+
+	for i := 0; i < 4; i++ {
+		resp, body := mustGet(proxy.URL)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("%d: got status %d want %d", i, got, want)
+		}
+		if got, want := string(body), "OK"; got != want {
+			t.Fatalf("%d: got body %q want %q", i, got, want)
+		}
+	}
+}
+
+func TestProxyRetriesHostDst(t *testing.T) {
+	var host, upstream string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, upstream = r.Host, r.Header.Get("X-Upstream")
+		w.Write([]byte("OK"))
+	}))
+	defer server.Close()
+
+	// the next target is looked up with the host of the client request
+	// and not with the host of the failed attempt.
+	cfg := config.Retry{Attempts: 2, On: []string{"connect-failure"}, Methods: []string{"GET"}, Budget: 20}
+	opts := ` opts "host=dst reqhdr.set.X-Upstream=$upstream_addr"`
+	proxy := newRetryProxy(t, cfg, "route add mock example.com/ "+closedAddr(t)+opts+"\nroute add mock example.com/ "+server.URL+opts)
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", proxy.URL, nil)
+		req.Host = "example.com"
+		resp, _ := mustDo(req)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("%d: got status %d want %d", i, got, want)
+		}
+		want := strings.TrimPrefix(server.URL, "http://")
+		if host != want || upstream != want {
+			t.Fatalf("%d: got host %q and X-Upstream %q want %q", i, host, upstream, want)
+		}
+	}
+}
+
+func TestProxyRetriesStatusCode(t *testing.T) {
+	var bad int32
+	badServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&bad, 1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer badServer.Close()
+	goodServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer goodServer.Close()
+
+	cfg := config.Retry{Attempts: 3, On: []string{"5xx"}, Methods: []string{"PUT"}, Budget: 20, MaxBodySize: 10}
+	proxy := newRetryProxy(t, cfg, "route add mock / "+badServer.URL+"\nroute add mock / "+goodServer.URL)
+
+	do := func(method, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, proxy.URL, strings.NewReader(body))
+		resp, b := mustDo(req)
+		return resp, string(b)
+	}
+
+	t.Run("body is replayed", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			resp, body := do("PUT", "hello")
+			if got, want := resp.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("%d: got status %d want %d", i, got, want)
+			}
+			if got, want := body, "hello"; got != want {
+				t.Fatalf("%d: got body %q want %q", i, got, want)
+			}
+		}
+		if atomic.LoadInt32(&bad) == 0 {
+			t.Fatal("failing server got no requests")
+		}
+	})
+
+	t.Run("large body is not retried", func(t *testing.T) {
+		atomic.StoreInt32(&bad, 0)
+		codes := map[int]int{}
+		for i := 0; i < 4; i++ {
+			resp, body := do("PUT", "hello world")
+			codes[resp.StatusCode]++
+			if resp.StatusCode == http.StatusOK && body != "hello world" {
+				t.Fatalf("%d: got body %q", i, body)
+			}
+		}
+		if got, want := codes[http.StatusServiceUnavailable], 2; got != want {
+			t.Fatalf("got %d failed requests want %d", got, want)
+		}
+	})
+
+	t.Run("method is not retried", func(t *testing.T) {
+		codes := map[int]int{}
+		for i := 0; i < 4; i++ {
+			resp, _ := do("POST", "hello")
+			codes[resp.StatusCode]++
+		}
+		if got, want := codes[http.StatusServiceUnavailable], 2; got != want {
+			t.Fatalf("got %d failed requests want %d", got, want)
+		}
+	})
+}
+
+func TestProxyRetryPerTryTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	defer fast.Close()
+
+	cfg := config.Retry{Attempts: 2, On: []string{"timeout"}, Methods: []string{"GET"}, Budget: 20, PerTryTimeout: 50 * time.Millisecond}
+	proxy := newRetryProxy(t, cfg, "route add mock / "+slow.URL+"\nroute add mock / "+fast.URL)
+
+	for i := 0; i < 2; i++ {
+		resp, _ := mustGet(proxy.URL)
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("%d: got status %d want %d", i, got, want)
+		}
+	}
+
+	// without another target the per-try timeout results in a 504
+	proxy = newRetryProxy(t, cfg, "route add mock / "+slow.URL)
+	resp, _ := mustGet(proxy.URL)
+	if got, want := resp.StatusCode, http.StatusGatewayTimeout; got != want {
+		t.Fatalf("got status %d want %d", got, want)
+	}
+}
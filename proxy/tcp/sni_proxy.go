@@ -22,8 +22,9 @@ type SNIProxy struct {
 	DialTimeout time.Duration
 
 	// Lookup returns a target host for the given server name.
+	// remoteAddr is the address of the client for the hash picker.
 	// The proxy will panic if this value is nil.
-	Lookup func(host string) *route.Target
+	Lookup func(host, remoteAddr string) *route.Target
 
 	// Conn counts the number of connections.
 	Conn gkm.Counter
@@ -90,7 +91,7 @@ func (p *SNIProxy) ServeTCP(in net.Conn) error {
 		return nil
 	}
 
-	t := p.Lookup(host)
+	t := p.Lookup(host, in.RemoteAddr().String())
 	if t == nil {
 		if p.Noroute != nil {
 			p.Noroute.Add(1)
@@ -103,16 +104,25 @@ func (p *SNIProxy) ServeTCP(in net.Conn) error {
 		return nil
 	}
 
+	if t.RateLimitedTCP(in) {
+		return nil
+	}
+
 	out, err := net.DialTimeout("tcp", addr, p.DialTimeout)
 	if err != nil {
 		log.Print("[WARN] tcp+sni: cannot connect to upstream ", addr)
+		t.ReportFailure()
 		if p.ConnFail != nil {
 			p.ConnFail.Add(1)
 		}
 		return err
 	}
+	t.ReportSuccess()
 	defer out.Close()
 
+	t.Acquire()
+	defer t.Release()
+
 	// enable PROXY protocol support on outbound connection
 	if t.ProxyProto {
 		err := WriteProxyHeader(out, in)
@@ -17,8 +17,9 @@ type DynamicProxy struct {
 	DialTimeout time.Duration
 
 	// Lookup returns a target host for the given request.
+	// remoteAddr is the address of the client for the hash picker.
 	// The proxy will panic if this value is nil.
-	Lookup func(host string) *route.Target
+	Lookup func(host, remoteAddr string) *route.Target
 
 	// Conn counts the number of connections.
 	Conn gkm.Counter
@@ -38,10 +39,10 @@ func (p *DynamicProxy) ServeTCP(in net.Conn) error {
 	}
 
 	target := in.LocalAddr().String()
-	t := p.Lookup(target)
+	t := p.Lookup(target, in.RemoteAddr().String())
 	if t == nil {
 		_, port, _ := net.SplitHostPort(target)
-		t = p.Lookup(":" + port)
+		t = p.Lookup(":"+port, in.RemoteAddr().String())
 	}
 	if t == nil {
 		if p.Noroute != nil {
@@ -56,16 +57,25 @@ func (p *DynamicProxy) ServeTCP(in net.Conn) error {
 		return nil
 	}
 
+	if t.RateLimitedTCP(in) {
+		return nil
+	}
+
 	out, err := net.DialTimeout("tcp", addr, p.DialTimeout)
 	if err != nil {
 		log.Print("[WARN] tcp: cannot connect to upstream ", addr)
+		t.ReportFailure()
 		if p.ConnFail != nil {
 			p.ConnFail.Add(1)
 		}
 		return err
 	}
+	t.ReportSuccess()
 	defer out.Close()
 
+	t.Acquire()
+	defer t.Release()
+
 	errc := make(chan error, 2)
 	cp := func(dst io.Writer, src io.Reader, c gkm.Counter) {
 		errc <- copyBuffer(dst, src, c)
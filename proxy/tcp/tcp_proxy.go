@@ -17,8 +17,9 @@ type Proxy struct {
 	DialTimeout time.Duration
 
 	// Lookup returns a target host for the given request.
+	// remoteAddr is the address of the client for the hash picker.
 	// The proxy will panic if this value is nil.
-	Lookup func(host string) *route.Target
+	Lookup func(host, remoteAddr string) *route.Target
 
 	// Conn counts the number of connections.
 	Conn gkm.Counter
@@ -39,7 +40,7 @@ func (p *Proxy) ServeTCP(in net.Conn) error {
 
 	_, port, _ := net.SplitHostPort(in.LocalAddr().String())
 	port = ":" + port
-	t := p.Lookup(port)
+	t := p.Lookup(port, in.RemoteAddr().String())
 	if t == nil {
 		if p.Noroute != nil {
 			p.Noroute.Add(1)
@@ -52,16 +53,25 @@ func (p *Proxy) ServeTCP(in net.Conn) error {
 		return nil
 	}
 
+	if t.RateLimitedTCP(in) {
+		return nil
+	}
+
 	out, err := net.DialTimeout("tcp", addr, p.DialTimeout)
 	if err != nil {
 		log.Print("[WARN] tcp: cannot connect to upstream ", addr)
+		t.ReportFailure()
 		if p.ConnFail != nil {
 			p.ConnFail.Add(1)
 		}
 		return err
 	}
+	t.ReportSuccess()
 	defer out.Close()
 
+	t.Acquire()
+	defer t.Release()
+
 	// enable PROXY protocol support on outbound connection
 	if t.ProxyProto {
 		err := WriteProxyHeader(out, in)
@@ -41,7 +41,7 @@ func TestTCPDyanmicProxy(t *testing.T) {
 	proxyAddr := "127.0.0.1:57778"
 	go func() {
 		h := &tcp.DynamicProxy{
-			Lookup: func(h string) *route.Target {
+			Lookup: func(h, _ string) *route.Target {
 				tbl, _ := route.NewTable(bytes.NewBufferString("route add srv 127.0.0.1:57778 tcp://" + srv.Addr))
 				return tbl.LookupHost(h, route.Picker["rr"])
 			},
@@ -73,7 +73,7 @@ func TestTCPProxy(t *testing.T) {
 	proxyAddr := "127.0.0.1:57778"
 	go func() {
 		h := &tcp.Proxy{
-			Lookup: func(h string) *route.Target {
+			Lookup: func(h, _ string) *route.Target {
 				tbl, _ := route.NewTable(bytes.NewBufferString("route add srv :57778 tcp://" + srv.Addr))
 				return tbl.LookupHost(h, route.Picker["rr"])
 			},
@@ -122,13 +122,14 @@ func TestTCPProxyWithTLS(t *testing.T) {
 		if err != nil {
 			t.Fatal("cert.NewSource: ", err)
 		}
-		cfg, err := cert.TLSConfig(src, false, 0, 0, nil)
+		cfg, stop, err := cert.TLSConfig("test", src, false, 0, 0, nil)
 		if err != nil {
 			t.Fatal("cert.TLSConfig: ", err)
 		}
+		defer stop()
 
 		h := &tcp.Proxy{
-			Lookup: func(string) *route.Target {
+			Lookup: func(string, string) *route.Target {
 				return &route.Target{URL: &url.URL{Host: srv.Addr}}
 			},
 		}
@@ -177,7 +178,7 @@ func TestTCPSNIProxy(t *testing.T) {
 	proxyAddr := "127.0.0.1:57778"
 	go func() {
 		h := &tcp.SNIProxy{
-			Lookup: func(string) *route.Target {
+			Lookup: func(string, string) *route.Target {
 				return &route.Target{URL: &url.URL{Host: srv.Addr}}
 			},
 		}
@@ -250,7 +251,7 @@ func TestTCPProxyWithProxyProto(t *testing.T) {
 	proxyAddr := "127.0.0.1:57778"
 	go func() {
 		h := &tcp.Proxy{
-			Lookup: func(h string) *route.Target {
+			Lookup: func(h, _ string) *route.Target {
 				tbl, _ := route.NewTable(bytes.NewBufferString("route add srv :57778 tcp://" + srv.Addr + " opts \"pxyproto=true\""))
 				tgt := tbl.LookupHost(h, route.Picker["rr"])
 				return tgt
@@ -302,13 +303,14 @@ func TestTCPProxyWithTLSWithProxyProto(t *testing.T) {
 		if err != nil {
 			t.Fatal("cert.NewSource: ", err)
 		}
-		cfg, err := cert.TLSConfig(src, false, 0, 0, nil)
+		cfg, stop, err := cert.TLSConfig("test", src, false, 0, 0, nil)
 		if err != nil {
 			t.Fatal("cert.TLSConfig: ", err)
 		}
+		defer stop()
 
 		h := &tcp.Proxy{
-			Lookup: func(string) *route.Target {
+			Lookup: func(string, string) *route.Target {
 				return &route.Target{URL: &url.URL{Host: srv.Addr}, ProxyProto: true}
 			},
 		}
@@ -359,7 +361,7 @@ func TestTCPSNIProxyWithProxyProto(t *testing.T) {
 	proxyAddr := "127.0.0.1:57778"
 	go func() {
 		h := &tcp.SNIProxy{
-			Lookup: func(string) *route.Target {
+			Lookup: func(string, string) *route.Target {
 				return &route.Target{URL: &url.URL{Host: srv.Addr}, ProxyProto: true}
 			},
 		}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
 	gkm "github.com/go-kit/kit/metrics"
 	"io"
@@ -20,8 +21,9 @@ type dialFunc func(network, address string) (net.Conn, error)
 // newWSHandler returns an HTTP handler which forwards data between
 // an incoming and outgoing websocket connection. It checks whether
 // the handshake was completed successfully before forwarding data
-// between the client and server.
-func newWSHandler(host string, dial dialFunc, conn gkm.Gauge) http.Handler {
+// between the client and server. If modifyHeader is not nil it is
+// called with the headers of the handshake response.
+func newWSHandler(host string, dial dialFunc, conn gkm.Gauge, modifyHeader func(http.Header)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if conn != nil {
 			conn.Set(float64(atomic.AddInt64(&conns, 1)))
@@ -76,7 +78,10 @@ func newWSHandler(host string, dial dialFunc, conn gkm.Gauge) http.Handler {
 		}
 
 		b = b[:n]
-		if m, err := in.Write(b); err != nil || n != m {
+		if modifyHeader != nil {
+			b = rewriteHandshake(b, modifyHeader)
+		}
+		if m, err := in.Write(b); err != nil || m != len(b) {
 			log.Printf("[ERROR] Error sending handshake for %s: %s", r.URL, err)
 			http.Error(w, "error sending handshake", http.StatusInternalServerError)
 			return
@@ -107,3 +112,26 @@ func newWSHandler(host string, dial dialFunc, conn gkm.Gauge) http.Handler {
 		}
 	})
 }
+
+// rewriteHandshake returns the handshake response with the headers
+// modified by fn. Data after the headers is preserved. The handshake
+// is returned unchanged if the headers cannot be parsed.
+func rewriteHandshake(b []byte, fn func(http.Header)) []byte {
+	n := bytes.Index(b, []byte("\r\n\r\n"))
+	if n < 0 {
+		return b
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n+4])), nil)
+	if err != nil {
+		return b
+	}
+	fn(resp.Header)
+
+	statusLine := b[:bytes.Index(b, []byte("\r\n"))+2]
+	buf := bytes.NewBuffer(make([]byte, 0, len(b)))
+	buf.Write(statusLine)
+	resp.Header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(b[n+4:])
+	return buf.Bytes()
+}
@@ -126,3 +126,21 @@ func testWSEcho(t *testing.T, url string, hdr http.Header) {
 func wsEchoHandler(ws *websocket.Conn) {
 	io.Copy(ws, ws)
 }
+
+func TestRewriteHandshake(t *testing.T) {
+	b := []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nServer: foo\r\n\r\nframe")
+	got := string(rewriteHandshake(b, func(h http.Header) {
+		h.Del("Server")
+		h.Set("X-Env", "prod")
+	}))
+	want := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nX-Env: prod\r\n\r\nframe"
+	if got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	// incomplete handshakes are not modified
+	b = []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n")
+	if got := rewriteHandshake(b, func(h http.Header) { h.Set("X-Env", "prod") }); !bytes.Equal(got, b) {
+		t.Fatalf("got %q want %q", got, b)
+	}
+}
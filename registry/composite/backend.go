@@ -0,0 +1,251 @@
+// Package composite implements a registry backend which merges the
+// routes of several other backends.
+package composite
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry"
+)
+
+// retryInterval is the time between attempts to create a backend which
+// failed to initialize.
+var retryInterval = 5 * time.Second
+
+// NewFunc creates the backend with the name.
+type NewFunc func(name string) (registry.Backend, error)
+
+// source is one of the backends of the composite backend.
+type source struct {
+	name string
+
+	mu          sync.Mutex
+	b           registry.Backend
+	err         error
+	initialized time.Time // time when b was created
+	lastUpdate  time.Time // time of the last routes of b
+}
+
+func (s *source) backend() registry.Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b
+}
+
+// be is an implementation of a registry backend which merges the
+// routes of its sources. The routes of later sources are applied after
+// the routes of earlier ones and take precedence.
+type be struct {
+	cfg     *config.Composite
+	sources []*source
+	manual  *source
+
+	mu       sync.Mutex
+	services []string // registered services
+	watches  []*watch // started watches
+}
+
+// NewBackend creates the backends with newBackend. It only fails if no
+// backend could be created. Backends which fail to initialize are
+// created in the background and do not block the others.
+func NewBackend(cfg *config.Composite, newBackend NewFunc) (registry.Backend, error) {
+	if len(cfg.Backends) == 0 {
+		return nil, errors.New("composite: no backends")
+	}
+
+	b := &be{cfg: cfg}
+	for _, name := range cfg.Backends {
+		if name == "composite" {
+			return nil, errors.New("composite: backends cannot be nested")
+		}
+		for _, s := range b.sources {
+			if s.name == name {
+				return nil, errors.New("composite: duplicate backend " + name)
+			}
+		}
+		s := &source{name: name}
+		b.sources = append(b.sources, s)
+		if name == cfg.Manual {
+			b.manual = s
+		}
+	}
+	if cfg.Manual == "" {
+		b.manual = b.sources[0]
+	}
+	if b.manual == nil {
+		return nil, errors.New("composite: manual backend " + cfg.Manual + " is not one of the backends")
+	}
+
+	var failed []*source
+	for _, s := range b.sources {
+		s.b, s.err = newBackend(s.name)
+		s.initialized = time.Now()
+		if s.err != nil {
+			log.Printf("[WARN] composite: Cannot initialize %s backend. %s", s.name, s.err)
+			failed = append(failed, s)
+		}
+	}
+	if len(failed) == len(b.sources) {
+		return nil, errors.New("composite: no backend could be initialized")
+	}
+	for _, s := range failed {
+		go b.retry(s, newBackend)
+	}
+
+	log.Printf("[INFO] composite: Using backends %s", strings.Join(cfg.Backends, ","))
+	return b, nil
+}
+
+// retry creates the backend of the source until it succeeds. Then it
+// registers the services and starts the running watches for it.
+func (b *be) retry(s *source, newBackend NewFunc) {
+	for {
+		time.Sleep(retryInterval)
+		sb, err := newBackend(s.name)
+		if err != nil {
+			log.Printf("[WARN] composite: Cannot initialize %s backend. %s", s.name, err)
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			continue
+		}
+		log.Printf("[INFO] composite: Initialized %s backend", s.name)
+
+		// the watches are started while b.mu is held so that
+		// startWatch does not start them a second time
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		s.mu.Lock()
+		s.b, s.err, s.initialized = sb, nil, time.Now()
+		s.mu.Unlock()
+		if b.services != nil {
+			if err := sb.Register(b.services); err != nil {
+				log.Printf("[WARN] composite: Cannot register services in %s backend. %s", s.name, err)
+			}
+		}
+		for _, w := range b.watches {
+			w.start(s)
+		}
+		return
+	}
+}
+
+func (b *be) Register(services []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.services = append([]string{}, services...)
+
+	var errs []error
+	for _, s := range b.sources {
+		if sb := s.backend(); sb != nil {
+			errs = append(errs, sb.Register(services))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *be) Deregister(service string) error {
+	var errs []error
+	for _, s := range b.sources {
+		if sb := s.backend(); sb != nil {
+			errs = append(errs, sb.Deregister(service))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *be) DeregisterAll() error {
+	var errs []error
+	for _, s := range b.sources {
+		if sb := s.backend(); sb != nil {
+			errs = append(errs, sb.DeregisterAll())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *be) ManualPaths() ([]string, error) {
+	sb := b.manual.backend()
+	if sb == nil {
+		return nil, errors.New("composite: " + b.manual.name + " backend is not initialized")
+	}
+	return sb.ManualPaths()
+}
+
+func (b *be) ReadManual(path string) (value string, version uint64, err error) {
+	sb := b.manual.backend()
+	if sb == nil {
+		return "", 0, errors.New("composite: " + b.manual.name + " backend is not initialized")
+	}
+	return sb.ReadManual(path)
+}
+
+func (b *be) WriteManual(path string, value string, version uint64) (ok bool, err error) {
+	sb := b.manual.backend()
+	if sb == nil {
+		return false, errors.New("composite: " + b.manual.name + " backend is not initialized")
+	}
+	return sb.WriteManual(path, value, version)
+}
+
+func (b *be) WatchServices() chan string {
+	w := &watch{
+		name:    "routes",
+		fn:      registry.Backend.WatchServices,
+		merge:   concatValues,
+		wait:    true,
+		timeout: b.cfg.Timeout,
+		updated: true,
+	}
+	return b.startWatch(w)
+}
+
+func (b *be) WatchManual() chan string {
+	w := &watch{
+		name:  "manual overrides",
+		fn:    registry.Backend.WatchManual,
+		merge: concatValues,
+	}
+	return b.startWatch(w)
+}
+
+func (b *be) WatchNoRouteHTML() chan string {
+	w := &watch{
+		name:  "noroute HTML",
+		fn:    registry.Backend.WatchNoRouteHTML,
+		merge: lastValue,
+	}
+	return b.startWatch(w)
+}
+
+// Status reports a source as unhealthy if it could not be initialized,
+// if it has not sent routes within the timeout or if its last routes
+// are older than its stale timeout.
+func (b *be) Status() []registry.SourceStatus {
+	now := time.Now()
+	var status []registry.SourceStatus
+	for _, s := range b.sources {
+		s.mu.Lock()
+		st := registry.SourceStatus{Name: s.name, LastUpdate: s.lastUpdate}
+		stale := b.cfg.StaleTimeout[s.name]
+		switch {
+		case s.b == nil:
+			st.Error = s.err.Error()
+		case s.lastUpdate.IsZero() && now.Sub(s.initialized) > b.cfg.Timeout:
+			st.Error = fmt.Sprintf("no routes after %s", b.cfg.Timeout)
+		case !s.lastUpdate.IsZero() && stale > 0 && now.Sub(s.lastUpdate) > stale:
+			st.Error = fmt.Sprintf("no routes for %s", now.Sub(s.lastUpdate).Truncate(time.Second))
+		default:
+			st.Healthy = true
+		}
+		s.mu.Unlock()
+		status = append(status, st)
+	}
+	return status
+}
@@ -0,0 +1,275 @@
+package composite
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry"
+	"github.com/fabiolb/fabio/registry/registrytest"
+)
+
+// fakeBackend is a backend whose values are sent by the test.
+type fakeBackend struct {
+	svc, man, html chan string
+
+	mu       sync.Mutex
+	services []string
+	manual   map[string]string
+	versions map[string]uint64
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		svc:      make(chan string),
+		man:      make(chan string),
+		html:     make(chan string),
+		manual:   map[string]string{},
+		versions: map[string]uint64{},
+	}
+}
+
+func (b *fakeBackend) Register(services []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.services = services
+	return nil
+}
+
+func (b *fakeBackend) registered() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.services
+}
+
+func (b *fakeBackend) Deregister(service string) error { return nil }
+func (b *fakeBackend) DeregisterAll() error            { return nil }
+
+func (b *fakeBackend) ManualPaths() ([]string, error) {
+	return []string{""}, nil
+}
+
+func (b *fakeBackend) ReadManual(path string) (string, uint64, error) {
+	return b.manual[path], b.versions[path], nil
+}
+
+func (b *fakeBackend) WriteManual(path string, value string, version uint64) (bool, error) {
+	if version != b.versions[path] {
+		return false, nil
+	}
+	b.manual[path] = value
+	b.versions[path]++
+	return true, nil
+}
+
+func (b *fakeBackend) WatchServices() chan string    { return b.svc }
+func (b *fakeBackend) WatchManual() chan string      { return b.man }
+func (b *fakeBackend) WatchNoRouteHTML() chan string { return b.html }
+
+func newTestBackend(t *testing.T, cfg *config.Composite, backends map[string]*fakeBackend) *be {
+	b, err := NewBackend(cfg, func(name string) (registry.Backend, error) {
+		return backends[name], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*be)
+}
+
+func TestNewBackendErrors(t *testing.T) {
+	fail := func(name string) (registry.Backend, error) { return nil, errors.New("down") }
+	ok := func(name string) (registry.Backend, error) { return newFakeBackend(), nil }
+
+	tests := []struct {
+		desc string
+		cfg  config.Composite
+		fn   NewFunc
+	}{
+		{"no backends", config.Composite{}, ok},
+		{"nested", config.Composite{Backends: []string{"consul", "composite"}}, ok},
+		{"duplicate", config.Composite{Backends: []string{"consul", "consul"}}, ok},
+		{"unknown manual", config.Composite{Backends: []string{"consul", "file"}, Manual: "etcd"}, ok},
+		{"all failed", config.Composite{Backends: []string{"consul", "file"}}, fail},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, err := NewBackend(&tt.cfg, tt.fn); err == nil {
+				t.Fatal("got nil want error")
+			}
+		})
+	}
+}
+
+func TestBackendWatchServices(t *testing.T) {
+	a, b := newFakeBackend(), newFakeBackend()
+	cb := newTestBackend(t, &config.Composite{Backends: []string{"consul", "file"}, Timeout: 5 * time.Second}, map[string]*fakeBackend{"consul": a, "file": b})
+	send := func(ch chan string, value string) func() {
+		return func() { ch <- value }
+	}
+
+	registrytest.Watch(t, cb.WatchServices(), []registrytest.Step{
+		// wait for the first routes of all backends
+		{Desc: "first backend", Update: send(a.svc, "route add web /web http://1.2.3.4/"), Same: true},
+		{
+			Desc:   "all backends",
+			Update: send(b.svc, "route del web"),
+			Want:   "# --- consul\nroute add web /web http://1.2.3.4/\n\n# --- file\nroute del web",
+		},
+		// later updates are sent immediately
+		{
+			Desc:   "update",
+			Update: send(a.svc, "route add api /api http://1.2.3.5/"),
+			Want:   "# --- consul\nroute add api /api http://1.2.3.5/\n\n# --- file\nroute del web",
+		},
+		{
+			Desc:   "no routes",
+			Update: send(b.svc, ""),
+			Want:   "# --- consul\nroute add api /api http://1.2.3.5/",
+		},
+	})
+
+	status := cb.Status()
+	if len(status) != 2 || !status[0].Healthy || status[0].LastUpdate.IsZero() || !status[1].Healthy || status[1].LastUpdate.IsZero() {
+		t.Fatalf("got %+v want two healthy sources with updates", status)
+	}
+}
+
+func TestBackendWatchServicesTimeout(t *testing.T) {
+	a, b := newFakeBackend(), newFakeBackend()
+	cb := newTestBackend(t, &config.Composite{Backends: []string{"consul", "file"}, Timeout: 50 * time.Millisecond}, map[string]*fakeBackend{"consul": a, "file": b})
+	svc := cb.WatchServices()
+
+	// a backend without routes does not block the others
+	a.svc <- "route add web /web http://1.2.3.4/"
+	want := "# --- consul\nroute add web /web http://1.2.3.4/"
+	registrytest.Expect(t, svc, want)
+
+	status := cb.Status()
+	if !status[0].Healthy || status[0].LastUpdate.IsZero() {
+		t.Fatalf("got %+v want healthy consul backend", status[0])
+	}
+	if got, want := status[1], (registry.SourceStatus{Name: "file", Error: "no routes after 50ms"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+}
+
+func TestBackendStatusStale(t *testing.T) {
+	a, b := newFakeBackend(), newFakeBackend()
+	cfg := &config.Composite{
+		Backends:     []string{"consul", "file"},
+		Timeout:      5 * time.Second,
+		StaleTimeout: map[string]time.Duration{"consul": 300 * time.Millisecond},
+	}
+	cb := newTestBackend(t, cfg, map[string]*fakeBackend{"consul": a, "file": b})
+	svc := cb.WatchServices()
+	a.svc <- "route add web /web http://1.2.3.4/"
+	b.svc <- "route del web"
+	registrytest.Receive(t, svc)
+
+	healthy := func() []bool {
+		var h []bool
+		for _, st := range cb.Status() {
+			h = append(h, st.Healthy)
+		}
+		return h
+	}
+
+	// only backends with a stale timeout become stale
+	time.Sleep(400 * time.Millisecond)
+	if got, want := healthy(), []bool{false, true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// the same routes make the backend healthy again
+	a.svc <- "route add web /web http://1.2.3.4/"
+	deadline := time.Now().Add(time.Second)
+	for !reflect.DeepEqual(healthy(), []bool{true, true}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v want [true true]", healthy())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	registrytest.NoReceive(t, svc, 100*time.Millisecond)
+}
+
+func TestBackendRetry(t *testing.T) {
+	defer func(d time.Duration) { retryInterval = d }(retryInterval)
+	retryInterval = 10 * time.Millisecond
+
+	a, b := newFakeBackend(), newFakeBackend()
+	var mu sync.Mutex
+	up := false
+	cb, err := NewBackend(&config.Composite{Backends: []string{"consul", "file"}, Timeout: 5 * time.Second}, func(name string) (registry.Backend, error) {
+		if name == "consul" {
+			return a, nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			return nil, errors.New("down")
+		}
+		return b, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := cb.(*be).Status()
+	if got, want := status[1], (registry.SourceStatus{Name: "file", Error: "down"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+
+	// the failed backend does not block the others
+	if err := cb.Register([]string{"alias"}); err != nil {
+		t.Fatal(err)
+	}
+	svc := cb.WatchServices()
+	a.svc <- "route add web /web http://1.2.3.4/"
+	want := "# --- consul\nroute add web /web http://1.2.3.4/"
+	registrytest.Expect(t, svc, want)
+
+	// the backend is registered and watched when it is up
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	b.svc <- "route del web"
+	want = "# --- consul\nroute add web /web http://1.2.3.4/\n\n# --- file\nroute del web"
+	registrytest.Expect(t, svc, want)
+	if got, want := b.registered(), []string{"alias"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if status := cb.(*be).Status(); !status[1].Healthy || status[1].Error != "" {
+		t.Fatalf("got %+v want healthy file backend", status[1])
+	}
+}
+
+func TestBackendManual(t *testing.T) {
+	a, b := newFakeBackend(), newFakeBackend()
+	cb := newTestBackend(t, &config.Composite{Backends: []string{"consul", "file"}, Manual: "file"}, map[string]*fakeBackend{"consul": a, "file": b})
+
+	registrytest.Manual(t, cb, nil, nil)
+	if got, want := b.manual[""], "route del db"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := len(a.manual), 0; got != want {
+		t.Fatalf("got %d manual overrides for consul want %d", got, want)
+	}
+
+	// manual overrides are not delayed
+	man := cb.WatchManual()
+	a.man <- "route weight web /web weight 0.1"
+	registrytest.Expect(t, man, "# --- consul\nroute weight web /web weight 0.1")
+
+	// the noroute HTML of the last backend which has one wins
+	html := cb.WatchNoRouteHTML()
+	b.html <- "<h1>file</h1>"
+	registrytest.Expect(t, html, "<h1>file</h1>")
+	a.html <- "<h1>consul</h1>"
+	registrytest.NoReceive(t, html, 100*time.Millisecond)
+	b.html <- ""
+	registrytest.Expect(t, html, "<h1>consul</h1>")
+}
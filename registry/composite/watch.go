@@ -0,0 +1,159 @@
+package composite
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/registry"
+)
+
+// watch merges the values of one of the watch methods of the sources.
+type watch struct {
+	// name describes the values in log messages.
+	name string
+
+	// fn is the watch method of the backends.
+	fn func(registry.Backend) chan string
+
+	// merge combines the values of the sources. values[i] is nil if
+	// sources[i] has not sent a value yet.
+	merge func(sources []*source, values []*string) string
+
+	// wait delays the first value until all initialized sources have
+	// sent a value or the timeout has expired.
+	wait    bool
+	timeout time.Duration
+
+	// updated records the time of the last value in the source.
+	updated bool
+
+	sources []*source
+	events  chan event
+}
+
+// event is a value of a source.
+type event struct {
+	i     int
+	value string
+}
+
+// startWatch runs the watch and starts it for all initialized sources.
+// Sources which are initialized later are started by retry.
+func (b *be) startWatch(w *watch) chan string {
+	w.sources = b.sources
+	w.events = make(chan event)
+	out := make(chan string)
+	go w.run(out)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.watches = append(b.watches, w)
+	for _, s := range b.sources {
+		if s.backend() != nil {
+			w.start(s)
+		}
+	}
+	return out
+}
+
+// start forwards the values of the source to the watch.
+func (w *watch) start(s *source) {
+	i := 0
+	for w.sources[i] != s {
+		i++
+	}
+	ch := w.fn(s.backend())
+	go func() {
+		for v := range ch {
+			w.events <- event{i, v}
+		}
+	}()
+}
+
+// run merges the values of the sources and pushes the result if there
+// is a difference. A source which does not send values does not block
+// the values of the other sources.
+func (w *watch) run(out chan string) {
+	values := make([]*string, len(w.sources))
+	waiting := w.wait
+	var timeout <-chan time.Time
+	if waiting {
+		timeout = time.After(w.timeout)
+	}
+
+	var last string
+	var pushed bool
+	for {
+		select {
+		case ev := <-w.events:
+			s := w.sources[ev.i]
+			values[ev.i] = &ev.value
+			if w.updated {
+				s.mu.Lock()
+				s.lastUpdate = time.Now()
+				s.mu.Unlock()
+			}
+			log.Printf("[DEBUG] composite: Received %s from %s backend", w.name, s.name)
+
+		case <-timeout:
+			timeout = nil
+			if waiting {
+				for i, s := range w.sources {
+					if values[i] == nil {
+						log.Printf("[WARN] composite: No %s from %s backend after %s", w.name, s.name, w.timeout)
+					}
+				}
+				waiting = false
+			}
+		}
+
+		if waiting {
+			if !w.ready(values) {
+				continue
+			}
+			waiting = false
+		}
+
+		next := w.merge(w.sources, values)
+		if pushed && next == last {
+			continue
+		}
+		out <- next
+		last, pushed = next, true
+	}
+}
+
+// ready returns true if all initialized sources have sent a value.
+func (w *watch) ready(values []*string) bool {
+	for i, s := range w.sources {
+		if values[i] == nil && s.backend() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// concatValues joins the values of the sources in their order so that the
+// values of later sources take precedence. Every value starts with a
+// comment which contains the name of the source.
+func concatValues(sources []*source, values []*string) string {
+	var s []string
+	for i, v := range values {
+		if v == nil || strings.TrimSpace(*v) == "" {
+			continue
+		}
+		s = append(s, "# --- "+sources[i].name+"\n"+strings.TrimSpace(*v))
+	}
+	return strings.Join(s, "\n\n")
+}
+
+// lastValue returns the last value which is not empty.
+func lastValue(sources []*source, values []*string) string {
+	for i := len(values) - 1; i >= 0; i-- {
+		if values[i] != nil && *values[i] != "" {
+			return *values[i]
+		}
+	}
+	return ""
+}
@@ -106,6 +106,23 @@ func (r routecmd) build() []string {
 	return config
 }
 
+// RouteCmds returns the route commands for the 'urlprefix-' tags of a
+// service instance. It allows other registry backends to use the same
+// tags as consul.
+func RouteCmds(name, addr string, port int, tags []string, prefix string, env map[string]string) []string {
+	r := routecmd{
+		svc: &api.CatalogService{
+			ServiceName:    name,
+			ServiceAddress: addr,
+			ServicePort:    port,
+			ServiceTags:    tags,
+		},
+		prefix: prefix,
+		env:    env,
+	}
+	return r.build()
+}
+
 // parseURLPrefixTag expects an input in the form of 'tag-host/path[ opts]'
 // and returns the lower cased host and the unaltered path if the
 // prefix matches the tag.
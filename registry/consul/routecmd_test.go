@@ -90,6 +90,21 @@ func TestRouteCmd(t *testing.T) {
 				`route add svc-1 :1234 tcp://1.1.1.1:2222`,
 			},
 		},
+		{
+			name: "http match conditions",
+			r: routecmd{
+				prefix: "p-",
+				svc: &api.CatalogService{
+					ServiceName:    "svc-1",
+					ServiceAddress: "1.1.1.1",
+					ServicePort:    2222,
+					ServiceTags:    []string{`p-foo/bar match.header.X-Canary=true match.method=POST,PUT`},
+				},
+			},
+			cfg: []string{
+				`route add svc-1 foo/bar http://1.1.1.1:2222/ opts "match.header.X-Canary=true match.method=POST,PUT"`,
+			},
+		},
 	}
 
 	for _, c := range cases {
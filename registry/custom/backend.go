@@ -7,11 +7,19 @@ import (
 )
 
 type be struct {
-	cfg *config.Custom
+	cfg  *config.Custom
+	cmds bool
 }
 
 func NewBackend(cfg *config.Custom) (registry.Backend, error) {
-	return &be{cfg}, nil
+	return &be{cfg: cfg}, nil
+}
+
+// NewRouteCmdBackend returns a custom backend which sends the routes as
+// route commands instead of replacing the routing table. This allows
+// the composite backend to merge them with the routes of other backends.
+func NewRouteCmdBackend(cfg *config.Custom) (registry.Backend, error) {
+	return &be{cfg: cfg, cmds: true}, nil
 }
 
 func (b *be) Register(services []string) error {
@@ -42,7 +50,11 @@ func (b *be) WatchServices() chan string {
 
 	log.Printf("[INFO] custom: Using custom routes from %s", b.cfg.Host)
 	ch := make(chan string, 1)
-	go customRoutes(b.cfg, ch)
+	if b.cmds {
+		go customRouteCmds(b.cfg, ch)
+	} else {
+		go customRoutes(b.cfg, ch)
+	}
 	return ch
 }
 
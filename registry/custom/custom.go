@@ -8,12 +8,66 @@ import (
 	"github.com/fabiolb/fabio/route"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
 func customRoutes(cfg *config.Custom, ch chan string) {
 
-	var Routes *[]route.RouteDef
+	client, URL := newClient(cfg)
+
+	for {
+		log.Printf("[DEBUG] Custom Registry starting request %s \n", time.Now())
+		Routes, err := fetchRoutes(client, URL)
+		if err != nil {
+			ch <- err.Error()
+			time.Sleep(cfg.PollInterval)
+			continue
+		}
+
+		log.Printf("[DEBUG] Custom Registry building table %s \n", time.Now())
+		t, err := route.NewTableCustom(Routes)
+		if err != nil {
+			ch <- fmt.Sprintf("Error generating new table - %s", err.Error())
+		}
+		log.Printf("[DEBUG] Custom Registry building table complete %s \n", time.Now())
+		route.SetTable(t)
+		log.Printf("[DEBUG] Custom Registry table set complete %s \n", time.Now())
+		ch <- "OK"
+		time.Sleep(cfg.PollInterval)
+
+	}
+
+}
+
+// customRouteCmds polls the routes like customRoutes but sends them as
+// route commands instead of replacing the routing table. The routes are
+// sent after every successful request even if they have not changed so
+// that the composite backend can detect a failing server. Nothing is
+// sent if the request fails.
+func customRouteCmds(cfg *config.Custom, ch chan string) {
+
+	client, URL := newClient(cfg)
+
+	for {
+		Routes, err := fetchRoutes(client, URL)
+		if err != nil {
+			log.Printf("[WARN] custom: %s", err)
+			time.Sleep(cfg.PollInterval)
+			continue
+		}
+
+		var cmds []string
+		for _, r := range *Routes {
+			cmds = append(cmds, r.String())
+		}
+		ch <- strings.Join(cmds, "\n")
+		time.Sleep(cfg.PollInterval)
+	}
+}
+
+func newClient(cfg *config.Custom) (*http.Client, string) {
+
 	var trans *http.Transport
 	var URL string
 
@@ -37,53 +91,39 @@ func customRoutes(cfg *config.Custom, ch chan string) {
 		URL = fmt.Sprintf("%s://%s/%s", cfg.Scheme, cfg.Host, cfg.Path)
 	}
 
+	return client, URL
+}
+
+func fetchRoutes(client *http.Client, URL string) (*[]route.RouteDef, error) {
+
+	var Routes *[]route.RouteDef
+
 	req, err := http.NewRequest("GET", URL, nil)
 	if err != nil {
-		log.Printf("[ERROR] Can not generate new HTTP request")
+		return nil, fmt.Errorf("Error Can not generate new HTTP request - %s -%s", URL, err.Error())
 	}
 	req.Close = true
 
-	for {
-		log.Printf("[DEBUG] Custom Registry starting request %s \n", time.Now())
-		resp, err := client.Do(req)
-		if resp != nil {
-			defer func() {
-				if err := resp.Body.Close(); err != nil {
-					log.Printf("Error Can not close HTTP resp body - %s -%s \n", URL, err.Error())
-				}
-			}()
-		}
-		if err != nil {
-			ch <- fmt.Sprintf("Error Sending HTTPs Request To Custom be - %s -%s", URL, err.Error())
-			time.Sleep(cfg.PollInterval)
-			continue
-		}
-
-		if resp.StatusCode != 200 {
-			ch <- fmt.Sprintf("Error Non-200 return (%v) from  -%s", resp.StatusCode, URL)
-			time.Sleep(cfg.PollInterval)
-			continue
-		}
-		log.Printf("[DEBUG] Custom Registry begin decoding json %s \n", time.Now())
-		decoder := json.NewDecoder(resp.Body)
-		err = decoder.Decode(&Routes)
-		if err != nil {
-			ch <- fmt.Sprintf("Error decoding request - %s -%s", URL, err.Error())
-			time.Sleep(cfg.PollInterval)
-			continue
-		}
-
-		log.Printf("[DEBUG] Custom Registry building table %s \n", time.Now())
-		t, err := route.NewTableCustom(Routes)
-		if err != nil {
-			ch <- fmt.Sprintf("Error generating new table - %s", err.Error())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error Sending HTTPs Request To Custom be - %s -%s", URL, err.Error())
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("Error Can not close HTTP resp body - %s -%s \n", URL, err.Error())
 		}
-		log.Printf("[DEBUG] Custom Registry building table complete %s \n", time.Now())
-		route.SetTable(t)
-		log.Printf("[DEBUG] Custom Registry table set complete %s \n", time.Now())
-		ch <- "OK"
-		time.Sleep(cfg.PollInterval)
+	}()
 
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Error Non-200 return (%v) from  -%s", resp.StatusCode, URL)
 	}
-
+	log.Printf("[DEBUG] Custom Registry begin decoding json %s \n", time.Now())
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&Routes); err != nil {
+		return nil, fmt.Errorf("Error decoding request - %s -%s", URL, err.Error())
+	}
+	if Routes == nil {
+		Routes = &[]route.RouteDef{}
+	}
+	return Routes, nil
 }
@@ -6,6 +6,8 @@ import (
 	"github.com/fabiolb/fabio/config"
 	"github.com/fabiolb/fabio/route"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -93,3 +95,29 @@ func handleTest(w http.ResponseWriter, r *http.Request) {
 	w.Write(rt)
 
 }
+
+func TestCustomRouteCmds(t *testing.T) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test", handleTest)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cfg := config.Custom{
+		Host:         strings.TrimPrefix(server.URL, "http://"),
+		Path:         "test",
+		Scheme:       "http",
+		PollInterval: 3 * time.Second,
+		Timeout:      3 * time.Second,
+	}
+
+	ch := make(chan string, 1)
+	go customRouteCmds(&cfg, ch)
+
+	want := `route add service1 app.com http://10.1.1.1:8080 weight 0.5 tags "tag1,tag2" opts "proto=http tlsskipverify=true"` + "\n" +
+		`route add service1 app.com http://10.1.1.2:8080 weight 0.5 tags "tag1,tag2" opts "proto=http tlsskipverify=true"` + "\n" +
+		`route add service2 app.com http://10.1.1.3:8080 weight 0.25 tags "tag1,tag2" opts "proto=http tlsskipverify=true"`
+	if got := <-ch; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
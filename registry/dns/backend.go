@@ -0,0 +1,76 @@
+// Package dns implements a registry backend which reads the routes from
+// DNS SRV records.
+package dns
+
+import (
+	"errors"
+	"log"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry"
+)
+
+// be is an implementation of a registry backend for DNS SRV records.
+type be struct {
+	r       *resolver
+	cfg     *config.DNS
+	records []*record
+}
+
+func NewBackend(cfg *config.DNS) (registry.Backend, error) {
+	records, err := parseRecords(cfg.Records)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MinTTL <= 0 {
+		return nil, errors.New("dns: minttl must be positive")
+	}
+
+	r := &resolver{addr: resolverAddr(cfg.Resolver), timeout: cfg.Timeout}
+	log.Printf("[INFO] dns: Using resolver %s", r.addr)
+	return &be{r: r, cfg: cfg, records: records}, nil
+}
+
+func (b *be) Register(services []string) error {
+	return nil
+}
+
+func (b *be) Deregister(serviceName string) error {
+	return nil
+}
+
+func (b *be) DeregisterAll() error {
+	return nil
+}
+
+func (b *be) ManualPaths() ([]string, error) {
+	return nil, nil
+}
+
+func (b *be) ReadManual(string) (value string, version uint64, err error) {
+	return "", 0, nil
+}
+
+func (b *be) WriteManual(path string, value string, version uint64) (ok bool, err error) {
+	return false, nil
+}
+
+func (b *be) WatchServices() chan string {
+	log.Printf("[INFO] dns: Using dynamic routes")
+	log.Printf("[INFO] dns: Using tag prefix %q", b.cfg.TagPrefix)
+	for _, r := range b.records {
+		log.Printf("[INFO] dns: Watching SRV record %s", r.name)
+	}
+
+	svc := make(chan string)
+	go b.watchServices(svc)
+	return svc
+}
+
+func (b *be) WatchManual() chan string {
+	return make(chan string)
+}
+
+func (b *be) WatchNoRouteHTML() chan string {
+	return make(chan string)
+}
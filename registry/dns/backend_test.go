@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry/registrytest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is a fake DNS server which answers SRV and TXT queries over
+// UDP and TCP on the same port.
+type dnsServer struct {
+	addr string
+
+	mu       sync.Mutex
+	srvs     map[string][]dnsmessage.SRVResource
+	txts     map[string][]string
+	ttl      uint32
+	fail     bool           // answer with SERVFAIL
+	truncate bool           // truncate UDP responses
+	queries  map[string]int // number of SRV queries per name
+}
+
+func newDNSServer(t *testing.T) *dnsServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+
+	s := &dnsServer{
+		addr:    udp.LocalAddr().String(),
+		srvs:    map[string][]dnsmessage.SRVResource{},
+		txts:    map[string][]string{},
+		queries: map[string]int{},
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(s.answer(buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			var l [2]byte
+			io.ReadFull(conn, l[:])
+			req := make([]byte, binary.BigEndian.Uint16(l[:]))
+			io.ReadFull(conn, req)
+			resp := s.answer(req, false)
+			binary.BigEndian.PutUint16(l[:], uint16(len(resp)))
+			conn.Write(append(l[:], resp...))
+			conn.Close()
+		}
+	}()
+	return s
+}
+
+func (s *dnsServer) answer(req []byte, udp bool) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var m dnsmessage.Message
+	if err := m.Unpack(req); err != nil || len(m.Questions) != 1 {
+		return nil
+	}
+	q := m.Questions[0]
+	name := q.Name.String()
+	if q.Type == dnsmessage.TypeSRV {
+		s.queries[name]++
+	}
+
+	m.Response = true
+	switch {
+	case s.fail:
+		m.RCode = dnsmessage.RCodeServerFailure
+	case s.truncate && udp:
+		m.Truncated = true
+	case s.srvs[name] == nil && s.txts[name] == nil:
+		m.RCode = dnsmessage.RCodeNameError
+	}
+
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	if m.RCode == dnsmessage.RCodeSuccess && !m.Truncated {
+		switch q.Type {
+		case dnsmessage.TypeSRV:
+			for _, srv := range s.srvs[name] {
+				m.Answers = append(m.Answers, dnsmessage.Resource{Header: hdr, Body: &srv})
+			}
+		case dnsmessage.TypeTXT:
+			for _, txt := range s.txts[name] {
+				m.Answers = append(m.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.TXTResource{TXT: []string{txt}}})
+			}
+		}
+	}
+	resp, _ := m.Pack()
+	return resp
+}
+
+func (s *dnsServer) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+func srv(target string, port uint16, prio, weight uint16) dnsmessage.SRVResource {
+	return dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Priority: prio, Weight: weight}
+}
+
+func newTestBackend(t *testing.T, s *dnsServer, records ...string) *be {
+	b, err := NewBackend(&config.DNS{
+		Records:   records,
+		Resolver:  s.addr,
+		TagPrefix: "urlprefix-",
+		MinTTL:    20 * time.Millisecond,
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*be)
+}
+
+func TestBackendWatchServices(t *testing.T) {
+	s := newDNSServer(t)
+	s.update(func() {
+		s.srvs["_web._tcp.example.com."] = []dnsmessage.SRVResource{
+			srv("web1.example.com.", 8080, 10, 1),
+			srv("web2.example.com.", 8080, 10, 3),
+			srv("backup.example.com.", 8080, 20, 1),
+		}
+		s.txts["_web._tcp.example.com."] = []string{"urlprefix-web.example.com/", "v=spf1 -all"}
+		s.srvs["_api._tcp.example.com."] = []dnsmessage.SRVResource{srv("api.example.com.", 9000, 0, 0)}
+	})
+
+	b := newTestBackend(t, s, "_web._tcp.example.com urlprefix-/web strip=/web", "_api._tcp.example.com urlprefix-/api")
+	registrytest.Watch(t, b.WatchServices(), []registrytest.Step{
+		{
+			Desc: "initial records",
+			Want: `route add web web.example.com/ http://web2.example.com:8080/ weight 0.75` + "\n" +
+				`route add web web.example.com/ http://web1.example.com:8080/ weight 0.25` + "\n" +
+				`route add web /web http://web2.example.com:8080/ weight 0.75 opts "strip=/web"` + "\n" +
+				`route add web /web http://web1.example.com:8080/ weight 0.25 opts "strip=/web"` + "\n" +
+				`route add api /api http://api.example.com:9000/`,
+		},
+		{
+			// the records are resolved again after the TTL
+			Desc: "records changed",
+			Update: func() {
+				s.update(func() {
+					s.srvs["_web._tcp.example.com."] = []dnsmessage.SRVResource{srv("backup.example.com.", 8080, 20, 1)}
+					delete(s.txts, "_web._tcp.example.com.")
+				})
+			},
+			Want: `route add web /web http://backup.example.com:8080/ opts "strip=/web"` + "\n" +
+				`route add api /api http://api.example.com:9000/`,
+		},
+		{
+			Desc:   "name no longer exists",
+			Update: func() { s.update(func() { delete(s.srvs, "_api._tcp.example.com.") }) },
+			Want:   `route add web /web http://backup.example.com:8080/ opts "strip=/web"`,
+		},
+	})
+}
+
+func TestBackendKeepLastAnswer(t *testing.T) {
+	s := newDNSServer(t)
+	s.update(func() {
+		s.srvs["_web._tcp.example.com."] = []dnsmessage.SRVResource{srv("web1.example.com.", 8080, 0, 0)}
+	})
+
+	b := newTestBackend(t, s, "_web._tcp.example.com urlprefix-/web")
+	registrytest.Watch(t, b.WatchServices(), []registrytest.Step{
+		{Desc: "initial records", Want: `route add web /web http://web1.example.com:8080/`},
+		{
+			// failed lookups must not change the routes
+			Desc:   "lookup fails",
+			Update: func() { s.update(func() { s.fail = true }) },
+			Same:   true,
+		},
+		{
+			Desc: "lookup succeeds",
+			Update: func() {
+				s.update(func() {
+					s.fail = false
+					s.srvs["_web._tcp.example.com."] = []dnsmessage.SRVResource{srv("web2.example.com.", 8080, 0, 0)}
+				})
+			},
+			Want: `route add web /web http://web2.example.com:8080/`,
+		},
+	})
+}
+
+func TestBackendHonorTTL(t *testing.T) {
+	s := newDNSServer(t)
+	s.update(func() {
+		s.ttl = 3600
+		s.srvs["_web._tcp.example.com."] = []dnsmessage.SRVResource{srv("web1.example.com.", 8080, 0, 0)}
+	})
+
+	b := newTestBackend(t, s, "_web._tcp.example.com urlprefix-/web")
+	registrytest.Receive(t, b.WatchServices())
+	time.Sleep(200 * time.Millisecond)
+
+	s.update(func() {
+		if got, want := s.queries["_web._tcp.example.com."], 1; got != want {
+			t.Fatalf("got %d queries want %d", got, want)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// resolver is a minimal DNS client which returns the TTLs of the
+// answers. The resolver of the standard library does not expose them.
+type resolver struct {
+	addr    string
+	timeout time.Duration
+}
+
+// resolverAddr returns the address of the DNS server with the default
+// port if it has none. If addr is empty it returns the first nameserver
+// from /etc/resolv.conf.
+func resolverAddr(addr string) string {
+	if addr == "" {
+		addr = systemResolver("/etc/resolv.conf")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
+
+// systemResolver returns the first nameserver from the resolv.conf file
+// or the local host if there is none.
+func systemResolver(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return "127.0.0.1"
+}
+
+// lookup queries the records of the type for the name and returns the
+// answers. The answers are empty if the name does not exist. The query
+// is sent over UDP and repeated over TCP if the response is truncated.
+func (r *resolver) lookup(name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("dns: invalid name %q: %s", name, err)
+	}
+
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: n, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	req, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.exchange("udp", req)
+	if err == nil && resp.Truncated {
+		resp, err = r.exchange("tcp", req)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dns: lookup %s %s failed: %s", name, qtype, err)
+	}
+	if resp.ID != q.ID {
+		return nil, fmt.Errorf("dns: lookup %s %s failed: invalid response id", name, qtype)
+	}
+
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+		return resp.Answers, nil
+	case dnsmessage.RCodeNameError:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("dns: lookup %s %s failed: %s", name, qtype, resp.RCode)
+	}
+}
+
+// exchange sends the request to the DNS server and returns the response.
+func (r *resolver) exchange(network string, req []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, r.addr, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	var buf []byte
+	switch network {
+	case "udp":
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = buf[:n]
+
+	case "tcp":
+		// messages over TCP are prefixed with their length
+		msg := make([]byte, 2+len(req))
+		binary.BigEndian.PutUint16(msg, uint16(len(req)))
+		copy(msg[2:], req)
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, errors.New("invalid network " + network)
+	}
+
+	resp := &dnsmessage.Message{}
+	if err := resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,52 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestResolverAddr(t *testing.T) {
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "resolv.conf")
+	os.WriteFile(conf, []byte("# comment\nsearch example.com\nnameserver 10.0.0.53\nnameserver 10.0.0.54\n"), 0644)
+
+	if got, want := systemResolver(conf), "10.0.0.53"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := systemResolver(filepath.Join(dir, "missing")), "127.0.0.1"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	tests := []struct{ in, out string }{
+		{"10.0.0.53", "10.0.0.53:53"},
+		{"10.0.0.53:5353", "10.0.0.53:5353"},
+		{"::1", "[::1]:53"},
+		{"[::1]:5353", "[::1]:5353"},
+	}
+	for _, tt := range tests {
+		if got, want := resolverAddr(tt.in), tt.out; got != want {
+			t.Errorf("%s: got %q want %q", tt.in, got, want)
+		}
+	}
+}
+
+func TestResolverTCPFallback(t *testing.T) {
+	s := newDNSServer(t)
+	s.update(func() {
+		s.truncate = true
+		s.srvs["_web._tcp.example.com."] = []dnsmessage.SRVResource{srv("web1.example.com.", 8080, 0, 0)}
+	})
+
+	r := &resolver{addr: s.addr, timeout: time.Second}
+	answers, err := r.lookup("_web._tcp.example.com", dnsmessage.TypeSRV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(answers), 1; got != want {
+		t.Fatalf("got %d answers want %d", got, want)
+	}
+}
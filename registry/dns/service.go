@@ -0,0 +1,231 @@
+package dns
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/registry/consul"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// record is a configured SRV record and the tags for its routes.
+type record struct {
+	name    string
+	service string
+	tags    []string
+}
+
+// answer is the last good answer for a record.
+type answer struct {
+	config  []string
+	expires time.Time
+}
+
+// parseRecords parses the configured records which have the form
+// '<name>[ <tag>]'. Tags of records with the same name are combined.
+//
+//	_web._tcp.example.com urlprefix-/web strip=/web
+//	_web._tcp.example.com urlprefix-web.example.com/
+func parseRecords(entries []string) ([]*record, error) {
+	var records []*record
+	byName := map[string]*record{}
+	for _, e := range entries {
+		p := strings.SplitN(strings.TrimSpace(e), " ", 2)
+		name := strings.ToLower(strings.TrimSuffix(p[0], "."))
+		if name == "" {
+			continue
+		}
+		if !validName(name) {
+			return nil, errors.New("dns: invalid record " + strconv.Quote(e))
+		}
+
+		r := byName[name]
+		if r == nil {
+			r = &record{name: name, service: serviceName(name)}
+			byName[name] = r
+			records = append(records, r)
+		}
+		if len(p) == 2 && strings.TrimSpace(p[1]) != "" {
+			r.tags = append(r.tags, strings.TrimSpace(p[1]))
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.New("dns: no records")
+	}
+	return records, nil
+}
+
+// validName returns true if the name has no empty or too long labels.
+func validName(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, l := range strings.Split(name, ".") {
+		if l == "" || len(l) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceName returns the service name for the SRV record which is the
+// service label without the underscore, e.g. 'web' for
+// '_web._tcp.example.com', or the full name if there is no such label.
+func serviceName(name string) string {
+	label := strings.SplitN(name, ".", 2)[0]
+	if strings.HasPrefix(label, "_") && len(label) > 1 {
+		return label[1:]
+	}
+	return name
+}
+
+// resolve looks up the SRV and TXT records of the record and returns
+// the route commands and the TTL of the answer.
+func (b *be) resolve(r *record) (config []string, ttl time.Duration, err error) {
+	srvs, err := b.r.lookup(r.name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	txts, err := b.r.lookup(r.name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the answer expires with the shortest TTL
+	minTTL := uint32(math.MaxUint32)
+	var targets []dnsmessage.SRVResource
+	for _, rr := range srvs {
+		if srv, ok := rr.Body.(*dnsmessage.SRVResource); ok {
+			targets = append(targets, *srv)
+			minTTL = min(minTTL, rr.Header.TTL)
+		}
+	}
+	var texts []string
+	for _, rr := range txts {
+		if txt, ok := rr.Body.(*dnsmessage.TXTResource); ok {
+			texts = append(texts, strings.Join(txt.TXT, ""))
+			minTTL = min(minTTL, rr.Header.TTL)
+		}
+	}
+	if minTTL != math.MaxUint32 {
+		ttl = time.Duration(minTTL) * time.Second
+	}
+
+	return routeCmds(r, targets, texts, b.cfg.TagPrefix), ttl, nil
+}
+
+// routeCmds builds the route commands for the targets with the lowest
+// priority. The tags are the configured tags and the TXT records with
+// the tag prefix. Different weights of the targets are added as the
+// 'weight' option to the tags which do not have one.
+func routeCmds(r *record, targets []dnsmessage.SRVResource, texts []string, prefix string) []string {
+	tags := append([]string(nil), r.tags...)
+	for _, t := range texts {
+		if strings.HasPrefix(strings.TrimSpace(t), prefix) {
+			tags = append(tags, strings.TrimSpace(t))
+		}
+	}
+
+	// only the targets with the lowest priority are used. A target of
+	// '.' means that the service is not available.
+	var active []dnsmessage.SRVResource
+	for _, t := range targets {
+		if t.Target.String() == "." {
+			continue
+		}
+		switch {
+		case len(active) == 0 || t.Priority == active[0].Priority:
+			active = append(active, t)
+		case t.Priority < active[0].Priority:
+			active = []dnsmessage.SRVResource{t}
+		}
+	}
+
+	var sum uint32
+	weighted := false
+	for _, t := range active {
+		sum += uint32(t.Weight)
+		weighted = weighted || t.Weight != active[0].Weight
+	}
+
+	var config []string
+	for _, t := range active {
+		ttags := tags
+		if weighted && sum > 0 {
+			w := math.Round(float64(t.Weight)/float64(sum)*1e4) / 1e4
+			ttags = withWeight(tags, prefix, strconv.FormatFloat(w, 'f', -1, 64))
+		}
+		host := strings.TrimSuffix(t.Target.String(), ".")
+		config = append(config, consul.RouteCmds(r.service, host, int(t.Port), ttags, prefix, nil)...)
+	}
+	return config
+}
+
+// withWeight returns a copy of the tags with the weight option added to
+// the tags with the prefix which do not have one.
+func withWeight(tags []string, prefix, weight string) []string {
+	var res []string
+	for _, t := range tags {
+		if strings.HasPrefix(t, prefix) && !strings.Contains(t, " weight=") {
+			t += " weight=" + weight
+		}
+		res = append(res, t)
+	}
+	return res
+}
+
+// watchServices resolves the records when their TTL expires and sends
+// a new configuration to the updates channel on every change.
+//
+// Records are not resolved more often than the minimum TTL. If a lookup
+// fails the last good answer is kept and the lookup is retried after
+// the minimum TTL.
+func (b *be) watchServices(updates chan string) {
+	answers := make([]*answer, len(b.records))
+	var last string
+	var pushed bool
+	for {
+		now := time.Now()
+		for i, r := range b.records {
+			if answers[i] != nil && now.Before(answers[i].expires) {
+				continue
+			}
+
+			config, ttl, err := b.resolve(r)
+			if err != nil {
+				log.Printf("[WARN] dns: Error resolving %s. Keeping last answer. %v", r.name, err)
+				if answers[i] == nil {
+					answers[i] = &answer{}
+				}
+				answers[i].expires = now.Add(b.cfg.MinTTL)
+				continue
+			}
+			answers[i] = &answer{config: config, expires: now.Add(max(ttl, b.cfg.MinTTL))}
+		}
+
+		var config []string
+		next := answers[0].expires
+		for _, a := range answers {
+			config = append(config, a.config...)
+			if a.expires.Before(next) {
+				next = a.expires
+			}
+		}
+
+		// sort config in reverse order to sort most specific config to the top
+		sort.Sort(sort.Reverse(sort.StringSlice(config)))
+
+		if value := strings.Join(config, "\n"); !pushed || value != last {
+			log.Printf("[DEBUG] dns: Services changed")
+			updates <- value
+			last, pushed = value, true
+		}
+
+		time.Sleep(time.Until(next))
+	}
+}
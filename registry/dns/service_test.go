@@ -0,0 +1,32 @@
+package dns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRecords(t *testing.T) {
+	records, err := parseRecords([]string{
+		"_web._tcp.example.com. urlprefix-/web strip=/web",
+		"_WEB._tcp.example.com urlprefix-web.example.com/",
+		"web.example.com",
+		"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*record{
+		{name: "_web._tcp.example.com", service: "web", tags: []string{"urlprefix-/web strip=/web", "urlprefix-web.example.com/"}},
+		{name: "web.example.com", service: "web.example.com"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("got %+v want %+v", records, want)
+	}
+
+	if _, err := parseRecords(nil); err == nil {
+		t.Fatal("expected error for no records")
+	}
+	if _, err := parseRecords([]string{"a..b"}); err == nil {
+		t.Fatal("expected error for invalid name")
+	}
+}
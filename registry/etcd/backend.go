@@ -0,0 +1,222 @@
+// Package etcd implements a registry backend for etcd.
+package etcd
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// requestTimeout is the timeout for single requests to etcd.
+const requestTimeout = 5 * time.Second
+
+// be is an implementation of a registry backend for etcd.
+type be struct {
+	c     *clientv3.Client
+	cfg   *config.Etcd
+	dereg map[string](chan bool)
+}
+
+func NewBackend(cfg *config.Etcd) (registry.Backend, error) {
+	etcdCfg := clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		DialTimeout: requestTimeout,
+		// fabio logs the errors itself
+		Logger: zap.NewNop(),
+	}
+	if useTLS(cfg) {
+		tlscfg, err := registry.TLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		etcdCfg.TLS = tlscfg
+	}
+
+	// create a reusable client
+	c, err := clientv3.New(etcdCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// ping the cluster
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if _, err := c.Get(ctx, cfg.KVPath, clientv3.WithCountOnly()); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// we're good
+	log.Printf("[INFO] etcd: Connecting to %q", strings.Join(cfg.Endpoints, ","))
+	return &be{c: c, cfg: cfg}, nil
+}
+
+// useTLS returns true if the client should use TLS for the connections
+// to the endpoints.
+func useTLS(cfg *config.Etcd) bool {
+	if cfg.TLS.KeyFile != "" || cfg.TLS.CertFile != "" || cfg.TLS.CAFile != "" || cfg.TLS.CAPath != "" || cfg.TLS.InsecureSkipVerify {
+		return true
+	}
+	for _, ep := range cfg.Endpoints {
+		if strings.HasPrefix(ep, "https://") {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *be) Register(services []string) error {
+	if b.dereg == nil {
+		b.dereg = make(map[string](chan bool))
+	}
+
+	if b.cfg.Register {
+		services = append(services, b.cfg.ServiceName)
+	}
+
+	// deregister unneeded services
+	for service := range b.dereg {
+		if stringInSlice(service, services) {
+			continue
+		}
+		if err := b.Deregister(service); err != nil {
+			return err
+		}
+	}
+
+	// register new services
+	for _, service := range services {
+		if b.dereg[service] != nil {
+			log.Printf("[DEBUG] %q already registered", service)
+			continue
+		}
+
+		key, rec, err := serviceRegistration(b.cfg, service)
+		if err != nil {
+			return err
+		}
+
+		b.dereg[service] = register(b.c, key, rec, b.cfg.RegisterTTL)
+	}
+
+	return nil
+}
+
+func (b *be) Deregister(service string) error {
+	dereg := b.dereg[service]
+	if dereg == nil {
+		log.Printf("[WARN]: Attempted to deregister unknown service %q", service)
+		return nil
+	}
+	dereg <- true // trigger deregistration
+	<-dereg       // wait for completion
+	delete(b.dereg, service)
+
+	return nil
+}
+
+func (b *be) DeregisterAll() error {
+	log.Printf("[DEBUG]: etcd: Deregistering all registered aliases.")
+	for _, dereg := range b.dereg {
+		if dereg == nil {
+			continue
+		}
+		dereg <- true // trigger deregistration
+		<-dereg       // wait for completion
+	}
+	return nil
+}
+
+func (b *be) ManualPaths() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := b.c.Get(ctx, b.cfg.KVPath, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, kv := range manualKVs(resp.Kvs, b.cfg.KVPath) {
+		paths = append(paths, strings.TrimPrefix(string(kv.Key), b.cfg.KVPath))
+	}
+	return paths, nil
+}
+
+func (b *be) ReadManual(path string) (value string, version uint64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := b.c.Get(ctx, b.cfg.KVPath+path)
+	if err != nil || len(resp.Kvs) == 0 {
+		return "", 0, err
+	}
+	kv := resp.Kvs[0]
+	return strings.TrimSpace(string(kv.Value)), uint64(kv.ModRevision), nil
+}
+
+func (b *be) WriteManual(path string, value string, version uint64) (ok bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	// the mod revision of a key which does not exist is 0 so
+	// version 0 creates the key
+	key := b.cfg.KVPath + path
+	resp, err := b.c.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(version))).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (b *be) WatchServices() chan string {
+	log.Printf("[INFO] etcd: Using dynamic routes")
+	log.Printf("[INFO] etcd: Using tag prefix %q", b.cfg.TagPrefix)
+
+	svc := make(chan string)
+	go b.watch(b.cfg.ServicePath, true, func(kvs []*mvccpb.KeyValue) string {
+		return servicesConfig(kvs, b.cfg.ServicePath, b.cfg.TagPrefix)
+	}, svc)
+	return svc
+}
+
+func (b *be) WatchManual() chan string {
+	log.Printf("[INFO] etcd: Watching KV path %q", b.cfg.KVPath)
+
+	man := make(chan string)
+	go b.watch(b.cfg.KVPath, true, func(kvs []*mvccpb.KeyValue) string {
+		return manualConfig(manualKVs(kvs, b.cfg.KVPath))
+	}, man)
+	return man
+}
+
+func (b *be) WatchNoRouteHTML() chan string {
+	log.Printf("[INFO] etcd: Watching KV path %q", b.cfg.NoRouteHTMLPath)
+
+	html := make(chan string)
+	go b.watch(b.cfg.NoRouteHTMLPath, false, func(kvs []*mvccpb.KeyValue) string {
+		if len(kvs) == 0 {
+			return ""
+		}
+		return string(kvs[0].Value)
+	}, html)
+	return html
+}
+
+func stringInSlice(str string, strSlice []string) bool {
+	for _, s := range strSlice {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package etcd
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry/registrytest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// newEtcdServer starts a single node etcd server and returns a client
+// for it. The test requires the ETCD_EXE environment variable which
+// points to the etcd binary.
+func newEtcdServer(t *testing.T) *clientv3.Client {
+	etcd := os.Getenv("ETCD_EXE")
+	if etcd == "" {
+		t.Skip("ETCD_EXE not set")
+	}
+
+	clientURL, peerURL := freeURL(t), freeURL(t)
+	cmd := exec.Command(etcd,
+		"--data-dir", t.TempDir(),
+		"--log-level", "error",
+		"--listen-client-urls", clientURL.String(),
+		"--advertise-client-urls", clientURL.String(),
+		"--listen-peer-urls", peerURL.String(),
+		"--initial-advertise-peer-urls", peerURL.String(),
+		"--initial-cluster", "default="+peerURL.String(),
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start etcd: %s", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{clientURL.Host}, DialTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := c.Get(ctx, "health")
+		cancel()
+		if err == nil {
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for etcd: %s", err)
+		}
+	}
+}
+
+// freeURL returns a URL with a local port which is not in use.
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func newTestBackend(t *testing.T, c *clientv3.Client) *be {
+	b, err := NewBackend(&config.Etcd{
+		Endpoints:       c.Endpoints(),
+		ServicePath:     "/fabio/services",
+		KVPath:          "/fabio/config",
+		NoRouteHTMLPath: "/fabio/noroute.html",
+		TagPrefix:       "urlprefix-",
+		ServiceAddr:     "127.0.0.1:9998",
+		RegisterTTL:     2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.(*be).c.Close() })
+	return b.(*be)
+}
+
+func TestBackendWatchServices(t *testing.T) {
+	c := newEtcdServer(t)
+	b := newTestBackend(t, c)
+	ctx := context.Background()
+
+	put := func(key, value string) func() {
+		return func() {
+			if _, err := c.Put(ctx, key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	registrytest.Watch(t, b.WatchServices(), []registrytest.Step{
+		{Desc: "no services", Want: ""},
+		{
+			Desc:   "service added",
+			Update: put("/fabio/services/web/web-1", `{"address":"10.0.0.1","port":80,"tags":["urlprefix-/web"]}`),
+			Want:   "route add web /web http://10.0.0.1:80/",
+		},
+		{
+			Desc:   "service without routes added",
+			Update: put("/fabio/services/db/db-1", `{"address":"10.0.0.2","port":5432}`),
+			Same:   true,
+		},
+		{
+			Desc: "service deleted",
+			Update: func() {
+				if _, err := c.Delete(ctx, "/fabio/services/web/web-1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			Want: "",
+		},
+	})
+}
+
+func TestWaitForChange(t *testing.T) {
+	c := newEtcdServer(t)
+	b := newTestBackend(t, c)
+	ctx := context.Background()
+
+	resp, err := c.Put(ctx, "/fabio/config", "route del web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := resp.Header.Revision
+
+	// a change after the revision which was read returns immediately
+	if _, err := c.Put(ctx, "/fabio/config", "route del api"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.waitForChange("/fabio/config", rev, nil); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+
+	// a compacted revision is an error after which the keys are read again
+	resp, err = c.Put(ctx, "/fabio/config", "route del db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Compact(ctx, resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.waitForChange("/fabio/config", rev, nil); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
+
+func TestBackendManual(t *testing.T) {
+	c := newEtcdServer(t)
+	b := newTestBackend(t, c)
+
+	man := b.WatchManual()
+	registrytest.Manual(t, b, man, func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return "# --- /fabio/config\n" + value
+	})
+
+	if ok, err := b.WriteManual("/canary", "route weight web 0.1", 0); !ok || err != nil {
+		t.Fatalf("got %v, %v want true, nil", ok, err)
+	}
+	registrytest.Expect(t, man, "# --- /fabio/config\nroute del db\n\n# --- /fabio/config/canary\nroute weight web 0.1")
+
+	// keys which only share the prefix are ignored
+	if _, err := c.Put(context.Background(), "/fabio/configuration", "route del web"); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := b.ManualPaths()
+	if got, want := strings.Join(paths, ","), ",/canary"; err != nil || got != want {
+		t.Fatalf("got %q, %v want %q, nil", got, err, want)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	c := newEtcdServer(t)
+	ctx := context.Background()
+	const key = "/fabio/services/fabio/fabio-1"
+
+	// lease returns the lease of the record or 0 if there is none
+	lease := func() clientv3.LeaseID {
+		resp, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) == 0 {
+			return 0
+		}
+		return clientv3.LeaseID(resp.Kvs[0].Lease)
+	}
+	waitFor := func(desc string, fn func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !fn(); time.Sleep(50 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", desc)
+			}
+		}
+	}
+
+	dereg := register(c, key, &record{Address: "127.0.0.1", Port: 9998}, 2*time.Second)
+	waitFor("registration", func() bool { return lease() != 0 })
+	first := lease()
+
+	// the lease is kept alive after the TTL
+	time.Sleep(3 * time.Second)
+	if got, want := lease(), first; got != want {
+		t.Fatalf("got lease %x want %x", got, want)
+	}
+
+	// a lost lease is replaced with a new registration
+	if _, err := c.Revoke(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("registration with a new lease", func() bool { l := lease(); return l != 0 && l != first })
+
+	// deregistration deletes the record
+	dereg <- true
+	<-dereg
+	if got := lease(); got != 0 {
+		t.Fatalf("got lease %x after deregistration want none", got)
+	}
+}
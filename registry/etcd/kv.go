@@ -0,0 +1,91 @@
+package etcd
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// watch monitors the key or all keys with the prefix if prefix is true
+// and pushes the value which fn returns for the key/value pairs if there
+// is a difference.
+//
+// The keys are read again after every change since the values which fn
+// returns depend on all of them.
+func (b *be) watch(key string, prefix bool, fn func(kvs []*mvccpb.KeyValue) string, ch chan string) {
+	var opts []clientv3.OpOption
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+
+	var last string
+	var pushed bool
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		resp, err := b.c.Get(ctx, key, opts...)
+		cancel()
+		if err != nil {
+			log.Printf("[WARN] etcd: Error fetching %s. %v", key, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		value := fn(resp.Kvs)
+		if !pushed || value != last {
+			log.Printf("[DEBUG] etcd: %s changed to #%d", key, resp.Header.Revision)
+			ch <- value
+			last, pushed = value, true
+		}
+
+		// wait for the next change after the revision we have read
+		if err := b.waitForChange(key, resp.Header.Revision, opts); err != nil {
+			log.Printf("[WARN] etcd: Error watching %s. %v", key, err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// waitForChange blocks until the key or the keys with the prefix change
+// after the revision.
+func (b *be) waitForChange(key string, rev int64, opts []clientv3.OpOption) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts = append(opts, clientv3.WithRev(rev+1))
+	for resp := range b.c.Watch(clientv3.WithRequireLeader(ctx), key, opts...) {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		if len(resp.Events) > 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// manualKVs returns the key/value pairs which are the path itself or
+// below it. The prefix 'fabio/config' also matches 'fabio/configuration'.
+func manualKVs(kvs []*mvccpb.KeyValue, path string) []*mvccpb.KeyValue {
+	var res []*mvccpb.KeyValue
+	for _, kv := range kvs {
+		k := string(kv.Key)
+		if k == path || strings.HasPrefix(k, strings.TrimSuffix(path, "/")+"/") {
+			res = append(res, kv)
+		}
+	}
+	return res
+}
+
+// manualConfig concatenates the values of the key/value pairs, which
+// etcd returns sorted by key, with a comment which contains the key.
+func manualConfig(kvs []*mvccpb.KeyValue) string {
+	var s []string
+	for _, kv := range kvs {
+		s = append(s, "# --- "+string(kv.Key)+"\n"+strings.TrimSpace(string(kv.Value)))
+	}
+	return strings.Join(s, "\n\n")
+}
@@ -0,0 +1,23 @@
+package etcd
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestManualConfig(t *testing.T) {
+	kvs := []*mvccpb.KeyValue{
+		{Key: []byte("/fabio/config"), Value: []byte("route del web\n")},
+		{Key: []byte("/fabio/config/canary"), Value: []byte("route weight web 0.1")},
+		{Key: []byte("/fabio/configuration"), Value: []byte("route del api")},
+	}
+
+	want := "# --- /fabio/config\nroute del web\n\n# --- /fabio/config/canary\nroute weight web 0.1"
+	if got := manualConfig(manualKVs(kvs, "/fabio/config")); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := manualConfig(nil), ""; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,149 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// register keeps a service registered in etcd.
+//
+// The record of the service is attached to a lease with the TTL which is
+// kept alive as long as the service is registered. If fabio doesn't exit
+// cleanly the lease expires and etcd removes the record. If the lease is
+// lost, e.g. because etcd was not reachable for longer than the TTL, the
+// service is registered again with a new lease.
+//
+// When a value is sent in the dereg channel the service is deregistered from
+// etcd. To wait for completion the caller should read the next value from
+// the dereg channel.
+//
+//	dereg <- true // trigger deregistration
+//	<-dereg       // wait for completion
+func register(c *clientv3.Client, key string, rec *record, ttl time.Duration) chan bool {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		// a record can always be marshaled
+		panic(err)
+	}
+
+	register := func(ctx context.Context) (clientv3.LeaseID, <-chan *clientv3.LeaseKeepAliveResponse) {
+		rctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+
+		lease, err := c.Grant(rctx, int64(ttl.Seconds()))
+		if err != nil {
+			log.Printf("[ERROR] etcd: Cannot grant lease for fabio [key:%q]. %s", key, err)
+			return 0, nil
+		}
+		if _, err := c.Put(rctx, key, string(value), clientv3.WithLease(lease.ID)); err != nil {
+			log.Printf("[ERROR] etcd: Cannot register fabio [key:%q] in etcd. %s", key, err)
+			return 0, nil
+		}
+		alive, err := c.KeepAlive(ctx, lease.ID)
+		if err != nil {
+			log.Printf("[ERROR] etcd: Cannot keep lease of fabio [key:%q] alive. %s", key, err)
+			return 0, nil
+		}
+
+		log.Printf("[INFO] etcd: Registered fabio as %q", key)
+		log.Printf("[INFO] etcd: Registered fabio with address %q", net.JoinHostPort(rec.Address, strconv.Itoa(rec.Port)))
+		log.Printf("[INFO] etcd: Registered fabio with tags %q", strings.Join(rec.Tags, ","))
+		log.Printf("[INFO] etcd: Registered fabio with lease %x and TTL %s", lease.ID, ttl)
+		return lease.ID, alive
+	}
+
+	deregister := func(lease clientv3.LeaseID) {
+		log.Printf("[INFO] etcd: Deregistering %q", key)
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		if lease != 0 {
+			// revoking the lease deletes the record
+			c.Revoke(ctx, lease)
+		}
+	}
+
+	dereg := make(chan bool)
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var lease clientv3.LeaseID
+		var alive <-chan *clientv3.LeaseKeepAliveResponse
+
+		for {
+			var retry <-chan time.Time
+			if alive == nil {
+				lease, alive = register(ctx)
+				if alive == nil {
+					retry = time.After(time.Second)
+				}
+			}
+
+			select {
+			case <-dereg:
+				cancel()
+				deregister(lease)
+				dereg <- true
+				return
+			case <-retry:
+			case _, ok := <-alive:
+				// the client refreshes the lease. The channel is closed
+				// when the lease has expired or cannot be refreshed.
+				if !ok {
+					log.Printf("[WARN] etcd: Lost lease %x of %q", lease, key)
+					lease, alive = 0, nil
+				}
+			}
+		}
+	}()
+	return dereg
+}
+
+// serviceRegistration returns the key and the record for the
+// registration of fabio under the service name.
+func serviceRegistration(cfg *config.Etcd, serviceName string) (string, *record, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", nil, err
+	}
+	ipstr, portstr, err := net.SplitHostPort(cfg.ServiceAddr)
+	if err != nil {
+		return "", nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		ip, err = config.LocalIP()
+		if err != nil {
+			return "", nil, err
+		}
+		if ip == nil {
+			return "", nil, errors.New("no local ip")
+		}
+	}
+
+	serviceID := fmt.Sprintf("%s-%s-%d", serviceName, hostname, port)
+	key := strings.TrimSuffix(cfg.ServicePath, "/") + "/" + serviceName + "/" + serviceID
+
+	rec := &record{
+		Address: ip.String(),
+		Port:    port,
+		Tags:    cfg.ServiceTags,
+	}
+	return key, rec, nil
+}
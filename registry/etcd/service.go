@@ -0,0 +1,67 @@
+package etcd
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/fabiolb/fabio/registry/consul"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// record is a service instance which is stored as JSON under
+// '<servicepath>/<service>/<id>'.
+type record struct {
+	Address string   `json:"address"`
+	Port    int      `json:"port"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// serviceName returns the name of the service for the key of a service
+// instance or an empty string if the key has not the expected format.
+func serviceName(key, servicePath string) string {
+	prefix := strings.TrimSuffix(servicePath, "/") + "/"
+	if !strings.HasPrefix(key, prefix) {
+		return ""
+	}
+	p := strings.Split(strings.TrimPrefix(key, prefix), "/")
+	if len(p) != 2 || p[0] == "" || p[1] == "" {
+		return ""
+	}
+	return p[0]
+}
+
+// servicesConfig builds the config for the service instances which
+// have tags with the right prefix.
+//
+// There is no health check for the instances. Services should attach
+// their records to a lease so that they are removed when the service
+// stops refreshing it.
+func servicesConfig(kvs []*mvccpb.KeyValue, servicePath, tagPrefix string) string {
+	var config []string
+	for _, kv := range kvs {
+		name := serviceName(string(kv.Key), servicePath)
+		if name == "" {
+			log.Printf("[WARN] etcd: Skipping %s since the key is not <service>/<id>", kv.Key)
+			continue
+		}
+
+		var r record
+		if err := json.Unmarshal(kv.Value, &r); err != nil {
+			log.Printf("[WARN] etcd: Skipping %s since the record is invalid. %v", kv.Key, err)
+			continue
+		}
+		if r.Address == "" || r.Port == 0 {
+			log.Printf("[WARN] etcd: Skipping %s since address or port are missing", kv.Key)
+			continue
+		}
+
+		config = append(config, consul.RouteCmds(name, r.Address, r.Port, r.Tags, tagPrefix, nil)...)
+	}
+
+	// sort config in reverse order to sort most specific config to the top
+	sort.Sort(sort.Reverse(sort.StringSlice(config)))
+
+	return strings.Join(config, "\n")
+}
@@ -0,0 +1,82 @@
+package etcd
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestServiceName(t *testing.T) {
+	tests := []struct {
+		key, path, name string
+	}{
+		{"/fabio/services/web/web-1", "/fabio/services", "web"},
+		{"/fabio/services/web/web-1", "/fabio/services/", "web"},
+		{"/fabio/services/web", "/fabio/services", ""},
+		{"/fabio/services/web/", "/fabio/services", ""},
+		{"/fabio/services/web/a/b", "/fabio/services", ""},
+		{"/fabio/servicesfoo/web/web-1", "/fabio/services", ""},
+		{"/other/web/web-1", "/fabio/services", ""},
+	}
+
+	for i, tt := range tests {
+		if got, want := serviceName(tt.key, tt.path), tt.name; got != want {
+			t.Errorf("%d: got %q want %q", i, got, want)
+		}
+	}
+}
+
+func TestServicesConfig(t *testing.T) {
+	kv := func(key, value string) *mvccpb.KeyValue {
+		return &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value)}
+	}
+
+	tests := []struct {
+		desc string
+		kvs  []*mvccpb.KeyValue
+		cfg  string
+	}{
+		{
+			desc: "no records",
+			kvs:  nil,
+			cfg:  "",
+		},
+		{
+			desc: "records with and without tag prefix",
+			kvs: []*mvccpb.KeyValue{
+				kv("/fabio/services/web/web-1", `{"address":"10.0.0.1","port":8080,"tags":["urlprefix-/web","v1"]}`),
+				kv("/fabio/services/web/web-2", `{"address":"10.0.0.2","port":8080,"tags":["urlprefix-/web","v1"]}`),
+				kv("/fabio/services/db/db-1", `{"address":"10.0.0.3","port":5432,"tags":["postgres"]}`),
+			},
+			cfg: `route add web /web http://10.0.0.2:8080/ tags "v1"` + "\n" +
+				`route add web /web http://10.0.0.1:8080/ tags "v1"`,
+		},
+		{
+			desc: "options and multiple prefixes",
+			kvs: []*mvccpb.KeyValue{
+				kv("/fabio/services/api/api-1", `{"address":"10.0.0.1","port":9000,"tags":["urlprefix-/api strip=/api","urlprefix-api.example.com/"]}`),
+			},
+			cfg: `route add api api.example.com/ http://10.0.0.1:9000/` + "\n" +
+				`route add api /api http://10.0.0.1:9000/ opts "strip=/api"`,
+		},
+		{
+			desc: "invalid records are skipped",
+			kvs: []*mvccpb.KeyValue{
+				kv("/fabio/services/web", `{"address":"10.0.0.1","port":8080,"tags":["urlprefix-/web"]}`),
+				kv("/fabio/services/web/web-1", `not json`),
+				kv("/fabio/services/web/web-2", `{"port":8080,"tags":["urlprefix-/web"]}`),
+				kv("/fabio/services/web/web-3", `{"address":"10.0.0.3","tags":["urlprefix-/web"]}`),
+				kv("/fabio/services/web/web-4", `{"address":"10.0.0.4","port":8080,"tags":["urlprefix-/web"]}`),
+			},
+			cfg: `route add web /web http://10.0.0.4:8080/`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got, want := servicesConfig(tt.kvs, "/fabio/services", "urlprefix-"), tt.cfg; got != want {
+				t.Fatalf("got %q want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+// Package kubernetes implements a registry backend which watches the
+// services, endpoint slices and ingresses of a Kubernetes cluster.
+package kubernetes
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry"
+)
+
+// noRouteHTMLKey is the key of the config map with the HTML which is
+// returned when no route is found.
+const noRouteHTMLKey = "noroute.html"
+
+// defaultManualKey is the key of the config map for the default
+// manual overrides.
+const defaultManualKey = "routes"
+
+// be is an implementation of a registry backend for kubernetes.
+type be struct {
+	c   *client
+	cfg *config.Kubernetes
+
+	// cmNamespace and cmName identify the config map for the manual
+	// overrides. They are empty if no config map is configured.
+	cmNamespace, cmName string
+}
+
+func NewBackend(cfg *config.Kubernetes) (registry.Backend, error) {
+	b := &be{cfg: cfg}
+	if cfg.ConfigMap != "" {
+		p := strings.Split(cfg.ConfigMap, "/")
+		if len(p) != 2 || p[0] == "" || p[1] == "" {
+			return nil, fmt.Errorf("kubernetes: invalid config map %q. Expected <namespace>/<name>", cfg.ConfigMap)
+		}
+		b.cmNamespace, b.cmName = p[0], p[1]
+	}
+
+	c, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	b.c = c
+
+	// ping the API server
+	var v struct {
+		GitVersion string `json:"gitVersion"`
+	}
+	if err := c.get("/version", &v); err != nil {
+		return nil, err
+	}
+
+	// we're good
+	log.Printf("[INFO] kubernetes: Connecting to %q with version %s", c.addr, v.GitVersion)
+	return b, nil
+}
+
+func (b *be) Register(services []string) error {
+	return nil
+}
+
+func (b *be) Deregister(serviceName string) error {
+	return nil
+}
+
+func (b *be) DeregisterAll() error {
+	return nil
+}
+
+func (b *be) ManualPaths() ([]string, error) {
+	cm, err := b.readConfigMap()
+	if err != nil || cm == nil {
+		return nil, err
+	}
+	var paths []string
+	for _, k := range manualKeys(cm) {
+		if k == defaultManualKey {
+			paths = append(paths, "")
+		} else {
+			paths = append(paths, "/"+k)
+		}
+	}
+	return paths, nil
+}
+
+func (b *be) ReadManual(path string) (value string, version uint64, err error) {
+	cm, err := b.readConfigMap()
+	if err != nil || cm == nil {
+		return "", 0, err
+	}
+	version, _ = strconv.ParseUint(cm.Metadata.ResourceVersion, 10, 64)
+	return strings.TrimSpace(cm.Data[manualKey(path)]), version, nil
+}
+
+func (b *be) WriteManual(path string, value string, version uint64) (ok bool, err error) {
+	if b.cmName == "" {
+		return false, fmt.Errorf("kubernetes: registry.kubernetes.configmap not set")
+	}
+
+	// create the config map if it did not exist, otherwise update it
+	// if its resource version still matches.
+	cm := configMap{
+		Metadata: objectMeta{Name: b.cmName, Namespace: b.cmNamespace},
+		Data:     map[string]string{manualKey(path): value},
+	}
+	if version == 0 {
+		cm.APIVersion, cm.Kind = "v1", "ConfigMap"
+		err = b.c.send("POST", "/api/v1/namespaces/"+b.cmNamespace+"/configmaps", "application/json", cm)
+	} else {
+		cm.Metadata.ResourceVersion = strconv.FormatUint(version, 10)
+		err = b.c.send("PATCH", b.configMapPath(), "application/merge-patch+json", cm)
+	}
+	if err == errConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *be) WatchServices() chan string {
+	log.Printf("[INFO] kubernetes: Using dynamic routes")
+	log.Printf("[INFO] kubernetes: Using annotation %q", b.cfg.Annotation)
+
+	var (
+		services  = newCache[*service]()
+		slices    = newCache[*endpointSlice]()
+		ingresses = newCache[*ingress]()
+		changed   = make(chan struct{}, 1)
+	)
+	go watchResource(b.c, b.resourcePath("/api/v1", "services"), services, changed)
+	go watchResource(b.c, b.resourcePath("/apis/discovery.k8s.io/v1", "endpointslices"), slices, changed)
+	if b.cfg.IngressClass != "" {
+		log.Printf("[INFO] kubernetes: Using ingresses with class %q", b.cfg.IngressClass)
+		go watchResource(b.c, b.resourcePath("/apis/networking.k8s.io/v1", "ingresses"), ingresses, changed)
+	} else {
+		ingresses.replace(map[string]*ingress{})
+	}
+
+	svc := make(chan string)
+	go func() {
+		var last string
+		for range changed {
+			svcs, ok1 := services.list()
+			sls, ok2 := slices.list()
+			ings, ok3 := ingresses.list()
+			// wait until all resources have been listed to avoid
+			// routing tables with missing routes on startup.
+			if !ok1 || !ok2 || !ok3 {
+				continue
+			}
+			next := b.routes(svcs, sls, ings)
+			if next == last {
+				continue
+			}
+			log.Printf("[DEBUG] kubernetes: Routes changed")
+			svc <- next
+			last = next
+		}
+	}()
+	return svc
+}
+
+func (b *be) WatchManual() chan string {
+	if b.cmName == "" {
+		return make(chan string)
+	}
+	log.Printf("[INFO] kubernetes: Watching config map %q", b.cfg.ConfigMap)
+	return b.watchConfigMap(func(cm *configMap) string {
+		var s []string
+		for _, k := range manualKeys(cm) {
+			s = append(s, "# --- "+k+"\n"+strings.TrimSpace(cm.Data[k]))
+		}
+		return strings.Join(s, "\n\n")
+	})
+}
+
+func (b *be) WatchNoRouteHTML() chan string {
+	if b.cmName == "" {
+		return make(chan string)
+	}
+	log.Printf("[INFO] kubernetes: Watching key %q of config map %q", noRouteHTMLKey, b.cfg.ConfigMap)
+	return b.watchConfigMap(func(cm *configMap) string {
+		return cm.Data[noRouteHTMLKey]
+	})
+}
+
+// routes returns the route commands for the annotated services and the
+// ingresses.
+func (b *be) routes(services []*service, slices []*endpointSlice, ingresses []*ingress) string {
+	// group the endpoint slices by the namespace/name key of their service
+	slicesBySvc := map[string][]*endpointSlice{}
+	for _, sl := range slices {
+		name := sl.Metadata.Labels[serviceNameLabel]
+		if name == "" {
+			continue
+		}
+		key := sl.Metadata.Namespace + "/" + name
+		slicesBySvc[key] = append(slicesBySvc[key], sl)
+	}
+
+	var config []string
+	svcsByNamespace := map[string]map[string]*service{}
+	for _, svc := range services {
+		ns := svc.Metadata.Namespace
+		if svcsByNamespace[ns] == nil {
+			svcsByNamespace[ns] = map[string]*service{}
+		}
+		svcsByNamespace[ns][svc.Metadata.Name] = svc
+
+		if svc.Metadata.Annotations[b.cfg.Annotation] == "" {
+			continue
+		}
+		r := routecmd{svc: svc, slices: slicesBySvc[svc.Metadata.key()], annotation: b.cfg.Annotation}
+		config = append(config, r.build()...)
+	}
+
+	for _, ing := range ingresses {
+		if !b.handlesIngress(ing) {
+			continue
+		}
+		ns := ing.Metadata.Namespace
+		r := ingresscmd{ing: ing, services: svcsByNamespace[ns], slices: map[string][]*endpointSlice{}}
+		for name := range r.services {
+			r.slices[name] = slicesBySvc[ns+"/"+name]
+		}
+		config = append(config, r.build()...)
+	}
+	return strings.Join(config, "\n")
+}
+
+// handlesIngress returns true if the ingress has the configured class.
+func (b *be) handlesIngress(ing *ingress) bool {
+	if ing.Spec.IngressClassName != nil {
+		return *ing.Spec.IngressClassName == b.cfg.IngressClass
+	}
+	return ing.Metadata.Annotations[ingressClassAnnotation] == b.cfg.IngressClass
+}
+
+// resourcePath returns the API path of the resource in the configured
+// namespace or in all namespaces.
+func (b *be) resourcePath(api, resource string) string {
+	if b.cfg.Namespace == "" {
+		return api + "/" + resource
+	}
+	return api + "/namespaces/" + b.cfg.Namespace + "/" + resource
+}
+
+func (b *be) configMapPath() string {
+	return "/api/v1/namespaces/" + b.cmNamespace + "/configmaps/" + b.cmName
+}
+
+// readConfigMap returns the config map for the manual overrides or nil
+// if it is not configured or does not exist.
+func (b *be) readConfigMap() (*configMap, error) {
+	if b.cmName == "" {
+		return nil, nil
+	}
+	cm := &configMap{}
+	switch err := b.c.get(b.configMapPath(), cm); err {
+	case nil:
+		return cm, nil
+	case errNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// watchConfigMap watches the config map for the manual overrides and
+// pushes the value which fn returns for it if there is a difference.
+// fn is called with an empty config map if it does not exist.
+func (b *be) watchConfigMap(fn func(cm *configMap) string) chan string {
+	path := "/api/v1/namespaces/" + b.cmNamespace + "/configmaps?fieldSelector=" + url.QueryEscape("metadata.name="+b.cmName)
+	cms := newCache[*configMap]()
+	changed := make(chan struct{}, 1)
+	go watchResource(b.c, path, cms, changed)
+
+	ch := make(chan string)
+	go func() {
+		var last string
+		var pushed bool
+		for range changed {
+			cm := &configMap{}
+			if objs, _ := cms.list(); len(objs) > 0 {
+				cm = objs[0]
+			}
+			next := fn(cm)
+			if pushed && next == last {
+				continue
+			}
+			ch <- next
+			last, pushed = next, true
+		}
+	}()
+	return ch
+}
+
+// manualKeys returns the sorted keys of the config map with manual
+// overrides.
+func manualKeys(cm *configMap) []string {
+	var keys []string
+	for k := range cm.Data {
+		if k != noRouteHTMLKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// manualKey returns the config map key for the path of the manual
+// overrides.
+func manualKey(path string) string {
+	if path = strings.TrimPrefix(path, "/"); path == "" {
+		return defaultManualKey
+	}
+	return path
+}
@@ -0,0 +1,276 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry/registrytest"
+)
+
+// apiServer is a fake Kubernetes API server which serves fixed lists,
+// streams the events which the test sends for a watch and stores a
+// single config map.
+type apiServer struct {
+	*httptest.Server
+
+	lists  map[string]string
+	events map[string]chan string
+
+	mu       sync.Mutex
+	cm       *configMap
+	version  int
+	selector string
+}
+
+func newAPIServer(t *testing.T, lists map[string]string) *apiServer {
+	s := &apiServer{lists: lists, events: map[string]chan string{}}
+	for path := range lists {
+		s.events[path] = make(chan string, 10)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"gitVersion":"v1.30.0"}`)
+	})
+	mux.HandleFunc("/api/v1/namespaces/fabio/configmaps", s.createConfigMap)
+	mux.HandleFunc("/api/v1/namespaces/fabio/configmaps/routes", s.configMap)
+	mux.HandleFunc("/", s.serveList)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		s.CloseClientConnections()
+		s.Close()
+	})
+	return s
+}
+
+// serveList serves the list or the watch for the path.
+func (s *apiServer) serveList(w http.ResponseWriter, r *http.Request) {
+	list, ok := s.lists[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	s.selector = r.URL.Query().Get("fieldSelector")
+	s.mu.Unlock()
+
+	if r.URL.Query().Get("watch") != "1" {
+		fmt.Fprint(w, list)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case ev := <-s.events[r.URL.Path]:
+			fmt.Fprintln(w, ev)
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *apiServer) createConfigMap(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		s.serveList(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cm != nil {
+		http.Error(w, "exists", http.StatusConflict)
+		return
+	}
+	cm := &configMap{}
+	json.NewDecoder(r.Body).Decode(cm)
+	s.version++
+	cm.Metadata.ResourceVersion = strconv.Itoa(s.version)
+	s.cm = cm
+}
+
+func (s *apiServer) configMap(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cm == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(s.cm)
+	case "PATCH":
+		if got, want := r.Header.Get("Content-Type"), "application/merge-patch+json"; got != want {
+			http.Error(w, "invalid content type "+got, http.StatusUnsupportedMediaType)
+			return
+		}
+		var patch configMap
+		json.NewDecoder(r.Body).Decode(&patch)
+		if patch.Metadata.ResourceVersion != s.cm.Metadata.ResourceVersion {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+		for k, v := range patch.Data {
+			s.cm.Data[k] = v
+		}
+		s.version++
+		s.cm.Metadata.ResourceVersion = strconv.Itoa(s.version)
+	}
+}
+
+func newTestBackend(t *testing.T, s *apiServer, cfg config.Kubernetes) *be {
+	cfg.Addr = s.URL
+	cfg.Annotation = "fabio.urlprefix"
+	b, err := NewBackend(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*be)
+}
+
+func TestBackendWatchServices(t *testing.T) {
+	const slice = `{"metadata":{"name":"web-1","namespace":"web","resourceVersion":"%d","labels":{"kubernetes.io/service-name":"web"}},
+		"addressType":"IPv4","ports":[{"name":"http","port":8080}],
+		"endpoints":[{"addresses":["10.0.0.1"]},{"addresses":["10.0.0.2"],"conditions":{"ready":%v}}]}`
+
+	s := newAPIServer(t, map[string]string{
+		"/api/v1/namespaces/web/services": `{"metadata":{"resourceVersion":"10"},"items":[
+			{"metadata":{"name":"web","namespace":"web","annotations":{"fabio.urlprefix":"example.com/"}},"spec":{"ports":[{"name":"http","port":80}]}},
+			{"metadata":{"name":"db","namespace":"web"},"spec":{"ports":[{"port":5432}]}}
+		]}`,
+		"/apis/discovery.k8s.io/v1/namespaces/web/endpointslices": `{"metadata":{"resourceVersion":"10"},"items":[` + fmt.Sprintf(slice, 10, false) + `]}`,
+		"/apis/networking.k8s.io/v1/namespaces/web/ingresses": `{"metadata":{"resourceVersion":"10"},"items":[
+			{"metadata":{"name":"api","namespace":"web"},"spec":{"ingressClassName":"fabio","rules":[{"host":"api.example.com","http":{"paths":[{"path":"/v1","backend":{"service":{"name":"web","port":{"number":80}}}}]}}]}},
+			{"metadata":{"name":"other","namespace":"web","annotations":{"kubernetes.io/ingress.class":"nginx"}},"spec":{"rules":[{"host":"other.example.com","http":{"paths":[{"backend":{"service":{"name":"web","port":{"number":80}}}}]}}]}}
+		]}`,
+	})
+	b := newTestBackend(t, s, config.Kubernetes{Namespace: "web", IngressClass: "fabio"})
+	event := func(path, ev string) func() {
+		return func() { s.events[path] <- ev }
+	}
+
+	registrytest.Watch(t, b.WatchServices(), []registrytest.Step{
+		{
+			Desc: "ready endpoint",
+			Want: "route add web.web example.com/ http://10.0.0.1:8080/\n" +
+				"route add web.web api.example.com/v1 http://10.0.0.1:8080/",
+		},
+		{
+			Desc:   "second endpoint becomes ready",
+			Update: event("/apis/discovery.k8s.io/v1/namespaces/web/endpointslices", `{"type":"MODIFIED","object":`+fmt.Sprintf(slice, 11, true)+`}`),
+			Want: "route add web.web example.com/ http://10.0.0.1:8080/\n" +
+				"route add web.web example.com/ http://10.0.0.2:8080/\n" +
+				"route add web.web api.example.com/v1 http://10.0.0.1:8080/\n" +
+				"route add web.web api.example.com/v1 http://10.0.0.2:8080/",
+		},
+		{
+			Desc:   "annotation removed",
+			Update: event("/api/v1/namespaces/web/services", `{"type":"MODIFIED","object":{"metadata":{"name":"web","namespace":"web","resourceVersion":"12"},"spec":{"ports":[{"name":"http","port":80}]}}}`),
+			Want: "route add web.web api.example.com/v1 http://10.0.0.1:8080/\n" +
+				"route add web.web api.example.com/v1 http://10.0.0.2:8080/",
+		},
+		{
+			Desc:   "ingress deleted",
+			Update: event("/apis/networking.k8s.io/v1/namespaces/web/ingresses", `{"type":"DELETED","object":{"metadata":{"name":"api","namespace":"web","resourceVersion":"13"}}}`),
+			Want:   "",
+		},
+	})
+}
+
+func TestBackendManual(t *testing.T) {
+	s := newAPIServer(t, map[string]string{})
+	b := newTestBackend(t, s, config.Kubernetes{ConfigMap: "fabio/routes"})
+
+	paths, err := b.ManualPaths()
+	if err != nil || paths != nil {
+		t.Fatalf("got %q, %v want nil, nil", paths, err)
+	}
+	// version 0 creates the config map
+	registrytest.Manual(t, b, nil, nil)
+
+	// all paths share the version of the config map
+	value, version, err := b.ReadManual("")
+	if err != nil || value != "route del db" || version != 2 {
+		t.Fatalf("got %q, %d, %v want \"route del db\", 2, nil", value, version, err)
+	}
+	if ok, err := b.WriteManual("/canary", "route weight web 0.1", version); !ok || err != nil {
+		t.Fatalf("got %v, %v want true, nil", ok, err)
+	}
+	// stale version
+	if ok, err := b.WriteManual("", "route del api", version); ok || err != nil {
+		t.Fatalf("got %v, %v want false, nil", ok, err)
+	}
+
+	value, version, err = b.ReadManual("/canary")
+	if err != nil || value != "route weight web 0.1" || version != 3 {
+		t.Fatalf("got %q, %d, %v want \"route weight web 0.1\", 3, nil", value, version, err)
+	}
+	paths, err = b.ManualPaths()
+	if got, want := fmt.Sprint(paths), "[/canary ]"; err != nil || got != want {
+		t.Fatalf("got %q, %v want %q, nil", got, err, want)
+	}
+}
+
+func TestBackendWatchManual(t *testing.T) {
+	list := `{"metadata":{"resourceVersion":"5"},"items":[{"metadata":{"name":"routes","namespace":"fabio","resourceVersion":"5"},
+		"data":{"routes":"route del web\n","canary":"route weight web 0.1","noroute.html":"<h1>no route</h1>"}}]}`
+	s := newAPIServer(t, map[string]string{"/api/v1/namespaces/fabio/configmaps": list})
+	b := newTestBackend(t, s, config.Kubernetes{ConfigMap: "fabio/routes"})
+
+	want := "# --- canary\nroute weight web 0.1\n\n# --- routes\nroute del web"
+	if got := registrytest.Receive(t, b.WatchManual()); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := registrytest.Receive(t, b.WatchNoRouteHTML()), "<h1>no route</h1>"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if got, want := s.selector, "metadata.name=routes"; got != want {
+		t.Fatalf("got field selector %q want %q", got, want)
+	}
+}
+
+func TestNewBackendInvalidConfigMap(t *testing.T) {
+	s := newAPIServer(t, map[string]string{})
+	if _, err := NewBackend(&config.Kubernetes{Addr: s.URL, ConfigMap: "routes"}); err == nil {
+		t.Fatal("got nil want error")
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+
+	// the token is read for every request since it is rotated
+	token := filepath.Join(t.TempDir(), "token")
+	c, err := newClient(&config.Kubernetes{Addr: srv.URL, TokenPath: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range []string{"first", "second"} {
+		if err := os.WriteFile(token, []byte(tok+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.get("/version", &struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := auth, "Bearer "+tok; got != want {
+			t.Fatalf("got %q want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// errGone is returned by watch when the resource version is too old
+// and the objects have to be listed again.
+var errGone = errors.New("kubernetes: resource version too old")
+
+// errConflict is returned when an update failed because the object
+// was modified or already exists.
+var errConflict = errors.New("kubernetes: conflict")
+
+// errNotFound is returned when the object does not exist.
+var errNotFound = errors.New("kubernetes: not found")
+
+// client is a minimal client for the Kubernetes API server which
+// supports the list, watch, get, create and patch requests of the
+// backend.
+type client struct {
+	addr      string
+	tokenPath string
+	http      *http.Client
+}
+
+func newClient(cfg *config.Kubernetes) (*client, error) {
+	addr := cfg.Addr
+	if addr == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("kubernetes: registry.kubernetes.addr not set and not running in a cluster")
+		}
+		addr = "https://" + net.JoinHostPort(host, port)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: invalid address %q: %s", addr, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("kubernetes: invalid address %q: scheme must be http or https", addr)
+	}
+
+	// The CA certificate of the service account does not exist outside
+	// of the cluster, e.g. when connecting to 'kubectl proxy'. Then the
+	// system roots are used.
+	tlscfg := &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}
+	if cfg.CAPath != "" {
+		pem, err := os.ReadFile(cfg.CAPath)
+		switch {
+		case err == nil:
+			tlscfg.RootCAs = x509.NewCertPool()
+			if !tlscfg.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("kubernetes: no certificates in %s", cfg.CAPath)
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+
+	return &client{
+		addr:      strings.TrimSuffix(u.String(), "/"),
+		tokenPath: cfg.TokenPath,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlscfg,
+			},
+		},
+	}, nil
+}
+
+// do sends the request and returns the response if the status code is
+// 2xx. The token is read for every request since the kubelet rotates
+// the projected service account tokens.
+func (c *client) do(method, path string, body []byte, contentType string, timeout time.Duration) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.addr+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.tokenPath != "" {
+		if token, err := os.ReadFile(c.tokenPath); err == nil {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+	}
+
+	hc := c.http
+	if timeout > 0 {
+		hc = &http.Client{Transport: c.http.Transport, Timeout: timeout}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch resp.StatusCode {
+	case http.StatusConflict:
+		return nil, errConflict
+	case http.StatusNotFound:
+		return nil, errNotFound
+	case http.StatusGone:
+		return nil, errGone
+	}
+	return nil, fmt.Errorf("kubernetes: %s %s failed with status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(msg))
+}
+
+// get decodes the object or list at the path into v.
+func (c *client) get(path string, v interface{}) error {
+	resp, err := c.do("GET", path, nil, "", requestTimeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// send creates or patches an object.
+func (c *client) send(method, path, contentType string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(method, path, body, contentType, requestTimeout)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// requestTimeout is the timeout for all requests but watches.
+const requestTimeout = 30 * time.Second
+
+// watchTimeout is the time after which the API server closes a watch.
+const watchTimeout = 5 * time.Minute
+
+// event is a watch event.
+type event struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// status is the object of an ERROR event.
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// watch watches the objects at the path starting after the resource
+// version and calls fn for every added, modified and deleted object.
+// It returns the last resource version when the API server closes the
+// watch.
+func (c *client) watch(path, version string, fn func(typ string, obj json.RawMessage)) (string, error) {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	q := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(watchTimeout.Seconds()))},
+	}
+	resp, err := c.do("GET", path+sep+q.Encode(), nil, "", 0)
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev event
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return version, nil
+			}
+			return version, err
+		}
+
+		if ev.Type == "ERROR" {
+			var st status
+			json.Unmarshal(ev.Object, &st)
+			if st.Code == http.StatusGone {
+				return version, errGone
+			}
+			return version, fmt.Errorf("kubernetes: watch %s failed: %s", path, st.Message)
+		}
+
+		var obj struct {
+			Metadata objectMeta `json:"metadata"`
+		}
+		if err := json.Unmarshal(ev.Object, &obj); err != nil {
+			return version, err
+		}
+		if obj.Metadata.ResourceVersion != "" {
+			version = obj.Metadata.ResourceVersion
+		}
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			fn(ev.Type, ev.Object)
+		case "BOOKMARK":
+		default:
+			log.Printf("[WARN] kubernetes: Unknown watch event %q for %s", ev.Type, path)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package kubernetes
+
+// The types below contain the fields of the Kubernetes API objects which
+// are used by the backend.
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// key returns the namespace/name key of the object.
+func (m objectMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type service struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		Ports []servicePort `json:"ports"`
+	} `json:"spec"`
+}
+
+type servicePort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+// serviceNameLabel is the label of an endpoint slice with the name of
+// the service.
+const serviceNameLabel = "kubernetes.io/service-name"
+
+type endpointSlice struct {
+	Metadata    objectMeta     `json:"metadata"`
+	AddressType string         `json:"addressType"`
+	Endpoints   []endpoint     `json:"endpoints"`
+	Ports       []endpointPort `json:"ports"`
+}
+
+type endpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		Ready *bool `json:"ready"`
+	} `json:"conditions"`
+}
+
+type endpointPort struct {
+	Name *string `json:"name"`
+	Port *int    `json:"port"`
+}
+
+type ingress struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		IngressClassName *string `json:"ingressClassName"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path    string `json:"path"`
+					Backend struct {
+						Service *struct {
+							Name string `json:"name"`
+							Port struct {
+								Name   string `json:"name"`
+								Number int    `json:"number"`
+							} `json:"port"`
+						} `json:"service"`
+					} `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// ingressClassAnnotation is the deprecated annotation for the ingress
+// class which is still widely used.
+const ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+type configMap struct {
+	APIVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   objectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
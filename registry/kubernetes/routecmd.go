@@ -0,0 +1,178 @@
+package kubernetes
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fabiolb/fabio/registry/consul"
+)
+
+// routecmd builds the route commands for a service from the routes in
+// its annotation.
+type routecmd struct {
+	// svc is the kubernetes service.
+	svc *service
+
+	// slices are the endpoint slices of the service.
+	slices []*endpointSlice
+
+	// annotation is the name of the annotation with the routes, e.g.
+	// 'fabio.urlprefix'. It contains one route per line.
+	annotation string
+}
+
+// build returns the route commands for the routes in the annotation.
+// A route has the same syntax as a consul 'urlprefix-' tag without the
+// prefix. The 'port' option selects the service port by name or number.
+func (r routecmd) build() []string {
+	var config []string
+	for _, line := range strings.Split(r.svc.Metadata.Annotations[r.annotation], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var port string
+		tag := []string{fields[0]}
+		for _, o := range fields[1:] {
+			if strings.HasPrefix(o, "port=") {
+				port = o[len("port="):]
+				continue
+			}
+			tag = append(tag, o)
+		}
+
+		sp, ok := findPort(r.svc, port, 0)
+		if !ok {
+			log.Printf("[WARN] kubernetes: Service %s has no port %q", r.svc.Metadata.key(), port)
+			continue
+		}
+
+		for _, ep := range endpoints(r.slices, sp.Name) {
+			config = append(config, consul.RouteCmds(serviceName(r.svc.Metadata), ep.host, ep.port, []string{strings.Join(tag, " ")}, "", nil)...)
+		}
+	}
+	return config
+}
+
+// ingresscmd builds the route commands for the rules of an ingress.
+type ingresscmd struct {
+	ing *ingress
+
+	// services are the services in the namespace of the ingress by name.
+	services map[string]*service
+
+	// slices are the endpoint slices of the services by service name.
+	slices map[string][]*endpointSlice
+}
+
+func (r ingresscmd) build() []string {
+	var config []string
+	for _, rule := range r.ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			backend := p.Backend.Service
+			if backend == nil {
+				continue
+			}
+			svc := r.services[backend.Name]
+			if svc == nil {
+				log.Printf("[WARN] kubernetes: Ingress %s refers to unknown service %q", r.ing.Metadata.key(), backend.Name)
+				continue
+			}
+			sp, ok := findPort(svc, backend.Port.Name, backend.Port.Number)
+			if !ok {
+				log.Printf("[WARN] kubernetes: Ingress %s refers to unknown port of service %q", r.ing.Metadata.key(), backend.Name)
+				continue
+			}
+
+			path := p.Path
+			if path == "" {
+				path = "/"
+			}
+			route := strings.ToLower(rule.Host) + path
+			for _, ep := range endpoints(r.slices[backend.Name], sp.Name) {
+				config = append(config, "route add "+serviceName(svc.Metadata)+" "+route+" http://"+ep.String()+"/")
+			}
+		}
+	}
+	return config
+}
+
+// serviceName returns the name of the service in the routing table.
+func serviceName(m objectMeta) string {
+	return m.Name + "." + m.Namespace
+}
+
+// findPort returns the port of the service with the given name or
+// number. port can also be the number as string. If both are empty the
+// first port is returned.
+func findPort(svc *service, port string, number int) (servicePort, bool) {
+	if port == "" && number == 0 {
+		if len(svc.Spec.Ports) == 0 {
+			return servicePort{}, false
+		}
+		return svc.Spec.Ports[0], true
+	}
+	for _, p := range svc.Spec.Ports {
+		if port != "" && (p.Name == port || strconv.Itoa(p.Port) == port) {
+			return p, true
+		}
+		if number != 0 && p.Port == number {
+			return p, true
+		}
+	}
+	return servicePort{}, false
+}
+
+// endpointAddr is the address of a ready endpoint.
+type endpointAddr struct {
+	host string
+	port int
+}
+
+func (a endpointAddr) String() string {
+	return net.JoinHostPort(a.host, strconv.Itoa(a.port))
+}
+
+// endpoints returns the addresses of the ready endpoints for the named
+// service port sorted by host and port.
+func endpoints(slices []*endpointSlice, portName string) []endpointAddr {
+	seen := map[endpointAddr]bool{}
+	var addrs []endpointAddr
+	for _, sl := range slices {
+		port := -1
+		for _, p := range sl.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			if name == portName && p.Port != nil {
+				port = *p.Port
+			}
+		}
+		if port < 0 {
+			continue
+		}
+		for _, ep := range sl.Endpoints {
+			// endpoints without ready condition are ready
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, a := range ep.Addresses {
+				addr := endpointAddr{host: a, port: port}
+				if !seen[addr] {
+					seen[addr] = true
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+	return addrs
+}
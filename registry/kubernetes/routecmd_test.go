@@ -0,0 +1,173 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func boolp(b bool) *bool       { return &b }
+func intp(n int) *int          { return &n }
+func stringp(s string) *string { return &s }
+
+func newService(name, routes string, ports ...servicePort) *service {
+	svc := &service{Metadata: objectMeta{
+		Name:        name,
+		Namespace:   "default",
+		Annotations: map[string]string{"fabio.urlprefix": routes},
+	}}
+	svc.Spec.Ports = ports
+	return svc
+}
+
+func newSlice(name, service, port string, number int, addrs ...string) *endpointSlice {
+	sl := &endpointSlice{Metadata: objectMeta{
+		Name:      name,
+		Namespace: "default",
+		Labels:    map[string]string{serviceNameLabel: service},
+	}}
+	sl.Ports = []endpointPort{{Name: stringp(port), Port: intp(number)}}
+	for _, a := range addrs {
+		sl.Endpoints = append(sl.Endpoints, endpoint{Addresses: []string{a}})
+	}
+	return sl
+}
+
+func TestRouteCmd(t *testing.T) {
+	http := servicePort{Name: "http", Port: 80}
+	admin := servicePort{Name: "admin", Port: 9000}
+
+	notReady := newSlice("web-2", "web", "http", 8080, "10.0.0.3")
+	notReady.Endpoints[0].Conditions.Ready = boolp(false)
+
+	cases := []struct {
+		name string
+		r    routecmd
+		cfg  []string
+	}{
+		{
+			name: "http",
+			r: routecmd{
+				svc:    newService("web", "Example.com/foo", http),
+				slices: []*endpointSlice{newSlice("web-1", "web", "http", 8080, "10.0.0.2", "10.0.0.1")},
+			},
+			cfg: []string{
+				`route add web.default example.com/foo http://10.0.0.1:8080/`,
+				`route add web.default example.com/foo http://10.0.0.2:8080/`,
+			},
+		},
+		{
+			name: "multiple routes with options",
+			r: routecmd{
+				svc:    newService("web", "a.com/ strip=/foo\n\n  b.com/ weight=0.2 proto=https", http),
+				slices: []*endpointSlice{newSlice("web-1", "web", "http", 8443, "10.0.0.1")},
+			},
+			cfg: []string{
+				`route add web.default a.com/ http://10.0.0.1:8443/ opts "strip=/foo"`,
+				`route add web.default b.com/ https://10.0.0.1:8443 weight 0.2`,
+			},
+		},
+		{
+			name: "tcp on named port",
+			r: routecmd{
+				svc: newService("web", ":1234 proto=tcp port=admin", http, admin),
+				slices: []*endpointSlice{
+					newSlice("web-1", "web", "http", 8080, "10.0.0.1"),
+					newSlice("web-2", "web", "admin", 9090, "10.0.0.1"),
+				},
+			},
+			cfg: []string{
+				`route add web.default :1234 tcp://10.0.0.1:9090`,
+			},
+		},
+		{
+			name: "port number",
+			r: routecmd{
+				svc:    newService("web", "/ port=9000", http, admin),
+				slices: []*endpointSlice{newSlice("web-1", "web", "admin", 9090, "10.0.0.1")},
+			},
+			cfg: []string{
+				`route add web.default / http://10.0.0.1:9090/`,
+			},
+		},
+		{
+			name: "unknown port",
+			r: routecmd{
+				svc:    newService("web", "/ port=grpc", http),
+				slices: []*endpointSlice{newSlice("web-1", "web", "http", 8080, "10.0.0.1")},
+			},
+			cfg: nil,
+		},
+		{
+			name: "not ready endpoints",
+			r: routecmd{
+				svc:    newService("web", "/", http),
+				slices: []*endpointSlice{notReady},
+			},
+			cfg: nil,
+		},
+		{
+			name: "redirect",
+			r: routecmd{
+				svc:    newService("web", "a.com/ redirect=301,https://b.com/$path", http),
+				slices: []*endpointSlice{newSlice("web-1", "web", "http", 8080, "10.0.0.1")},
+			},
+			cfg: []string{
+				`route add web.default a.com/ https://b.com/$path opts "redirect=301"`,
+			},
+		},
+		{
+			name: "ipv6",
+			r: routecmd{
+				svc:    newService("web", "/", http),
+				slices: []*endpointSlice{newSlice("web-1", "web", "http", 8080, "fd00::1")},
+			},
+			cfg: []string{
+				`route add web.default / http://[fd00::1]:8080/`,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.r.annotation = "fabio.urlprefix"
+			if got, want := tt.r.build(), tt.cfg; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestIngressCmd(t *testing.T) {
+	ing := &ingress{Metadata: objectMeta{Name: "web", Namespace: "default"}}
+	if err := json.Unmarshal([]byte(`{"rules":[
+		{"host":"Example.com","http":{"paths":[
+			{"path":"/api","backend":{"service":{"name":"api","port":{"number":80}}}},
+			{"backend":{"service":{"name":"web","port":{"name":"http"}}}},
+			{"path":"/missing","backend":{"service":{"name":"missing","port":{"number":80}}}}
+		]}},
+		{"http":{"paths":[{"path":"/static","backend":{"service":{"name":"web","port":{"name":"http"}}}}]}}
+	]}`), &ing.Spec); err != nil {
+		t.Fatal(err)
+	}
+
+	r := ingresscmd{
+		ing: ing,
+		services: map[string]*service{
+			"api": newService("api", "", servicePort{Name: "", Port: 80}),
+			"web": newService("web", "", servicePort{Name: "http", Port: 80}),
+		},
+		slices: map[string][]*endpointSlice{
+			"api": {newSlice("api-1", "api", "", 3000, "10.0.0.1")},
+			"web": {newSlice("web-1", "web", "http", 8080, "10.0.0.2")},
+		},
+	}
+	want := []string{
+		`route add api.default example.com/api http://10.0.0.1:3000/`,
+		`route add web.default example.com/ http://10.0.0.2:8080/`,
+		`route add web.default /static http://10.0.0.2:8080/`,
+	}
+	if got := r.build(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
@@ -0,0 +1,137 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retryInterval is the time between failed requests to the API server.
+var retryInterval = time.Second
+
+// cache holds the objects of a resource by their namespace/name key.
+type cache[T any] struct {
+	mu     sync.RWMutex
+	objs   map[string]T
+	synced bool
+}
+
+func newCache[T any]() *cache[T] {
+	return &cache[T]{objs: map[string]T{}}
+}
+
+// replace replaces all objects after a list.
+func (c *cache[T]) replace(objs map[string]T) {
+	c.mu.Lock()
+	c.objs, c.synced = objs, true
+	c.mu.Unlock()
+}
+
+func (c *cache[T]) set(key string, obj T) {
+	c.mu.Lock()
+	c.objs[key] = obj
+	c.mu.Unlock()
+}
+
+func (c *cache[T]) delete(key string) {
+	c.mu.Lock()
+	delete(c.objs, key)
+	c.mu.Unlock()
+}
+
+// list returns the objects sorted by key and whether the cache has
+// been populated.
+func (c *cache[T]) list() ([]T, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.objs))
+	for k := range c.objs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	objs := make([]T, len(keys))
+	for i, k := range keys {
+		objs[i] = c.objs[k]
+	}
+	return objs, c.synced
+}
+
+// decode decodes the object and returns its key.
+func decode[T any](raw json.RawMessage) (string, T, error) {
+	var obj T
+	var m struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return "", obj, err
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return "", obj, err
+	}
+	return m.Metadata.key(), obj, nil
+}
+
+// watchResource keeps the cache in sync with the objects at the path
+// and signals every change on the changed channel. It lists the objects
+// and then watches them until the resource version expires.
+func watchResource[T any](c *client, path string, objs *cache[T], changed chan<- struct{}) {
+	for {
+		var list struct {
+			Metadata listMeta          `json:"metadata"`
+			Items    []json.RawMessage `json:"items"`
+		}
+		if err := c.get(path, &list); err != nil {
+			log.Printf("[WARN] kubernetes: Error listing %s. %s", path, err)
+			time.Sleep(retryInterval)
+			continue
+		}
+		m := map[string]T{}
+		for _, raw := range list.Items {
+			key, obj, err := decode[T](raw)
+			if err != nil {
+				log.Printf("[WARN] kubernetes: Error decoding object from %s. %s", path, err)
+				continue
+			}
+			m[key] = obj
+		}
+		objs.replace(m)
+		notify(changed)
+
+		version := list.Metadata.ResourceVersion
+		for {
+			var err error
+			version, err = c.watch(path, version, func(typ string, raw json.RawMessage) {
+				key, obj, err := decode[T](raw)
+				if err != nil {
+					log.Printf("[WARN] kubernetes: Error decoding object from %s. %s", path, err)
+					return
+				}
+				if typ == "DELETED" {
+					objs.delete(key)
+				} else {
+					objs.set(key, obj)
+				}
+				notify(changed)
+			})
+			if err == errGone {
+				log.Printf("[DEBUG] kubernetes: Listing %s again", path)
+				break
+			}
+			if err != nil {
+				log.Printf("[WARN] kubernetes: Error watching %s. %s", path, err)
+				time.Sleep(retryInterval)
+			}
+		}
+	}
+}
+
+// notify signals a change without blocking. Changes which happen while
+// the previous change is processed are coalesced.
+func notify(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
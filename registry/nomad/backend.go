@@ -0,0 +1,115 @@
+// Package nomad implements a registry backend for the native service
+// discovery of Nomad.
+package nomad
+
+import (
+	"log"
+	"strings"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry"
+)
+
+// be is an implementation of a registry backend for nomad.
+type be struct {
+	c   *client
+	cfg *config.Nomad
+}
+
+func NewBackend(cfg *config.Nomad) (registry.Backend, error) {
+	c, err := newClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// ping the agent
+	var self struct {
+		Config struct {
+			Region     string
+			Datacenter string
+		}
+	}
+	if _, err := c.get("/v1/agent/self", 0, 0, &self); err != nil {
+		return nil, err
+	}
+
+	// we're good
+	log.Printf("[INFO] nomad: Connecting to %q in region %q and datacenter %q", cfg.Addr, self.Config.Region, self.Config.Datacenter)
+	return &be{c: c, cfg: cfg}, nil
+}
+
+func (b *be) Register(services []string) error {
+	return nil
+}
+
+func (b *be) Deregister(serviceName string) error {
+	return nil
+}
+
+func (b *be) DeregisterAll() error {
+	return nil
+}
+
+func (b *be) ManualPaths() ([]string, error) {
+	paths, _, err := b.listVars(b.cfg.VarPath, 0)
+	for i, p := range paths {
+		paths[i] = strings.TrimPrefix(p, b.cfg.VarPath)
+	}
+	return paths, err
+}
+
+func (b *be) ReadManual(path string) (value string, version uint64, err error) {
+	v, err := b.getVar(b.cfg.VarPath + path)
+	if err != nil || v == nil {
+		return "", 0, err
+	}
+	return strings.TrimSpace(v.Items[routesItem]), v.ModifyIndex, nil
+}
+
+func (b *be) WriteManual(path string, value string, version uint64) (ok bool, err error) {
+	v := &variable{
+		Namespace: b.namespace(),
+		Path:      b.cfg.VarPath + path,
+		Items:     map[string]string{routesItem: value},
+	}
+	// version 0 creates the variable if it does not exist
+	return b.putVar(v, version)
+}
+
+func (b *be) WatchServices() chan string {
+	log.Printf("[INFO] nomad: Using dynamic routes")
+	log.Printf("[INFO] nomad: Using tag prefix %q", b.cfg.TagPrefix)
+
+	svc := make(chan string)
+	go b.watchServices(svc)
+	return svc
+}
+
+func (b *be) WatchManual() chan string {
+	log.Printf("[INFO] nomad: Watching variables at %q", b.cfg.VarPath)
+
+	man := make(chan string)
+	go b.watchVars(b.cfg.VarPath, func(vars []*variable) string {
+		var s []string
+		for _, v := range vars {
+			s = append(s, "# --- "+v.Path+"\n"+strings.TrimSpace(v.Items[routesItem]))
+		}
+		return strings.Join(s, "\n\n")
+	}, man)
+	return man
+}
+
+func (b *be) WatchNoRouteHTML() chan string {
+	log.Printf("[INFO] nomad: Watching variable %q", b.cfg.NoRouteHTMLPath)
+
+	html := make(chan string)
+	go b.watchVars(b.cfg.NoRouteHTMLPath, func(vars []*variable) string {
+		for _, v := range vars {
+			if v.Path == b.cfg.NoRouteHTMLPath {
+				return v.Items[htmlItem]
+			}
+		}
+		return ""
+	}, html)
+	return html
+}
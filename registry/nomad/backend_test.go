@@ -0,0 +1,277 @@
+package nomad
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry/registrytest"
+)
+
+// nomadServer is a fake Nomad agent which supports blocking queries on
+// the service and variable lists.
+type nomadServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	index    uint64
+	regs     map[string][]registration         // service name -> instances
+	checks   map[string]map[string]checkResult // alloc id -> check results
+	vars     map[string]*variable              // path -> variable
+	svcReqs  int                               // requests for service instances
+	failChks bool                              // fail the check requests
+}
+
+func newNomadServer(t *testing.T) *nomadServer {
+	s := &nomadServer{
+		index:  1,
+		regs:   map[string][]registration{},
+		checks: map[string]map[string]checkResult{},
+		vars:   map[string]*variable{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/self", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Config":{"Region":"global","Datacenter":"dc1"}}`))
+	})
+	mux.HandleFunc("/v1/services", func(w http.ResponseWriter, r *http.Request) {
+		s.block(r)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		stub := map[string]interface{}{"Namespace": "default"}
+		var svcs []map[string]interface{}
+		for name, regs := range s.regs {
+			svcs = append(svcs, map[string]interface{}{"ServiceName": name, "Tags": regs[0].Tags})
+		}
+		stub["Services"] = svcs
+		s.write(w, []interface{}{stub})
+	})
+	mux.HandleFunc("/v1/service/", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.svcReqs++
+		s.write(w, s.regs[strings.TrimPrefix(r.URL.Path, "/v1/service/")])
+	})
+	mux.HandleFunc("/v1/client/allocation/", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/client/allocation/"), "/checks")
+		checks, ok := s.checks[id]
+		if !ok || s.failChks {
+			http.Error(w, "unknown allocation", http.StatusInternalServerError)
+			return
+		}
+		s.write(w, checks)
+	})
+	mux.HandleFunc("/v1/vars", func(w http.ResponseWriter, r *http.Request) {
+		s.block(r)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var stubs []map[string]string
+		for p := range s.vars {
+			if strings.HasPrefix(p, r.URL.Query().Get("prefix")) {
+				stubs = append(stubs, map[string]string{"Path": p})
+			}
+		}
+		s.write(w, stubs)
+	})
+	mux.HandleFunc("/v1/var/", s.variable)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// block waits until the index changed or the wait time is over.
+func (s *nomadServer) block(r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		changed := s.index > index
+		s.mu.Unlock()
+		if changed {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *nomadServer) write(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(s.index, 10))
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *nomadServer) variable(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v1/var/")
+	v := s.vars[path]
+	switch r.Method {
+	case "GET":
+		if v == nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.write(w, v)
+	case "PUT":
+		var modify uint64
+		if v != nil {
+			modify = v.ModifyIndex
+		}
+		if cas := r.URL.Query().Get("cas"); cas != strconv.FormatUint(modify, 10) {
+			w.WriteHeader(http.StatusConflict)
+			s.write(w, v)
+			return
+		}
+		nv := &variable{}
+		json.NewDecoder(r.Body).Decode(nv)
+		s.index++
+		nv.ModifyIndex = s.index
+		s.vars[path] = nv
+		s.write(w, nv)
+	}
+}
+
+func (s *nomadServer) update(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+	s.index++
+}
+
+func newTestBackend(t *testing.T, s *nomadServer) *be {
+	b, err := NewBackend(&config.Nomad{
+		Addr:            s.URL,
+		Namespace:       "default",
+		TagPrefix:       "urlprefix-",
+		VarPath:         "fabio/config",
+		NoRouteHTMLPath: "fabio/noroute",
+		PollInterval:    20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*be)
+}
+
+func TestBackendWatchServices(t *testing.T) {
+	s := newNomadServer(t)
+	tags := []string{"urlprefix-/web", "urlprefix-${DC}.example.com/", "v1"}
+	s.update(func() {
+		s.regs["web"] = []registration{
+			{ServiceName: "web", Datacenter: "dc1", AllocID: "a1", Address: "10.0.0.1", Port: 8080, Tags: tags},
+			{ServiceName: "web", Datacenter: "dc1", AllocID: "a2", Address: "10.0.0.2", Port: 8080, Tags: tags},
+		}
+		s.regs["db"] = []registration{
+			{ServiceName: "db", Datacenter: "dc1", AllocID: "a3", Address: "10.0.0.3", Port: 5432, Tags: []string{"postgres"}},
+		}
+		s.checks["a1"] = map[string]checkResult{"c1": {Check: "alive", Service: "web", Status: "success"}}
+		s.checks["a2"] = map[string]checkResult{
+			"c2": {Check: "alive", Service: "web", Status: "failure"},
+			"c3": {Check: "other", Service: "sidecar", Status: "success"},
+		}
+		s.checks["a3"] = map[string]checkResult{}
+	})
+
+	b := newTestBackend(t, s)
+	svc := b.WatchServices()
+
+	svcReqs := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.svcReqs
+	}
+	var reqs int
+	registrytest.Watch(t, svc, []registrytest.Step{
+		{
+			Desc: "passing instances",
+			Want: `route add web dc1.example.com/ http://10.0.0.1:8080/ tags "v1"` + "\n" +
+				`route add web /web http://10.0.0.1:8080/ tags "v1"`,
+		},
+		{
+			// check results do not change the index of the service list
+			Desc: "check passes",
+			Update: func() {
+				s.mu.Lock()
+				s.checks["a2"]["c2"] = checkResult{Check: "alive", Service: "web", Status: "success"}
+				s.mu.Unlock()
+			},
+			Want: `route add web dc1.example.com/ http://10.0.0.2:8080/ tags "v1"` + "\n" +
+				`route add web dc1.example.com/ http://10.0.0.1:8080/ tags "v1"` + "\n" +
+				`route add web /web http://10.0.0.2:8080/ tags "v1"` + "\n" +
+				`route add web /web http://10.0.0.1:8080/ tags "v1"`,
+		},
+		{Desc: "no change", Update: func() { reqs = svcReqs() }, Same: true},
+	})
+
+	// the instances are only fetched again when the index changes
+	if got, want := svcReqs(), reqs; got != want {
+		t.Fatalf("got %d service requests want %d", got, want)
+	}
+
+	registrytest.Watch(t, svc, []registrytest.Step{
+		{
+			// the last check results are kept when they cannot be fetched
+			Desc: "checks fail",
+			Update: func() {
+				s.mu.Lock()
+				s.failChks = true
+				s.mu.Unlock()
+			},
+			Same: true,
+		},
+		{Desc: "service deleted", Update: func() { s.update(func() { delete(s.regs, "web") }) }, Want: ""},
+	})
+}
+
+func TestBackendManual(t *testing.T) {
+	s := newNomadServer(t)
+	b := newTestBackend(t, s)
+	man := b.WatchManual()
+	registrytest.Manual(t, b, man, func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return "# --- fabio/config\n" + value
+	})
+
+	if ok, err := b.WriteManual("/canary", "route weight web 0.1", 0); !ok || err != nil {
+		t.Fatalf("got %v, %v want true, nil", ok, err)
+	}
+	want := "# --- fabio/config\nroute del db\n\n# --- fabio/config/canary\nroute weight web 0.1"
+	registrytest.Expect(t, man, want)
+
+	// variables which only share the prefix are ignored
+	s.update(func() {
+		s.vars["fabio/configuration"] = &variable{Path: "fabio/configuration", Items: map[string]string{"routes": "route del api"}}
+	})
+	paths, err := b.ManualPaths()
+	sort.Strings(paths)
+	if got, want := strings.Join(paths, ","), ",/canary"; err != nil || got != want {
+		t.Fatalf("got %q, %v want %q, nil", got, err, want)
+	}
+}
+
+func TestBackendWatchNoRouteHTML(t *testing.T) {
+	s := newNomadServer(t)
+	b := newTestBackend(t, s)
+	registrytest.Watch(t, b.WatchNoRouteHTML(), []registrytest.Step{
+		{Desc: "no variable", Want: ""},
+		{
+			Desc: "variable added",
+			Update: func() {
+				s.update(func() {
+					s.vars["fabio/noroute"] = &variable{Path: "fabio/noroute", Items: map[string]string{"html": "<h1>no route</h1>"}}
+				})
+			},
+			Want: "<h1>no route</h1>",
+		},
+	})
+}
@@ -0,0 +1,141 @@
+package nomad
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/fabiolb/fabio/registry"
+)
+
+// errNotFound is returned when the object does not exist.
+var errNotFound = errors.New("nomad: not found")
+
+// errConflict is returned when a check-and-set write failed.
+var errConflict = errors.New("nomad: conflict")
+
+// client is a minimal client for the Nomad HTTP API which supports
+// blocking queries.
+type client struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+func newClient(cfg *config.Nomad) (*client, error) {
+	u, err := url.Parse(cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("nomad: invalid address %q: %s", cfg.Addr, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("nomad: invalid address %q: scheme must be http or https", cfg.Addr)
+	}
+
+	tlscfg, err := registry.TLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client{
+		addr:  strings.TrimSuffix(u.String(), "/"),
+		token: cfg.Token,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlscfg,
+			},
+		},
+	}, nil
+}
+
+// requestTimeout is the timeout for requests in addition to the wait
+// time of blocking queries.
+const requestTimeout = 30 * time.Second
+
+// get decodes the response for the path into v. If index is not zero
+// the request is a blocking query which returns when the index of the
+// object changes or after the wait time. get returns the index of the
+// response.
+func (c *client) get(path string, index uint64, wait time.Duration, v interface{}) (uint64, error) {
+	q := url.Values{}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		if wait > 0 {
+			q.Set("wait", wait.String())
+		}
+	}
+	if len(q) > 0 {
+		if strings.Contains(path, "?") {
+			path += "&" + q.Encode()
+		} else {
+			path += "?" + q.Encode()
+		}
+	}
+
+	resp, err := c.do("GET", path, nil, requestTimeout+wait)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return 0, err
+	}
+	idx, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	return idx, nil
+}
+
+// put sends v as JSON to the path.
+func (c *client) put(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("PUT", path, body, requestTimeout)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends the request and returns the response if the status code is
+// 2xx.
+func (c *client) do(method, path string, body []byte, timeout time.Duration) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.addr+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Nomad-Token", c.token)
+	}
+
+	hc := &http.Client{Transport: c.http.Transport, Timeout: timeout}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, errNotFound
+	case http.StatusConflict:
+		return nil, errConflict
+	}
+	return nil, fmt.Errorf("nomad: %s %s failed with status %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(msg))
+}
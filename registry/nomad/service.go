@@ -0,0 +1,196 @@
+package nomad
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fabiolb/fabio/registry/consul"
+)
+
+// serviceStubs is the response of the service list.
+type serviceStubs []struct {
+	Namespace string
+	Services  []struct {
+		ServiceName string
+		Tags        []string
+	}
+}
+
+// registration is a service instance.
+type registration struct {
+	ServiceName string
+	Namespace   string
+	Datacenter  string
+	AllocID     string
+	Address     string
+	Port        int
+	Tags        []string
+}
+
+// checkResult is the latest result of a nomad service check.
+type checkResult struct {
+	Check   string
+	Service string
+	Status  string
+	Output  string
+}
+
+// serviceKey identifies a service in a namespace.
+type serviceKey struct {
+	namespace, name string
+}
+
+// serviceRegs are the instances of a service and the index of the
+// service list for which they were fetched.
+type serviceRegs struct {
+	index uint64
+	regs  []registration
+}
+
+// watchServices monitors the nomad services and sends a new configuration
+// to the updates channel on every change.
+//
+// The service list is watched with blocking queries which wait at most
+// for the poll interval since the results of the health checks do not
+// change the index of the list. The instances of the services are only
+// fetched again when the index changes but the check results are
+// fetched on every poll.
+func (b *be) watchServices(updates chan string) {
+	var lastIndex uint64
+	var last string
+	services := map[serviceKey]*serviceRegs{}
+	checks := map[string]map[string]checkResult{}
+	for {
+		var stubs serviceStubs
+		index, err := b.c.get("/v1/services?namespace="+url.QueryEscape(b.cfg.Namespace), lastIndex, b.cfg.PollInterval, &stubs)
+		if err != nil {
+			log.Printf("[WARN] nomad: Error fetching services. %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if index != lastIndex {
+			log.Printf("[DEBUG] nomad: Services changed to #%d", index)
+		}
+		lastIndex = index
+
+		next := b.makeConfig(stubs, index, services, checks)
+		if next == last {
+			continue
+		}
+		updates <- next
+		last = next
+	}
+}
+
+// makeConfig builds the config for the healthy instances of the
+// services which have tags with the right prefix. services and checks
+// cache the instances and the check results between the calls and
+// entries of services and allocations which no longer exist are
+// removed.
+func (b *be) makeConfig(stubs serviceStubs, index uint64, services map[serviceKey]*serviceRegs, checks map[string]map[string]checkResult) string {
+	seen := map[serviceKey]bool{}
+	fetched := map[string]bool{}
+
+	var config []string
+	for _, ns := range stubs {
+		for _, svc := range ns.Services {
+			if !hasTagPrefix(svc.Tags, b.cfg.TagPrefix) {
+				continue
+			}
+			k := serviceKey{ns.Namespace, svc.ServiceName}
+			seen[k] = true
+			for _, reg := range b.registrations(k, index, services) {
+				if !fetched[reg.AllocID] {
+					b.fetchChecks(reg.AllocID, checks)
+					fetched[reg.AllocID] = true
+				}
+				if !passing(reg, checks[reg.AllocID]) {
+					continue
+				}
+
+				env := map[string]string{
+					"DC": reg.Datacenter,
+				}
+				config = append(config, consul.RouteCmds(reg.ServiceName, reg.Address, reg.Port, reg.Tags, b.cfg.TagPrefix, env)...)
+			}
+		}
+	}
+
+	for k := range services {
+		if !seen[k] {
+			delete(services, k)
+		}
+	}
+	for id := range checks {
+		if !fetched[id] {
+			delete(checks, id)
+		}
+	}
+
+	// sort config in reverse order to sort most specific config to the top
+	sort.Sort(sort.Reverse(sort.StringSlice(config)))
+
+	return strings.Join(config, "\n")
+}
+
+// registrations returns the instances of the service. They are fetched
+// again if the index of the service list has changed. If that fails the
+// previous instances are returned and fetched again on the next call.
+func (b *be) registrations(k serviceKey, index uint64, services map[serviceKey]*serviceRegs) []registration {
+	if s := services[k]; s != nil && s.index == index {
+		return s.regs
+	}
+
+	var regs []registration
+	path := "/v1/service/" + url.PathEscape(k.name) + "?namespace=" + url.QueryEscape(k.namespace)
+	if _, err := b.c.get(path, 0, 0, &regs); err != nil {
+		log.Printf("[WARN] nomad: Error getting service %s. %v", k.name, err)
+		if s := services[k]; s != nil {
+			return s.regs
+		}
+		return nil
+	}
+	services[k] = &serviceRegs{index: index, regs: regs}
+	return regs
+}
+
+// fetchChecks updates the check results of the allocation. The last
+// known results are kept if they cannot be fetched.
+func (b *be) fetchChecks(allocID string, checks map[string]map[string]checkResult) {
+	var c map[string]checkResult
+	if _, err := b.c.get("/v1/client/allocation/"+url.PathEscape(allocID)+"/checks", 0, 0, &c); err != nil {
+		log.Printf("[WARN] nomad: Error getting checks of allocation %s. %v", allocID, err)
+		return
+	}
+	checks[allocID] = c
+}
+
+// passing returns true if all checks of the service instance passed.
+// checks is nil if the results have never been fetched.
+func passing(reg registration, checks map[string]checkResult) bool {
+	if checks == nil {
+		return false
+	}
+	for _, c := range checks {
+		if c.Service != reg.ServiceName {
+			continue
+		}
+		if c.Status != "success" {
+			log.Printf("[DEBUG] nomad: Skipping service %q of allocation %s since check %q is %s: %s", reg.ServiceName, reg.AllocID, c.Check, c.Status, c.Output)
+			return false
+		}
+	}
+	return true
+}
+
+func hasTagPrefix(tags []string, prefix string) bool {
+	for _, t := range tags {
+		if strings.HasPrefix(strings.TrimSpace(t), prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package nomad
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// routesItem is the item of a variable with the manual overrides.
+	routesItem = "routes"
+
+	// htmlItem is the item of a variable with the HTML which is
+	// returned when no route is found.
+	htmlItem = "html"
+)
+
+// variable is a nomad variable.
+type variable struct {
+	Namespace   string
+	Path        string
+	Items       map[string]string
+	ModifyIndex uint64 `json:",omitempty"`
+}
+
+// namespace returns the namespace of the variables. It is the default
+// namespace if the services of all namespaces are watched.
+func (b *be) namespace() string {
+	if b.cfg.Namespace == "*" {
+		return "default"
+	}
+	return b.cfg.Namespace
+}
+
+// listVars returns the sorted paths of the variables at the path and
+// below it. If index is not zero the request is a blocking query.
+func (b *be) listVars(path string, index uint64) ([]string, uint64, error) {
+	var stubs []struct{ Path string }
+	q := "/v1/vars?prefix=" + url.QueryEscape(path) + "&namespace=" + url.QueryEscape(b.namespace())
+	index, err := b.c.get(q, index, 5*time.Minute, &stubs)
+	if err != nil {
+		return nil, 0, err
+	}
+	var paths []string
+	for _, s := range stubs {
+		// the prefix also matches 'fabio/configuration' for 'fabio/config'
+		if s.Path == path || strings.HasPrefix(s.Path, path+"/") {
+			paths = append(paths, s.Path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, index, nil
+}
+
+// getVar returns the variable or nil if it does not exist.
+func (b *be) getVar(path string) (*variable, error) {
+	v := &variable{}
+	_, err := b.c.get("/v1/var/"+path+"?namespace="+url.QueryEscape(b.namespace()), 0, 0, v)
+	switch err {
+	case nil:
+		return v, nil
+	case errNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// getVars returns the existing variables for the paths.
+func (b *be) getVars(paths []string) ([]*variable, error) {
+	var vars []*variable
+	for _, p := range paths {
+		v, err := b.getVar(p)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			vars = append(vars, v)
+		}
+	}
+	return vars, nil
+}
+
+// putVar writes the variable if its modify index still matches.
+func (b *be) putVar(v *variable, index uint64) (bool, error) {
+	q := "/v1/var/" + v.Path + "?namespace=" + url.QueryEscape(v.Namespace) + "&cas=" + strconv.FormatUint(index, 10)
+	switch err := b.c.put(q, v); err {
+	case nil:
+		return true, nil
+	case errConflict:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// watchVars monitors the variables at the path and below it and pushes
+// the value which fn returns for them if there is a difference.
+func (b *be) watchVars(path string, fn func(vars []*variable) string, ch chan string) {
+	var lastIndex uint64
+	var last string
+	var pushed bool
+	for {
+		paths, index, err := b.listVars(path, lastIndex)
+		if err != nil {
+			log.Printf("[WARN] nomad: Error fetching variables from %s. %v", path, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if pushed && index == lastIndex {
+			continue
+		}
+
+		vars, err := b.getVars(paths)
+		if err != nil {
+			log.Printf("[WARN] nomad: Error fetching variables from %s. %v", path, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		value := fn(vars)
+		if !pushed || value != last {
+			log.Printf("[DEBUG] nomad: Variables at %s changed to #%d", path, index)
+			ch <- value
+			last, pushed = value, true
+		}
+		lastIndex = index
+	}
+}
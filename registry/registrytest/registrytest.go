@@ -0,0 +1,137 @@
+// Package registrytest provides helpers for the tests of the registry
+// backends.
+package registrytest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/registry"
+)
+
+// Timeout is the time Receive waits for a value.
+var Timeout = 5 * time.Second
+
+// Quiet is the time Watch waits for a step which must not send a value.
+var Quiet = 200 * time.Millisecond
+
+// Receive returns the next value from a watch channel of a backend. The
+// test fails if there is none within Timeout.
+func Receive(t *testing.T, ch chan string) string {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(Timeout):
+		t.Fatal("timeout")
+		return ""
+	}
+}
+
+// Expect fails the test if the next value from the watch channel is not
+// want.
+func Expect(t *testing.T, ch chan string, want string) {
+	t.Helper()
+	if got := Receive(t, ch); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+// NoReceive fails the test if the watch channel sends a value within d.
+func NoReceive(t *testing.T, ch chan string, d time.Duration) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		t.Fatalf("got unexpected value %q", v)
+	case <-time.After(d):
+	}
+}
+
+// Step is a change of the registry and the value which the watch
+// channel sends afterwards.
+type Step struct {
+	Desc string
+
+	// Update changes the registry. It is nil for the initial value.
+	Update func()
+
+	// Want is the next value of the watch channel.
+	Want string
+
+	// Same is true if the change must not send a value.
+	Same bool
+}
+
+// Watch applies the steps and checks the values of the watch channel.
+func Watch(t *testing.T, ch chan string, steps []Step) {
+	t.Helper()
+	for _, st := range steps {
+		if st.Update != nil {
+			st.Update()
+		}
+		if st.Same {
+			select {
+			case v := <-ch:
+				t.Fatalf("%s: got unexpected value %q", st.Desc, v)
+			case <-time.After(Quiet):
+			}
+			continue
+		}
+		select {
+		case v := <-ch:
+			if v != st.Want {
+				t.Fatalf("%s: got %q want %q", st.Desc, v, st.Want)
+			}
+		case <-time.After(Timeout):
+			t.Fatalf("%s: timeout", st.Desc)
+		}
+	}
+}
+
+// Manual checks the manual overrides of the backend for the default
+// path. A missing value is empty with version 0, version 0 creates the
+// value only if it does not exist and an update requires the version
+// which was read. If man is not nil it must be the channel of
+// WatchManual and watch must return the value which it sends for the
+// overrides.
+func Manual(t *testing.T, b registry.Backend, man chan string, watch func(value string) string) {
+	t.Helper()
+	expect := func(value string) {
+		t.Helper()
+		if man != nil {
+			Expect(t, man, watch(value))
+		}
+	}
+	write := func(value string, version uint64, want bool) {
+		t.Helper()
+		if ok, err := b.WriteManual("", value, version); ok != want || err != nil {
+			t.Fatalf("write %q with version %d: got %v, %v want %v, nil", value, version, ok, err, want)
+		}
+	}
+
+	expect("")
+	value, version, err := b.ReadManual("")
+	if err != nil || value != "" || version != 0 {
+		t.Fatalf("got %q, %d, %v want \"\", 0, nil", value, version, err)
+	}
+
+	// version 0 creates the value
+	write("route del web", 0, true)
+	expect("route del web")
+	// the value exists
+	write("route del db", 0, false)
+
+	value, version, err = b.ReadManual("")
+	if err != nil || value != "route del web" || version == 0 {
+		t.Fatalf("got %q, %d, %v want \"route del web\", >0, nil", value, version, err)
+	}
+	write("route del db", version, true)
+	expect("route del db")
+	// stale version
+	write("route del api", version, false)
+
+	value, _, err = b.ReadManual("")
+	if err != nil || value != "route del db" {
+		t.Fatalf("got %q, %v want \"route del db\", nil", value, err)
+	}
+}
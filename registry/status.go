@@ -0,0 +1,28 @@
+package registry
+
+import "time"
+
+// SourceStatus is the status of one source of a backend which combines
+// several sources.
+type SourceStatus struct {
+	// Name is the name of the source, e.g. 'consul'.
+	Name string `json:"name"`
+
+	// Healthy is true if the source has been initialized and is still
+	// sending routes.
+	Healthy bool `json:"healthy"`
+
+	// Error describes why the source is not healthy.
+	Error string `json:"error,omitempty"`
+
+	// LastUpdate is the time of the last update of the routes
+	// of the source. It is zero if there was none.
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+// StatusReporter is implemented by backends which report the status
+// of their sources separately.
+type StatusReporter interface {
+	// Status returns the status of the sources of the backend.
+	Status() []SourceStatus
+}
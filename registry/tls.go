@@ -0,0 +1,21 @@
+package registry
+
+import (
+	"crypto/tls"
+
+	"github.com/fabiolb/fabio/config"
+	"github.com/hashicorp/consul/api"
+)
+
+// TLSConfig creates the TLS configuration for the connections to a
+// registry from the TLS options which are the same for all registries
+// as for consul.
+func TLSConfig(c config.ConsulTlS) (*tls.Config, error) {
+	return api.SetupTLSConfig(&api.TLSConfig{
+		KeyFile:            c.KeyFile,
+		CertFile:           c.CertFile,
+		CAFile:             c.CAFile,
+		CAPath:             c.CAPath,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	})
+}
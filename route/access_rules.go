@@ -1,43 +1,53 @@
 package route
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"strings"
-)
 
-const (
-	ipAllowTag = "allow:ip"
-	ipDenyTag  = "deny:ip"
+	"github.com/fabiolb/fabio/auth"
 )
 
-// AccessDeniedHTTP checks rules on the target for HTTP proxy routes.
-func (t *Target) AccessDeniedHTTP(r *http.Request) bool {
+// addrTypes are the access item types which are checked against the
+// client addresses. All other types are checked against the request.
+var addrTypes = []string{"ip", "country"}
+
+// requestTypes are the access item types which are checked against the
+// HTTP request. They never match TCP connections.
+var requestTypes = []string{"header", "cookie", "method", "path", "clientcert"}
+
+// accessValue is the name and the optional value of a header or cookie
+// access item. An empty value matches any value.
+type accessValue struct {
+	name  string
+	value string
+}
+
+// AccessDeniedHTTP checks rules on the target for HTTP proxy routes. It
+// returns the rule which denied the request or an empty string if the
+// request is allowed.
+func (t *Target) AccessDeniedHTTP(r *http.Request) string {
 	// No rules ... skip checks
 	if len(t.accessRules) == 0 {
-		return false
+		return ""
 	}
 
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.Printf("[ERROR] failed to get host from remote header %s: %s",
 			r.RemoteAddr, err.Error())
-		return false
+		return ""
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
 		log.Printf("[WARN] failed to parse remote address %s", host)
 	}
 
-	// check remote source and return if denied
-	if t.denyByIP(ip) {
-		return true
-	}
-
 	// check xff source if present
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		// Trusting XFF headers sent from clients is dangerous and generally
@@ -52,21 +62,26 @@ func (t *Target) AccessDeniedHTTP(r *http.Request) bool {
 			if xip == host {
 				continue
 			}
-			if ip = net.ParseIP(xip); ip == nil {
+			ip := net.ParseIP(xip)
+			if ip == nil {
 				log.Printf("[WARN] failed to parse xff address %s", xip)
 				continue
 			}
-			if t.denyByIP(ip) {
-				return true
-			}
+			ips = append(ips, ip)
 		}
 	}
 
-	// default allow
-	return false
+	reason := t.accessDenied(ips, r)
+	if reason != "" {
+		t.countDenied(reason)
+		log.Printf("[INFO] route rules denied access from %s to %s: %s",
+			host, t.URL.String(), reason)
+	}
+	return reason
 }
 
-// AccessDeniedTCP checks rules on the target for TCP proxy routes.
+// AccessDeniedTCP checks rules on the target for TCP proxy routes. Only
+// the 'ip' and 'country' rules are checked since there is no request.
 func (t *Target) AccessDeniedTCP(c net.Conn) bool {
 	// Calling RemoteAddr on a proxy-protocol enabled connection may block.
 	// Therefore we explicitly check and bail out early if there are no
@@ -82,74 +97,152 @@ func (t *Target) AccessDeniedTCP(c net.Conn) bool {
 		return false
 	}
 	// check remote connection address
-	if t.denyByIP(addr.IP) {
+	reason := t.accessDenied([]net.IP{addr.IP}, nil)
+	if reason != "" {
+		t.countDenied(reason)
+		log.Printf("[INFO] route rules denied access from %s to %s: %s",
+			addr.IP.String(), t.URL.String(), reason)
 		return true
 	}
 	// default allow
 	return false
 }
 
+// denyByIP returns true if the rules deny a client with the ip.
 func (t *Target) denyByIP(ip net.IP) bool {
 	if ip == nil || len(t.accessRules) == 0 {
 		return false
 	}
-	// check allow (whitelist) first if it exists
-	if _, ok := t.accessRules[ipAllowTag]; ok {
-		var block *net.IPNet
-		for _, x := range t.accessRules[ipAllowTag] {
-			if block, ok = x.(*net.IPNet); !ok {
-				log.Printf("[ERROR] failed to assert ip block while checking allow rule for %s", t.Service)
-				continue
-			}
-			// debug logging
-			log.Printf("[DEBUG] checking %s against ip allow rule %s", ip.String(), block.String())
-			// check block
-			if block.Contains(ip) {
-				// debug logging
-				log.Printf("[DEBUG] allowing request from %s via %s", ip.String(), block.String())
-				// specific allow matched - allow this request
-				return false
+	return t.accessDenied([]net.IP{ip}, nil) != ""
+}
+
+// accessDenied returns the rule which denies the client with the
+// addresses and the request or an empty string if access is allowed.
+// The request is nil for TCP connections.
+//
+// Deny rules take precedence over allow rules. A client is denied if one
+// of its addresses or the request matches a deny item. If the target
+// has allow rules the client is only allowed if all of its addresses
+// match an 'ip' or 'country' allow item or if the request matches one
+// of the other allow items.
+func (t *Target) accessDenied(ips []net.IP, r *http.Request) string {
+	for _, ip := range ips {
+		if item := t.matchAddr("deny", ip); item != "" {
+			return "deny=" + item
+		}
+	}
+	if r != nil {
+		if item := t.matchRequest("deny", r); item != "" {
+			return "deny=" + item
+		}
+	}
+
+	if !t.hasAccessRules("allow", addrTypes) && !t.hasAccessRules("allow", requestTypes) {
+		return ""
+	}
+	if t.hasAccessRules("allow", addrTypes) && len(ips) > 0 {
+		allowed := true
+		for _, ip := range ips {
+			if t.matchAddr("allow", ip) == "" {
+				allowed = false
+				break
 			}
 		}
-		// we checked all the blocks - deny this request
-		log.Printf("[INFO] route rules denied access from %s to %s",
-			ip.String(), t.URL.String())
-		return true
+		if allowed {
+			return ""
+		}
 	}
+	if r != nil && t.matchRequest("allow", r) != "" {
+		return ""
+	}
+	return "allow"
+}
 
-	// still going - check deny (blacklist) if it exists
-	if _, ok := t.accessRules[ipDenyTag]; ok {
-		var block *net.IPNet
-		for _, x := range t.accessRules[ipDenyTag] {
-			if block, ok = x.(*net.IPNet); !ok {
-				log.Printf("[INFO] failed to assert ip block while checking deny rule for %s", t.Service)
-				continue
+func (t *Target) hasAccessRules(allowDeny string, types []string) bool {
+	for _, typ := range types {
+		if len(t.accessRules[allowDeny+":"+typ]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr returns the first 'ip' or 'country' item of the allow or
+// deny rule which matches the ip.
+func (t *Target) matchAddr(allowDeny string, ip net.IP) string {
+	for _, x := range t.accessRules[allowDeny+":ip"] {
+		block, ok := x.(*net.IPNet)
+		if !ok {
+			log.Printf("[ERROR] failed to assert ip block while checking %s rule for %s", allowDeny, t.Service)
+			continue
+		}
+		// debug logging
+		log.Printf("[DEBUG] checking %s against ip %s rule %s", ip.String(), allowDeny, block.String())
+		if block.Contains(ip) {
+			return "ip:" + block.String()
+		}
+	}
+
+	if countries := t.accessRules[allowDeny+":country"]; len(countries) > 0 {
+		country := countryOf(ip)
+		for _, x := range countries {
+			if x.(string) == country {
+				return "country:" + country
 			}
-			// debug logging
-			log.Printf("[DEBUG] checking %s against ip deny rule %s", ip.String(), block.String())
-			// check block
-			if block.Contains(ip) {
-				// specific deny matched - deny this request
-				log.Printf("[INFO] route rules denied access from %s to %s",
-					ip.String(), t.URL.String())
-				return true
+		}
+	}
+	return ""
+}
+
+// matchRequest returns the first item of the allow or deny rule other
+// than 'ip' and 'country' which matches the request.
+func (t *Target) matchRequest(allowDeny string, r *http.Request) string {
+	for _, x := range t.accessRules[allowDeny+":header"] {
+		h := x.(accessValue)
+		for _, v := range r.Header.Values(h.name) {
+			if h.value == "" || v == h.value {
+				return "header:" + h.String()
 			}
 		}
 	}
+	for _, x := range t.accessRules[allowDeny+":cookie"] {
+		c := x.(accessValue)
+		if ck, err := r.Cookie(c.name); err == nil && (c.value == "" || ck.Value == c.value) {
+			return "cookie:" + c.String()
+		}
+	}
+	for _, x := range t.accessRules[allowDeny+":method"] {
+		if r.Method == x.(string) {
+			return "method:" + r.Method
+		}
+	}
+	for _, x := range t.accessRules[allowDeny+":path"] {
+		if strings.HasPrefix(r.URL.Path, x.(string)) {
+			return "path:" + x.(string)
+		}
+	}
+	if len(t.accessRules[allowDeny+":clientcert"]) > 0 && auth.ClientCertificate(r) != nil {
+		return "clientcert:present"
+	}
+	return ""
+}
 
-	// debug logging
-	log.Printf("[DEBUG] default allowing request from %s that was not denied", ip.String())
+func (v accessValue) String() string {
+	if v.value == "" {
+		return v.name
+	}
+	return v.name + "=" + v.value
+}
 
-	// default - do not deny
-	return false
+// countDenied counts the denied request or connection by the rule.
+func (t *Target) countDenied(reason string) {
+	if t.DenyCounter != nil {
+		t.DenyCounter.With("rule", reason).Add(1)
+	}
 }
 
 // ProcessAccessRules processes access rules from options specified on the target route
 func (t *Target) ProcessAccessRules() error {
-	if t.Opts["allow"] != "" && t.Opts["deny"] != "" {
-		return errors.New("specifying allow and deny on the same route is not supported")
-	}
-
 	for _, allowDeny := range []string{"allow", "deny"} {
 		if t.Opts[allowDeny] != "" {
 			if err := t.parseAccessRule(allowDeny); err != nil {
@@ -179,11 +272,12 @@ func (t *Target) parseAccessRule(allowDeny string) error {
 
 		// form access type tag
 		accessTag = allowDeny + ":" + strings.ToLower(strings.TrimSpace(temps[0]))
+		value = strings.TrimSpace(temps[1])
 
-		// switch on formed access tag - currently only ip types are implemented
-		switch accessTag {
-		case ipAllowTag, ipDenyTag:
-			if value = strings.TrimSpace(temps[1]); !strings.Contains(value, "/") {
+		// switch on the access type
+		switch strings.TrimPrefix(accessTag, allowDeny+":") {
+		case "ip":
+			if !strings.Contains(value, "/") {
 				if ip = net.ParseIP(value); ip == nil {
 					return fmt.Errorf("failed to parse IP %s", value)
 				}
@@ -200,6 +294,36 @@ func (t *Target) parseAccessRule(allowDeny string) error {
 			}
 			// add element to rule map
 			t.accessRules[accessTag] = append(t.accessRules[accessTag], net)
+		case "country":
+			if len(value) != 2 {
+				return fmt.Errorf("invalid country code %s, expected ISO 3166-1 alpha-2 code", value)
+			}
+			t.accessRules[accessTag] = append(t.accessRules[accessTag], strings.ToUpper(value))
+		case "header", "cookie":
+			p := strings.SplitN(value, "=", 2)
+			v := accessValue{name: strings.TrimSpace(p[0])}
+			if len(p) == 2 {
+				v.value = strings.TrimSpace(p[1])
+			}
+			if v.name == "" {
+				return fmt.Errorf("missing name in access item %s", c)
+			}
+			t.accessRules[accessTag] = append(t.accessRules[accessTag], v)
+		case "method":
+			if value == "" {
+				return fmt.Errorf("missing method in access item %s", c)
+			}
+			t.accessRules[accessTag] = append(t.accessRules[accessTag], strings.ToUpper(value))
+		case "path":
+			if !strings.HasPrefix(value, "/") {
+				return fmt.Errorf("path prefix %s must start with /", value)
+			}
+			t.accessRules[accessTag] = append(t.accessRules[accessTag], value)
+		case "clientcert":
+			if value != "present" {
+				return fmt.Errorf("invalid access item %s, expected clientcert:present", c)
+			}
+			t.accessRules[accessTag] = append(t.accessRules[accessTag], value)
 		default:
 			return fmt.Errorf("unknown access item type: %s", temps[0])
 		}
@@ -1,6 +1,9 @@
 package route
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"net/url"
@@ -223,7 +226,7 @@ func TestAccessRules_AccessDeniedHTTP(t *testing.T) {
 					i, tt.desc, err.Error())
 			}
 			tt.target.URL = mustParse("http://testing.test/")
-			if deny := tt.target.AccessDeniedHTTP(req); deny != tt.denied {
+			if deny := tt.target.AccessDeniedHTTP(req) != ""; deny != tt.denied {
 				t.Errorf("%d: %s\ngot denied: %t\nwant denied: %t\n",
 					i, tt.desc, deny, tt.denied)
 				return
@@ -231,3 +234,227 @@ func TestAccessRules_AccessDeniedHTTP(t *testing.T) {
 		})
 	}
 }
+
+func TestAccessRules_parseAccessRuleTypes(t *testing.T) {
+	tests := []struct {
+		desc  string
+		rules string
+		fail  bool
+	}{
+		{desc: "header", rules: "header:X-Env=prod,header:X-Debug"},
+		{desc: "cookie", rules: "cookie:session,cookie:beta=1"},
+		{desc: "method", rules: "method:get,method:POST"},
+		{desc: "path", rules: "path:/admin"},
+		{desc: "clientcert", rules: "clientcert:present"},
+		{desc: "country", rules: "country:de,country:US"},
+		{desc: "header without name", rules: "header:=x", fail: true},
+		{desc: "path without slash", rules: "path:admin", fail: true},
+		{desc: "invalid clientcert", rules: "clientcert:yes", fail: true},
+		{desc: "invalid country", rules: "country:Germany", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tgt := &Target{Opts: map[string]string{"allow": tt.rules}}
+			if got, want := tgt.ProcessAccessRules() != nil, tt.fail; got != want {
+				t.Fatalf("got error %v want error %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAccessRules_countryRequiresGeoIP(t *testing.T) {
+	defer func(f func() bool) { geoIPLoaded = f }(geoIPLoaded)
+	const routes = `route add svc / http://foo.com/ opts "allow=ip:10.0.0.0/8,country:de"`
+
+	geoIPLoaded = func() bool { return false }
+	if _, err := NewTable(bytes.NewBufferString(routes)); err == nil {
+		t.Fatal("got nil want error")
+	}
+
+	geoIPLoaded = func() bool { return true }
+	if _, err := NewTable(bytes.NewBufferString(routes)); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+}
+
+func TestAccessRules_AccessDeniedHTTPRequest(t *testing.T) {
+	defer func(f func(net.IP) string) { countryOf = f }(countryOf)
+	countryOf = func(ip net.IP) string {
+		switch ip.String() {
+		case "85.1.1.1":
+			return "DE"
+		case "6.6.6.6":
+			return "XX"
+		}
+		return ""
+	}
+
+	tests := []struct {
+		desc   string
+		opts   map[string]string
+		req    func(r *http.Request)
+		reason string
+	}{
+		{
+			desc:   "header allowed",
+			opts:   map[string]string{"allow": "header:X-Env=prod"},
+			req:    func(r *http.Request) { r.Header.Set("X-Env", "prod") },
+			reason: "",
+		},
+		{
+			desc:   "header value not allowed",
+			opts:   map[string]string{"allow": "header:X-Env=prod"},
+			req:    func(r *http.Request) { r.Header.Set("X-Env", "dev") },
+			reason: "allow",
+		},
+		{
+			desc:   "header present denied",
+			opts:   map[string]string{"deny": "header:X-Debug"},
+			req:    func(r *http.Request) { r.Header.Set("X-Debug", "1") },
+			reason: "deny=header:X-Debug",
+		},
+		{
+			desc:   "cookie allowed",
+			opts:   map[string]string{"allow": "cookie:beta=1"},
+			req:    func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "beta", Value: "1"}) },
+			reason: "",
+		},
+		{
+			desc:   "cookie missing",
+			opts:   map[string]string{"allow": "cookie:beta"},
+			req:    func(r *http.Request) {},
+			reason: "allow",
+		},
+		{
+			desc:   "method denied",
+			opts:   map[string]string{"deny": "method:delete"},
+			req:    func(r *http.Request) { r.Method = "DELETE" },
+			reason: "deny=method:DELETE",
+		},
+		{
+			desc:   "path denied",
+			opts:   map[string]string{"deny": "path:/admin"},
+			req:    func(r *http.Request) { r.URL.Path = "/admin/users" },
+			reason: "deny=path:/admin",
+		},
+		{
+			desc:   "client certificate required",
+			opts:   map[string]string{"allow": "clientcert:present"},
+			req:    func(r *http.Request) {},
+			reason: "allow",
+		},
+		{
+			desc: "client certificate present",
+			opts: map[string]string{"allow": "clientcert:present"},
+			req: func(r *http.Request) {
+				x := &x509.Certificate{}
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{x}, VerifiedChains: [][]*x509.Certificate{{x}}}
+			},
+			reason: "",
+		},
+		{
+			desc:   "country allowed",
+			opts:   map[string]string{"allow": "country:de"},
+			req:    func(r *http.Request) { r.RemoteAddr = "85.1.1.1:1234" },
+			reason: "",
+		},
+		{
+			desc:   "country of xff denied",
+			opts:   map[string]string{"deny": "country:XX"},
+			req:    func(r *http.Request) { r.Header.Set("X-Forwarded-For", "6.6.6.6") },
+			reason: "deny=country:XX",
+		},
+		{
+			desc:   "ip or header allowed by ip",
+			opts:   map[string]string{"allow": "ip:10.0.0.0/8,header:X-Token=abc"},
+			req:    func(r *http.Request) {},
+			reason: "",
+		},
+		{
+			desc: "ip or header allowed by header",
+			opts: map[string]string{"allow": "ip:10.0.0.0/8,header:X-Token=abc"},
+			req: func(r *http.Request) {
+				r.RemoteAddr = "1.2.3.4:1234"
+				r.Header.Set("X-Token", "abc")
+			},
+			reason: "",
+		},
+		{
+			desc:   "ip or header not allowed",
+			opts:   map[string]string{"allow": "ip:10.0.0.0/8,header:X-Token=abc"},
+			req:    func(r *http.Request) { r.RemoteAddr = "1.2.3.4:1234" },
+			reason: "allow",
+		},
+		{
+			desc:   "deny takes precedence over allow",
+			opts:   map[string]string{"allow": "ip:10.0.0.0/8", "deny": "method:DELETE"},
+			req:    func(r *http.Request) { r.Method = "DELETE" },
+			reason: "deny=method:DELETE",
+		},
+		{
+			desc:   "allow and deny",
+			opts:   map[string]string{"allow": "ip:10.0.0.0/8", "deny": "method:DELETE"},
+			req:    func(r *http.Request) {},
+			reason: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = "10.1.2.3:1234"
+			tt.req(req)
+
+			tgt := &Target{Opts: tt.opts, URL: mustParse("http://testing.test/")}
+			if err := tgt.ProcessAccessRules(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := tgt.AccessDeniedHTTP(req), tt.reason; got != want {
+				t.Fatalf("got reason %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestAccessRules_AccessDeniedTCP(t *testing.T) {
+	tests := []struct {
+		desc   string
+		opts   map[string]string
+		denied bool
+	}{
+		{"ip allowed", map[string]string{"allow": "ip:127.0.0.0/8"}, false},
+		{"ip denied", map[string]string{"deny": "ip:127.0.0.0/8"}, true},
+		{"request rules never allow", map[string]string{"allow": "header:X-Env=prod"}, true},
+		{"request rules never deny", map[string]string{"deny": "method:GET"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tgt := &Target{Opts: tt.opts, URL: mustParse("tcp://testing.test/")}
+			if err := tgt.ProcessAccessRules(); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := tgt.AccessDeniedTCP(tcpConn{addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}}), tt.denied; got != want {
+				t.Fatalf("got denied %v want %v", got, want)
+			}
+		})
+	}
+}
+
+// tcpConn is a connection with a remote address for testing.
+type tcpConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c tcpConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestSetGeoIPDatabase(t *testing.T) {
+	if err := SetGeoIPDatabase("/some/non/existent/file"); err == nil {
+		t.Fatal("got nil want error")
+	}
+	if err := SetGeoIPDatabase(""); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,474 @@
+package route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	gkm "github.com/go-kit/kit/metrics"
+)
+
+var (
+	// ErrCircuitOpen is returned by Admit when the circuit breaker of
+	// the target is open.
+	ErrCircuitOpen = errors.New("circuit open")
+
+	// ErrTooManyRequests is returned by Admit when the target has
+	// reached its concurrency limit and the pending queue is full or
+	// when the route has reached its concurrency limit.
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// Breaker is the concurrency limit and circuit breaker configuration of
+// a target configured with the 'maxconns', 'maxpending' and 'breaker.*'
+// route options.
+type Breaker struct {
+	// MaxConns is the maximum number of concurrent requests to the
+	// target. Zero means no limit.
+	MaxConns int
+
+	// MaxPending is the maximum number of requests which wait for one
+	// of the MaxConns slots. Requests exceeding the limit are rejected.
+	MaxPending int
+
+	// ErrorRate is the ratio of failed requests within Window which
+	// opens the circuit. Zero disables the circuit breaker.
+	ErrorRate float64
+
+	// MinRequests is the minimum number of requests within Window
+	// before the error rate is evaluated.
+	MinRequests int
+
+	// Window is the duration over which the error rate is measured.
+	Window time.Duration
+
+	// Timeout is the time the circuit stays open before a single probe
+	// request is let through.
+	Timeout time.Duration
+}
+
+func (b Breaker) String() string {
+	return fmt.Sprintf("maxconns=%d maxpending=%d errorrate=%g minrequests=%d window=%s timeout=%s",
+		b.MaxConns, b.MaxPending, b.ErrorRate, b.MinRequests, b.Window, b.Timeout)
+}
+
+// parseBreaker returns the breaker configuration from the route options
+// or nil if neither a concurrency limit nor a circuit breaker is
+// configured.
+func parseBreaker(opts map[string]string) (*Breaker, error) {
+	b := Breaker{MinRequests: 20, Window: 10 * time.Second, Timeout: 30 * time.Second}
+
+	atoi := func(k string, v *int) error {
+		s := opts[k]
+		if s == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q", k, s)
+		}
+		*v = n
+		return nil
+	}
+	dur := func(k string, v *time.Duration) error {
+		s := opts[k]
+		if s == "" {
+			return nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s %q", k, s)
+		}
+		*v = d
+		return nil
+	}
+
+	if err := atoi("maxconns", &b.MaxConns); err != nil {
+		return nil, err
+	}
+	if err := atoi("maxpending", &b.MaxPending); err != nil {
+		return nil, err
+	}
+	if err := atoi("breaker.minrequests", &b.MinRequests); err != nil {
+		return nil, err
+	}
+	if err := dur("breaker.window", &b.Window); err != nil {
+		return nil, err
+	}
+	if err := dur("breaker.timeout", &b.Timeout); err != nil {
+		return nil, err
+	}
+	if s := opts["breaker.errorrate"]; s != "" {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r <= 0 || r > 1 {
+			return nil, fmt.Errorf("invalid breaker.errorrate %q. Use a value between 0 and 1", s)
+		}
+		b.ErrorRate = r
+	}
+	if b.MaxPending > 0 && b.MaxConns == 0 {
+		return nil, fmt.Errorf("maxpending requires maxconns")
+	}
+	if b.MaxConns == 0 && b.ErrorRate == 0 {
+		return nil, nil
+	}
+	return &b, nil
+}
+
+// breakerState tracks the active requests and the error rate of a
+// target. It is shared between routing tables so that the state
+// survives table updates for unchanged targets.
+type breakerState struct {
+	cfg Breaker
+
+	// slots limits the number of concurrent requests. It is nil if
+	// there is no limit.
+	slots chan struct{}
+
+	rejected gkm.Counter
+	open     gkm.Gauge
+
+	mu          sync.Mutex
+	pending     int
+	state       string
+	openedAt    time.Time
+	probing     bool
+	windowStart time.Time
+	requests    int
+	failures    int
+}
+
+// breakerStates stores the breaker state by target and configuration.
+var breakerStates = struct {
+	sync.Mutex
+	m map[string]*breakerState
+}{m: map[string]*breakerState{}}
+
+func (r *Route) breakerKey(t *Target, b Breaker) string {
+	return r.Host + r.Path + " " + r.conds.String() + " " + t.URL.String() + " " + b.String()
+}
+
+func breakerStateFor(r *Route, t *Target, b Breaker) *breakerState {
+	key := r.breakerKey(t, b)
+
+	breakerStates.Lock()
+	defer breakerStates.Unlock()
+	s := breakerStates.m[key]
+	if s == nil {
+		s = &breakerState{
+			cfg:      b,
+			state:    CircuitClosed,
+			rejected: counters.circuitRejected.With("service", t.Service, "host", r.Host, "path", r.Path, "target", t.URL.String()),
+			open:     counters.circuitOpen.With("service", t.Service, "host", r.Host, "path", r.Path, "target", t.URL.String()),
+		}
+		if b.MaxConns > 0 {
+			s.slots = make(chan struct{}, b.MaxConns)
+		}
+		breakerStates.m[key] = s
+	}
+	return s
+}
+
+// retainBreakers removes the breaker state of targets which are no
+// longer in the table.
+func retainBreakers(t Table) {
+	keep := map[string]bool{}
+	for _, routes := range t {
+		for _, r := range routes {
+			for _, tg := range r.Targets {
+				if tg.breaker != nil {
+					keep[r.breakerKey(tg, tg.breaker.cfg)] = true
+				}
+			}
+		}
+	}
+
+	breakerStates.Lock()
+	defer breakerStates.Unlock()
+	for k := range breakerStates.m {
+		if !keep[k] {
+			delete(breakerStates.m, k)
+		}
+	}
+}
+
+// parseRouteMaxConns returns the concurrency limit for all targets of
+// the route configured with the 'route.maxconns' option or zero if
+// there is none.
+func parseRouteMaxConns(opts map[string]string) (int, error) {
+	s := opts["route.maxconns"]
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid route.maxconns %q", s)
+	}
+	return n, nil
+}
+
+// routeConns limits the concurrent requests to all targets of a route.
+// Requests exceeding the limit are rejected immediately.
+type routeConns chan struct{}
+
+// routeConnStates stores the concurrency limits of the routes so that
+// the active requests are counted across table updates.
+var routeConnStates = struct {
+	sync.Mutex
+	m map[string]routeConns
+}{m: map[string]routeConns{}}
+
+func (r *Route) routeConnsKey(n int) string {
+	return r.Host + r.Path + " " + r.conds.String() + " " + strconv.Itoa(n)
+}
+
+func routeConnsFor(r *Route, n int) routeConns {
+	key := r.routeConnsKey(n)
+
+	routeConnStates.Lock()
+	defer routeConnStates.Unlock()
+	c := routeConnStates.m[key]
+	if c == nil {
+		c = make(routeConns, n)
+		routeConnStates.m[key] = c
+	}
+	return c
+}
+
+// retainRouteConns removes the concurrency limits of routes which are
+// no longer in the table.
+func retainRouteConns(t Table) {
+	keep := map[string]bool{}
+	for _, routes := range t {
+		for _, r := range routes {
+			if r.conns != nil {
+				keep[r.routeConnsKey(cap(r.conns))] = true
+			}
+		}
+	}
+
+	routeConnStates.Lock()
+	defer routeConnStates.Unlock()
+	for k := range routeConnStates.m {
+		if !keep[k] {
+			delete(routeConnStates.m, k)
+		}
+	}
+}
+
+// acquire takes one of the slots of the route and returns false if all
+// of them are in use. A nil limit always succeeds.
+func (c routeConns) acquire() bool {
+	if c == nil {
+		return true
+	}
+	select {
+	case c <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c routeConns) release() {
+	if c != nil {
+		<-c
+	}
+}
+
+// allow returns true if the circuit lets the request through. An open
+// circuit switches to half-open after the timeout and lets a single
+// probe request through. The second return value is true for the probe.
+func (s *breakerState) allow() (ok, probe bool) {
+	if s.cfg.ErrorRate == 0 {
+		return true, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.state {
+	case CircuitOpen:
+		if timeNow().Before(s.openedAt.Add(s.cfg.Timeout)) {
+			return false, false
+		}
+		s.state, s.probing = CircuitHalfOpen, true
+		return true, true
+	case CircuitHalfOpen:
+		if s.probing {
+			return false, false
+		}
+		s.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// report records the result of a request and updates the state of the
+// circuit. Only the result of the probe request closes or re-opens a
+// half-open circuit.
+func (s *breakerState) report(t *Target, failed, probe bool) {
+	if s.cfg.ErrorRate == 0 {
+		return
+	}
+	now := timeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case probe:
+		s.probing = false
+		if failed {
+			s.trip(t, now)
+			return
+		}
+		log.Printf("[INFO] route: Closing circuit for %s", t.URL)
+		s.state, s.requests, s.failures, s.windowStart = CircuitClosed, 0, 0, now
+		s.open.Set(0)
+		return
+	case s.state != CircuitClosed:
+		// result of a request which started before the circuit opened
+		return
+	}
+
+	if now.Sub(s.windowStart) > s.cfg.Window {
+		s.requests, s.failures, s.windowStart = 0, 0, now
+	}
+	s.requests++
+	if failed {
+		s.failures++
+	}
+	if s.requests >= s.cfg.MinRequests && float64(s.failures)/float64(s.requests) >= s.cfg.ErrorRate {
+		s.trip(t, now)
+	}
+}
+
+func (s *breakerState) trip(t *Target, now time.Time) {
+	log.Printf("[WARN] route: Opening circuit for %s for %s", t.URL, s.cfg.Timeout)
+	s.state, s.openedAt = CircuitOpen, now
+	s.open.Set(1)
+}
+
+// acquire takes one of the slots and waits for a free slot if the
+// pending queue is not full.
+func (s *breakerState) acquire(ctx context.Context) bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	s.mu.Lock()
+	if s.pending >= s.cfg.MaxPending {
+		s.mu.Unlock()
+		return false
+	}
+	s.pending++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.pending--
+		s.mu.Unlock()
+	}()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *breakerState) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// Admit checks whether a request can be sent to the target. If the
+// circuit is open or the concurrency limit of the target or the route
+// is reached it returns ErrCircuitOpen or ErrTooManyRequests.
+// Otherwise, the returned done function must be called with the result
+// of the request when it has completed. Requests wait for a free slot
+// of the target up to the 'maxpending' limit or until ctx is done.
+func (t *Target) Admit(ctx context.Context) (done func(failed bool), err error) {
+	conns := t.routeConns
+	if !conns.acquire() {
+		return nil, ErrTooManyRequests
+	}
+	s := t.breaker
+	if s == nil {
+		if conns == nil {
+			return func(bool) {}, nil
+		}
+		var once sync.Once
+		return func(bool) { once.Do(conns.release) }, nil
+	}
+	ok, probe := s.allow()
+	if !ok {
+		conns.release()
+		s.rejected.Add(1)
+		return nil, ErrCircuitOpen
+	}
+	if !s.acquire(ctx) {
+		conns.release()
+		s.rejected.Add(1)
+		if probe {
+			s.mu.Lock()
+			s.probing = false
+			s.mu.Unlock()
+		}
+		return nil, ErrTooManyRequests
+	}
+	var once sync.Once
+	return func(failed bool) {
+		once.Do(func() {
+			s.release()
+			conns.release()
+			s.report(t, failed, probe)
+		})
+	}, nil
+}
+
+// CircuitState returns the state of the circuit breaker of the target
+// or an empty string if the target has no circuit breaker.
+func (t *Target) CircuitState() string {
+	if t.breaker == nil || t.breaker.cfg.ErrorRate == 0 {
+		return ""
+	}
+	t.breaker.mu.Lock()
+	defer t.breaker.mu.Unlock()
+	if t.breaker.state == CircuitOpen && !timeNow().Before(t.breaker.openedAt.Add(t.breaker.cfg.Timeout)) {
+		return CircuitHalfOpen
+	}
+	return t.breaker.state
+}
+
+// CircuitOpen returns true if the circuit breaker of the target rejects
+// requests because it is open or the probe request of the half-open
+// circuit is still active.
+func (t *Target) CircuitOpen() bool {
+	if t.breaker == nil || t.breaker.cfg.ErrorRate == 0 {
+		return false
+	}
+	t.breaker.mu.Lock()
+	defer t.breaker.mu.Unlock()
+	switch t.breaker.state {
+	case CircuitOpen:
+		return timeNow().Before(t.breaker.openedAt.Add(t.breaker.cfg.Timeout))
+	case CircuitHalfOpen:
+		return t.breaker.probing
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBreaker(t *testing.T) {
+	def := Breaker{MinRequests: 20, Window: 10 * time.Second, Timeout: 30 * time.Second}
+	with := func(f func(b *Breaker)) *Breaker {
+		b := def
+		f(&b)
+		return &b
+	}
+
+	tests := []struct {
+		desc string
+		opts map[string]string
+		b    *Breaker
+		err  bool
+	}{
+		{"none", map[string]string{}, nil, false},
+		{"only defaults", map[string]string{"breaker.window": "5s"}, nil, false},
+		{"maxconns", map[string]string{"maxconns": "10"}, with(func(b *Breaker) { b.MaxConns = 10 }), false},
+		{"maxpending", map[string]string{"maxconns": "10", "maxpending": "5"}, with(func(b *Breaker) { b.MaxConns, b.MaxPending = 10, 5 }), false},
+		{"errorrate", map[string]string{"breaker.errorrate": "0.5"}, with(func(b *Breaker) { b.ErrorRate = 0.5 }), false},
+		{
+			"all",
+			map[string]string{"breaker.errorrate": "0.2", "breaker.minrequests": "5", "breaker.window": "1m", "breaker.timeout": "5s"},
+			&Breaker{ErrorRate: 0.2, MinRequests: 5, Window: time.Minute, Timeout: 5 * time.Second},
+			false,
+		},
+		{"invalid maxconns", map[string]string{"maxconns": "x"}, nil, true},
+		{"negative maxconns", map[string]string{"maxconns": "-1"}, nil, true},
+		{"maxpending without maxconns", map[string]string{"maxpending": "5"}, nil, true},
+		{"errorrate too high", map[string]string{"breaker.errorrate": "2"}, nil, true},
+		{"invalid window", map[string]string{"breaker.errorrate": "0.5", "breaker.window": "0s"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			b, err := parseBreaker(tt.opts)
+			if got, want := err != nil, tt.err; got != want {
+				t.Fatalf("got error %v want %v", err, want)
+			}
+			if got, want := b, tt.b; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v want %+v", got, want)
+			}
+		})
+	}
+}
+
+func setupBreakerTest(t *testing.T) *time.Time {
+	now := time.Unix(1000, 0)
+	prevNow := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() {
+		timeNow = prevNow
+		retainBreakers(Table{})
+	})
+	return &now
+}
+
+func TestAdmitMaxConns(t *testing.T) {
+	setupBreakerTest(t)
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, map[string]string{"maxconns": "2", "maxpending": "1"})
+	tg := r.Targets[0]
+
+	done1, err := tg.Admit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tg.Admit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the third request waits for a free slot
+	admitted := make(chan error)
+	go func() {
+		_, err := tg.Admit(context.Background())
+		admitted <- err
+	}()
+
+	// the pending queue is full
+	for {
+		tg.breaker.mu.Lock()
+		pending := tg.breaker.pending
+		tg.breaker.mu.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := tg.Admit(context.Background()); err != ErrTooManyRequests {
+		t.Fatalf("got %v want %v", err, ErrTooManyRequests)
+	}
+
+	done1(false)
+	done1(false) // done is idempotent
+	if err := <-admitted; err != nil {
+		t.Fatalf("pending request got %v", err)
+	}
+
+	// pending requests give up when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tg.Admit(ctx); err != ErrTooManyRequests {
+		t.Fatalf("got %v want %v", err, ErrTooManyRequests)
+	}
+}
+
+func TestAdmitRouteMaxConns(t *testing.T) {
+	setupBreakerTest(t)
+	t.Cleanup(func() { retainRouteConns(Table{}) })
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, map[string]string{"route.maxconns": "2", "maxconns": "1"})
+	r.addTarget("svc", mustParse("http://bar.com/"), 0, nil, map[string]string{"route.maxconns": "2", "maxconns": "1"})
+	r.addTarget("svc", mustParse("http://baz.com/"), 0, nil, map[string]string{"route.maxconns": "2"})
+
+	// the limit is shared by all targets of the route
+	done1, err := r.Targets[0].Admit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Targets[1].Admit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Targets[2].Admit(context.Background()); err != ErrTooManyRequests {
+		t.Fatalf("got %v want %v", err, ErrTooManyRequests)
+	}
+
+	done1(false)
+	done1(false) // done is idempotent
+	if _, err := r.Targets[2].Admit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rejection by the target frees the slot of the route
+	r = &Route{Host: "www.bar.com", Path: "/bar"}
+	r.addTarget("svc", fooDotCom, 0, nil, map[string]string{"route.maxconns": "2", "maxconns": "1"})
+	if _, err := r.Targets[0].Admit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Targets[0].Admit(context.Background()); err != ErrTooManyRequests {
+		t.Fatalf("got %v want %v", err, ErrTooManyRequests)
+	}
+	if got, want := len(r.conns), 1; got != want {
+		t.Fatalf("got %d active requests want %d", got, want)
+	}
+}
+
+func TestAdmitCircuitBreaker(t *testing.T) {
+	now := setupBreakerTest(t)
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, map[string]string{
+		"breaker.errorrate":   "0.5",
+		"breaker.minrequests": "4",
+		"breaker.window":      "10s",
+		"breaker.timeout":     "30s",
+	})
+	tg := r.Targets[0]
+
+	request := func(failed bool) error {
+		done, err := tg.Admit(context.Background())
+		if err != nil {
+			return err
+		}
+		done(failed)
+		return nil
+	}
+
+	if got, want := tg.CircuitState(), CircuitClosed; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	// failures in an old window do not count
+	request(true)
+	request(true)
+	request(true)
+	*now = now.Add(11 * time.Second)
+
+	request(false)
+	request(true)
+	request(false)
+	if tg.CircuitOpen() {
+		t.Fatal("circuit is open before min requests")
+	}
+	request(true)
+	if got, want := tg.CircuitState(), CircuitOpen; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if err := request(false); err != ErrCircuitOpen {
+		t.Fatalf("got %v want %v", err, ErrCircuitOpen)
+	}
+
+	// a single probe after the timeout
+	*now = now.Add(30 * time.Second)
+	if got, want := tg.CircuitState(), CircuitHalfOpen; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	probe, err := tg.Admit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := request(false); err != ErrCircuitOpen {
+		t.Fatalf("got %v want %v while probing", err, ErrCircuitOpen)
+	}
+
+	// failed probe opens the circuit again
+	probe(true)
+	if got, want := tg.CircuitState(), CircuitOpen; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	// successful probe closes it
+	*now = now.Add(30 * time.Second)
+	if err := request(false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tg.CircuitState(), CircuitClosed; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestCircuitOpenTargetIsSkipped(t *testing.T) {
+	setupBreakerTest(t)
+
+	opts := map[string]string{"breaker.errorrate": "1", "breaker.minrequests": "1"}
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, opts)
+	r.addTarget("svc", barDotCom, 0, nil, opts)
+
+	done, _ := r.Targets[0].Admit(context.Background())
+	done(true)
+
+	if got, want := r.availableTarget(r.Targets[0], nil), r.Targets[1]; got != want {
+		t.Fatalf("got %v want %v", got.URL, want.URL)
+	}
+}
+
+func TestBreakerSurvivesReload(t *testing.T) {
+	setupBreakerTest(t)
+
+	const routes = `route add svc www.bar.com/foo http://10.0.0.1/ opts "breaker.errorrate=1 breaker.minrequests=1"`
+	lookup := func(tbl Table) *Target {
+		req := &http.Request{Host: "www.bar.com", URL: mustParse("/foo"), Header: http.Header{}}
+		return tbl.Lookup(req, "", Picker["rr"], Matcher["prefix"], globCache, false)
+	}
+
+	t1, err := NewTable(bytes.NewBufferString(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTable(t1)
+	done, _ := lookup(t1).Admit(context.Background())
+	done(true)
+
+	t2, _ := NewTable(bytes.NewBufferString(routes))
+	SetTable(t2)
+	if !lookup(t2).CircuitOpen() {
+		t.Fatal("circuit is closed after reload")
+	}
+
+	SetTable(Table{})
+	breakerStates.Lock()
+	n := len(breakerStates.m)
+	breakerStates.Unlock()
+	if n != 0 {
+		t.Fatalf("got %d breaker states want 0", n)
+	}
+}
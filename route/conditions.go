@@ -0,0 +1,153 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	matchHeaderOpt = "match.header."
+	matchQueryOpt  = "match.query."
+	matchMethodOpt = "match.method"
+)
+
+// condition is a single match condition of a route which is evaluated
+// against the request after the host and path have matched.
+type condition struct {
+	// kind is either 'header', 'query' or 'method'.
+	kind string
+
+	// name is the canonical header name or the query parameter name.
+	name string
+
+	// values are the accepted values. For headers and query parameters
+	// the value '*' matches any value as long as the header or query
+	// parameter is present.
+	values []string
+}
+
+func (c condition) match(req *http.Request) bool {
+	switch c.kind {
+	case "method":
+		return containsString(c.values, req.Method)
+	case "header":
+		vals, ok := req.Header[c.name]
+		if !ok {
+			return false
+		}
+		if containsString(c.values, "*") {
+			return true
+		}
+		// headers like 'Accept' can have multiple comma separated values
+		for _, v := range vals {
+			for _, s := range strings.Split(v, ",") {
+				if containsString(c.values, strings.TrimSpace(s)) {
+					return true
+				}
+			}
+		}
+		return false
+	case "query":
+		vals, ok := req.URL.Query()[c.name]
+		if !ok {
+			return false
+		}
+		if containsString(c.values, "*") {
+			return true
+		}
+		for _, v := range vals {
+			if containsString(c.values, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func (c condition) String() string {
+	switch c.kind {
+	case "method":
+		return matchMethodOpt + "=" + strings.Join(c.values, ",")
+	case "header":
+		return matchHeaderOpt + c.name + "=" + strings.Join(c.values, ",")
+	default:
+		return matchQueryOpt + c.name + "=" + strings.Join(c.values, ",")
+	}
+}
+
+// conditions are the match conditions of a route configured with the
+// 'match.header.<name>', 'match.query.<name>' and 'match.method'
+// options. All conditions must match for the route to match.
+type conditions []condition
+
+// parseConditions returns the match conditions from the route options
+// sorted by their string representation. Multiple accepted values are
+// separated by comma.
+func parseConditions(opts map[string]string) (conditions, error) {
+	var cs conditions
+	for k, v := range opts {
+		if !strings.HasPrefix(k, "match.") {
+			continue
+		}
+		if v == "" {
+			return nil, fmt.Errorf("route: match condition %s has no value", k)
+		}
+		values := strings.Split(v, ",")
+
+		switch {
+		case k == matchMethodOpt:
+			for i := range values {
+				values[i] = strings.ToUpper(values[i])
+			}
+			cs = append(cs, condition{kind: "method", values: values})
+		case strings.HasPrefix(k, matchHeaderOpt) && len(k) > len(matchHeaderOpt):
+			name := http.CanonicalHeaderKey(k[len(matchHeaderOpt):])
+			cs = append(cs, condition{kind: "header", name: name, values: values})
+		case strings.HasPrefix(k, matchQueryOpt) && len(k) > len(matchQueryOpt):
+			cs = append(cs, condition{kind: "query", name: k[len(matchQueryOpt):], values: values})
+		default:
+			return nil, fmt.Errorf("route: invalid match condition %s", k)
+		}
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].String() < cs[j].String() })
+	return cs, nil
+}
+
+// match returns true if the request matches all conditions. Routes with
+// conditions never match TCP connections since there is no request.
+func (cs conditions) match(c *client) bool {
+	if len(cs) == 0 {
+		return true
+	}
+	if c == nil || c.req == nil {
+		return false
+	}
+	for _, cond := range cs {
+		if !cond.match(c.req) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the conditions in the route option format. Routes with
+// the same path and the same conditions are the same route.
+func (cs conditions) String() string {
+	s := make([]string, len(cs))
+	for i, c := range cs {
+		s[i] = c.String()
+	}
+	return strings.Join(s, " ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package route
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestParseConditions(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts map[string]string
+		str  string
+		err  bool
+	}{
+		{"no conditions", map[string]string{"strip": "/foo"}, "", false},
+		{"header", map[string]string{"match.header.x-canary": "true"}, "match.header.X-Canary=true", false},
+		{"method", map[string]string{"match.method": "post,PUT"}, "match.method=POST,PUT", false},
+		{"query", map[string]string{"match.query.v": "2"}, "match.query.v=2", false},
+		{"sorted", map[string]string{"match.query.v": "2", "match.method": "GET"}, "match.method=GET match.query.v=2", false},
+		{"no value", map[string]string{"match.method": ""}, "", true},
+		{"no name", map[string]string{"match.header.": "x"}, "", true},
+		{"unknown", map[string]string{"match.cookie.x": "y"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cs, err := parseConditions(tt.opts)
+			if got, want := err != nil, tt.err; got != want {
+				t.Fatalf("got error %v want %v", err, want)
+			}
+			if got, want := cs.String(), tt.str; got != want {
+				t.Fatalf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestTableLookupConditions(t *testing.T) {
+	s := `
+	route add svc /foo http://foo.com:800
+	route add svc /foo http://foo.com:900 opts "match.header.X-Canary=true"
+	route add svc /foo http://foo.com:1000 opts "match.header.X-Canary=true match.method=POST,PUT"
+	route add svc /foo http://foo.com:1100 opts "match.query.v=2"
+	route add svc /foo http://foo.com:1200 opts "match.header.Accept=application/vnd.v3+json"
+	route add svc /bar http://foo.com:1300 opts "match.header.X-Debug=*"
+	route add svc / http://foo.com:1400
+	`
+
+	tbl, err := NewTable(bytes.NewBufferString(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := func(method, uri string, hdr ...string) *http.Request {
+		r := &http.Request{Method: method, URL: mustParse(uri), Header: http.Header{}}
+		for i := 0; i < len(hdr); i += 2 {
+			r.Header.Add(hdr[i], hdr[i+1])
+		}
+		return r
+	}
+
+	tests := []struct {
+		desc string
+		req  *http.Request
+		dst  string
+	}{
+		{"no conditions", req("GET", "/foo"), "http://foo.com:800"},
+		{"header", req("GET", "/foo", "X-Canary", "true"), "http://foo.com:900"},
+		{"header mismatch", req("GET", "/foo", "X-Canary", "false"), "http://foo.com:800"},
+		{"header and method", req("PUT", "/foo", "X-Canary", "true"), "http://foo.com:1000"},
+		{"query", req("GET", "/foo?v=2"), "http://foo.com:1100"},
+		{"query mismatch", req("GET", "/foo?v=1"), "http://foo.com:800"},
+		{"list header", req("GET", "/foo", "Accept", "text/html, application/vnd.v3+json"), "http://foo.com:1200"},
+		{"any value", req("GET", "/bar", "X-Debug", "1"), "http://foo.com:1300"},
+		{"fall through", req("GET", "/bar"), "http://foo.com:1400"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			target := tbl.Lookup(tt.req, "", rndPicker, prefixMatcher, globCache, false)
+			if target == nil {
+				t.Fatal("got no target")
+			}
+			if got, want := target.URL.String(), tt.dst; got != want {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+
+	// routes with conditions never match TCP connections
+	tbl, err = NewTable(bytes.NewBufferString(`route add svc :1234 tcp://1.2.3.4:5678 opts "match.method=GET"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tbl.LookupHost(":1234", rndPicker); got != nil {
+		t.Fatalf("got %v want nil", got.URL)
+	}
+}
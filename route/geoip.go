@@ -0,0 +1,84 @@
+package route
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIP is the MaxMind database for the 'country' access rules. db is
+// nil if no database is configured.
+var geoIP struct {
+	sync.RWMutex
+	db *maxminddb.Reader
+}
+
+// SetGeoIPDatabase opens the MaxMind GeoIP2 or GeoLite2 country or city
+// database for the 'country' access rules and closes the previous one.
+// An empty filename disables the lookup.
+func SetGeoIPDatabase(filename string) error {
+	var db *maxminddb.Reader
+	if filename != "" {
+		var err error
+		if db, err = maxminddb.Open(filename); err != nil {
+			return err
+		}
+	}
+
+	geoIP.Lock()
+	old := geoIP.db
+	geoIP.db = db
+	geoIP.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// geoIPLoaded returns true if a GeoIP database is loaded. It can be
+// overridden in tests.
+var geoIPLoaded = func() bool {
+	geoIP.RLock()
+	defer geoIP.RUnlock()
+	return geoIP.db != nil
+}
+
+// checkCountryRules returns an error if the route options contain
+// 'country' access rules but no GeoIP database is loaded since the
+// rules could never match.
+func checkCountryRules(opts map[string]string) error {
+	for _, allowDeny := range []string{"allow", "deny"} {
+		for _, item := range strings.Split(opts[allowDeny], ",") {
+			typ, _, _ := strings.Cut(item, ":")
+			if strings.EqualFold(strings.TrimSpace(typ), "country") && !geoIPLoaded() {
+				return fmt.Errorf("route: access rule %s requires a GeoIP database. Set proxy.geoip.db", strings.TrimSpace(item))
+			}
+		}
+	}
+	return nil
+}
+
+// countryOf returns the ISO 3166-1 country code of the ip or an empty
+// string if it is unknown. It can be overridden in tests.
+var countryOf = func(ip net.IP) string {
+	geoIP.RLock()
+	defer geoIP.RUnlock()
+	if geoIP.db == nil {
+		return ""
+	}
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := geoIP.db.Lookup(ip, &rec); err != nil {
+		log.Printf("[WARN] route: GeoIP lookup for %s failed: %s", ip, err)
+		return ""
+	}
+	return rec.Country.ISOCode
+}
@@ -0,0 +1,157 @@
+package route
+
+import (
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// hashCfg is the default configuration of the hash picker.
+var hashCfg = config.Hash{Key: "ip"}
+
+// SetHashConfig configures the default key source and affinity cookie
+// of the hash picker for all routes which are added to a routing table
+// after the call.
+func SetHashConfig(cfg config.Hash) {
+	hashCfg = cfg
+}
+
+// client describes the client of a request for the pickers.
+type client struct {
+	// req is the HTTP request. It is nil for TCP connections.
+	req *http.Request
+
+	// addr is the remote address of the client in 'host:port' format.
+	addr string
+}
+
+// hashKey returns the value of the key source src for the client which
+// is either 'ip', 'header:<name>', 'cookie:<name>' or 'query:<name>'.
+// TCP connections are always keyed by the client IP. The second return
+// value is false if the client has no value for the key.
+func (c *client) hashKey(src string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if c.req == nil || src == "ip" {
+		host, _, err := net.SplitHostPort(c.addr)
+		if err != nil {
+			host = c.addr
+		}
+		return host, host != ""
+	}
+
+	kind, name, _ := strings.Cut(src, ":")
+	var v string
+	switch kind {
+	case "header":
+		v = c.req.Header.Get(name)
+	case "cookie":
+		if ck, err := c.req.Cookie(name); err == nil {
+			v = ck.Value
+		}
+	case "query":
+		v = c.req.URL.Query().Get(name)
+	}
+	return v, v != ""
+}
+
+// ringReplicas is the number of points on the hash ring for a target
+// with the average weight.
+const ringReplicas = 100
+
+type ringNode struct {
+	hash   uint64
+	target *Target
+}
+
+// hashRing returns the consistent hash ring of the route. Every target
+// has a number of points on the ring proportional to its weight. The
+// position of the points only depends on the target URL so that adding
+// or removing a target only remaps the keys of that target.
+func (r *Route) hashRing() []ringNode {
+	r.ringOnce.Do(func() {
+		n := float64(len(r.Targets))
+		for _, t := range r.Targets {
+			replicas := int(math.Round(t.Weight * n * ringReplicas))
+			id := t.URL.String()
+			for i := 0; i < replicas; i++ {
+				r.ring = append(r.ring, ringNode{hashString(id + "#" + strconv.Itoa(i)), t})
+			}
+		}
+		sort.Slice(r.ring, func(i, j int) bool { return r.ring[i].hash < r.ring[j].hash })
+	})
+	return r.ring
+}
+
+// hashPicker picks the target for the client from the consistent hash
+// ring of the route. Clients which present a valid affinity cookie are
+// sent to the target of the cookie. Clients without a value for the key
+// source are distributed randomly.
+func hashPicker(r *Route, c *client) *Target {
+	if t := r.stickyTarget(c); t != nil {
+		return t
+	}
+
+	src := r.hashKey
+	if src == "" {
+		src = hashCfg.Key
+	}
+	key, ok := c.hashKey(src)
+	ring := r.hashRing()
+	if !ok || len(ring) == 0 {
+		return rndPicker(r, c)
+	}
+
+	h := hashString(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+
+	// use the next available target on the ring so that the keys of an
+	// unavailable target are spread over the remaining targets.
+	for j := 0; j < len(ring); j++ {
+		if t := ring[(i+j)%len(ring)].target; t.Healthy() && !t.Ejected() && !t.CircuitOpen() {
+			return t
+		}
+	}
+	return ring[i%len(ring)].target
+}
+
+// stickyTarget returns the available target of the route which matches
+// the affinity cookie of the client or nil.
+func (r *Route) stickyTarget(c *client) *Target {
+	if c == nil || c.req == nil || len(r.Targets) == 0 || r.Targets[0].StickyCookie == "" {
+		return nil
+	}
+	ck, err := c.req.Cookie(r.Targets[0].StickyCookie)
+	if err != nil {
+		return nil
+	}
+	for _, t := range r.Targets {
+		if t.StickyID == ck.Value && t.Healthy() && !t.Ejected() && !t.CircuitOpen() {
+			return t
+		}
+	}
+	return nil
+}
+
+// hashString returns a 64 bit hash of s which is stable across
+// processes so that multiple instances route a key to the same target.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	// finalizer from MurmurHash3 to spread similar strings over the ring
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
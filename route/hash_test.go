@@ -0,0 +1,161 @@
+package route
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	req := &http.Request{
+		URL:    mustParse("/foo?user=q"),
+		Header: http.Header{"X-User": {"h"}, "Cookie": {"user=c"}},
+	}
+	tests := []struct {
+		desc string
+		c    *client
+		src  string
+		key  string
+		ok   bool
+	}{
+		{"ip", &client{req: req, addr: "1.2.3.4:5678"}, "ip", "1.2.3.4", true},
+		{"ip without port", &client{req: req, addr: "1.2.3.4"}, "ip", "1.2.3.4", true},
+		{"header", &client{req: req}, "header:X-User", "h", true},
+		{"cookie", &client{req: req}, "cookie:user", "c", true},
+		{"query", &client{req: req}, "query:user", "q", true},
+		{"missing header", &client{req: req}, "header:X-Other", "", false},
+		{"tcp uses ip", &client{addr: "1.2.3.4:5678"}, "header:X-User", "1.2.3.4", true},
+		{"no client", nil, "ip", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			key, ok := tt.c.hashKey(tt.src)
+			if key != tt.key || ok != tt.ok {
+				t.Fatalf("got %q, %v want %q, %v", key, ok, tt.key, tt.ok)
+			}
+		})
+	}
+}
+
+func hashRoute(n int, opts map[string]string) *Route {
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	for i := 0; i < n; i++ {
+		r.addTarget("svc", mustParse(fmt.Sprintf("http://10.0.0.%d/", i)), 0, nil, opts)
+	}
+	r.weighTargets()
+	return r
+}
+
+func hashClient(key string) *client {
+	return &client{req: &http.Request{URL: mustParse("/foo"), Header: http.Header{"X-User": {key}}}}
+}
+
+func TestHashPicker(t *testing.T) {
+	opts := map[string]string{"strategy": "hash", "hashkey": "header:X-User"}
+
+	t.Run("same key same target", func(t *testing.T) {
+		r := hashRoute(4, opts)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			if got, want := hashPicker(r, hashClient(key)), hashPicker(r, hashClient(key)); got != want {
+				t.Fatalf("%s: got %v want %v", key, got.URL, want.URL)
+			}
+		}
+	})
+
+	t.Run("adding a target remaps few keys", func(t *testing.T) {
+		r3, r4 := hashRoute(3, opts), hashRoute(4, opts)
+		moved := 0
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			if hashPicker(r3, hashClient(key)).URL.String() != hashPicker(r4, hashClient(key)).URL.String() {
+				moved++
+			}
+		}
+		// ideally 25% of the keys move to the new target
+		if moved > 400 {
+			t.Fatalf("%d of 1000 keys moved", moved)
+		}
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		r := &Route{Host: "www.bar.com", Path: "/foo"}
+		r.addTarget("svc", fooDotCom, 0, nil, opts)
+		r.addTarget("svc", barDotCom, 0, nil, opts)
+		r.Targets[0].FixedWeight = 0.8
+		r.weighTargets()
+
+		counts := map[*url.URL]int{}
+		for i := 0; i < 1000; i++ {
+			counts[hashPicker(r, hashClient(fmt.Sprintf("user-%d", i))).URL]++
+		}
+		if got := counts[fooDotCom]; got < 700 || got > 900 {
+			t.Fatalf("got %d of 1000 keys for %s want ~800", got, fooDotCom)
+		}
+	})
+
+	t.Run("unavailable target", func(t *testing.T) {
+		defer retainHealth(nil)
+
+		hc := map[string]string{"strategy": "hash", "hashkey": "header:X-User", "healthcheck": "/health"}
+		r := hashRoute(3, hc)
+		down := hashPicker(r, hashClient("alice"))
+		SetHealth(down.HealthKey(), false, "connection refused")
+		if got := hashPicker(r, hashClient("alice")); got == down {
+			t.Fatalf("got unhealthy target %v", got.URL)
+		}
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		r := hashRoute(3, opts)
+		c := &client{req: &http.Request{URL: mustParse("/foo")}}
+		if got := hashPicker(r, c); got == nil {
+			t.Fatal("got no target")
+		}
+	})
+}
+
+func TestStickyTarget(t *testing.T) {
+	r := hashRoute(3, map[string]string{"sticky": "lb"})
+	if got, want := r.strategy, "hash"; got != want {
+		t.Fatalf("got strategy %q want %q", got, want)
+	}
+
+	want := r.Targets[2]
+	req := &http.Request{URL: mustParse("/foo"), Header: http.Header{}}
+	req.AddCookie(&http.Cookie{Name: "lb", Value: want.StickyID})
+	for i := 0; i < 10; i++ {
+		if got := hashPicker(r, &client{req: req, addr: fmt.Sprintf("1.2.3.%d:1234", i)}); got != want {
+			t.Fatalf("%d: got %v want %v", i, got.URL, want.URL)
+		}
+	}
+
+	// unknown cookie value falls back to the hash key
+	req = &http.Request{URL: mustParse("/foo"), Header: http.Header{}}
+	req.AddCookie(&http.Cookie{Name: "lb", Value: "unknown"})
+	if got := hashPicker(r, &client{req: req, addr: "1.2.3.4:1234"}); got == nil {
+		t.Fatal("got no target")
+	}
+}
+
+func TestLookupHostFrom(t *testing.T) {
+	tbl, err := NewTable(bytes.NewBufferString(`
+route add svc :1234 tcp://10.0.0.1:80 opts "strategy=hash"
+route add svc :1234 tcp://10.0.0.2:80 opts "strategy=hash"
+route add svc :1234 tcp://10.0.0.3:80 opts "strategy=hash"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		addr := fmt.Sprintf("1.2.3.%d", i)
+		want := tbl.LookupHostFrom(":1234", addr+":1000", Picker["rr"])
+		if got := tbl.LookupHostFrom(":1234", addr+":2000", Picker["rr"]); got != want {
+			t.Fatalf("%s: got %v want %v", addr, got.URL, want.URL)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/fabiolb/fabio/logger"
+)
+
+// HeaderRules modify the request or response headers for a target.
+// They are configured with the '<prefix>.set.<name>=<value>',
+// '<prefix>.add.<name>=<value>' and '<prefix>.del=<name>,<name>'
+// options where prefix is either 'reqhdr' or 'resphdr'. Values can
+// contain the fields of the access log format like '$remote_host'.
+type HeaderRules struct {
+	del []string
+	set []headerValue
+	add []headerValue
+}
+
+type headerValue struct {
+	name  string
+	value *logger.Template
+}
+
+// parseHeaderRules returns the header rules with the given prefix from
+// the route options or nil if there are none.
+func parseHeaderRules(prefix string, opts map[string]string) (*HeaderRules, error) {
+	var h HeaderRules
+	for k, v := range opts {
+		if !strings.HasPrefix(k, prefix+".") {
+			continue
+		}
+		op, name, _ := strings.Cut(k[len(prefix)+1:], ".")
+
+		switch op {
+		case "del":
+			if name != "" || v == "" {
+				return nil, fmt.Errorf("invalid header option %s=%s. Use %s.del=<name>,<name>", k, v, prefix)
+			}
+			for _, s := range strings.Split(v, ",") {
+				h.del = append(h.del, http.CanonicalHeaderKey(s))
+			}
+		case "set", "add":
+			if name == "" {
+				return nil, fmt.Errorf("invalid header option %s. Use %s.%s.<name>=<value>", k, prefix, op)
+			}
+			tmpl, err := logger.NewTemplate(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for header option %s. %s", k, err)
+			}
+			hv := headerValue{http.CanonicalHeaderKey(name), tmpl}
+			if op == "set" {
+				h.set = append(h.set, hv)
+			} else {
+				h.add = append(h.add, hv)
+			}
+		default:
+			return nil, fmt.Errorf("invalid header option %s", k)
+		}
+	}
+	if h.del == nil && h.set == nil && h.add == nil {
+		return nil, nil
+	}
+
+	// the options are unordered
+	sort.Strings(h.del)
+	sort.Slice(h.set, func(i, j int) bool { return h.set[i].name < h.set[j].name })
+	sort.Slice(h.add, func(i, j int) bool { return h.add[i].name < h.add[j].name })
+	return &h, nil
+}
+
+// Apply removes, sets and adds the headers in that order. The values
+// are expanded for the event. Apply does nothing if h is nil.
+func (h *HeaderRules) Apply(hdr http.Header, e *logger.Event) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.del {
+		hdr.Del(name)
+	}
+	for _, v := range h.set {
+		hdr.Set(v.name, v.value.Execute(e))
+	}
+	for _, v := range h.add {
+		hdr.Add(v.name, v.value.Execute(e))
+	}
+}
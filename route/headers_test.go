@@ -0,0 +1,78 @@
+package route
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/fabiolb/fabio/logger"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts map[string]string
+		nil  bool
+		err  bool
+	}{
+		{"no rules", map[string]string{"strip": "/foo", "resphdr.set.X-Foo": "bar"}, true, false},
+		{"set", map[string]string{"reqhdr.set.X-Env": "prod"}, false, false},
+		{"add", map[string]string{"reqhdr.add.X-Env": "prod"}, false, false},
+		{"del", map[string]string{"reqhdr.del": "Cookie,X-Debug"}, false, false},
+		{"del with name", map[string]string{"reqhdr.del.Cookie": ""}, false, true},
+		{"set without name", map[string]string{"reqhdr.set": "prod"}, false, true},
+		{"unknown op", map[string]string{"reqhdr.replace.X-Env": "prod"}, false, true},
+		{"unknown field", map[string]string{"reqhdr.set.X-Env": "$unknown"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h, err := parseHeaderRules("reqhdr", tt.opts)
+			if got, want := err != nil, tt.err; got != want {
+				t.Fatalf("got error %v want %v", err, want)
+			}
+			if got, want := h == nil, tt.nil || tt.err; got != want {
+				t.Fatalf("got nil rules %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	h, err := parseHeaderRules("reqhdr", map[string]string{
+		"reqhdr.set.x-env":     "prod",
+		"reqhdr.set.X-Client":  "$remote_host",
+		"reqhdr.add.X-Via":     "$upstream_service",
+		"reqhdr.del":           "Cookie",
+		"reqhdr.set.X-Request": "id-$request_id",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := http.Header{
+		"Cookie": {"a=b"},
+		"X-Env":  {"dev"},
+		"X-Via":  {"lb"},
+	}
+	e := &logger.Event{
+		Request:         &http.Request{RemoteAddr: "1.2.3.4:5678"},
+		UpstreamService: "svc-a",
+		RequestID:       "123",
+	}
+	h.Apply(hdr, e)
+
+	want := http.Header{
+		"X-Env":     {"prod"},
+		"X-Client":  {"1.2.3.4"},
+		"X-Via":     {"lb", "svc-a"},
+		"X-Request": {"id-123"},
+	}
+	if !reflect.DeepEqual(hdr, want) {
+		t.Fatalf("got %v want %v", hdr, want)
+	}
+
+	// nil rules do nothing
+	var none *HeaderRules
+	none.Apply(hdr, e)
+}
@@ -0,0 +1,194 @@
+package route
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck describes the active health check for a target.
+type HealthCheck struct {
+	// Type is the type of the probe: "http", "tcp" or "grpc".
+	Type string
+
+	// Path is the request path for "http" checks and the
+	// service name for "grpc" checks.
+	Path string
+
+	// Interval is the time between two checks. If Interval is zero
+	// the globally configured default is used.
+	Interval time.Duration
+
+	// Timeout is the maximum duration of a single check. If Timeout
+	// is zero the globally configured default is used.
+	Timeout time.Duration
+}
+
+// parseHealthCheck creates the health check configuration from the
+// target options. The value of the 'healthcheck' option determines
+// the type of the check:
+//
+//	healthcheck=/path         : HTTP GET on /path
+//	healthcheck=tcp           : TCP connect
+//	healthcheck=grpc[:<svc>]  : gRPC health protocol for service svc
+func parseHealthCheck(opts map[string]string) (*HealthCheck, error) {
+	v := opts["healthcheck"]
+	if v == "" {
+		return nil, nil
+	}
+
+	hc := &HealthCheck{}
+	switch {
+	case strings.HasPrefix(v, "/"):
+		hc.Type, hc.Path = "http", v
+	case v == "http":
+		hc.Type, hc.Path = "http", "/"
+	case v == "tcp":
+		hc.Type = "tcp"
+	case v == "grpc":
+		hc.Type = "grpc"
+	case strings.HasPrefix(v, "grpc:"):
+		hc.Type, hc.Path = "grpc", v[len("grpc:"):]
+	default:
+		return nil, fmt.Errorf("invalid health check %q", v)
+	}
+
+	for _, k := range []string{"healthcheck.interval", "healthcheck.timeout"} {
+		if opts[k] == "" {
+			continue
+		}
+		d, err := time.ParseDuration(opts[k])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", k, opts[k])
+		}
+		if k == "healthcheck.interval" {
+			hc.Interval = d
+		} else {
+			hc.Timeout = d
+		}
+	}
+	return hc, nil
+}
+
+// healthState contains the result of the active health check for all
+// targets with the same health check key. It is shared between routing
+// tables so that the state survives table updates.
+type healthState struct {
+	unhealthy int32
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	lastError string
+}
+
+// healthStates stores the health state by health check key.
+var healthStates = struct {
+	sync.Mutex
+	m map[string]*healthState
+}{m: map[string]*healthState{}}
+
+func healthStateFor(key string) *healthState {
+	healthStates.Lock()
+	defer healthStates.Unlock()
+	s := healthStates.m[key]
+	if s == nil {
+		s = &healthState{}
+		healthStates.m[key] = s
+	}
+	return s
+}
+
+// SetHealth records the result of the active health check for all
+// targets with the given health check key. msg describes the reason
+// for a failed check. Results for keys which are not in a routing table
+// are ignored.
+func SetHealth(key string, healthy bool, msg string) {
+	healthStates.Lock()
+	s := healthStates.m[key]
+	healthStates.Unlock()
+	if s == nil {
+		return
+	}
+
+	if healthy {
+		atomic.StoreInt32(&s.unhealthy, 0)
+	} else {
+		atomic.StoreInt32(&s.unhealthy, 1)
+	}
+	s.mu.Lock()
+	s.lastCheck = time.Now()
+	s.lastError = msg
+	s.mu.Unlock()
+}
+
+// retainHealth removes the health state of the targets which are no
+// longer in the routing table.
+func retainHealth(t Table) {
+	keep := map[string]bool{}
+	for _, routes := range t {
+		for _, r := range routes {
+			for _, tg := range r.Targets {
+				if key := tg.HealthKey(); key != "" {
+					keep[key] = true
+				}
+			}
+		}
+	}
+
+	healthStates.Lock()
+	defer healthStates.Unlock()
+	for k := range healthStates.m {
+		if !keep[k] {
+			delete(healthStates.m, k)
+		}
+	}
+}
+
+// HealthKey returns the key which identifies the health check of the
+// target. Targets with the same key share the result of a single check.
+// The key contains all settings which change how the check is made and
+// is empty if the target has no active health check.
+func (t *Target) HealthKey() string {
+	hc := t.HealthCheck
+	if hc == nil || t.URL == nil {
+		return ""
+	}
+	key := hc.Type + " " + t.URL.Scheme + "://" + t.URL.Host + hc.Path
+	if hc.Type == "http" && t.Host != "" && t.Host != "dst" {
+		key += " host=" + t.Host
+	}
+	if hc.Type == "grpc" && t.Opts["grpcservername"] != "" {
+		key += " grpcservername=" + t.Opts["grpcservername"]
+	}
+	if hc.Type != "tcp" && t.TLSSkipVerify {
+		key += " tlsskipverify"
+	}
+	if hc.Interval > 0 {
+		key += " interval=" + hc.Interval.String()
+	}
+	if hc.Timeout > 0 {
+		key += " timeout=" + hc.Timeout.String()
+	}
+	return key
+}
+
+// Healthy returns false if the active health check for the target
+// failed. Targets without a health check are always healthy.
+func (t *Target) Healthy() bool {
+	return t.health == nil || atomic.LoadInt32(&t.health.unhealthy) == 0
+}
+
+// HealthStatus returns "healthy" or "unhealthy" for targets with an
+// active health check and an empty string otherwise.
+func (t *Target) HealthStatus() string {
+	switch {
+	case t.health == nil:
+		return ""
+	case t.Healthy():
+		return "healthy"
+	default:
+		return "unhealthy"
+	}
+}
@@ -0,0 +1,155 @@
+package route
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts map[string]string
+		hc   *HealthCheck
+		err  bool
+	}{
+		{"no check", nil, nil, false},
+		{"http path", map[string]string{"healthcheck": "/health"}, &HealthCheck{Type: "http", Path: "/health"}, false},
+		{"http", map[string]string{"healthcheck": "http"}, &HealthCheck{Type: "http", Path: "/"}, false},
+		{"tcp", map[string]string{"healthcheck": "tcp"}, &HealthCheck{Type: "tcp"}, false},
+		{"grpc", map[string]string{"healthcheck": "grpc"}, &HealthCheck{Type: "grpc"}, false},
+		{"grpc service", map[string]string{"healthcheck": "grpc:foo.Bar"}, &HealthCheck{Type: "grpc", Path: "foo.Bar"}, false},
+		{
+			"interval and timeout",
+			map[string]string{"healthcheck": "tcp", "healthcheck.interval": "5s", "healthcheck.timeout": "1s"},
+			&HealthCheck{Type: "tcp", Interval: 5 * time.Second, Timeout: time.Second},
+			false,
+		},
+		{"invalid type", map[string]string{"healthcheck": "udp"}, nil, true},
+		{"invalid interval", map[string]string{"healthcheck": "tcp", "healthcheck.interval": "x"}, nil, true},
+		{"negative timeout", map[string]string{"healthcheck": "tcp", "healthcheck.timeout": "-1s"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			hc, err := parseHealthCheck(tt.opts)
+			if got, want := err != nil, tt.err; got != want {
+				t.Fatalf("got error %v want error %v", err, want)
+			}
+			if got, want := hc, tt.hc; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestHealthKey(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts map[string]string
+		key  string
+	}{
+		{"no check", map[string]string{}, ""},
+		{"http", map[string]string{"healthcheck": "/health"}, "http http://foo.com/health"},
+		{"http host", map[string]string{"healthcheck": "/health", "host": "a.com"}, "http http://foo.com/health host=a.com"},
+		{"http host dst", map[string]string{"healthcheck": "/health", "host": "dst"}, "http http://foo.com/health"},
+		{"http tlsskipverify", map[string]string{"healthcheck": "/health", "tlsskipverify": "true"}, "http http://foo.com/health tlsskipverify"},
+		{"tcp host", map[string]string{"healthcheck": "tcp", "host": "a.com", "tlsskipverify": "true"}, "tcp http://foo.com"},
+		{"grpc", map[string]string{"healthcheck": "grpc:foo.Bar", "grpcservername": "a.com"}, "grpc http://foo.comfoo.Bar grpcservername=a.com"},
+		{
+			"interval and timeout",
+			map[string]string{"healthcheck": "tcp", "healthcheck.interval": "5s", "healthcheck.timeout": "1s"},
+			"tcp http://foo.com interval=5s timeout=1s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := &Route{Host: "www.bar.com", Path: "/foo"}
+			r.addTarget("svc", fooDotCom, 0, nil, tt.opts)
+			if got, want := r.Targets[0].HealthKey(), tt.key; got != want {
+				t.Fatalf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHealthyTarget(t *testing.T) {
+	defer retainHealth(nil)
+
+	opts := map[string]string{"healthcheck": "/health"}
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, opts)
+	r.addTarget("svc", barDotCom, 0, nil, opts)
+
+	foo, bar := r.Targets[0], r.Targets[1]
+	if got, want := foo.HealthStatus(), "healthy"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	SetHealth(foo.HealthKey(), false, "connection refused")
+	if got, want := foo.HealthStatus(), "unhealthy"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	for i := 0; i < 10; i++ {
+		if got, want := r.availableTarget(rrPicker(r, nil), nil), bar; got != want {
+			t.Fatalf("%d: got %v want %v", i, got.URL, want.URL)
+		}
+	}
+
+	// all targets unhealthy: use the picked target
+	SetHealth(bar.HealthKey(), false, "connection refused")
+	if got, want := r.availableTarget(foo, nil), foo; got != want {
+		t.Fatalf("got %v want %v", got.URL, want.URL)
+	}
+
+	// health state survives a table update
+	r2 := &Route{Host: "www.bar.com", Path: "/foo"}
+	r2.addTarget("svc", fooDotCom, 0, nil, opts)
+	if r2.Targets[0].Healthy() {
+		t.Fatal("got healthy want unhealthy")
+	}
+
+	// target without health check is always healthy
+	r3 := &Route{Host: "www.bar.com", Path: "/foo"}
+	r3.addTarget("svc", fooDotCom, 0, nil, nil)
+	if got, want := r3.Targets[0].HealthStatus(), ""; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+func TestHealthStateTableUpdate(t *testing.T) {
+	defer SetTable(Table{})
+	const routes = `route add svc www.bar.com/foo http://10.0.0.1/ opts "healthcheck=/health"`
+
+	t1, err := NewTable(bytes.NewBufferString(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTable(t1)
+	tg1 := t1["www.bar.com"][0].Targets[0]
+	SetHealth(tg1.HealthKey(), false, "connection refused")
+
+	// the state is kept while the target is in the routing table
+	t2, _ := NewTable(bytes.NewBufferString(routes))
+	SetTable(t2)
+	tg2 := t2["www.bar.com"][0].Targets[0]
+	if tg2.Healthy() {
+		t.Fatal("got healthy after table update want unhealthy")
+	}
+	SetHealth(tg2.HealthKey(), true, "")
+	if !tg2.Healthy() {
+		t.Fatal("got unhealthy want healthy")
+	}
+
+	// results for targets which are no longer in the table are ignored
+	SetTable(Table{})
+	SetHealth(tg2.HealthKey(), false, "connection refused")
+	healthStates.Lock()
+	n := len(healthStates.m)
+	healthStates.Unlock()
+	if n != 0 {
+		t.Fatalf("got %d health states want 0", n)
+	}
+}
@@ -13,6 +13,18 @@ var Matcher = map[string]matcher{
 	"prefix":  prefixMatcher,
 	"glob":    globMatcher,
 	"iprefix": iPrefixMatcher,
+	"regex":   regexMatcher,
+}
+
+// regexPaths is true if the paths of the routes are compiled as regular
+// expressions for the regex matcher.
+var regexPaths bool
+
+// SetMatcher configures the route paths for the matcher of the proxy for
+// all routes which are added to a routing table after the call. The
+// paths are only compiled as regular expressions for the regex matcher.
+func SetMatcher(name string) {
+	regexPaths = name == "regex"
 }
 
 // prefixMatcher matches path to the routes' path.
@@ -33,3 +45,9 @@ func iPrefixMatcher(uri string, r *Route) bool {
 	lowerPath := strings.ToLower(r.Path)
 	return strings.HasPrefix(lowerURI, lowerPath)
 }
+
+// regexMatcher matches path to the routes' path as a regular expression
+// which is anchored at the start of the path.
+func regexMatcher(uri string, r *Route) bool {
+	return r.Regex != nil && r.Regex.MatchString(uri)
+}
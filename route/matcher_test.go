@@ -1,6 +1,8 @@
 package route
 
 import (
+	"bytes"
+	"reflect"
 	"testing"
 
 	"github.com/gobwas/glob"
@@ -81,3 +83,66 @@ func TestIPrefixMatcher(t *testing.T) {
 		})
 	}
 }
+
+func TestRegexMatcher(t *testing.T) {
+	tests := []struct {
+		uri     string
+		matches bool
+		route   *Route
+	}{
+		{uri: "/users/42/orders", matches: true, route: &Route{Path: "/users/[0-9]+/orders"}},
+		{uri: "/users/42/orders/7", matches: true, route: &Route{Path: "/users/[0-9]+/orders"}},
+		{uri: "/users/42/orders/7", matches: false, route: &Route{Path: "/users/[0-9]+/orders$"}},
+		{uri: "/users/joe/orders", matches: false, route: &Route{Path: "/users/[0-9]+/orders"}},
+		{uri: "/api/users/42/orders", matches: false, route: &Route{Path: "/users/[0-9]+/orders"}},
+		{uri: "/foo", matches: false, route: &Route{Path: "/foo(("}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			tt.route.Regex, _ = compileRegex(tt.route.Path)
+			if got, want := regexMatcher(tt.uri, tt.route), tt.matches; got != want {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRouteRegex(t *testing.T) {
+	defer SetMatcher("prefix")
+	const routes = "route add svc /users/[0-9]+ http://foo.com/\n" +
+		"route add svc /orders/[0-9]+ http://foo.com/ opts \"rewrite=/o/\""
+
+	regex := func() map[string]bool {
+		tbl, err := NewTable(bytes.NewBufferString(routes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := map[string]bool{}
+		for _, r := range tbl[""] {
+			m[r.Path] = r.Regex != nil
+		}
+		return m
+	}
+
+	// only routes which rewrite the path need the regular expression
+	SetMatcher("prefix")
+	if got, want := regex(), map[string]bool{"/users/[0-9]+": false, "/orders/[0-9]+": true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	SetMatcher("regex")
+	if got, want := regex(), map[string]bool{"/users/[0-9]+": true, "/orders/[0-9]+": true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// invalid regular expressions are only an error for the regex matcher
+	const invalid = "route add svc /users/(a http://foo.com/"
+	if _, err := NewTable(bytes.NewBufferString(invalid)); err == nil {
+		t.Fatal("got nil want error for invalid regular expression")
+	}
+	SetMatcher("prefix")
+	if _, err := NewTable(bytes.NewBufferString(invalid)); err != nil {
+		t.Fatalf("got %v want nil", err)
+	}
+}
@@ -0,0 +1,189 @@
+package route
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+// outlierCfg is the configuration of the passive outlier detection.
+// Outlier detection is disabled if ConsecutiveFailures and ErrorRate
+// are zero.
+var outlierCfg config.Outlier
+
+// timeNow returns the current time. It can be overridden in tests.
+var timeNow = time.Now
+
+// SetOutlierConfig configures the passive outlier detection for all
+// targets which are added to a routing table after the call.
+func SetOutlierConfig(cfg config.Outlier) {
+	outlierCfg = cfg
+}
+
+// outlierState tracks the failures of all targets with the same upstream
+// address. It is shared between routing tables so that the state
+// survives table updates.
+type outlierState struct {
+	// ejectedUntil is the end of the current ejection in
+	// nanoseconds since the epoch.
+	ejectedUntil int64
+
+	mu        sync.Mutex
+	failures  int
+	ejections int
+	ejectedAt time.Time
+
+	// windowStart, requests and errors track the error rate within
+	// proxy.outlier.window.
+	windowStart time.Time
+	requests    int
+	errors      int
+}
+
+// outlierStates stores the outlier state by upstream address.
+var outlierStates = struct {
+	sync.Mutex
+	m map[string]*outlierState
+}{m: map[string]*outlierState{}}
+
+func outlierStateFor(key string) *outlierState {
+	outlierStates.Lock()
+	defer outlierStates.Unlock()
+	s := outlierStates.m[key]
+	if s == nil {
+		s = &outlierState{}
+		outlierStates.m[key] = s
+	}
+	return s
+}
+
+// ReportSuccess records a successful request to the target and resets
+// its failure count. The ejection count which determines the length of
+// the next ejection is reset once the target has been serving requests
+// for proxy.outlier.maxejectiontime after its last ejection.
+func (t *Target) ReportSuccess() {
+	s := t.outlier
+	if s == nil {
+		return
+	}
+	now := timeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = 0
+	if now.UnixNano() >= atomic.LoadInt64(&s.ejectedUntil) {
+		s.count(now, false)
+	}
+	if s.ejections > 0 && now.UnixNano() > atomic.LoadInt64(&s.ejectedUntil)+int64(outlierCfg.MaxEjectionTime) {
+		s.ejections = 0
+	}
+}
+
+// ReportFailure records a failed request to the target. The target is
+// ejected after proxy.outlier.consecutivefailures failures in a row or
+// when the ratio of failed requests within proxy.outlier.window reaches
+// proxy.outlier.errorrate after at least proxy.outlier.minrequests
+// requests. The duration of the ejection doubles with every ejection
+// starting at proxy.outlier.baseejectiontime up to
+// proxy.outlier.maxejectiontime. Failures of requests which were in
+// flight while the target was ejected are ignored.
+func (t *Target) ReportFailure() {
+	s := t.outlier
+	if s == nil {
+		return
+	}
+	now := timeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.UnixNano() < atomic.LoadInt64(&s.ejectedUntil) {
+		return
+	}
+	s.failures++
+	s.count(now, true)
+
+	var reason string
+	switch {
+	case outlierCfg.ConsecutiveFailures > 0 && s.failures >= outlierCfg.ConsecutiveFailures:
+		reason = fmt.Sprintf("%d consecutive failures", s.failures)
+	case outlierCfg.ErrorRate > 0 && s.requests >= outlierCfg.MinRequests && float64(s.errors)/float64(s.requests) >= outlierCfg.ErrorRate:
+		reason = fmt.Sprintf("%d of %d failed requests", s.errors, s.requests)
+	default:
+		return
+	}
+
+	d := outlierCfg.BaseEjectionTime
+	for i := 0; i < s.ejections && d < outlierCfg.MaxEjectionTime; i++ {
+		d *= 2
+	}
+	if d > outlierCfg.MaxEjectionTime {
+		d = outlierCfg.MaxEjectionTime
+	}
+	s.failures, s.requests, s.errors = 0, 0, 0
+	s.ejections++
+	s.ejectedAt = now
+	atomic.StoreInt64(&s.ejectedUntil, now.Add(d).UnixNano())
+
+	log.Printf("[WARN] route: Ejecting %s for %s after %s", t.URL, d, reason)
+	if t.EjectCounter != nil {
+		t.EjectCounter.Add(1)
+	}
+}
+
+// count records the result of a request for the error rate. The counts
+// are reset when the window has passed.
+func (s *outlierState) count(now time.Time, failed bool) {
+	if outlierCfg.ErrorRate == 0 {
+		return
+	}
+	if now.Sub(s.windowStart) > outlierCfg.Window {
+		s.windowStart, s.requests, s.errors = now, 0, 0
+	}
+	s.requests++
+	if failed {
+		s.errors++
+	}
+}
+
+// Ejected returns true if the target is currently ejected by the
+// outlier detection. The route may still send traffic to an ejected
+// target if too many of its targets are ejected.
+func (t *Target) Ejected() bool {
+	return t.outlier != nil && timeNow().UnixNano() < atomic.LoadInt64(&t.outlier.ejectedUntil)
+}
+
+func (t *Target) ejectedAt() time.Time {
+	t.outlier.mu.Lock()
+	defer t.outlier.mu.Unlock()
+	return t.outlier.ejectedAt
+}
+
+// ejectedTargets returns the ejected targets of the route which should
+// not receive traffic. If more than proxy.outlier.maxejectionpercent of
+// the targets are ejected only the targets which were ejected first
+// are returned.
+func (r *Route) ejectedTargets() map[*Target]bool {
+	var ejected []*Target
+	for _, t := range r.Targets {
+		if t.Ejected() {
+			ejected = append(ejected, t)
+		}
+	}
+	max := len(r.Targets) * outlierCfg.MaxEjectionPercent / 100
+	if len(ejected) > max {
+		sort.SliceStable(ejected, func(i, j int) bool {
+			return ejected[i].ejectedAt().Before(ejected[j].ejectedAt())
+		})
+		ejected = ejected[:max]
+	}
+	m := make(map[*Target]bool, len(ejected))
+	for _, t := range ejected {
+		m[t] = true
+	}
+	return m
+}
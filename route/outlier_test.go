@@ -0,0 +1,187 @@
+package route
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/config"
+)
+
+func setupOutlierTest(t *testing.T, cfg config.Outlier) *time.Time {
+	now := time.Unix(1000, 0)
+	prevCfg, prevNow := outlierCfg, timeNow
+	outlierCfg = cfg
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() {
+		outlierCfg, timeNow = prevCfg, prevNow
+		retainUpstreams(Table{})
+	})
+	return &now
+}
+
+func TestOutlierEjection(t *testing.T) {
+	now := setupOutlierTest(t, config.Outlier{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    10 * time.Second,
+		MaxEjectionTime:     30 * time.Second,
+		MaxEjectionPercent:  100,
+	})
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, nil)
+	tg := r.Targets[0]
+
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			tg.ReportFailure()
+		}
+	}
+
+	// success resets the failure count
+	fail(2)
+	tg.ReportSuccess()
+	fail(2)
+	if tg.Ejected() {
+		t.Fatal("ejected after 2 failures")
+	}
+
+	// ejection times double up to the max ejection time
+	for i, d := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		fail(3)
+		if !tg.Ejected() {
+			t.Fatalf("%d: not ejected", i)
+		}
+		*now = now.Add(d - time.Millisecond)
+		if !tg.Ejected() {
+			t.Fatalf("%d: not ejected before %s", i, d)
+		}
+		*now = now.Add(time.Millisecond)
+		if tg.Ejected() {
+			t.Fatalf("%d: still ejected after %s", i, d)
+		}
+	}
+
+	// the ejection count is reset after serving for the max ejection time
+	*now = now.Add(31 * time.Second)
+	tg.ReportSuccess()
+	fail(3)
+	*now = now.Add(10 * time.Second)
+	if tg.Ejected() {
+		t.Fatal("ejection count was not reset")
+	}
+}
+
+func TestOutlierErrorRate(t *testing.T) {
+	now := setupOutlierTest(t, config.Outlier{
+		ErrorRate:          0.5,
+		MinRequests:        4,
+		Window:             10 * time.Second,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionTime:    time.Minute,
+		MaxEjectionPercent: 100,
+	})
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, nil)
+	tg := r.Targets[0]
+
+	// the error rate is not evaluated before the minimum requests
+	tg.ReportFailure()
+	tg.ReportFailure()
+	if tg.Ejected() {
+		t.Fatal("ejected before the minimum requests")
+	}
+
+	// requests of the previous window do not count
+	*now = now.Add(11 * time.Second)
+	tg.ReportSuccess()
+	tg.ReportFailure()
+	tg.ReportSuccess()
+	if tg.Ejected() {
+		t.Fatal("ejected with failures of the previous window")
+	}
+
+	// alternating failures never reach consecutive failures
+	tg.ReportFailure()
+	if !tg.Ejected() {
+		t.Fatal("not ejected with 2 of 4 failed requests")
+	}
+}
+
+func TestOutlierIgnoresFailuresWhileEjected(t *testing.T) {
+	setupOutlierTest(t, config.Outlier{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    10 * time.Second,
+		MaxEjectionTime:     time.Minute,
+		MaxEjectionPercent:  100,
+	})
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, nil)
+	tg := r.Targets[0]
+
+	tg.ReportFailure()
+	tg.ReportFailure()
+	if got, want := tg.outlier.ejections, 1; got != want {
+		t.Fatalf("got %d ejections want %d", got, want)
+	}
+}
+
+func TestOutlierDisabled(t *testing.T) {
+	setupOutlierTest(t, config.Outlier{})
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, nil)
+	tg := r.Targets[0]
+	for i := 0; i < 100; i++ {
+		tg.ReportFailure()
+	}
+	if tg.Ejected() {
+		t.Fatal("target ejected with disabled outlier detection")
+	}
+}
+
+func TestAvailableTargetMaxEjectionPercent(t *testing.T) {
+	now := setupOutlierTest(t, config.Outlier{
+		ConsecutiveFailures: 1,
+		BaseEjectionTime:    10 * time.Second,
+		MaxEjectionTime:     time.Minute,
+		MaxEjectionPercent:  50,
+	})
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	for _, s := range []string{"http://a.com/", "http://b.com/", "http://c.com/", "http://d.com/"} {
+		u, _ := url.Parse(s)
+		r.addTarget("svc", u, 0, nil, nil)
+	}
+	a, b, c, d := r.Targets[0], r.Targets[1], r.Targets[2], r.Targets[3]
+
+	// eject a, b and c. Only a and b are honored since at most
+	// 50% of the targets can be ejected.
+	a.ReportFailure()
+	*now = now.Add(time.Second)
+	b.ReportFailure()
+	*now = now.Add(time.Second)
+	c.ReportFailure()
+
+	got := map[*Target]int{}
+	for i := 0; i < 100; i++ {
+		got[r.availableTarget(rrPicker(r, nil), nil)]++
+	}
+	if got[a] != 0 || got[b] != 0 {
+		t.Fatalf("ejected targets received traffic: a=%d b=%d", got[a], got[b])
+	}
+	if got[c] == 0 || got[d] == 0 {
+		t.Fatalf("available targets received no traffic: c=%d d=%d", got[c], got[d])
+	}
+
+	// the state survives a table update
+	tbl := Table{"www.bar.com": Routes{r}}
+	retainUpstreams(tbl)
+	r2 := &Route{Host: "www.bar.com", Path: "/foo"}
+	r2.addTarget("svc", a.URL, 0, nil, nil)
+	if !r2.Targets[0].Ejected() {
+		t.Fatal("ejection lost on table update")
+	}
+}
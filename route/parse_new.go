@@ -27,12 +27,49 @@ route add <svc> <src> <dst>[ weight <w>][ tags "<t1>,<t2>,..."][ opts "k1=v1 k2=
 
 	  strip=/path        : forward '/path/to/file' as '/to/file'
 	  prepend=/prefix    : forward '/path/to/file' as '/prefix/path/to/file'
+	  rewrite=/u/$1      : replace the part of the path matched by src as a regular expression.
+	                       Capture groups can be referenced with '$1' or '${name}'
 	  proto=tcp          : upstream service is TCP, dst is ':port'
 	  proto=https        : upstream service is HTTPS
 	  tlsskipverify=true : disable TLS cert validation for HTTPS upstream
+	  tlsprofile=name    : use the upstream TLS profile 'name' (defined in proxy.upstream.tls) for HTTPS and gRPCS upstreams
+	  tlspolicy=name     : use the TLS policy 'name' (defined in proxy.tls.policy) for client connections to the host of the route
 	  host=name          : set the Host header to 'name'. If 'name == "dst"' then the 'Host' header will be set to the registered upstream host name
 	  register=name      : register fabio as new service 'name'. Useful for registering hostnames for host specific routes.
       auth=name          : name of the auth scheme to use (defined in proxy.auth)
+	  healthcheck=/path  : actively check the target with 'GET /path'. Use 'tcp' for a TCP connect check
+	                       and 'grpc' or 'grpc:<svc>' for the gRPC health protocol
+	  healthcheck.interval=5s : time between two health checks (default: proxy.healthcheck.interval)
+	  healthcheck.timeout=2s  : timeout of a single health check (default: proxy.healthcheck.timeout)
+	  strategy=leastconn : load balancing strategy for the route (default: proxy.strategy)
+	  hashkey=header:X-User : key of the 'hash' strategy (default: proxy.hash.key)
+	  sticky=name        : pin clients to a target with the cookie 'name'. Implies 'strategy=hash'
+	  reqhdr.set.X-Env=prod : set the request header. Values can contain access log fields like '$remote_host'
+	  reqhdr.add.X-Env=prod : add a value to the request header
+	  reqhdr.del=Cookie  : remove the comma separated request headers
+	  resphdr.set.Cache-Control=no-store : set the response header
+	  resphdr.add.X-Env=prod : add a value to the response header
+	  resphdr.del=Server : remove the comma separated response headers
+	  match.header.X-Canary=true : only match requests with the header value. Use '*' for any value
+	  match.query.v=2    : only match requests with the query parameter value
+	  match.method=POST,PUT : only match requests with one of the methods
+	  ratelimit=100/s    : limit the requests per client to 100 per second. Units are 's', 'm' and 'h'
+	  burst=200          : number of requests a client can send at once (default: the rate)
+	  ratelimit.key=principal : key of the rate limit: 'ip', 'header:<name>' or 'principal' (default: ip)
+	  maxconns=100       : maximum number of concurrent requests to the target
+	  maxpending=50      : maximum number of requests waiting for one of the 'maxconns' slots (default: 0)
+	  route.maxconns=200 : maximum number of concurrent requests to all targets of the route
+	  breaker.errorrate=0.5 : open the circuit of the target when half of the requests fail
+	  breaker.minrequests=20 : minimum number of requests in the window before the circuit can open (default: 20)
+	  breaker.window=10s : window for the error rate (default: 10s)
+	  breaker.timeout=30s : time before an open circuit lets a probe request through (default: 30s)
+
+    Routes are matched per host in reverse lexicographical order of their
+    src path which puts longer paths before their prefixes. With the 'regex'
+    matcher the src path is a regular expression anchored at the start of
+    the path, e.g. '/users/[0-9]+/orders'. Overlapping expressions which are
+    not prefixes of each other are matched in the same order, e.g.
+    '/users/[a-z]+' is matched before '/users/[0-9]+'.
 
 route del <svc>[ <src>[ <dst>]]
   - Remove route matching svc, src and/or dst
@@ -7,28 +7,74 @@ import (
 	"time"
 )
 
-// picker selects a target from a list of targets.
-type picker func(r *Route) *Target
+// picker selects a target from a list of targets. c describes the client
+// of the request and is only used by pickers which need to route the
+// same client to the same target.
+type picker func(r *Route, c *client) *Target
 
 // Picker contains the available picker functions.
 // Update config/load.go#load after updating.
 var Picker = map[string]picker{
-	"rnd": rndPicker,
-	"rr":  rrPicker,
+	"rnd":       rndPicker,
+	"rr":        rrPicker,
+	"leastconn": leastConnPicker,
+	"ewma":      ewmaPicker,
+	"hash":      hashPicker,
 }
 
 // rndPicker picks a random target from the list of targets.
-func rndPicker(r *Route) *Target {
+func rndPicker(r *Route, _ *client) *Target {
 	return r.wTargets[randIntn(len(r.wTargets))]
 }
 
 // rrPicker picks the next target from a list of targets using round-robin.
-func rrPicker(r *Route) *Target {
+func rrPicker(r *Route, _ *client) *Target {
 	u := r.wTargets[r.total%uint64(len(r.wTargets))]
 	atomic.AddUint64(&r.total, 1)
 	return u
 }
 
+// leastConnPicker picks the target with the least number of active
+// requests relative to its weight. Ties are broken randomly.
+func leastConnPicker(r *Route, _ *client) *Target {
+	var best *Target
+	var bestScore float64
+	n := len(r.Targets)
+	start := randIntn(n)
+	for i := 0; i < n; i++ {
+		t := r.Targets[(start+i)%n]
+		if t.Weight <= 0 {
+			continue
+		}
+		score := float64(t.Inflight()+1) / t.Weight
+		if best == nil || score < bestScore {
+			best, bestScore = t, score
+		}
+	}
+	if best == nil {
+		return rndPicker(r, nil)
+	}
+	return best
+}
+
+// ewmaPicker picks two random targets according to their weight and
+// returns the one with the lower peak EWMA latency multiplied by the
+// number of active requests (power of two choices).
+func ewmaPicker(r *Route, _ *client) *Target {
+	a := r.wTargets[randIntn(len(r.wTargets))]
+	b := r.wTargets[randIntn(len(r.wTargets))]
+	for i := 0; i < 3 && a == b; i++ {
+		b = r.wTargets[randIntn(len(r.wTargets))]
+	}
+	if a.load == nil || b.load == nil || a == b {
+		return a
+	}
+	if b.load.cost() < a.load.cost() {
+		return b
+	}
+	return a
+}
+
 // as it turns out, math/rand's Intn is now way faster (4x) than the previous implementation using
 // time.UnixNano().  As a bonus, this actually works properly on 32 bit platforms.
 var rndOnce sync.Once
@@ -41,3 +87,33 @@ var randIntn = func(n int) int {
 	}
 	return rand.Intn(n)
 }
+
+// availableTarget returns t if it is healthy, not ejected, its circuit
+// is not open and it is not excluded by its URL. Otherwise, it returns an available target from
+// the weighted targets of the route starting at a random position to
+// preserve the traffic distribution. If none of the targets are
+// available t is returned since failing all requests is worse than
+// trying an unavailable target.
+func (r *Route) availableTarget(t *Target, excluded map[string]bool) *Target {
+	isExcluded := func(c *Target) bool {
+		return len(excluded) > 0 && excluded[c.URL.String()]
+	}
+	if t.Healthy() && !t.Ejected() && !t.CircuitOpen() && !isExcluded(t) {
+		return t
+	}
+	ejected := r.ejectedTargets()
+	available := func(c *Target) bool {
+		return c.Healthy() && !ejected[c] && !c.CircuitOpen() && !isExcluded(c)
+	}
+	if available(t) {
+		return t
+	}
+	n := len(r.wTargets)
+	start := randIntn(n)
+	for i := 0; i < n; i++ {
+		if c := r.wTargets[(start+i)%n]; available(c) {
+			return c
+		}
+	}
+	return t
+}
@@ -1,6 +1,9 @@
 package route
 
 import (
+	"bytes"
+	"math"
+	"net/http"
 	"net/url"
 	"reflect"
 	"testing"
@@ -38,7 +41,7 @@ func TestRndPicker(t *testing.T) {
 
 	for i, tt := range tests {
 		randIntn = func(int) int { return i }
-		if got, want := rndPicker(r).URL, tt.targetURL; !reflect.DeepEqual(got, want) {
+		if got, want := rndPicker(r, nil).URL, tt.targetURL; !reflect.DeepEqual(got, want) {
 			t.Errorf("%d: got %v want %v", i, got, want)
 		}
 	}
@@ -52,7 +55,7 @@ func TestRRPicker(t *testing.T) {
 	tests := []*url.URL{fooDotCom, barDotCom, fooDotCom, barDotCom, fooDotCom, barDotCom}
 
 	for i, tt := range tests {
-		if got, want := rrPicker(r).URL, tt; !reflect.DeepEqual(got, want) {
+		if got, want := rrPicker(r, nil).URL, tt; !reflect.DeepEqual(got, want) {
 			t.Errorf("%d: got %v want %v", i, got, want)
 		}
 	}
@@ -83,3 +86,143 @@ func BenchmarkMathRandIntn(b *testing.B) {
 	}
 	result = r
 }
+
+func TestLeastConnPicker(t *testing.T) {
+	defer retainUpstreams(Table{})
+
+	tbl, err := NewTable(bytes.NewBufferString(`
+route add a / http://a.com/
+route add b / http://b.com/
+route add c / http://c.com/
+route weight c / weight 0.5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tbl[""][0]
+	targets := map[string]*Target{}
+	for _, tg := range r.Targets {
+		targets[tg.Service] = tg
+	}
+	a, b, c := targets["a"], targets["b"], targets["c"]
+
+	// a has the least active requests
+	b.Acquire()
+	c.Acquire()
+	c.Acquire()
+	for i := 0; i < 10; i++ {
+		if got, want := leastConnPicker(r, nil), a; got != want {
+			t.Fatalf("%d: got %s want %s", i, got.URL, want.URL)
+		}
+	}
+
+	// c has twice the weight of a and b
+	a.Acquire()
+	a.Acquire()
+	b.Acquire()
+	if got, want := leastConnPicker(r, nil), c; got != want {
+		t.Fatalf("got %s want %s", got.URL, want.URL)
+	}
+
+	// active requests survive a table update
+	c.Release()
+	c.Release()
+	r2 := &Route{Path: "/"}
+	r2.addTarget("a", a.URL, 0, nil, nil)
+	if got, want := r2.Targets[0].Inflight(), int64(2); got != want {
+		t.Fatalf("got %d active requests want %d", got, want)
+	}
+}
+
+func TestEWMAPicker(t *testing.T) {
+	defer retainUpstreams(Table{})
+
+	r := &Route{Path: "/"}
+	r.addTarget("svc", fooDotCom, 0, nil, nil)
+	r.addTarget("svc", barDotCom, 0, nil, nil)
+	foo, bar := r.Targets[0], r.Targets[1]
+
+	foo.Timer.Observe(0.5)
+	bar.Timer.Observe(0.01)
+
+	prev := randIntn
+	defer func() { randIntn = prev }()
+	var i int
+	randIntn = func(n int) int { i++; return (i * 37) % n }
+
+	for j := 0; j < 10; j++ {
+		if got, want := ewmaPicker(r, nil), bar; got != want {
+			t.Fatalf("%d: got %s want %s", j, got.URL, want.URL)
+		}
+	}
+
+	// active requests increase the cost
+	for j := 0; j < 100; j++ {
+		bar.Acquire()
+	}
+	if got, want := ewmaPicker(r, nil), foo; got != want {
+		t.Fatalf("got %s want %s", got.URL, want.URL)
+	}
+}
+
+func TestPeakEWMA(t *testing.T) {
+	now := time.Unix(1000, 0)
+	prev := timeNow
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = prev }()
+
+	s := &loadState{}
+	s.observe(0.1)
+	if got, want := s.ewma, 0.1; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// a peak replaces the average immediately
+	s.observe(1)
+	if got, want := s.ewma, 1.0; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// the cost decays while no requests complete
+	now = now.Add(ewmaDecay)
+	if got, want := s.cost(), 1/math.E; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("got cost %v want %v", got, want)
+	}
+
+	// lower latencies decay the average over time
+	s.observe(0)
+	if got, want := s.ewma, 1/math.E; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	// upstreams without observations have a default latency so that
+	// their active requests count
+	s = &loadState{}
+	s.inflight = 2
+	if got, want := s.cost(), 3*ewmaDefault; math.Abs(got-want) > 1e-9 {
+		t.Fatalf("got cost %v want %v", got, want)
+	}
+}
+
+func TestRouteStrategy(t *testing.T) {
+	defer retainUpstreams(Table{})
+
+	tbl, err := NewTable(bytes.NewBufferString(`
+route add svc /foo http://a.com/ opts "strategy=leastconn"
+route add svc /foo http://b.com/ opts "strategy=leastconn"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := tbl[""][0].Targets[0]
+	a.Acquire()
+	defer a.Release()
+
+	req := &http.Request{URL: mustParse("/foo")}
+	for i := 0; i < 10; i++ {
+		got := tbl.Lookup(req, "", Picker["rr"], Matcher["prefix"], NewGlobCache(10), false)
+		if got == a {
+			t.Fatalf("%d: got %s with active request", i, got.URL)
+		}
+	}
+}
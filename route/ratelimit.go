@@ -0,0 +1,224 @@
+package route
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fabiolb/fabio/auth"
+	"github.com/fabiolb/fabio/config"
+	gkm "github.com/go-kit/kit/metrics"
+)
+
+// RateLimit is a token bucket rate limit of a route configured with
+// the 'ratelimit=<n>/<unit>', 'burst=<n>' and 'ratelimit.key=<key>'
+// options.
+type RateLimit struct {
+	// Rate is the number of requests per second.
+	Rate float64
+
+	// Burst is the size of the bucket.
+	Burst int
+
+	// Key is the key source for the buckets which is either 'ip',
+	// 'header:<name>' or 'principal'.
+	Key string
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("rate=%g burst=%d key=%s", l.Rate, l.Burst, l.Key)
+}
+
+// parseRateLimit returns the rate limit from the route options or nil
+// if there is none. The unit of the rate is either 's', 'm' or 'h'. The
+// burst defaults to the number of requests per unit.
+func parseRateLimit(opts map[string]string) (*RateLimit, error) {
+	v := opts["ratelimit"]
+	if v == "" {
+		return nil, nil
+	}
+
+	rate, burst, err := config.ParseRate(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ratelimit: %s", err)
+	}
+
+	l := &RateLimit{
+		Rate:  rate,
+		Burst: burst,
+		Key:   "ip",
+	}
+	if b := opts["burst"]; b != "" {
+		if l.Burst, err = strconv.Atoi(b); err != nil || l.Burst < 1 {
+			return nil, fmt.Errorf("invalid burst %q", b)
+		}
+	}
+	if k := opts["ratelimit.key"]; k != "" {
+		if k != "ip" && k != "principal" && !(strings.HasPrefix(k, "header:") && len(k) > len("header:")) {
+			return nil, fmt.Errorf("invalid ratelimit.key %q", k)
+		}
+		l.Key = k
+	}
+	return l, nil
+}
+
+// bucket is the token bucket for a single key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter tracks the token buckets of a route by key.
+type rateLimiter struct {
+	limit   RateLimit
+	counter gkm.Counter
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// rateLimitSweep is the interval in which buckets which have been
+// refilled completely are removed.
+const rateLimitSweep = time.Minute
+
+// take removes a token from the bucket for the key. If the bucket is
+// empty it returns false and the time until the next token is
+// available.
+func (l *rateLimiter) take(key string) (bool, time.Duration) {
+	now := timeNow()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweep {
+		l.sweep(now)
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		if l.counter != nil {
+			l.counter.Add(1)
+		}
+		wait := (1 - b.tokens) / l.limit.Rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets which are full since they are the same as
+// a new bucket.
+func (l *rateLimiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= float64(l.limit.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimiters stores the rate limiters by route and limit so that the
+// state survives table updates for unchanged routes.
+var rateLimiters = struct {
+	sync.Mutex
+	m map[string]*rateLimiter
+}{m: map[string]*rateLimiter{}}
+
+func (r *Route) rateLimitKey(l RateLimit) string {
+	return r.Host + r.Path + " " + r.conds.String() + " " + l.String()
+}
+
+func rateLimiterFor(r *Route, l RateLimit, service string) *rateLimiter {
+	key := r.rateLimitKey(l)
+
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+	rl := rateLimiters.m[key]
+	if rl == nil {
+		rl = &rateLimiter{
+			limit:   l,
+			counter: counters.rateLimited.With("service", service, "host", r.Host, "path", r.Path),
+			buckets: map[string]*bucket{},
+		}
+		rateLimiters.m[key] = rl
+	}
+	return rl
+}
+
+// retainRateLimits removes the rate limiters of routes which are no
+// longer in the table.
+func retainRateLimits(t Table) {
+	keep := map[string]bool{}
+	for _, routes := range t {
+		for _, r := range routes {
+			if r.limiter != nil {
+				keep[r.rateLimitKey(r.limiter.limit)] = true
+			}
+		}
+	}
+
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+	for k := range rateLimiters.m {
+		if !keep[k] {
+			delete(rateLimiters.m, k)
+		}
+	}
+}
+
+// RateLimitedHTTP returns true and the time after which the client can
+// retry if the request exceeds the rate limit of the route. Requests
+// without a value for the key are limited by the client IP.
+func (t *Target) RateLimitedHTTP(r *http.Request) (bool, time.Duration) {
+	if t.limiter == nil {
+		return false, 0
+	}
+
+	var key string
+	switch k := t.limiter.limit.Key; {
+	case k == "principal":
+		key = auth.Principal(r)
+	case strings.HasPrefix(k, "header:"):
+		key = r.Header.Get(k[len("header:"):])
+	}
+	if key == "" {
+		key = remoteHost(r.RemoteAddr)
+	} else {
+		// keep the keys from different sources apart
+		key = t.limiter.limit.Key + "=" + key
+	}
+
+	ok, wait := t.limiter.take(key)
+	return !ok, wait
+}
+
+// RateLimitedTCP returns true if the connection exceeds the rate limit
+// of the route. TCP connections are always limited by the client IP.
+func (t *Target) RateLimitedTCP(c net.Conn) bool {
+	if t.limiter == nil {
+		return false
+	}
+	ok, _ := t.limiter.take(remoteHost(c.RemoteAddr().String()))
+	return !ok
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,247 @@
+package route
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fabiolb/fabio/auth"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		desc string
+		opts map[string]string
+		l    *RateLimit
+		err  bool
+	}{
+		{"none", map[string]string{}, nil, false},
+		{"per second", map[string]string{"ratelimit": "100/s"}, &RateLimit{Rate: 100, Burst: 100, Key: "ip"}, false},
+		{"per minute", map[string]string{"ratelimit": "60/m"}, &RateLimit{Rate: 1, Burst: 60, Key: "ip"}, false},
+		{"per hour", map[string]string{"ratelimit": "3600/h"}, &RateLimit{Rate: 1, Burst: 3600, Key: "ip"}, false},
+		{"burst", map[string]string{"ratelimit": "100/s", "burst": "200"}, &RateLimit{Rate: 100, Burst: 200, Key: "ip"}, false},
+		{"header key", map[string]string{"ratelimit": "1/s", "ratelimit.key": "header:X-Api-Key"}, &RateLimit{Rate: 1, Burst: 1, Key: "header:X-Api-Key"}, false},
+		{"principal key", map[string]string{"ratelimit": "1/s", "ratelimit.key": "principal"}, &RateLimit{Rate: 1, Burst: 1, Key: "principal"}, false},
+		{"no unit", map[string]string{"ratelimit": "100"}, nil, true},
+		{"invalid unit", map[string]string{"ratelimit": "100/d"}, nil, true},
+		{"invalid rate", map[string]string{"ratelimit": "x/s"}, nil, true},
+		{"zero rate", map[string]string{"ratelimit": "0/s"}, nil, true},
+		{"invalid burst", map[string]string{"ratelimit": "1/s", "burst": "0"}, nil, true},
+		{"invalid key", map[string]string{"ratelimit": "1/s", "ratelimit.key": "cookie:x"}, nil, true},
+		{"empty header key", map[string]string{"ratelimit": "1/s", "ratelimit.key": "header:"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			l, err := parseRateLimit(tt.opts)
+			if got, want := err != nil, tt.err; got != want {
+				t.Fatalf("got error %v want %v", err, want)
+			}
+			if got, want := l, tt.l; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v want %+v", got, want)
+			}
+		})
+	}
+}
+
+func setupRateLimitTest(t *testing.T) *time.Time {
+	now := time.Unix(1000, 0)
+	prevNow := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() {
+		timeNow = prevNow
+		retainRateLimits(Table{})
+	})
+	return &now
+}
+
+func TestRateLimitedHTTP(t *testing.T) {
+	now := setupRateLimitTest(t)
+
+	r := &Route{Host: "www.bar.com", Path: "/foo"}
+	r.addTarget("svc", fooDotCom, 0, nil, map[string]string{"ratelimit": "2/s", "burst": "3"})
+	r.addTarget("svc", barDotCom, 0, nil, nil)
+	a, b := r.Targets[0], r.Targets[1]
+	if a.limiter == nil || a.limiter != b.limiter {
+		t.Fatal("targets do not share the rate limiter of the route")
+	}
+
+	req := &http.Request{RemoteAddr: "1.2.3.4:5678", Header: http.Header{}}
+	for i := 0; i < 3; i++ {
+		if limited, _ := a.RateLimitedHTTP(req); limited {
+			t.Fatalf("%d: request is rate limited", i)
+		}
+	}
+	limited, wait := b.RateLimitedHTTP(req)
+	if !limited {
+		t.Fatal("request exceeding the burst is not rate limited")
+	}
+	if got, want := wait, 500*time.Millisecond; got != want {
+		t.Fatalf("got retry after %v want %v", got, want)
+	}
+
+	// other clients have their own bucket
+	other := &http.Request{RemoteAddr: "5.6.7.8:5678", Header: http.Header{}}
+	if limited, _ := a.RateLimitedHTTP(other); limited {
+		t.Fatal("request from other client is rate limited")
+	}
+
+	// refill one token
+	*now = now.Add(500 * time.Millisecond)
+	if limited, _ := a.RateLimitedHTTP(req); limited {
+		t.Fatal("request after refill is rate limited")
+	}
+	if limited, _ := a.RateLimitedHTTP(req); !limited {
+		t.Fatal("second request after refill is not rate limited")
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	setupRateLimitTest(t)
+
+	t.Run("header", func(t *testing.T) {
+		r := &Route{Host: "www.bar.com", Path: "/header"}
+		r.addTarget("svc", fooDotCom, 0, nil, map[string]string{"ratelimit": "1/s", "ratelimit.key": "header:X-Api-Key"})
+		tg := r.Targets[0]
+
+		req := func(key string) *http.Request {
+			return &http.Request{RemoteAddr: "1.2.3.4:5678", Header: http.Header{"X-Api-Key": {key}}}
+		}
+		if limited, _ := tg.RateLimitedHTTP(req("a")); limited {
+			t.Fatal("first request for key a is rate limited")
+		}
+		if limited, _ := tg.RateLimitedHTTP(req("b")); limited {
+			t.Fatal("first request for key b is rate limited")
+		}
+		if limited, _ := tg.RateLimitedHTTP(req("a")); !limited {
+			t.Fatal("second request for key a is not rate limited")
+		}
+
+		// requests without the header are limited by the client ip
+		noKey := &http.Request{RemoteAddr: "1.2.3.4:5678", Header: http.Header{}}
+		if limited, _ := tg.RateLimitedHTTP(noKey); limited {
+			t.Fatal("first request without key is rate limited")
+		}
+		if limited, _ := tg.RateLimitedHTTP(noKey); !limited {
+			t.Fatal("second request without key is not rate limited")
+		}
+	})
+
+	t.Run("principal", func(t *testing.T) {
+		r := &Route{Host: "www.bar.com", Path: "/principal"}
+		r.addTarget("svc", fooDotCom, 0, nil, map[string]string{"ratelimit": "1/s", "ratelimit.key": "principal"})
+		tg := r.Targets[0]
+
+		req := func(user string) *http.Request {
+			r := auth.WithPrincipal(&http.Request{RemoteAddr: "1.2.3.4:5678", Header: http.Header{}})
+			auth.SetPrincipal(r, user)
+			return r
+		}
+		if limited, _ := tg.RateLimitedHTTP(req("alice")); limited {
+			t.Fatal("first request for alice is rate limited")
+		}
+		if limited, _ := tg.RateLimitedHTTP(req("bob")); limited {
+			t.Fatal("first request for bob is rate limited")
+		}
+		if limited, _ := tg.RateLimitedHTTP(req("alice")); !limited {
+			t.Fatal("second request for alice is not rate limited")
+		}
+
+		// the unverified basic auth user is not a principal
+		basic := &http.Request{RemoteAddr: "1.2.3.5:5678", Header: http.Header{}}
+		basic.SetBasicAuth("carol", "secret")
+		if limited, _ := tg.RateLimitedHTTP(basic); limited {
+			t.Fatal("first request for carol is rate limited")
+		}
+		basic.SetBasicAuth("dave", "secret")
+		if limited, _ := tg.RateLimitedHTTP(basic); !limited {
+			t.Fatal("second request from the same ip is not rate limited")
+		}
+	})
+}
+
+func TestRateLimitedTCP(t *testing.T) {
+	setupRateLimitTest(t)
+
+	tbl, err := NewTable(bytes.NewBufferString(`route add svc :1234 tcp://10.0.0.1:80 opts "ratelimit=1/m"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := tbl.LookupHost(":1234", Picker["rr"])
+
+	c := &fakeConn{remote: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 5678}}
+	if tg.RateLimitedTCP(c) {
+		t.Fatal("first connection is rate limited")
+	}
+	c.remote.Port = 5679
+	if !tg.RateLimitedTCP(c) {
+		t.Fatal("second connection is not rate limited")
+	}
+}
+
+func TestRateLimitSurvivesReload(t *testing.T) {
+	setupRateLimitTest(t)
+
+	const routes = `route add svc www.bar.com/foo http://10.0.0.1/ opts "ratelimit=1/m"`
+	const changed = `route add svc www.bar.com/foo http://10.0.0.1/ opts "ratelimit=2/m"`
+	lookup := func(tbl Table) *Target {
+		req := &http.Request{Host: "www.bar.com", URL: mustParse("/foo"), RemoteAddr: "1.2.3.4:5678", Header: http.Header{}}
+		return tbl.Lookup(req, "", Picker["rr"], Matcher["prefix"], globCache, false)
+	}
+
+	t1, err := NewTable(bytes.NewBufferString(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTable(t1)
+	if limited, _ := lookup(t1).RateLimitedHTTP(&http.Request{RemoteAddr: "1.2.3.4:5678"}); limited {
+		t.Fatal("first request is rate limited")
+	}
+
+	// unchanged route keeps its buckets
+	t2, _ := NewTable(bytes.NewBufferString(routes))
+	SetTable(t2)
+	if limited, _ := lookup(t2).RateLimitedHTTP(&http.Request{RemoteAddr: "1.2.3.4:5678"}); !limited {
+		t.Fatal("request after reload is not rate limited")
+	}
+
+	// changed limit starts over
+	t3, _ := NewTable(bytes.NewBufferString(changed))
+	SetTable(t3)
+	if limited, _ := lookup(t3).RateLimitedHTTP(&http.Request{RemoteAddr: "1.2.3.4:5678"}); limited {
+		t.Fatal("request after changing the limit is rate limited")
+	}
+	rateLimiters.Lock()
+	n := len(rateLimiters.m)
+	rateLimiters.Unlock()
+	if n != 1 {
+		t.Fatalf("got %d rate limiters want 1", n)
+	}
+	SetTable(Table{})
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	now := setupRateLimitTest(t)
+
+	r := &Route{Host: "www.bar.com", Path: "/sweep"}
+	r.addTarget("svc", fooDotCom, 0, nil, map[string]string{"ratelimit": "1/s"})
+	l := r.limiter
+
+	l.take("a")
+	l.take("b")
+	*now = now.Add(2 * rateLimitSweep)
+	l.take("c")
+	if got, want := len(l.buckets), 1; got != want {
+		t.Fatalf("got %d buckets want %d", got, want)
+	}
+}
+
+type fakeConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.remote }
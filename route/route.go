@@ -7,9 +7,11 @@ import (
 	"log"
 	"net/url"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/gobwas/glob"
 )
@@ -41,6 +43,40 @@ type Route struct {
 
 	// Glob represents compiled pattern.
 	Glob glob.Glob
+
+	// Regex is the path compiled as a regular expression which is
+	// anchored at the start of the path. It is only set for the regex
+	// matcher and for routes which rewrite the path and is nil if the
+	// path is not a valid regular expression.
+	Regex *regexp.Regexp
+
+	// conds are the match conditions of the route which are evaluated
+	// after the host and path have matched. Routes with the same path
+	// but different conditions are separate routes.
+	conds conditions
+
+	// strategy and pick are the name and the picker configured with
+	// the 'strategy' option. If pick is nil the globally configured
+	// picker is used.
+	strategy string
+	pick     picker
+
+	// hashKey is the key source for the hash picker configured with
+	// the 'hashkey' option. If hashKey is empty proxy.hash.key is used.
+	hashKey string
+
+	// ring is the consistent hash ring for the hash picker. It is
+	// built on first use.
+	ringOnce sync.Once
+	ring     []ringNode
+
+	// limiter is the rate limiter configured with the 'ratelimit'
+	// option. It is nil if the route is not rate limited.
+	limiter *rateLimiter
+
+	// conns is the concurrency limit configured with the
+	// 'route.maxconns' option. It is nil if there is no limit.
+	conns routeConns
 }
 
 func (r *Route) addTarget(service string, targetURL *url.URL, fixedWeight float64, tags []string, opts map[string]string) {
@@ -61,16 +97,37 @@ func (r *Route) addTarget(service string, targetURL *url.URL, fixedWeight float6
 		Opts:        opts,
 		URL:         targetURL,
 		FixedWeight: fixedWeight,
-		Timer:       counters.histogram.With("service", service, "host", r.Host, "path", r.Path, "target", targetURL.String()),
 		RxCounter:   counters.rxCounter.With("service", service, "host", r.Host, "path", r.Path, "target", targetURL.String()),
 		TxCounter:   counters.txCounter.With("service", service, "host", r.Host, "path", r.Path, "target", targetURL.String()),
 	}
 
+	t.load = loadStateFor(t.upstreamKey())
+	t.Timer = latencyTimer{
+		Histogram: counters.histogram.With("service", service, "host", r.Host, "path", r.Path, "target", targetURL.String()),
+		load:      t.load,
+	}
+
+	if outlierCfg.ConsecutiveFailures > 0 || outlierCfg.ErrorRate > 0 {
+		t.EjectCounter = counters.ejections.With("service", service, "host", r.Host, "path", r.Path, "target", targetURL.String())
+		t.outlier = outlierStateFor(t.upstreamKey())
+	}
+
 	var err error
 	if opts != nil {
 
 		t.StripPath = opts["strip"]
 		t.PrependPath = opts["prepend"]
+		if opts["rewrite"] != "" {
+			if r.Regex == nil {
+				r.Regex, _ = compileRegex(r.Path)
+			}
+			if r.Regex != nil {
+				t.RewritePath = opts["rewrite"]
+				t.rewrite = r.Regex
+			} else {
+				log.Printf("[ERROR] cannot rewrite path for invalid regular expression %q", r.Path)
+			}
+		}
 		t.TLSSkipVerify = opts["tlsskipverify"] == "true"
 		t.Host = opts["host"]
 		t.ProxyProto = opts["pxyproto"] == "true"
@@ -81,6 +138,19 @@ func (r *Route) addTarget(service string, targetURL *url.URL, fixedWeight float6
 			t.Transport = transport.NewTransport(&tls.Config{ServerName: t.Host, InsecureSkipVerify: t.TLSSkipVerify})
 		}
 
+		// the upstream TLS profile provides the client certificate and
+		// the CA bundle for the upstream connection.
+		if name := opts["tlsprofile"]; name != "" {
+			serverName := t.Host
+			if serverName == "dst" {
+				serverName = ""
+			}
+			t.Transport, err = transport.ProfileTransport(name, serverName, t.TLSSkipVerify)
+			if err != nil {
+				log.Printf("[ERROR] %s", err)
+			}
+		}
+
 		if opts["redirect"] != "" {
 			t.RedirectCode, err = strconv.Atoi(opts["redirect"])
 			if err != nil {
@@ -95,10 +165,76 @@ func (r *Route) addTarget(service string, targetURL *url.URL, fixedWeight float6
 			log.Printf("[ERROR] failed to process access rules: %s",
 				err.Error())
 		}
+		if len(t.accessRules) > 0 {
+			t.DenyCounter = counters.accessDenied.With("service", service, "host", r.Host, "path", r.Path)
+		}
 
 		t.AuthScheme = opts["auth"]
+
+		if t.RequestHeaders, err = parseHeaderRules("reqhdr", opts); err != nil {
+			log.Printf("[ERROR] %s", err)
+		}
+		if t.ResponseHeaders, err = parseHeaderRules("resphdr", opts); err != nil {
+			log.Printf("[ERROR] %s", err)
+		}
+
+		if s := opts["strategy"]; s != "" {
+			if pick := Picker[s]; pick != nil {
+				r.strategy, r.pick = s, pick
+			} else {
+				log.Printf("[ERROR] invalid strategy %q", s)
+			}
+		}
+		if opts["hashkey"] != "" {
+			r.hashKey = opts["hashkey"]
+		}
+		// an affinity cookie implies the hash strategy
+		if opts["sticky"] != "" {
+			r.strategy, r.pick = "hash", hashPicker
+			t.StickyCookie = opts["sticky"]
+		}
+
+		if l, err := parseRateLimit(opts); err != nil {
+			log.Printf("[ERROR] %s", err)
+		} else if l != nil {
+			r.limiter = rateLimiterFor(r, *l, service)
+			for _, t := range r.Targets {
+				t.limiter = r.limiter
+			}
+		}
+
+		if n, err := parseRouteMaxConns(opts); err != nil {
+			log.Printf("[ERROR] %s", err)
+		} else if n > 0 {
+			r.conns = routeConnsFor(r, n)
+			for _, t := range r.Targets {
+				t.routeConns = r.conns
+			}
+		}
+
+		if b, err := parseBreaker(opts); err != nil {
+			log.Printf("[ERROR] %s", err)
+		} else if b != nil {
+			t.breaker = breakerStateFor(r, t, *b)
+		}
+
+		if t.HealthCheck, err = parseHealthCheck(opts); err != nil {
+			log.Printf("[ERROR] failed to parse health check: %s", err)
+		}
+		if key := t.HealthKey(); key != "" {
+			t.health = healthStateFor(key)
+		}
 	}
 
+	if t.StickyCookie == "" && (r.strategy == "hash" || r.strategy == "") {
+		t.StickyCookie = hashCfg.Sticky
+	}
+	if t.StickyCookie != "" {
+		t.StickyID = strconv.FormatUint(hashString(targetURL.String()), 16)
+	}
+
+	t.limiter = r.limiter
+	t.routeConns = r.conns
 	r.Targets = append(r.Targets, t)
 	r.weighTargets()
 }
@@ -216,6 +352,9 @@ const maxSlots = 1e4 // 10000
 // Targets with a dynamic weight will receive an equal share of the remaining
 // traffic if there is any left.
 func (r *Route) weighTargets() {
+	// the hash ring depends on the weights
+	r.ringOnce, r.ring = sync.Once{}, nil
+
 	// how big is the fixed weighted traffic?
 	var nFixed int
 	var sumFixed float64
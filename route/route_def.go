@@ -1,5 +1,11 @@
 package route
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
 type Cmd string
 
 const (
@@ -17,3 +23,55 @@ type RouteDef struct {
 	Tags    []string          `json:"tags,omitempty"`
 	Opts    map[string]string `json:"opts,omitempty"`
 }
+
+// String returns the route command for the definition in the format
+// which Parse accepts.
+func (d *RouteDef) String() string {
+	s := string(d.Cmd)
+	switch d.Cmd {
+	case RouteAddCmd:
+		s += " " + d.Service + " " + d.Src + " " + d.Dst
+		if d.Weight != 0 {
+			s += " weight " + strconv.FormatFloat(d.Weight, 'f', -1, 64)
+		}
+		if len(d.Tags) > 0 {
+			s += " tags " + strconv.Quote(strings.Join(d.Tags, ","))
+		}
+		if len(d.Opts) > 0 {
+			var opts []string
+			for k, v := range d.Opts {
+				if v == "" {
+					opts = append(opts, k)
+				} else {
+					opts = append(opts, k+"="+v)
+				}
+			}
+			sort.Strings(opts)
+			s += " opts " + strconv.Quote(strings.Join(opts, " "))
+		}
+
+	case RouteDelCmd:
+		if d.Service != "" {
+			s += " " + d.Service
+		}
+		switch {
+		case len(d.Tags) > 0:
+			s += " tags " + strconv.Quote(strings.Join(d.Tags, ","))
+		case d.Src != "":
+			s += " " + d.Src
+			if d.Dst != "" {
+				s += " " + d.Dst
+			}
+		}
+
+	case RouteWeightCmd:
+		if d.Service != "" {
+			s += " " + d.Service
+		}
+		s += " " + d.Src + " weight " + strconv.FormatFloat(d.Weight, 'f', -1, 64)
+		if len(d.Tags) > 0 {
+			s += " tags " + strconv.Quote(strings.Join(d.Tags, ","))
+		}
+	}
+	return s
+}
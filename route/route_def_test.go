@@ -0,0 +1,35 @@
+package route
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRouteDefString(t *testing.T) {
+	tests := []string{
+		`route add svc /prefix http://1.2.3.4/`,
+		`route add svc :1234 tcp://1.2.3.4:5678`,
+		`route add svc /prefix http://1.2.3.4/ weight 0.25`,
+		`route add svc /prefix http://1.2.3.4/ tags "a,b"`,
+		`route add svc /prefix http://1.2.3.4/ weight 0.5 tags "a,b" opts "proto=https strip=/prefix tlsskipverify=true"`,
+		`route add svc /prefix http://1.2.3.4/ opts "sticky"`,
+		`route del svc`,
+		`route del svc /prefix`,
+		`route del svc /prefix http://1.2.3.4/`,
+		`route del svc tags "a,b"`,
+		`route del tags "a,b"`,
+		`route weight svc /prefix weight 0.1`,
+		`route weight svc /prefix weight 0.1 tags "a,b"`,
+		`route weight /prefix weight 0.1 tags "a,b"`,
+	}
+
+	for _, tt := range tests {
+		defs, err := Parse(bytes.NewBufferString(tt))
+		if err != nil {
+			t.Fatalf("%s: %s", tt, err)
+		}
+		if got, want := defs[0].String(), tt; got != want {
+			t.Errorf("got %s want %s", got, want)
+		}
+	}
+}
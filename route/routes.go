@@ -3,17 +3,58 @@ package route
 // Routes stores a list of routes usually for a single host.
 type Routes []*Route
 
-// find returns the route with the given path and returns nil if none was found.
+// find returns the route with the given path and without match
+// conditions and returns nil if none was found.
 func (rt Routes) find(path string) *Route {
+	return rt.findMatch(path, nil)
+}
+
+// findMatch returns the route with the given path and match conditions
+// and returns nil if none was found.
+func (rt Routes) findMatch(path string, conds conditions) *Route {
 	for _, r := range rt {
-		if r.Path == path {
+		if r.Path == path && r.conds.String() == conds.String() {
 			return r
 		}
 	}
 	return nil
 }
 
-// sort by path in reverse order (most to least specific)
-func (rt Routes) Len() int           { return len(rt) }
-func (rt Routes) Swap(i, j int)      { rt[i], rt[j] = rt[j], rt[i] }
-func (rt Routes) Less(i, j int) bool { return rt[j].Path < rt[i].Path }
+// findAll returns all routes with the given path independent of their
+// match conditions.
+func (rt Routes) findAll(path string) Routes {
+	var routes Routes
+	for _, r := range rt {
+		if r.Path == path {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// tlsPolicy returns the first TLS policy which is selected with the
+// 'tlspolicy' option by one of the targets.
+func (rt Routes) tlsPolicy() string {
+	for _, r := range rt {
+		for _, t := range r.Targets {
+			if name := t.Opts["tlspolicy"]; name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// sort by path in reverse order (most to least specific). Routes with
+// the same path and more match conditions are more specific.
+func (rt Routes) Len() int      { return len(rt) }
+func (rt Routes) Swap(i, j int) { rt[i], rt[j] = rt[j], rt[i] }
+func (rt Routes) Less(i, j int) bool {
+	if rt[i].Path == rt[j].Path {
+		if len(rt[i].conds) != len(rt[j].conds) {
+			return len(rt[i].conds) > len(rt[j].conds)
+		}
+		return rt[j].conds.String() < rt[i].conds.String()
+	}
+	return rt[j].Path < rt[i].Path
+}
@@ -2,6 +2,7 @@ package route
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	gkm "github.com/go-kit/kit/metrics"
@@ -9,8 +10,10 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/gobwas/glob"
@@ -38,6 +41,12 @@ type metrix struct {
 	histogram gkm.Histogram
 	rxCounter gkm.Counter
 	txCounter gkm.Counter
+	ejections gkm.Counter
+
+	rateLimited     gkm.Counter
+	circuitOpen     gkm.Gauge
+	circuitRejected gkm.Counter
+	accessDenied    gkm.Counter
 }
 
 var counters metrix
@@ -46,6 +55,11 @@ func SetMetricsProvider(p metrics.Provider) {
 	counters.histogram = p.NewHistogram("route", "service", "host", "path", "target")
 	counters.rxCounter = p.NewCounter("route.rx", "service", "host", "path", "target")
 	counters.txCounter = p.NewCounter("route.tx", "service", "host", "path", "target")
+	counters.ejections = p.NewCounter("route.ejections", "service", "host", "path", "target")
+	counters.rateLimited = p.NewCounter("route.ratelimited", "service", "host", "path")
+	counters.circuitOpen = p.NewGauge("route.circuit.open", "service", "host", "path", "target")
+	counters.circuitRejected = p.NewCounter("route.circuit.rejected", "service", "host", "path", "target")
+	counters.accessDenied = p.NewCounter("route.access.denied", "service", "host", "path", "rule")
 }
 
 // GetTable returns the active routing table. The function
@@ -64,6 +78,12 @@ func SetTable(t Table) {
 		return
 	}
 	table.Store(t)
+	tlsPolicyHosts.Store(t.tlsPolicyHosts())
+	retainUpstreams(t)
+	retainRateLimits(t)
+	retainBreakers(t)
+	retainRouteConns(t)
+	retainHealth(t)
 }
 
 // Table contains a set of routes grouped by host.
@@ -163,6 +183,22 @@ func (t Table) addRoute(d *RouteDef) error {
 		return fmt.Errorf("route: invalid target. %s", err)
 	}
 
+	conds, err := parseConditions(d.Opts)
+	if err != nil {
+		return err
+	}
+
+	if err := checkCountryRules(d.Opts); err != nil {
+		return err
+	}
+
+	// an unknown TLS policy would otherwise fail all handshakes for
+	// the host and rejecting the route would reject the whole table.
+	if name := d.Opts["tlspolicy"]; name != "" && !knownTLSPolicy(name) {
+		log.Printf("[WARN] route: unknown TLS policy %q for %s. Ignoring", name, d.Src)
+		delete(d.Opts, "tlspolicy")
+	}
+
 	switch {
 	// add new host
 	case t[host] == nil:
@@ -170,28 +206,60 @@ func (t Table) addRoute(d *RouteDef) error {
 		if err != nil {
 			return err
 		}
-		r := &Route{Host: host, Path: path, Glob: g}
+		re, err := routeRegex(path)
+		if err != nil {
+			return err
+		}
+		r := &Route{Host: host, Path: path, Glob: g, Regex: re, conds: conds}
 		r.addTarget(d.Service, targetURL, d.Weight, d.Tags, d.Opts)
 		t[host] = Routes{r}
 
 	// add new route to existing host
-	case t[host].find(path) == nil:
+	case t[host].findMatch(path, conds) == nil:
 		g, err := glob.Compile(path)
 		if err != nil {
 			return err
 		}
-		r := &Route{Host: host, Path: path, Glob: g}
+		re, err := routeRegex(path)
+		if err != nil {
+			return err
+		}
+		r := &Route{Host: host, Path: path, Glob: g, Regex: re, conds: conds}
 		r.addTarget(d.Service, targetURL, d.Weight, d.Tags, d.Opts)
 		t[host] = append(t[host], r)
 
 	// add new target to existing route
 	default:
-		t[host].find(path).addTarget(d.Service, targetURL, d.Weight, d.Tags, d.Opts)
+		t[host].findMatch(path, conds).addTarget(d.Service, targetURL, d.Weight, d.Tags, d.Opts)
 	}
 
 	return nil
 }
 
+// routeRegex returns the path compiled as a regular expression if the
+// regex matcher is configured and nil otherwise. Routes with an invalid
+// regular expression are rejected since the regex matcher cannot match
+// them.
+func routeRegex(path string) (*regexp.Regexp, error) {
+	if !regexPaths {
+		return nil, nil
+	}
+	re, err := compileRegex(path)
+	if err != nil {
+		return nil, fmt.Errorf("route: invalid regular expression %q. %s", path, err)
+	}
+	return re, nil
+}
+
+// compileRegex compiles the path as a regular expression for the regex
+// matcher and the rewrite option.
+func compileRegex(path string) (*regexp.Regexp, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^" + path)
+}
+
 func (t Table) weighRoute(d *RouteDef) error {
 	host, path := hostpath(d.Src)
 
@@ -199,11 +267,13 @@ func (t Table) weighRoute(d *RouteDef) error {
 		return errInvalidPrefix
 	}
 
-	if t[host] == nil || t[host].find(path) == nil {
-		return errNoMatch
+	// the weight applies to all routes for the path
+	// independent of their match conditions.
+	n := 0
+	for _, r := range t[host].findAll(path) {
+		n += r.setWeight(d.Service, d.Weight, d.Tags)
 	}
-
-	if n := t[host].find(path).setWeight(d.Service, d.Weight, d.Tags); n == 0 {
+	if n == 0 {
 		return errNoMatch
 	}
 	return nil
@@ -237,13 +307,11 @@ func (t Table) delRoute(d *RouteDef) error {
 		}
 
 	case d.Dst == "":
-		r := t.route(hostpath(d.Src))
-		if r == nil {
-			return nil
+		for _, r := range t.routes(hostpath(d.Src)) {
+			r.filter(func(tg *Target) bool {
+				return tg.Service == d.Service
+			})
 		}
-		r.filter(func(tg *Target) bool {
-			return tg.Service == d.Service
-		})
 
 	default:
 		targetURL, err := url.Parse(d.Dst)
@@ -251,13 +319,11 @@ func (t Table) delRoute(d *RouteDef) error {
 			return fmt.Errorf("route: invalid target. %s", err)
 		}
 
-		r := t.route(hostpath(d.Src))
-		if r == nil {
-			return nil
+		for _, r := range t.routes(hostpath(d.Src)) {
+			r.filter(func(tg *Target) bool {
+				return tg.Service == d.Service && tg.URL.String() == targetURL.String()
+			})
 		}
-		r.filter(func(tg *Target) bool {
-			return tg.Service == d.Service && tg.URL.String() == targetURL.String()
-		})
 	}
 
 	// remove all routes without targets
@@ -282,7 +348,8 @@ func (t Table) delRoute(d *RouteDef) error {
 	return nil
 }
 
-// route finds the route for host/path or returns nil if none exists.
+// route finds the route without match conditions for host/path or
+// returns nil if none exists.
 func (t Table) route(host, path string) *Route {
 	routes := t[host]
 	if routes == nil {
@@ -291,6 +358,12 @@ func (t Table) route(host, path string) *Route {
 	return routes.find(path)
 }
 
+// routes finds the routes for host/path independent of their match
+// conditions.
+func (t Table) routes(host, path string) Routes {
+	return t[host].findAll(path)
+}
+
 // normalizeHost returns the hostname from the request
 // and removes the default port if present.
 func normalizeHost(host string, tls bool) string {
@@ -332,6 +405,129 @@ func (t Table) matchingHosts(req *http.Request, globCache *GlobCache) (hosts []s
 	return
 }
 
+// HasHost returns true if the routing table has routes for the host
+// name either by name or by a glob pattern. The port of the host
+// patterns is ignored.
+func (t Table) HasHost(host string, globCache *GlobCache) bool {
+	host = strings.ToLower(host)
+	for pattern := range t {
+		normpat := strings.ToLower(pattern)
+		if h, _, err := net.SplitHostPort(normpat); err == nil {
+			normpat = h
+		}
+		if normpat == host {
+			return true
+		}
+		g, err := globCache.Get(normpat)
+		if err != nil {
+			continue
+		}
+		if g.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsPolicyHost is the host pattern of a route which selects a TLS
+// policy with the 'tlspolicy' option.
+type tlsPolicyHost struct {
+	pattern string // host pattern of the route
+	host    string // lower case pattern without port
+	policy  string
+}
+
+// tlsPolicyNames contains the names of the configured TLS policies for
+// validating the 'tlspolicy' option of the routes.
+var tlsPolicyNames struct {
+	sync.RWMutex
+	m map[string]bool
+}
+
+// SetTLSPolicyNames sets the names of the configured TLS policies. The
+// 'tlspolicy' option of routes which select an unknown policy is
+// ignored. Without policies the option is not checked since it has no
+// effect.
+func SetTLSPolicyNames(names []string) {
+	m := map[string]bool{}
+	for _, name := range names {
+		m[name] = true
+	}
+	tlsPolicyNames.Lock()
+	tlsPolicyNames.m = m
+	tlsPolicyNames.Unlock()
+}
+
+// knownTLSPolicy returns true if the TLS policy is configured or if
+// there are no TLS policies.
+func knownTLSPolicy(name string) bool {
+	tlsPolicyNames.RLock()
+	defer tlsPolicyNames.RUnlock()
+	return len(tlsPolicyNames.m) == 0 || tlsPolicyNames.m[name]
+}
+
+// tlsPolicyHosts contains the hosts of the active routing table which
+// select a TLS policy. It is updated by SetTable so that the policy for
+// a TLS handshake is found without going through the whole table.
+var tlsPolicyHosts atomic.Value
+
+// tlsPolicyHosts returns the host patterns of the table which select a
+// TLS policy.
+func (t Table) tlsPolicyHosts() []tlsPolicyHost {
+	var hosts []tlsPolicyHost
+	for pattern, rt := range t {
+		name := rt.tlsPolicy()
+		if name == "" {
+			continue
+		}
+		host := strings.ToLower(pattern)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		hosts = append(hosts, tlsPolicyHost{pattern, host, name})
+	}
+	return hosts
+}
+
+// TLSPolicy returns the name of the TLS policy which is selected with the
+// 'tlspolicy' option by a route for the host. Routes for the exact host
+// take precedence over routes with a matching glob pattern.
+func (t Table) TLSPolicy(host string, globCache *GlobCache) string {
+	return tlsPolicyFor(t.tlsPolicyHosts(), host, globCache)
+}
+
+// TLSPolicy returns the name of the TLS policy which is selected by a
+// route of the active routing table for the host.
+func TLSPolicy(host string, globCache *GlobCache) string {
+	hosts, _ := tlsPolicyHosts.Load().([]tlsPolicyHost)
+	return tlsPolicyFor(hosts, host, globCache)
+}
+
+func tlsPolicyFor(hosts []tlsPolicyHost, host string, globCache *GlobCache) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	host = strings.ToLower(host)
+	policies := map[string]string{}
+	var exact, globs []string
+	for _, h := range hosts {
+		if h.host == host {
+			exact = append(exact, h.pattern)
+		} else if g, err := globCache.Get(h.host); err == nil && g.Match(host) {
+			globs = append(globs, h.pattern)
+		} else {
+			continue
+		}
+		policies[h.pattern] = h.policy
+	}
+	for _, patterns := range [][]string{exact, globs} {
+		if len(patterns) > 0 {
+			return policies[sortHostsReverseHostPort(patterns)[0]]
+		}
+	}
+	return ""
+}
+
 // Issue 548 - Added separate func
 //
 // matchingHostNoGlob returns the route from the
@@ -420,8 +616,10 @@ func (t Table) Lookup(req *http.Request, trace string, pick picker, match matche
 		log.Printf("[TRACE] %s Matching hosts: %v", trace, hosts)
 	}
 	hosts = append(hosts, "")
+	excluded := ExcludedTargets(req.Context())
+	c := &client{req: req, addr: req.RemoteAddr}
 	for _, h := range hosts {
-		if target = t.lookup(h, req.URL.Path, trace, pick, match); target != nil {
+		if target = t.lookup(h, req.URL.Path, trace, pick, match, excluded, c); target != nil {
 			if target.RedirectCode != 0 {
 				req.URL.Host = req.Host
 				target.BuildRedirectURL(req.URL) // build redirect url and cache in target
@@ -444,13 +642,42 @@ func (t Table) Lookup(req *http.Request, trace string, pick picker, match matche
 }
 
 func (t Table) LookupHost(host string, pick picker) *Target {
-	return t.lookup(host, "/", "", pick, prefixMatcher)
+	return t.lookup(host, "/", "", pick, prefixMatcher, nil, nil)
+}
+
+// LookupHostFrom is like LookupHost but considers the remote address of
+// the client in 'host:port' format for the hash picker.
+func (t Table) LookupHostFrom(host, remoteAddr string, pick picker) *Target {
+	return t.lookup(host, "/", "", pick, prefixMatcher, nil, &client{addr: remoteAddr})
 }
 
-func (t Table) lookup(host, path, trace string, pick picker, match matcher) *Target {
+type excludedTargetsKey struct{}
+
+// ExcludeTarget returns a copy of ctx which excludes the target from
+// being returned by Lookup for requests with that context unless there
+// is no other target for the route. It is used to retry a request on a
+// different target.
+func ExcludeTarget(ctx context.Context, t *Target) context.Context {
+	prev := ExcludedTargets(ctx)
+	excluded := make(map[string]bool, len(prev)+1)
+	for k := range prev {
+		excluded[k] = true
+	}
+	excluded[t.URL.String()] = true
+	return context.WithValue(ctx, excludedTargetsKey{}, excluded)
+}
+
+// ExcludedTargets returns the URLs of the targets excluded by
+// ExcludeTarget.
+func ExcludedTargets(ctx context.Context) map[string]bool {
+	excluded, _ := ctx.Value(excludedTargetsKey{}).(map[string]bool)
+	return excluded
+}
+
+func (t Table) lookup(host, path, trace string, pick picker, match matcher, excluded map[string]bool, c *client) *Target {
 	host = strings.ToLower(host) // routes are always added lowercase
 	for _, r := range t[host] {
-		if match(path, r) {
+		if match(path, r) && r.conds.match(c) {
 			n := len(r.Targets)
 			if n == 0 {
 				return nil
@@ -460,7 +687,11 @@ func (t Table) lookup(host, path, trace string, pick picker, match matcher) *Tar
 			if n == 1 {
 				target = r.Targets[0]
 			} else {
-				target = pick(r)
+				p := pick
+				if r.pick != nil {
+					p = r.pick
+				}
+				target = r.availableTarget(p(r, c), excluded)
 			}
 			if trace != "" {
 				log.Printf("[TRACE] %s Match %s%s", trace, r.Host, r.Path)
@@ -529,7 +760,11 @@ func (t Table) Dump() string {
 				p1 = "+-- "
 			}
 
-			fmt.Fprintf(w, "%s%spath=%s\n", p0, p1, r.Path)
+			if len(r.conds) > 0 {
+				fmt.Fprintf(w, "%s%spath=%s %s\n", p0, p1, r.Path, r.conds)
+			} else {
+				fmt.Fprintf(w, "%s%spath=%s\n", p0, p1, r.Path)
+			}
 
 			m := map[*Target]int{}
 			for _, t := range r.wTargets {
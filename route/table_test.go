@@ -11,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/fabiolb/fabio/transport"
 )
 
 const (
@@ -671,6 +673,102 @@ func TestTableLookup_656(t *testing.T) {
 	}
 }
 
+func TestTableTLSProfile(t *testing.T) {
+	transport.SetTLSProfiles(map[string]*tls.Config{
+		"mesh": {ServerName: "upstream.mesh"},
+	})
+	defer transport.SetTLSProfiles(nil)
+
+	s := `
+	route add svc a.com/ https://1.2.3.4/ opts "tlsprofile=mesh"
+	route add svc b.com/ https://1.2.3.4/ opts "tlsprofile=mesh host=other.mesh"
+	route add svc c.com/ https://1.2.3.4/ opts "tlsprofile=foo"
+	`
+	tbl, err := NewTable(bytes.NewBufferString(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, serverName string
+	}{
+		{"a.com", "upstream.mesh"},
+		{"b.com", "other.mesh"},
+		{"c.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			target := tbl[tt.host][0].Targets[0]
+			if target.Transport == nil {
+				t.Fatal("got nil transport")
+			}
+			var serverName string
+			if target.Transport.TLSClientConfig != nil {
+				serverName = target.Transport.TLSClientConfig.ServerName
+			}
+			if got, want := serverName, tt.serverName; got != want {
+				t.Fatalf("got server name %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestTableTLSPolicy(t *testing.T) {
+	s := `
+	route add svc a.com/ http://1.2.3.4/ opts "tlspolicy=strict"
+	route add svc a.com/foo http://1.2.3.4/
+	route add svc *.a.com/ http://1.2.3.4/ opts "tlspolicy=legacy"
+	route add svc *.b.a.com/ http://1.2.3.4/ opts "tlspolicy=internal"
+	route add svc c.com/ http://1.2.3.4/
+	`
+	tbl, err := NewTable(bytes.NewBufferString(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, policy string
+	}{
+		{"a.com", "strict"},
+		{"A.com", "strict"},
+		{"www.a.com", "legacy"},
+		{"x.b.a.com", "internal"},
+		{"c.com", ""},
+		{"d.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got, want := tbl.TLSPolicy(tt.host, globCache), tt.policy; got != want {
+				t.Fatalf("got %q want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestTableUnknownTLSPolicy(t *testing.T) {
+	SetTLSPolicyNames([]string{"strict"})
+	defer SetTLSPolicyNames(nil)
+
+	s := `
+	route add svc a.com/ http://1.2.3.4/ opts "tlspolicy=strict"
+	route add svc b.com/ http://1.2.3.4/ opts "tlspolicy=foo"
+	`
+	tbl, err := NewTable(bytes.NewBufferString(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tbl.TLSPolicy("a.com", globCache), "strict"; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	if got, want := tbl.TLSPolicy("b.com", globCache), ""; got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+	req := &http.Request{Host: "b.com", URL: mustParse("/")}
+	if tbl.Lookup(req, "", Picker["rr"], Matcher["prefix"], globCache, false) == nil {
+		t.Fatal("route for b.com was not added")
+	}
+}
+
 func TestNewTableCustom(t *testing.T) {
 
 	var routes []RouteDef
@@ -763,3 +861,32 @@ func TestTable_Dump(t *testing.T) {
 		t.Errorf("Unexpected Dump() output:\nwant:\n%s\ngot:\n%s\n", want, got)
 	}
 }
+
+func TestTableHasHost(t *testing.T) {
+	tbl, err := NewTable(bytes.NewBufferString(`
+		route add svc www.example.com/ http://1.2.3.4/
+		route add svc *.foo.com/ http://1.2.3.4/
+		route add svc bar.com:443/ http://1.2.3.4/
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"www.example.com", true},
+		{"WWW.Example.com", true},
+		{"example.com", false},
+		{"a.foo.com", true},
+		{"foo.com", false},
+		{"bar.com", true},
+		{"baz.com", false},
+	}
+	for _, tt := range tests {
+		if got, want := tbl.HasHost(tt.host, globCache), tt.ok; got != want {
+			t.Errorf("%s: got %v want %v", tt.host, got, want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	gkm "github.com/go-kit/kit/metrics"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 )
 
@@ -25,6 +26,20 @@ type Target struct {
 	// request path (after StripPath has been removed)
 	PrependPath string
 
+	// RewritePath replaces the part of the outgoing request path
+	// which matches the route path as a regular expression. It can
+	// refer to capture groups with $1 or ${name}.
+	RewritePath string
+
+	// rewrite is the regular expression of the route for RewritePath.
+	rewrite *regexp.Regexp
+
+	// RequestHeaders and ResponseHeaders modify the headers of the
+	// upstream request and of the response. They are nil if the target
+	// has no header options.
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+
 	// TLSSkipVerify disables certificate validation for upstream
 	// TLS connections.
 	TLSSkipVerify bool
@@ -60,9 +75,16 @@ type Target struct {
 	RxCounter gkm.Counter
 	TxCounter gkm.Counter
 
+	// EjectCounter counts the ejections by the outlier detection
+	EjectCounter gkm.Counter
+
 	// accessRules is map of access information for the target.
 	accessRules map[string][]interface{}
 
+	// DenyCounter counts the requests and connections which were denied
+	// by the access rules. It is nil if the target has no access rules.
+	DenyCounter gkm.Counter
+
 	// name of the auth handler for this target
 	AuthScheme string
 
@@ -71,6 +93,57 @@ type Target struct {
 
 	// Transport allows for different types of transports
 	Transport *http.Transport
+
+	// HealthCheck is the active health check for the target.
+	// If HealthCheck is nil the target is not actively checked.
+	HealthCheck *HealthCheck
+
+	// health contains the result of the active health check.
+	health *healthState
+
+	// outlier tracks the failures for the passive outlier detection.
+	// It is nil if outlier detection is disabled.
+	outlier *outlierState
+
+	// StickyCookie is the name of the affinity cookie of the hash
+	// picker. If StickyCookie is empty no cookie is set.
+	StickyCookie string
+
+	// StickyID is the value of the affinity cookie for the target.
+	StickyID string
+
+	// load tracks the active requests and latency of the upstream
+	// for the leastconn and ewma pickers.
+	load *loadState
+
+	// limiter is the rate limiter of the route configured with the
+	// 'ratelimit' option. It is shared by all targets of the route and
+	// nil if the route is not rate limited.
+	limiter *rateLimiter
+
+	// breaker limits the concurrent requests to the target and tracks
+	// its error rate. It is nil if neither is configured.
+	breaker *breakerState
+
+	// routeConns limits the concurrent requests to all targets of the
+	// route configured with the 'route.maxconns' option. It is shared
+	// by all targets of the route and nil if there is no limit.
+	routeConns routeConns
+}
+
+// Rewrite returns the path with the part which matches the route path
+// replaced by RewritePath. The remainder of the path is preserved. If
+// the path does not match it is returned unchanged.
+func (t *Target) Rewrite(path string) string {
+	if t.rewrite == nil {
+		return path
+	}
+	m := t.rewrite.FindStringSubmatchIndex(path)
+	if m == nil {
+		return path
+	}
+	dst := t.rewrite.ExpandString(nil, t.RewritePath, path, m)
+	return string(dst) + path[m[1]:]
 }
 
 func (t *Target) BuildRedirectURL(requestURL *url.URL) {
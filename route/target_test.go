@@ -193,3 +193,29 @@ func TestTarget_BuildRedirectURL(t *testing.T) {
 		}
 	}
 }
+
+func TestTarget_Rewrite(t *testing.T) {
+	tests := []struct {
+		route   string
+		rewrite string
+		path    string
+		want    string
+	}{
+		{"/users/([0-9]+)/orders", "/orders/$1", "/users/42/orders", "/orders/42"},
+		{"/users/([0-9]+)/orders", "/orders/$1", "/users/42/orders/7", "/orders/42/7"},
+		{"/users/([0-9]+)/orders", "/orders/$1", "/users/joe/orders", "/users/joe/orders"},
+		{"/api/(?P<version>v[0-9])/", "/${version}/", "/api/v2/items", "/v2/items"},
+		{"/foo", "/bar", "/foo/baz", "/bar/baz"},
+	}
+
+	for i, tt := range tests {
+		tbl, err := NewTable(bytes.NewBufferString("route add svc " + tt.route + " http://foo.com/ opts \"rewrite=" + tt.rewrite + "\""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := tbl[""][0].Targets[0]
+		if got, want := target.Rewrite(tt.path), tt.want; got != want {
+			t.Errorf("%d: got %q want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package route
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gkm "github.com/go-kit/kit/metrics"
+)
+
+// upstreamKey returns the key for the state which is shared by all
+// targets with the same upstream address.
+func (t *Target) upstreamKey() string {
+	if t.URL == nil {
+		return ""
+	}
+	return t.URL.Scheme + "://" + t.URL.Host
+}
+
+// retainUpstreams removes the shared state for all upstreams which are
+// not part of the routing table.
+func retainUpstreams(t Table) {
+	keep := map[string]bool{}
+	for _, routes := range t {
+		for _, r := range routes {
+			for _, tg := range r.Targets {
+				keep[tg.upstreamKey()] = true
+			}
+		}
+	}
+
+	outlierStates.Lock()
+	for k := range outlierStates.m {
+		if !keep[k] {
+			delete(outlierStates.m, k)
+		}
+	}
+	outlierStates.Unlock()
+
+	loadStates.Lock()
+	for k := range loadStates.m {
+		if !keep[k] {
+			delete(loadStates.m, k)
+		}
+	}
+	loadStates.Unlock()
+}
+
+// ewmaDecay is the time constant of the exponentially weighted moving
+// average of the upstream latency. Observations older than ewmaDecay
+// have a weight of less than 1/e.
+const ewmaDecay = 10 * time.Second
+
+// ewmaDefault is the latency in seconds of an upstream without
+// observations. It is small so that new upstreams receive requests
+// but not zero so that their active requests count.
+const ewmaDefault = 0.01
+
+// loadState tracks the load of all targets with the same upstream
+// address for the leastconn and ewma pickers. It is shared between
+// routing tables so that the state survives table updates.
+type loadState struct {
+	// inflight is the number of active requests or connections.
+	inflight int64
+
+	mu       sync.Mutex
+	ewma     float64 // seconds
+	observed time.Time
+}
+
+// loadStates stores the load state by upstream address.
+var loadStates = struct {
+	sync.Mutex
+	m map[string]*loadState
+}{m: map[string]*loadState{}}
+
+func loadStateFor(key string) *loadState {
+	loadStates.Lock()
+	defer loadStates.Unlock()
+	s := loadStates.m[key]
+	if s == nil {
+		s = &loadState{}
+		loadStates.m[key] = s
+	}
+	return s
+}
+
+// observe adds the latency of a request in seconds to the peak EWMA.
+// Latencies above the average replace it immediately so that the
+// picker reacts quickly to slow upstreams. Lower latencies decay the
+// average over time.
+func (s *loadState) observe(v float64) {
+	now := timeNow()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v > s.ewma {
+		s.ewma = v
+	} else {
+		w := math.Exp(-float64(now.Sub(s.observed)) / float64(ewmaDecay))
+		s.ewma = s.ewma*w + v*(1-w)
+	}
+	s.observed = now
+}
+
+// cost returns the peak EWMA latency weighted by the number of active
+// requests. The latency decays while no requests complete so that an
+// upstream which was avoided after a peak receives requests again.
+func (s *loadState) cost() float64 {
+	now := timeNow()
+	s.mu.Lock()
+	ewma := ewmaDefault
+	if !s.observed.IsZero() {
+		ewma = s.ewma * math.Exp(-float64(now.Sub(s.observed))/float64(ewmaDecay))
+	}
+	s.mu.Unlock()
+	return ewma * float64(atomic.LoadInt64(&s.inflight)+1)
+}
+
+// latencyTimer is a histogram which also records the observed latencies
+// in the peak EWMA of the upstream.
+type latencyTimer struct {
+	gkm.Histogram
+	load *loadState
+}
+
+func (h latencyTimer) With(labelValues ...string) gkm.Histogram {
+	return latencyTimer{h.Histogram.With(labelValues...), h.load}
+}
+
+func (h latencyTimer) Observe(value float64) {
+	h.Histogram.Observe(value)
+	h.load.observe(value)
+}
+
+// Acquire marks the start of a request or connection to the target.
+// Every call must be followed by a call to Release.
+func (t *Target) Acquire() {
+	if t.load != nil {
+		atomic.AddInt64(&t.load.inflight, 1)
+	}
+}
+
+// Release marks the end of a request or connection to the target.
+func (t *Target) Release() {
+	if t.load != nil {
+		atomic.AddInt64(&t.load.inflight, -1)
+	}
+}
+
+// Inflight returns the number of active requests or connections to the
+// upstream of the target.
+func (t *Target) Inflight() int64 {
+	if t.load == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.load.inflight)
+}
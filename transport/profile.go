@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// profiles contains the upstream TLS profiles by name and the
+// transports which have been created for them. Transports are shared
+// between targets with the same profile, server name and verification
+// setting so that connections are reused across routing table updates.
+var profiles = struct {
+	sync.Mutex
+	m          map[string]*tls.Config
+	transports map[profileKey]*http.Transport
+}{
+	m:          map[string]*tls.Config{},
+	transports: map[profileKey]*http.Transport{},
+}
+
+type profileKey struct {
+	name       string
+	serverName string
+	skipVerify bool
+}
+
+// SetTLSProfiles replaces the upstream TLS profiles.
+func SetTLSProfiles(m map[string]*tls.Config) {
+	profiles.Lock()
+	defer profiles.Unlock()
+	for _, t := range profiles.transports {
+		t.CloseIdleConnections()
+	}
+	profiles.m = m
+	profiles.transports = map[profileKey]*http.Transport{}
+}
+
+// TLSProfile returns a copy of the TLS configuration of the named
+// upstream TLS profile. A non-empty serverName overrides the server name
+// of the profile.
+func TLSProfile(name, serverName string, skipVerify bool) (*tls.Config, error) {
+	profiles.Lock()
+	defer profiles.Unlock()
+	return tlsProfile(name, serverName, skipVerify)
+}
+
+func tlsProfile(name, serverName string, skipVerify bool) (*tls.Config, error) {
+	p := profiles.m[name]
+	if p == nil {
+		return nil, fmt.Errorf("unknown upstream TLS profile %q", name)
+	}
+	c := p.Clone()
+	if serverName != "" {
+		c.ServerName = serverName
+	}
+	if skipVerify {
+		c.InsecureSkipVerify = true
+	}
+	return c, nil
+}
+
+// ProfileTransport returns the transport for the named upstream TLS
+// profile. If the profile does not exist the returned transport fails
+// all TLS connections so that requests are not sent to the upstream
+// without the configured client certificate.
+func ProfileTransport(name, serverName string, skipVerify bool) (*http.Transport, error) {
+	profiles.Lock()
+	defer profiles.Unlock()
+
+	key := profileKey{name, serverName, skipVerify}
+	if t := profiles.transports[key]; t != nil {
+		return t, nil
+	}
+
+	tlscfg, err := tlsProfile(name, serverName, skipVerify)
+	if err != nil {
+		t := NewTransport(nil)
+		t.DialTLSContext = func(context.Context, string, string) (net.Conn, error) {
+			return nil, err
+		}
+		return t, err
+	}
+	t := NewTransport(tlscfg)
+	profiles.transports[key] = t
+	return t, nil
+}
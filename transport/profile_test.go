@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTLSProfile(t *testing.T) {
+	SetTLSProfiles(map[string]*tls.Config{
+		"mesh": {ServerName: "upstream.mesh", MinVersion: tls.VersionTLS12},
+	})
+	defer SetTLSProfiles(nil)
+
+	c, err := TLSProfile("mesh", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.ServerName, "upstream.mesh"; got != want {
+		t.Fatalf("got server name %q want %q", got, want)
+	}
+
+	c, err = TLSProfile("mesh", "other.mesh", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.ServerName, "other.mesh"; got != want {
+		t.Fatalf("got server name %q want %q", got, want)
+	}
+	if !c.InsecureSkipVerify {
+		t.Fatal("got InsecureSkipVerify false want true")
+	}
+
+	// the profile must not be modified
+	c, _ = TLSProfile("mesh", "", false)
+	if c.ServerName != "upstream.mesh" || c.InsecureSkipVerify {
+		t.Fatalf("profile was modified: %q %v", c.ServerName, c.InsecureSkipVerify)
+	}
+
+	if _, err := TLSProfile("foo", "", false); err == nil {
+		t.Fatal("got nil want error for unknown profile")
+	}
+}
+
+func TestProfileTransport(t *testing.T) {
+	SetTLSProfiles(map[string]*tls.Config{
+		"mesh": {InsecureSkipVerify: true},
+	})
+	defer SetTLSProfiles(nil)
+
+	t1, err := ProfileTransport("mesh", "a.mesh", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, _ := ProfileTransport("mesh", "a.mesh", false)
+	if t1 != t2 {
+		t.Fatal("transport was not reused")
+	}
+	t3, _ := ProfileTransport("mesh", "b.mesh", false)
+	if t1 == t3 {
+		t.Fatal("transport was reused for a different server name")
+	}
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	resp, err := (&http.Client{Transport: t1}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// requests with an unknown profile fail instead of using the
+	// default transport
+	tr, err := ProfileTransport("foo", "", true)
+	if err == nil {
+		t.Fatal("got nil want error for unknown profile")
+	}
+	_, err = (&http.Client{Transport: tr}).Get(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), `unknown upstream TLS profile "foo"`) {
+		t.Fatalf("got %v want error for unknown profile", err)
+	}
+}